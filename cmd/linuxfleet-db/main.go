@@ -0,0 +1,218 @@
+// Command linuxfleet-db backs up, restores, exports and imports the LinuxFleet database.
+//
+// Usage:
+//
+//	linuxfleet-db backup -database fleet.db -out backups/fleet.tar.gz
+//	linuxfleet-db verify -archive backups/fleet.tar.gz
+//	linuxfleet-db restore -archive backups/fleet.tar.gz -database fleet.db
+//	linuxfleet-db export -database fleet.db -table device -owner org1 > devices.ndjson
+//	linuxfleet-db import -database fleet.db -table device -mode upsert < devices.ndjson
+//
+// Export and import decrypt and encrypt sensitive attributes when a master key is
+// given with -master-key-file or the LINUXFLEET_MASTER_KEY environment variable.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/jrpalma/linuxfleet/data"
+	"github.com/jrpalma/linuxfleet/secret"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "backup":
+		err = backupCommand(os.Args[2:])
+	case "verify":
+		err = verifyCommand(os.Args[2:])
+	case "restore":
+		err = restoreCommand(os.Args[2:])
+	case "export":
+		err = exportCommand(os.Args[2:])
+	case "import":
+		err = importCommand(os.Args[2:])
+	default:
+		usage()
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "linuxfleet-db:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: linuxfleet-db backup|verify|restore|export|import [flags]")
+	os.Exit(2)
+}
+
+func backupCommand(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	databasePath := flags.String("database", "linuxfleet.db", "path of the database to back up")
+	out := flags.String("out", "", "path of the archive to write")
+	flags.Parse(args)
+	if *out == "" {
+		return fmt.Errorf("backup: -out is required")
+	}
+
+	tables, err := openTables(*databasePath, "")
+	if err != nil {
+		return err
+	}
+	manifest, err := tables.BackupToFile(context.Background(), *out)
+	if err != nil {
+		return err
+	}
+	printManifest(*out, manifest)
+	return nil
+}
+
+func verifyCommand(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	archive := flags.String("archive", "", "path of the archive to verify")
+	flags.Parse(args)
+	if *archive == "" {
+		return fmt.Errorf("verify: -archive is required")
+	}
+
+	manifest, err := data.VerifyBackup(*archive)
+	if err != nil {
+		return err
+	}
+	printManifest(*archive, manifest)
+	return nil
+}
+
+func restoreCommand(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	archive := flags.String("archive", "", "path of the archive to restore")
+	databasePath := flags.String("database", "linuxfleet.db", "path of the database to replace; the server must be stopped")
+	flags.Parse(args)
+	if *archive == "" {
+		return fmt.Errorf("restore: -archive is required")
+	}
+
+	manifest, err := data.RestoreBackup(*archive, *databasePath)
+	if err != nil {
+		return err
+	}
+	printManifest(*archive, manifest)
+	fmt.Printf("restored into %s\n", *databasePath)
+	return nil
+}
+
+func exportCommand(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	databasePath := flags.String("database", "linuxfleet.db", "path of the database to export from")
+	masterKeyFile := flags.String("master-key-file", "", "file holding the master key used to decrypt sensitive attributes")
+	tableName := flags.String("table", "", "name of the table to export")
+	owners := flags.String("owner", "", "comma separated owner IDs to export; all owners when empty")
+	out := flags.String("out", "", "path of the NDJSON file to write; standard output when empty")
+	flags.Parse(args)
+
+	tables, err := openTables(*databasePath, *masterKeyFile)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	var ownerIDs []string
+	if *owners != "" {
+		ownerIDs = strings.Split(*owners, ",")
+	}
+	count, err := tables.Export(w, *tableName, ownerIDs...)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d objects from %s\n", count, *tableName)
+	return nil
+}
+
+func importCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	databasePath := flags.String("database", "linuxfleet.db", "path of the database to import into")
+	masterKeyFile := flags.String("master-key-file", "", "file holding the master key used to encrypt sensitive attributes")
+	tableName := flags.String("table", "", "name of the table to import into")
+	mode := flags.String("mode", string(data.ImportInsertOnly), "insert, upsert or replace")
+	in := flags.String("in", "", "path of the NDJSON file to read; standard input when empty")
+	flags.Parse(args)
+
+	tables, err := openTables(*databasePath, *masterKeyFile)
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if *in != "" {
+		file, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	report, err := tables.Import(r, *tableName, data.ImportMode(*mode))
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(report)
+	if err != nil {
+		return err
+	}
+	if report.Failed > 0 {
+		return fmt.Errorf("import: %d of %d records failed", report.Failed, report.Read)
+	}
+	return nil
+}
+
+// openTables opens the database and enables encryption when a master key is
+// available from masterKeyFile or the environment.
+func openTables(databasePath string, masterKeyFile string) (*data.Tables, error) {
+	database, err := data.OpenDatabase(databasePath, data.DefaultDatabaseOptions())
+	if err != nil {
+		return nil, err
+	}
+	tables, err := data.NewDatabaseTables(database)
+	if err != nil {
+		return nil, err
+	}
+
+	if masterKeyFile == "" && os.Getenv(secret.MasterKeyEnv) == "" {
+		return tables, nil
+	}
+	masterKey, err := secret.LoadMasterKey(masterKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return tables, tables.EnableEncryption(masterKey)
+}
+
+func printManifest(archive string, manifest data.BackupManifest) {
+	fmt.Printf("%s: schema version %d, %d bytes, created %s, sha256 %s\n",
+		archive, manifest.SchemaVersion, manifest.DatabaseSize, manifest.CreatedAt.Format("2006-01-02T15:04:05Z07:00"), manifest.DatabaseSHA256)
+}
@@ -0,0 +1,302 @@
+// Command linuxfleet-server serves the LinuxFleet API.
+//
+// Usage:
+//
+//	linuxfleet-server -config linuxfleet.yaml -database-path fleet.db -listen-address :8080
+//	linuxfleet-server -config linuxfleet.yaml -listen-address :8443 -tls-cert-file cert.pem -tls-key-file key.pem
+//
+// Every option can also be set with an environment variable such as
+// LINUXFLEET_BASE_URL or a flag such as -base-url. Run linuxfleet-server -h to
+// list them. SIGHUP reloads the options and SIGINT or SIGTERM shut the server
+// down gracefully. See the README for the routes and features of the server.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/sendgrid/rest"
+	"github.com/sendgrid/sendgrid-go"
+	"github.com/sendgrid/sendgrid-go/helpers/mail"
+
+	"github.com/jrpalma/linuxfleet/data"
+	"github.com/jrpalma/linuxfleet/html"
+	"github.com/jrpalma/linuxfleet/opts"
+	"github.com/jrpalma/linuxfleet/replication"
+	"github.com/jrpalma/linuxfleet/secret"
+	"github.com/jrpalma/linuxfleet/server"
+)
+
+func main() {
+	options, err := loadOptions()
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "linuxfleet-server: invalid options:")
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	err = run(options)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "linuxfleet-server:", err)
+		os.Exit(1)
+	}
+}
+
+// loadOptions loads the options from the options file, the environment and the
+// command line.
+func loadOptions() (opts.ServerOptions, error) {
+	return opts.LoadServerOptions("linuxfleet-server", os.Args[1:], os.LookupEnv)
+}
+
+func run(options opts.ServerOptions) error {
+	logLevel := &slog.LevelVar{}
+	logLevel.Set(options.SlogLevel())
+	slog.SetDefault(newLogger(options, logLevel))
+	slog.Info("starting", "options", options)
+
+	database, err := data.OpenDatabase(options.DatabasePath, data.DefaultDatabaseOptions())
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+	tables, err := openTables(database, options)
+	if err != nil {
+		return err
+	}
+
+	email := &reloadingEmailSender{}
+	email.OptionsChanged(options)
+	srv := server.NewServer(options, tables, html.NewTemplates(), email)
+	srv.AddOptionsListener(email)
+	srv.AddOptionsListener(logLevelListener{logLevel})
+
+	cluster, err := startCluster(tables, options, srv)
+	if err != nil {
+		return err
+	}
+	if options.BackupDirectory != "" {
+		backupOptions := data.BackupSchedulerOptions{
+			Directory: options.BackupDirectory,
+			Interval:  options.BackupInterval,
+			Keep:      options.BackupKeep,
+			OnError: func(err error) {
+				slog.Error("failed to back up the database", "error", err)
+			},
+		}
+		srv.AddWorker(data.NewBackupScheduler(tables, backupOptions))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go reloadOnHangup(ctx, srv)
+
+	served := make(chan error, 1)
+	go func() {
+		if options.TLSEnabled() {
+			slog.Info("listening for HTTPS requests", "address", options.ListenAddress)
+			served <- srv.StartTLS(options.ListenAddress, options.TLSCertFile, options.TLSKeyFile)
+		} else {
+			slog.Info("listening for HTTP requests", "address", options.ListenAddress)
+			served <- srv.Start(options.ListenAddress)
+		}
+	}()
+
+	select {
+	case err = <-served:
+	case <-ctx.Done():
+		slog.Info("shutting down")
+	}
+	stop()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), srv.Options().ShutdownDrainDelay+srv.Options().ShutdownTimeout)
+	defer cancel()
+	shutdownErr := srv.Shutdown(shutdownCtx)
+	if cluster != nil {
+		cluster.Shutdown(shutdownCtx)
+	}
+	return errors.Join(err, shutdownErr)
+}
+
+// openTables creates the data tables and enables encryption when a master key
+// is available from the options or the environment.
+func openTables(database *data.Database, options opts.ServerOptions) (*data.Tables, error) {
+	tables, err := data.NewDatabaseTables(database)
+	if err != nil {
+		return nil, err
+	}
+	if options.MasterKeyFile == "" && os.Getenv(secret.MasterKeyEnv) == "" {
+		return tables, nil
+	}
+	masterKey, err := secret.LoadMasterKey(options.MasterKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return tables, tables.EnableEncryption(masterKey)
+}
+
+// newLogger returns the logger of the server, writing to the standard error in
+// the format of the options at the level of logLevel.
+func newLogger(options opts.ServerOptions, logLevel *slog.LevelVar) *slog.Logger {
+	handlerOptions := &slog.HandlerOptions{Level: logLevel}
+	if options.LogFormat == opts.LogFormatJSON {
+		return slog.New(slog.NewJSONHandler(os.Stderr, handlerOptions))
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, handlerOptions))
+}
+
+// logLevelListener changes the level of the log when the options are reloaded.
+type logLevelListener struct {
+	level *slog.LevelVar
+}
+
+func (l logLevelListener) OptionsChanged(options opts.ServerOptions) {
+	l.level.Set(options.SlogLevel())
+}
+
+// reloadOnHangup reloads the options of the server on SIGHUP until ctx is done.
+func reloadOnHangup(ctx context.Context, srv *server.Server) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+		}
+		options, err := loadOptions()
+		if err == nil {
+			err = srv.ReloadOptions(options)
+		}
+		if err != nil {
+			slog.Error("rejected the reload of the options", "error", err)
+			continue
+		}
+		slog.Info("reloaded the options", "options", srv.Options())
+	}
+}
+
+// reloadingEmailSender sends emails with the mail provider of the latest options.
+type reloadingEmailSender struct {
+	mu     sync.RWMutex
+	sender server.EmailSender
+}
+
+func (r *reloadingEmailSender) OptionsChanged(options opts.ServerOptions) {
+	sender := newEmailSender(options)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sender = sender
+}
+
+func (r *reloadingEmailSender) Send(email *mail.SGMailV3) (*rest.Response, error) {
+	r.mu.RLock()
+	sender := r.sender
+	r.mu.RUnlock()
+	return sender.Send(email)
+}
+
+// newEmailSender returns the sender of the mail provider of the options.
+func newEmailSender(options opts.ServerOptions) server.EmailSender {
+	if options.MailProvider == opts.MailProviderSendGrid {
+		return sendgrid.NewSendClient(options.SendGridAPIKey)
+	}
+	return logEmailSender{}
+}
+
+// logEmailSender writes the emails to the log instead of sending them, for
+// servers that run without a mail provider.
+type logEmailSender struct{}
+
+func (logEmailSender) Send(email *mail.SGMailV3) (*rest.Response, error) {
+	var to []string
+	for _, personalization := range email.Personalizations {
+		for _, recipient := range personalization.To {
+			to = append(to, recipient.Address)
+		}
+	}
+	var content strings.Builder
+	for _, part := range email.Content {
+		content.WriteString(part.Value)
+	}
+	slog.Info("email", "from", email.From.Address, "to", to, "subject", email.Subject, "content", content.String())
+	return &rest.Response{StatusCode: http.StatusAccepted}, nil
+}
+
+// startCluster joins the database cluster when more than one node is
+// configured. The replication node runs as a worker of the server and its
+// peers reach it on the address of DatabaseNode, through the returned HTTP server.
+func startCluster(tables *data.Tables, options opts.ServerOptions, srv *server.Server) (*http.Server, error) {
+	if len(options.DatabaseCluster) <= 1 {
+		return nil, nil
+	}
+	listen, err := nodeListenAddress(options.DatabaseNode)
+	if err != nil {
+		return nil, err
+	}
+
+	logDB, err := sql.Open("sqlite3", options.DatabasePath+"-replication")
+	if err != nil {
+		return nil, err
+	}
+	logDB.SetMaxOpenConns(1)
+	node, err := replication.NewNode(tables, logDB, replication.Options{
+		ID:     options.DatabaseNode,
+		Peers:  options.DatabaseCluster,
+		Secret: []byte(options.DatabaseClusterSecret),
+		OnError: func(err error) {
+			slog.Error("database replication", "error", err)
+		},
+	})
+	if err != nil {
+		logDB.Close()
+		return nil, err
+	}
+	srv.AddWorker(node)
+
+	cluster := &http.Server{Addr: listen, Handler: node.Handler()}
+	cluster.RegisterOnShutdown(func() { logDB.Close() })
+	go func() {
+		slog.Info("listening for database replication", "address", listen)
+		err := cluster.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("database replication", "error", err)
+		}
+	}()
+	return cluster, nil
+}
+
+// nodeListenAddress returns the address to listen on for a node address of the
+// cluster, such as 10.0.0.2:7946 or http://db2:7946. Only the interface of the
+// node host is used, so that replication is not exposed on the other networks
+// of the machine.
+func nodeListenAddress(node string) (string, error) {
+	host := node
+	if strings.Contains(node, "://") {
+		parsed, err := url.Parse(node)
+		if err != nil {
+			return "", fmt.Errorf("database_node: %w", err)
+		}
+		host = parsed.Host
+	}
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return "", fmt.Errorf("database_node %q: %w", node, err)
+	}
+	return net.JoinHostPort(hostname, port), nil
+}
@@ -0,0 +1,394 @@
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// ErrForbidden is returned by Authorize when a principal lacks a permission on an object.
+var ErrForbidden = errors.New("data: permission denied")
+
+// Permission is a set of operations a principal may perform on an object.
+type Permission uint8
+
+const (
+	// PermissionRead allows reading the object.
+	PermissionRead Permission = 1 << iota
+	// PermissionWrite allows updating and deleting the object.
+	PermissionWrite
+	// PermissionExecute allows running jobs on the object, such as a device.
+	PermissionExecute
+
+	// PermissionAll is held by the owner of an object.
+	PermissionAll = PermissionRead | PermissionWrite | PermissionExecute
+)
+
+// Has reports whether every permission of other is in p.
+func (p Permission) Has(other Permission) bool {
+	return p&other == other
+}
+
+// String returns the permissions as letters, such as "rw-".
+func (p Permission) String() string {
+	letters := []byte("---")
+	for i, letter := range "rwx" {
+		if p.Has(1 << i) {
+			letters[i] = byte(letter)
+		}
+	}
+	return string(letters)
+}
+
+// Grant gives a principal permissions on an object of a table. The object may
+// also be a group, in which case the grant applies to every object in it.
+type Grant struct {
+	Table       string     `json:"table"`
+	ObjectID    string     `json:"object_id"`
+	PrincipalID string     `json:"principal_id"`
+	Permissions Permission `json:"permissions"`
+}
+
+// MemberKind is the kind of a group member. Members are matched by kind and
+// ID, so an object or principal whose ID is the name of a group does not
+// inherit the grants of that group.
+type MemberKind string
+
+const (
+	// MemberPrincipal is a principal, such as an admin.
+	MemberPrincipal MemberKind = "principal"
+	// MemberGroup is another group, such as a team in an organization.
+	MemberGroup MemberKind = "group"
+	// MemberObject is an object of a data table, such as a device.
+	MemberObject MemberKind = "object"
+)
+
+// Member is a member of a group.
+type Member struct {
+	Kind MemberKind `json:"kind"`
+	ID   string     `json:"id"`
+}
+
+// AddGroupMember adds a principal, an object or another group to a group. A
+// principal holds the grants made to every group it belongs to, directly or
+// through other groups, and a grant on a group applies to every object in it,
+// such as the devices of a site.
+func (table *Tables) AddGroupMember(groupID string, member Member) error {
+	switch member.Kind {
+	case MemberPrincipal, MemberGroup, MemberObject:
+	default:
+		return fmt.Errorf("data: unknown group member kind %q", member.Kind)
+	}
+	if member.Kind == MemberGroup && groupID == member.ID {
+		return fmt.Errorf("data: group %s cannot be a member of itself", groupID)
+	}
+	_, err := table.writer.Exec(sqlAddGroupMember(), groupID, member.Kind, member.ID)
+	return err
+}
+
+// RemoveGroupMember removes a member from a group.
+func (table *Tables) RemoveGroupMember(groupID string, member Member) error {
+	_, err := table.writer.Exec(sqlRemoveGroupMember(), groupID, member.Kind, member.ID)
+	return err
+}
+
+// GroupMembers returns the direct members of a group ordered by kind and ID.
+func (table *Tables) GroupMembers(groupID string) ([]Member, error) {
+	rows, err := table.db.Query(sqlGroupMembers(), groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []Member
+	for rows.Next() {
+		var member Member
+		err := rows.Scan(&member.Kind, &member.ID)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+// Principals returns the principal and every group it belongs to, directly or
+// through other groups, ordered by ID.
+func (table *Tables) Principals(principalID string) ([]string, error) {
+	return queryStrings(table.db, sqlPrincipals(), principalID)
+}
+
+// Grant sets the permissions of a principal on an object, replacing the ones
+// granted before. Granting no permission revokes them.
+func (table *Tables) Grant(grant Grant) error {
+	if !isDataTable(grant.Table) {
+		return fmt.Errorf("%w: %s", ErrUnknownTable, grant.Table)
+	}
+	if grant.Permissions == 0 {
+		return table.Revoke(grant.Table, grant.ObjectID, grant.PrincipalID)
+	}
+	_, err := table.writer.Exec(sqlGrant(), grant.Table, grant.ObjectID, grant.PrincipalID, grant.Permissions)
+	return err
+}
+
+// Revoke removes the permissions granted to a principal on an object.
+func (table *Tables) Revoke(tableName string, objectID string, principalID string) error {
+	_, err := table.writer.Exec(sqlRevoke(), tableName, objectID, principalID)
+	return err
+}
+
+// ListGrants returns the grants made directly on an object or group, ordered by principal.
+func (table *Tables) ListGrants(tableName string, objectID string) ([]Grant, error) {
+	rows, err := table.db.Query(sqlListGrants(), tableName, objectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var grants []Grant
+	for rows.Next() {
+		grant := Grant{Table: tableName, ObjectID: objectID}
+		err := rows.Scan(&grant.PrincipalID, &grant.Permissions)
+		if err != nil {
+			return nil, err
+		}
+		grants = append(grants, grant)
+	}
+	return grants, rows.Err()
+}
+
+// Permissions returns the permissions of a principal on an object. It holds
+// every permission when one of its principals owns the object, so the members
+// of a group used as OwnerID share its objects. Otherwise it holds the union of
+// the grants to its principals on the object and the groups containing it.
+// It returns sql.ErrNoRows when the object does not exist.
+func (table *Tables) Permissions(tableName string, id string, principalID string) (Permission, error) {
+	if !isDataTable(tableName) {
+		return 0, fmt.Errorf("%w: %s", ErrUnknownTable, tableName)
+	}
+	var ownerID string
+	err := table.db.QueryRow(sqlGetOwner(tableName), id).Scan(&ownerID)
+	if err != nil {
+		return 0, err
+	}
+	principals, err := table.Principals(principalID)
+	if err != nil {
+		return 0, err
+	}
+	if slices.Contains(principals, ownerID) {
+		return PermissionAll, nil
+	}
+
+	rows, err := table.db.Query(sqlObjectGrants(), principalID, id, tableName)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var permissions Permission
+	for rows.Next() {
+		var granted Permission
+		err := rows.Scan(&granted)
+		if err != nil {
+			return 0, err
+		}
+		permissions |= granted
+	}
+	return permissions, rows.Err()
+}
+
+// Authorize returns ErrForbidden unless the principal holds the permission on the object.
+func (table *Tables) Authorize(tableName string, id string, principalID string, permission Permission) error {
+	permissions, err := table.Permissions(tableName, id, principalID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: %s %s", ErrForbidden, tableName, id)
+	} else if err != nil {
+		return err
+	}
+	if !permissions.Has(permission) {
+		return fmt.Errorf("%w: %s on %s %s", ErrForbidden, permission, tableName, id)
+	}
+	return nil
+}
+
+// ListAccessible returns the objects of a table on which the principal holds
+// the permission, either as an owner or through grants. The access checks are
+// evaluated by SQLite in the same query that reads the objects.
+func (table *Tables) ListAccessible(tableName string, principalID string, permission Permission) ([]Object, error) {
+	if !isDataTable(tableName) {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownTable, tableName)
+	}
+	rows, err := table.db.Query(sqlListAccessible(tableName), principalID, tableName, permission, permission)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	objects, err := scanObjects(rows)
+	if err != nil {
+		return nil, err
+	}
+	return table.decryptObjects(tableName, objects)
+}
+
+// createACLTables creates the grant and group tables, and the triggers that
+// delete the grants on an object when it is deleted.
+func createACLTables(db *sql.DB) error {
+	_, err := db.Exec(sqlCreateACLTables())
+	if err != nil {
+		return err
+	}
+	for _, tableName := range dataTableList() {
+		_, err := db.Exec(sqlCreateACLTrigger(tableName))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func queryStrings(db *sql.DB, query string, args ...any) ([]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var value string
+		err := rows.Scan(&value)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+func sqlCreateACLTables() string {
+	return `
+	CREATE TABLE IF NOT EXISTS acl_group_member (
+		group_id TEXT NOT NULL,
+		member_kind TEXT NOT NULL,
+		member_id TEXT NOT NULL,
+		PRIMARY KEY (group_id, member_kind, member_id)
+	) WITHOUT ROWID;
+	CREATE INDEX IF NOT EXISTS idx_acl_group_member_member_id ON acl_group_member(member_id, member_kind, group_id);
+	CREATE TABLE IF NOT EXISTS acl_grant (
+		table_name TEXT NOT NULL,
+		object_id TEXT NOT NULL,
+		principal_id TEXT NOT NULL,
+		permissions INTEGER NOT NULL,
+		PRIMARY KEY (table_name, object_id, principal_id)
+	) WITHOUT ROWID;
+	CREATE INDEX IF NOT EXISTS idx_acl_grant_principal_id ON acl_grant(table_name, principal_id, object_id);
+	`
+}
+
+func sqlCreateACLTrigger(tableName string) string {
+	query := `
+	CREATE TRIGGER IF NOT EXISTS %[1]s_acl_delete AFTER DELETE ON %[1]s
+	BEGIN
+		DELETE FROM acl_grant WHERE table_name = '%[1]s' AND object_id = old.id;
+	END
+	`
+	return fmt.Sprintf(query, tableName)
+}
+
+func sqlAddGroupMember() string {
+	return `INSERT OR IGNORE INTO acl_group_member (group_id, member_kind, member_id) VALUES (?, ?, ?)`
+}
+
+func sqlRemoveGroupMember() string {
+	return `DELETE FROM acl_group_member WHERE group_id = ? AND member_kind = ? AND member_id = ?`
+}
+
+func sqlGroupMembers() string {
+	return `SELECT member_kind, member_id FROM acl_group_member WHERE group_id = ? ORDER BY member_kind, member_id`
+}
+
+// sqlPrincipalsCTE is the recursive common table expression of the principal
+// given as its argument and the groups it belongs to. Each step follows the
+// memberships of the kind of the previous one. UNION stops on cycles.
+const sqlPrincipalsCTE = `
+	principals(id, kind) AS (
+		SELECT ?, 'principal'
+		UNION
+		SELECT m.group_id, 'group' FROM acl_group_member m
+		JOIN principals p ON m.member_id = p.id AND m.member_kind = p.kind
+	)`
+
+func sqlPrincipals() string {
+	return `WITH RECURSIVE` + sqlPrincipalsCTE + ` SELECT id FROM principals ORDER BY id`
+}
+
+func sqlGrant() string {
+	return `
+	INSERT INTO acl_grant (table_name, object_id, principal_id, permissions) VALUES (?, ?, ?, ?)
+	ON CONFLICT (table_name, object_id, principal_id) DO UPDATE SET permissions = excluded.permissions
+	`
+}
+
+func sqlRevoke() string {
+	return `DELETE FROM acl_grant WHERE table_name = ? AND object_id = ? AND principal_id = ?`
+}
+
+func sqlListGrants() string {
+	return `SELECT principal_id, permissions FROM acl_grant WHERE table_name = ? AND object_id = ? ORDER BY principal_id`
+}
+
+func sqlGetOwner(tableName string) string {
+	return fmt.Sprintf(`SELECT owner_id FROM %s WHERE id = ?`, tableName)
+}
+
+// sqlObjectGrants constructs the SQL query of the grants to a principal on an
+// object and the groups containing it. The arguments are the principal, the
+// object and the table.
+func sqlObjectGrants() string {
+	return `
+	WITH RECURSIVE` + sqlPrincipalsCTE + `,
+	targets(id, kind) AS (
+		SELECT ?, 'object'
+		UNION
+		SELECT m.group_id, 'group' FROM acl_group_member m
+		JOIN targets t ON m.member_id = t.id AND m.member_kind = t.kind
+	)
+	SELECT permissions FROM acl_grant
+	WHERE table_name = ? AND object_id IN (SELECT id FROM targets) AND principal_id IN (SELECT id FROM principals)
+	`
+}
+
+// sqlGrantedCTE is the recursive common table expression of the objects and
+// groups on which the principals were granted permissions. The grants to the
+// principals apply to the object they were made on and are expanded down
+// through the group of that name. Like Permissions, the accessible objects
+// hold the union of their grants, so a permission may be split across grants,
+// before it is compared with the permission. SQLite has no bitwise OR
+// aggregate, so the union is built bit by bit. It follows sqlPrincipalsCTE and
+// its arguments are the table and the permission twice.
+const sqlGrantedCTE = `
+	granted(id, kind, permissions) AS (
+		SELECT object_id, kind, permissions FROM acl_grant, (SELECT 'object' AS kind UNION ALL SELECT 'group')
+		WHERE table_name = ? AND principal_id IN (SELECT id FROM principals)
+		UNION
+		SELECT m.member_id, m.member_kind, g.permissions FROM acl_group_member m
+		JOIN granted g ON m.group_id = g.id AND g.kind = 'group'
+	),
+	accessible(id) AS (
+		SELECT id FROM granted WHERE kind = 'object' GROUP BY id
+		HAVING (max(permissions & 1) | max(permissions & 2) | max(permissions & 4)) & ? = ?
+	)`
+
+// sqlListAccessible constructs the SQL query of ListAccessible. The arguments
+// are the principal, the table and the permission twice.
+func sqlListAccessible(tableName string) string {
+	query := `
+	WITH RECURSIVE` + sqlPrincipalsCTE + `,` + sqlGrantedCTE + `
+	SELECT %s FROM %s
+	WHERE owner_id IN (SELECT id FROM principals) OR id IN (SELECT id FROM accessible)
+	ORDER BY id
+	`
+	return fmt.Sprintf(query, objectColumns, tableName)
+}
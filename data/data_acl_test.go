@@ -0,0 +1,157 @@
+package data
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func objectIDs(objects []Object) []string {
+	var ids []string
+	for _, obj := range objects {
+		ids = append(ids, obj.ID)
+	}
+	return ids
+}
+
+func TestACL(t *testing.T) {
+	tables, err := NewTables(newTestDatabase(t))
+	assert.NoError(t, err)
+	for _, id := range []string{"web-1", "web-2", "db-1", "other-1"} {
+		ownerID := "org1"
+		if id == "other-1" {
+			ownerID = "org2"
+		}
+		assert.NoError(t, tables.Insert("device", Object{ID: id, OwnerID: ownerID, Version: 1}))
+	}
+
+	// alice is in the ops team, which is part of org1. The contractor can read
+	// the web servers and the dba can run jobs on the database server.
+	assert.NoError(t, tables.AddGroupMember("org1", Member{MemberGroup, "ops"}))
+	assert.NoError(t, tables.AddGroupMember("ops", Member{MemberPrincipal, "alice"}))
+	assert.NoError(t, tables.AddGroupMember("web-servers", Member{MemberObject, "web-1"}))
+	assert.NoError(t, tables.AddGroupMember("web-servers", Member{MemberObject, "web-2"}))
+	assert.NoError(t, tables.Grant(Grant{Table: "device", ObjectID: "web-servers", PrincipalID: "contractor", Permissions: PermissionRead}))
+	assert.NoError(t, tables.Grant(Grant{Table: "device", ObjectID: "db-1", PrincipalID: "dba", Permissions: PermissionRead | PermissionExecute}))
+	assert.Error(t, tables.AddGroupMember("ops", Member{MemberGroup, "ops"}))
+	assert.Error(t, tables.AddGroupMember("ops", Member{"user", "bob"}))
+	assert.ErrorIs(t, tables.Grant(Grant{Table: "unknown", ObjectID: "db-1", PrincipalID: "dba", Permissions: PermissionRead}), ErrUnknownTable)
+
+	principals, err := tables.Principals("alice")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"alice", "ops", "org1"}, principals)
+
+	for _, test := range []struct {
+		principal  string
+		permission Permission
+		expected   []string
+	}{
+		{"alice", PermissionAll, []string{"db-1", "web-1", "web-2"}},
+		{"contractor", PermissionRead, []string{"web-1", "web-2"}},
+		{"contractor", PermissionWrite, nil},
+		{"dba", PermissionExecute, []string{"db-1"}},
+		{"org2", PermissionRead, []string{"other-1"}},
+		{"nobody", PermissionRead, nil},
+	} {
+		objects, err := tables.ListAccessible("device", test.principal, test.permission)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, objectIDs(objects), "%s %s", test.principal, test.permission)
+	}
+
+	permissions, err := tables.Permissions("device", "web-1", "contractor")
+	assert.NoError(t, err)
+	assert.Equal(t, PermissionRead, permissions)
+	assert.Equal(t, "r--", permissions.String())
+	assert.NoError(t, tables.Authorize("device", "db-1", "alice", PermissionWrite))
+	assert.NoError(t, tables.Authorize("device", "db-1", "dba", PermissionExecute))
+	assert.ErrorIs(t, tables.Authorize("device", "db-1", "dba", PermissionWrite), ErrForbidden)
+	assert.ErrorIs(t, tables.Authorize("device", "web-1", "dba", PermissionRead), ErrForbidden)
+	assert.ErrorIs(t, tables.Authorize("device", "missing", "alice", PermissionRead), ErrForbidden)
+	_, err = tables.Permissions("device", "missing", "alice")
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+
+	// Removing a device from the group or a member from a team revokes the inherited access.
+	assert.NoError(t, tables.RemoveGroupMember("web-servers", Member{MemberObject, "web-2"}))
+	assert.ErrorIs(t, tables.Authorize("device", "web-2", "contractor", PermissionRead), ErrForbidden)
+	assert.NoError(t, tables.RemoveGroupMember("ops", Member{MemberPrincipal, "alice"}))
+	assert.ErrorIs(t, tables.Authorize("device", "web-1", "alice", PermissionRead), ErrForbidden)
+	members, err := tables.GroupMembers("web-servers")
+	assert.NoError(t, err)
+	assert.Equal(t, []Member{{MemberObject, "web-1"}}, members)
+
+	// Members only inherit the grants of the groups they were added to as
+	// their kind: a device or a principal named after a group gets nothing.
+	assert.NoError(t, tables.Insert("device", Object{ID: "web-servers", OwnerID: "org2", Version: 1}))
+	assert.NoError(t, tables.AddGroupMember("ops", Member{MemberObject, "web-servers"}))
+	assert.NoError(t, tables.Grant(Grant{Table: "device", ObjectID: "ops", PrincipalID: "auditor", Permissions: PermissionRead}))
+	assert.ErrorIs(t, tables.Authorize("device", "web-1", "auditor", PermissionRead), ErrForbidden)
+	assert.NoError(t, tables.Authorize("device", "web-servers", "auditor", PermissionRead))
+	principals, err = tables.Principals("web-servers")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"web-servers"}, principals)
+	objects, err := tables.ListAccessible("device", "auditor", PermissionRead)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"web-servers"}, objectIDs(objects))
+	assert.NoError(t, tables.DeleteByID("device", "web-servers"))
+
+	// Cycles between groups do not prevent the evaluation.
+	assert.NoError(t, tables.AddGroupMember("ops", Member{MemberGroup, "org1"}))
+	assert.NoError(t, tables.AddGroupMember("ops", Member{MemberPrincipal, "alice"}))
+	principals, err = tables.Principals("alice")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"alice", "ops", "org1"}, principals)
+
+	// Grants are replaced, revoked with no permission and deleted with the object.
+	assert.NoError(t, tables.Grant(Grant{Table: "device", ObjectID: "db-1", PrincipalID: "dba", Permissions: PermissionRead}))
+	assert.NoError(t, tables.Grant(Grant{Table: "device", ObjectID: "db-1", PrincipalID: "contractor", Permissions: PermissionRead}))
+	grants, err := tables.ListGrants("device", "db-1")
+	assert.NoError(t, err)
+	assert.Equal(t, []Grant{
+		{Table: "device", ObjectID: "db-1", PrincipalID: "contractor", Permissions: PermissionRead},
+		{Table: "device", ObjectID: "db-1", PrincipalID: "dba", Permissions: PermissionRead},
+	}, grants)
+	assert.NoError(t, tables.Grant(Grant{Table: "device", ObjectID: "db-1", PrincipalID: "contractor"}))
+	assert.NoError(t, tables.DeleteByID("device", "db-1"))
+	assert.NoError(t, tables.Insert("device", Object{ID: "db-1", OwnerID: "org1", Version: 1}))
+	grants, err = tables.ListGrants("device", "db-1")
+	assert.NoError(t, err)
+	assert.Empty(t, grants)
+}
+
+func TestACLSplitGrants(t *testing.T) {
+	tables, err := NewTables(newTestDatabase(t))
+	assert.NoError(t, err)
+	for _, id := range []string{"web-1", "web-2"} {
+		assert.NoError(t, tables.Insert("device", Object{ID: id, OwnerID: "org1", Version: 1}))
+	}
+
+	// bob reads web-1 through the readers and writes the web servers through
+	// the writers, so only web-1 is both readable and writable.
+	assert.NoError(t, tables.AddGroupMember("readers", Member{MemberPrincipal, "bob"}))
+	assert.NoError(t, tables.AddGroupMember("writers", Member{MemberPrincipal, "bob"}))
+	assert.NoError(t, tables.AddGroupMember("web-servers", Member{MemberObject, "web-1"}))
+	assert.NoError(t, tables.AddGroupMember("web-servers", Member{MemberObject, "web-2"}))
+	assert.NoError(t, tables.Grant(Grant{Table: "device", ObjectID: "web-1", PrincipalID: "readers", Permissions: PermissionRead}))
+	assert.NoError(t, tables.Grant(Grant{Table: "device", ObjectID: "web-servers", PrincipalID: "writers", Permissions: PermissionWrite}))
+
+	permissions, err := tables.Permissions("device", "web-1", "bob")
+	assert.NoError(t, err)
+	assert.Equal(t, "rw-", permissions.String())
+	assert.NoError(t, tables.Authorize("device", "web-1", "bob", PermissionRead|PermissionWrite))
+	assert.ErrorIs(t, tables.Authorize("device", "web-2", "bob", PermissionRead|PermissionWrite), ErrForbidden)
+
+	for _, test := range []struct {
+		permission Permission
+		expected   []string
+	}{
+		{PermissionRead, []string{"web-1"}},
+		{PermissionWrite, []string{"web-1", "web-2"}},
+		{PermissionRead | PermissionWrite, []string{"web-1"}},
+		{PermissionExecute, nil},
+	} {
+		objects, err := tables.ListAccessible("device", "bob", test.permission)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, objectIDs(objects), "%s", test.permission)
+	}
+}
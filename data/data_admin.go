@@ -0,0 +1,62 @@
+package data
+
+import (
+	"time"
+)
+
+// AdminTable stores the administrators of an organization.
+var AdminTable = RegisterTable(TableDefinition{
+	Name:      "admin",
+	Sensitive: []string{"password", "salt", "seed"},
+	Indexes: []AttributeIndex{
+		{Path: "email", Unique: true},
+	},
+})
+
+// Admin is an administrator stored in AdminTable. The owner ID is the
+// organization the administrator manages, and TOTPStep is the time step of
+// the last TOTP code it logged in with, see AcceptTOTPStep.
+type Admin struct {
+	ID       string `data:"id,meta"`
+	OwnerID  string `data:"owner_id,meta"`
+	Email    string `data:"email"`
+	Password string `data:"password"`
+	Salt     string `data:"salt"`
+	Seed     string `data:"seed"`
+	TOTPStep uint64 `data:"totp_step,omitempty"`
+}
+
+// AcceptTOTPStep records that the administrator logged in with a TOTP code of
+// the time step, and reports false when a code of this step or a later one was
+// already accepted, so that a code cannot be used twice. The step is compared
+// and written by one statement, so that two logins with the same code cannot
+// both be accepted.
+func (table *Tables) AcceptTOTPStep(adminID string, step uint64) (_ bool, err error) {
+	defer table.observe("accept_totp_step", AdminTable.Name, time.Now(), &err)
+	tx, err := table.writer.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	updatedAt, hlc := table.stamp()
+	result, err := tx.Exec(sqlAcceptTOTPStep(), step, updatedAt, hlc, adminID, step)
+	if err != nil {
+		return false, translateError(err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if affected == 0 {
+		return false, nil
+	}
+	return true, tx.Commit()
+}
+
+// sqlAcceptTOTPStep constructs the SQL query that writes the TOTP step of an
+// administrator only if it is after the last accepted one.
+func sqlAcceptTOTPStep() string {
+	return `UPDATE admin SET attributes = json_set(attributes, '$.totp_step', ?), version = version + 1, updated_at = ?, hlc = ?
+WHERE id = ? AND coalesce(json_extract(attributes, '$.totp_step'), 0) < ?`
+}
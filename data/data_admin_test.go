@@ -0,0 +1,43 @@
+package data
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcceptTOTPStep(t *testing.T) {
+	db := newTestDatabase(t)
+	table, _ := newEncryptedTables(t, db)
+	admins := NewRepository[Admin](table, AdminTable)
+
+	admin := Admin{ID: uuid.NewString(), OwnerID: uuid.NewString(), Email: "admin@example.com", Password: "hash", Salt: "salt", Seed: "seed"}
+	assert.NoError(t, admins.Insert(admin))
+
+	accepted, err := table.AcceptTOTPStep(admin.ID, 100)
+	assert.NoError(t, err)
+	assert.True(t, accepted)
+
+	// The code of the same step or of an earlier one cannot be used again.
+	accepted, err = table.AcceptTOTPStep(admin.ID, 100)
+	assert.NoError(t, err)
+	assert.False(t, accepted)
+	accepted, err = table.AcceptTOTPStep(admin.ID, 99)
+	assert.NoError(t, err)
+	assert.False(t, accepted)
+
+	accepted, err = table.AcceptTOTPStep(admin.ID, 101)
+	assert.NoError(t, err)
+	assert.True(t, accepted)
+
+	accepted, err = table.AcceptTOTPStep(uuid.NewString(), 102)
+	assert.NoError(t, err)
+	assert.False(t, accepted)
+
+	// The other attributes, including the encrypted ones, are left unchanged.
+	stored, err := admins.Get(admin.ID)
+	assert.NoError(t, err)
+	admin.TOTPStep = 101
+	assert.Equal(t, admin, stored)
+}
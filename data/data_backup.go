@@ -0,0 +1,358 @@
+package data
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// backupFormatVersion is the version of the archive layout written by Backup.
+const backupFormatVersion = 1
+
+const (
+	backupManifestName = "manifest.json"
+	backupDatabaseName = "linuxfleet.db"
+	// backupStepPages is the number of pages copied per backup step. Copying in
+	// steps lets writers make progress while a backup is running.
+	backupStepPages = 256
+)
+
+var ErrBackupChecksum = errors.New("data: backup checksum mismatch")
+var ErrBackupSchema = errors.New("data: backup schema is newer than this server")
+var ErrBackupFormat = errors.New("data: unsupported backup archive")
+
+// BackupManifest describes the database stored in a backup archive.
+type BackupManifest struct {
+	FormatVersion  int       `json:"format_version"`
+	CreatedAt      Timestamp `json:"created_at"`
+	SchemaVersion  int       `json:"schema_version"`
+	DatabaseSize   int64     `json:"database_size"`
+	DatabaseSHA256 string    `json:"database_sha256"`
+}
+
+// Backup writes a consistent snapshot of the database to w as a gzip compressed
+// tar archive holding a manifest and the database file. The snapshot is taken
+// with the SQLite online backup API so the database stays usable meanwhile.
+func (table *Tables) Backup(ctx context.Context, w io.Writer) (BackupManifest, error) {
+	snapshot, err := os.CreateTemp("", "linuxfleet-backup-*.db")
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	snapshot.Close()
+	defer os.Remove(snapshot.Name())
+
+	err = copyDatabase(ctx, table.db, snapshot.Name())
+	if err != nil {
+		return BackupManifest{}, err
+	}
+
+	version, err := schemaVersion(table.db)
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	checksum, size, err := fileChecksum(snapshot.Name())
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	manifest := BackupManifest{
+		FormatVersion:  backupFormatVersion,
+		CreatedAt:      NowTimestamp(),
+		SchemaVersion:  version,
+		DatabaseSize:   size,
+		DatabaseSHA256: checksum,
+	}
+	return manifest, writeBackupArchive(w, manifest, snapshot.Name())
+}
+
+// BackupToFile writes a backup archive to filename together with a
+// filename.sha256 file holding the checksum of the archive.
+func (table *Tables) BackupToFile(ctx context.Context, filename string) (BackupManifest, error) {
+	partial := filename + ".partial"
+	file, err := os.Create(partial)
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	defer os.Remove(partial)
+
+	hash := sha256.New()
+	manifest, err := table.Backup(ctx, io.MultiWriter(file, hash))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return manifest, err
+	}
+
+	checksum := fmt.Sprintf("%s  %s\n", hex.EncodeToString(hash.Sum(nil)), filepath.Base(filename))
+	err = os.WriteFile(filename+".sha256", []byte(checksum), 0644)
+	if err != nil {
+		return manifest, err
+	}
+	return manifest, os.Rename(partial, filename)
+}
+
+// VerifyBackup checks the archive checksum, when a filename.sha256 file exists,
+// the database checksum recorded in the manifest, the integrity of the database
+// and that its schema is not newer than the migrations known to this build.
+func VerifyBackup(filename string) (BackupManifest, error) {
+	snapshot, manifest, err := extractBackup(filename, os.TempDir())
+	if err != nil {
+		return manifest, err
+	}
+	defer os.Remove(snapshot)
+	return manifest, checkDatabase(snapshot)
+}
+
+// RestoreBackup validates a backup archive and then atomically replaces the
+// database file at databasePath with the database it holds. The server using
+// databasePath must be stopped while it is restored.
+func RestoreBackup(filename string, databasePath string) (BackupManifest, error) {
+	snapshot, manifest, err := extractBackup(filename, filepath.Dir(databasePath))
+	if err != nil {
+		return manifest, err
+	}
+	defer os.Remove(snapshot)
+
+	err = checkDatabase(snapshot)
+	if err != nil {
+		return manifest, err
+	}
+
+	for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+		err := os.Remove(databasePath + suffix)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return manifest, err
+		}
+	}
+	return manifest, os.Rename(snapshot, databasePath)
+}
+
+// copyDatabase copies the main database of db into the file at filename with the
+// SQLite online backup API.
+func copyDatabase(ctx context.Context, db *sql.DB, filename string) error {
+	dest, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	srcConn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+
+	return destConn.Raw(func(destDriver any) error {
+		return srcConn.Raw(func(srcDriver any) error {
+			destSQLite, ok := destDriver.(*sqlite3.SQLiteConn)
+			srcSQLite, ok2 := srcDriver.(*sqlite3.SQLiteConn)
+			if !ok || !ok2 {
+				return errors.New("data: backup requires the sqlite3 driver")
+			}
+
+			backup, err := destSQLite.Backup("main", srcSQLite, "main")
+			if err != nil {
+				return err
+			}
+			for {
+				done, err := backup.Step(backupStepPages)
+				if err != nil {
+					backup.Finish()
+					return err
+				}
+				if done {
+					return backup.Finish()
+				}
+				select {
+				case <-ctx.Done():
+					backup.Finish()
+					return ctx.Err()
+				case <-time.After(time.Millisecond):
+				}
+			}
+		})
+	})
+}
+
+func writeBackupArchive(w io.Writer, manifest BackupManifest, snapshot string) error {
+	manifestJson, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	database, err := os.Open(snapshot)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	compressed := gzip.NewWriter(w)
+	archive := tar.NewWriter(compressed)
+	modTime := manifest.CreatedAt.Time
+
+	err = archive.WriteHeader(&tar.Header{Name: backupManifestName, Mode: 0644, Size: int64(len(manifestJson)), ModTime: modTime})
+	if err != nil {
+		return err
+	}
+	_, err = archive.Write(manifestJson)
+	if err != nil {
+		return err
+	}
+
+	err = archive.WriteHeader(&tar.Header{Name: backupDatabaseName, Mode: 0600, Size: manifest.DatabaseSize, ModTime: modTime})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(archive, database)
+	if err != nil {
+		return err
+	}
+
+	err = archive.Close()
+	if err != nil {
+		return err
+	}
+	return compressed.Close()
+}
+
+// extractBackup verifies the checksums of a backup archive and extracts its
+// database into a temporary file in dir.
+func extractBackup(filename string, dir string) (string, BackupManifest, error) {
+	var manifest BackupManifest
+	err := verifyArchiveChecksum(filename)
+	if err != nil {
+		return "", manifest, err
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", manifest, err
+	}
+	defer file.Close()
+	compressed, err := gzip.NewReader(file)
+	if err != nil {
+		return "", manifest, fmt.Errorf("%w: %v", ErrBackupFormat, err)
+	}
+	archive := tar.NewReader(compressed)
+
+	header, err := archive.Next()
+	if err != nil || header.Name != backupManifestName {
+		return "", manifest, ErrBackupFormat
+	}
+	err = json.NewDecoder(archive).Decode(&manifest)
+	if err != nil {
+		return "", manifest, fmt.Errorf("%w: %v", ErrBackupFormat, err)
+	}
+	if manifest.FormatVersion != backupFormatVersion {
+		return "", manifest, ErrBackupFormat
+	}
+	if manifest.SchemaVersion > latestSchemaVersion() {
+		return "", manifest, fmt.Errorf("%w: archive has version %d, server supports %d", ErrBackupSchema, manifest.SchemaVersion, latestSchemaVersion())
+	}
+
+	header, err = archive.Next()
+	if err != nil || header.Name != backupDatabaseName {
+		return "", manifest, ErrBackupFormat
+	}
+	snapshot, err := os.CreateTemp(dir, ".linuxfleet-restore-*.db")
+	if err != nil {
+		return "", manifest, err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(snapshot, hash), archive)
+	if err == nil {
+		err = snapshot.Sync()
+	}
+	if closeErr := snapshot.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && hex.EncodeToString(hash.Sum(nil)) != manifest.DatabaseSHA256 {
+		err = ErrBackupChecksum
+	}
+	if err != nil {
+		os.Remove(snapshot.Name())
+		return "", manifest, err
+	}
+	return snapshot.Name(), manifest, nil
+}
+
+// verifyArchiveChecksum compares the archive with its filename.sha256 file if there is one.
+func verifyArchiveChecksum(filename string) error {
+	content, err := os.ReadFile(filename + ".sha256")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	expected, _, _ := strings.Cut(strings.TrimSpace(string(content)), " ")
+	actual, _, err := fileChecksum(filename)
+	if err != nil {
+		return err
+	}
+	if actual != expected {
+		return ErrBackupChecksum
+	}
+	return nil
+}
+
+// checkDatabase runs an integrity check on the database file and makes sure its
+// schema can be migrated by this build.
+func checkDatabase(filename string) error {
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var result string
+	err = db.QueryRow(`PRAGMA integrity_check`).Scan(&result)
+	if err != nil {
+		return err
+	}
+	if result != "ok" {
+		return fmt.Errorf("data: backup integrity check failed: %s", result)
+	}
+
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version > latestSchemaVersion() {
+		return ErrBackupSchema
+	}
+	return nil
+}
+
+func fileChecksum(filename string) (string, int64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
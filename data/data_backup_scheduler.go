@@ -0,0 +1,143 @@
+package data
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const backupFilePrefix = "linuxfleet-"
+const backupFileSuffix = ".tar.gz"
+
+// BackupSchedulerOptions configures periodic backups and their rotation.
+type BackupSchedulerOptions struct {
+	// Directory is where the backup archives are written.
+	Directory string
+	// Interval is the time between two backups.
+	Interval time.Duration
+	// Keep is the number of most recent archives kept in Directory.
+	Keep int
+	// OnBackup is called with the path of every archive written. It may be nil.
+	OnBackup func(filename string, manifest BackupManifest)
+	// OnError is called when a backup or the rotation fails. It may be nil.
+	OnError func(err error)
+}
+
+// DefaultBackupSchedulerOptions returns the options used when none are configured.
+func DefaultBackupSchedulerOptions() BackupSchedulerOptions {
+	return BackupSchedulerOptions{
+		Interval: 24 * time.Hour,
+		Keep:     7,
+	}
+}
+
+// BackupScheduler is a background worker that backs up the database at a fixed
+// interval and removes the oldest archives.
+type BackupScheduler struct {
+	worker
+	tables  *Tables
+	options BackupSchedulerOptions
+}
+
+// NewBackupScheduler creates a backup scheduler for the data tables. Call Start to run it.
+func NewBackupScheduler(tables *Tables, options BackupSchedulerOptions) *BackupScheduler {
+	defaults := DefaultBackupSchedulerOptions()
+	if options.Interval <= 0 {
+		options.Interval = defaults.Interval
+	}
+	if options.Keep <= 0 {
+		options.Keep = defaults.Keep
+	}
+	return &BackupScheduler{
+		worker:  newWorker(),
+		tables:  tables,
+		options: options,
+	}
+}
+
+// Start runs the backup scheduler in its own goroutine until Stop is called.
+// The first backup is taken after one interval.
+func (b *BackupScheduler) Start() {
+	b.start(b.run)
+}
+
+func (b *BackupScheduler) run() {
+	ticker := time.NewTicker(b.options.Interval)
+	defer ticker.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-b.stop
+		cancel()
+	}()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+			_, err := b.BackupNow(ctx)
+			if err != nil && b.options.OnError != nil {
+				b.options.OnError(err)
+			}
+		}
+	}
+}
+
+// BackupNow writes a new archive to the backup directory and then removes the
+// archives beyond the configured number to keep. It returns the archive path.
+func (b *BackupScheduler) BackupNow(ctx context.Context) (string, error) {
+	err := os.MkdirAll(b.options.Directory, 0750)
+	if err != nil {
+		return "", err
+	}
+
+	name := backupFilePrefix + time.Now().UTC().Format("20060102T150405.000000000Z") + backupFileSuffix
+	filename := filepath.Join(b.options.Directory, name)
+	manifest, err := b.tables.BackupToFile(ctx, filename)
+	if err != nil {
+		return "", err
+	}
+	if b.options.OnBackup != nil {
+		b.options.OnBackup(filename, manifest)
+	}
+	return filename, b.rotate()
+}
+
+// ListBackups returns the archives in the backup directory from oldest to newest.
+func (b *BackupScheduler) ListBackups() ([]string, error) {
+	entries, err := os.ReadDir(b.options.Directory)
+	if err != nil {
+		return nil, err
+	}
+	var backups []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.Type().IsRegular() && strings.HasPrefix(name, backupFilePrefix) && strings.HasSuffix(name, backupFileSuffix) {
+			backups = append(backups, filepath.Join(b.options.Directory, name))
+		}
+	}
+	// The UTC time in the names makes lexical order chronological.
+	slices.Sort(backups)
+	return backups, nil
+}
+
+func (b *BackupScheduler) rotate() error {
+	backups, err := b.ListBackups()
+	if err != nil {
+		return err
+	}
+	for len(backups) > b.options.Keep {
+		err := os.Remove(backups[0])
+		if err != nil {
+			return err
+		}
+		os.Remove(backups[0] + ".sha256")
+		backups = backups[1:]
+	}
+	return nil
+}
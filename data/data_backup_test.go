@@ -0,0 +1,108 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func backupTestTables(t *testing.T) (*Tables, Object) {
+	table, err := NewTables(newTestDatabase(t))
+	assert.NoError(t, err)
+	obj := Object{ID: uuid.NewString(), OwnerID: "owner1", Version: 1, Attributes: map[string]any{"hostname": "web-1"}}
+	assert.NoError(t, table.Insert("device", obj))
+	return table, obj
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	table, obj := backupTestTables(t)
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "backup.tar.gz")
+
+	manifest, err := table.BackupToFile(context.Background(), archive)
+	assert.NoError(t, err)
+	assert.Equal(t, latestSchemaVersion(), manifest.SchemaVersion)
+	assert.FileExists(t, archive+".sha256")
+
+	verified, err := VerifyBackup(archive)
+	assert.NoError(t, err)
+	assert.Equal(t, manifest.DatabaseSHA256, verified.DatabaseSHA256)
+
+	databasePath := filepath.Join(dir, "restored.db")
+	assert.NoError(t, os.WriteFile(databasePath, []byte("previous database"), 0600))
+	_, err = RestoreBackup(archive, databasePath)
+	assert.NoError(t, err)
+
+	restoredDB, err := sql.Open("sqlite3", databasePath)
+	assert.NoError(t, err)
+	defer restoredDB.Close()
+	restored, err := NewTables(restoredDB)
+	assert.NoError(t, err)
+	retrieved, err := restored.GetByID("device", obj.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "web-1", retrieved.Attributes["hostname"])
+}
+
+func TestRestoreRejectsCorruptArchive(t *testing.T) {
+	table, _ := backupTestTables(t)
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "backup.tar.gz")
+	_, err := table.BackupToFile(context.Background(), archive)
+	assert.NoError(t, err)
+
+	content, err := os.ReadFile(archive)
+	assert.NoError(t, err)
+	content[len(content)/2] ^= 0xff
+	assert.NoError(t, os.WriteFile(archive, content, 0600))
+
+	databasePath := filepath.Join(dir, "current.db")
+	assert.NoError(t, os.WriteFile(databasePath, []byte("current database"), 0600))
+	_, err = RestoreBackup(archive, databasePath)
+	assert.ErrorIs(t, err, ErrBackupChecksum)
+
+	current, err := os.ReadFile(databasePath)
+	assert.NoError(t, err)
+	assert.Equal(t, "current database", string(current))
+}
+
+func TestRestoreRejectsNewerSchema(t *testing.T) {
+	table, _ := backupTestTables(t)
+	_, err := table.db.Exec(sqlInsertMigration(), "device", latestSchemaVersion()+1, NowTimestamp())
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "backup.tar.gz")
+	_, err = table.BackupToFile(context.Background(), archive)
+	assert.NoError(t, err)
+
+	_, err = RestoreBackup(archive, filepath.Join(dir, "current.db"))
+	assert.ErrorIs(t, err, ErrBackupSchema)
+	assert.NoFileExists(t, filepath.Join(dir, "current.db"))
+}
+
+func TestBackupSchedulerRotation(t *testing.T) {
+	table, _ := backupTestTables(t)
+	dir := t.TempDir()
+
+	var written []string
+	scheduler := NewBackupScheduler(table, BackupSchedulerOptions{
+		Directory: dir,
+		Keep:      2,
+		OnBackup:  func(filename string, manifest BackupManifest) { written = append(written, filename) },
+	})
+	for i := 0; i < 3; i++ {
+		_, err := scheduler.BackupNow(context.Background())
+		assert.NoError(t, err)
+	}
+
+	backups, err := scheduler.ListBackups()
+	assert.NoError(t, err)
+	assert.Equal(t, written[1:], backups)
+	assert.NoFileExists(t, written[0])
+	assert.NoFileExists(t, written[0]+".sha256")
+}
@@ -0,0 +1,83 @@
+package data
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+// InsertBatch inserts the objects into the table in one transaction with one
+// prepared statement. Either every object is inserted or none is.
+func (table *Tables) InsertBatch(tableName string, objs []Object) error {
+	objs = slices.Clone(objs)
+	for i := range objs {
+		objs[i].CreatedAt, objs[i].HLC = table.stamp()
+		objs[i].UpdatedAt = objs[i].CreatedAt
+	}
+	return table.writeBatch(tableName, sqlInsert(tableName), objs)
+}
+
+// UpsertBatch inserts the objects into the table, or updates the existing
+// objects with the same ID, in one transaction with one prepared statement.
+// Updated objects keep their creation time. Either every object is written or
+// none is.
+func (table *Tables) UpsertBatch(tableName string, objs []Object) error {
+	objs = slices.Clone(objs)
+	for i := range objs {
+		objs[i].CreatedAt, objs[i].HLC = table.stamp()
+		objs[i].UpdatedAt = objs[i].CreatedAt
+	}
+	return table.writeBatch(tableName, sqlBatchUpsert(tableName), objs)
+}
+
+// writeBatch executes query once per object in one transaction. The query
+// takes the object columns as arguments.
+func (table *Tables) writeBatch(tableName string, query string, objs []Object) (err error) {
+	defer table.observe("write_batch", tableName, time.Now(), &err)
+	if !isDataTable(tableName) {
+		return fmt.Errorf("%w: %s", ErrUnknownTable, tableName)
+	}
+	if len(objs) == 0 {
+		return nil
+	}
+
+	// Attributes are encoded before the transaction begins because encrypting
+	// them may create a data key, which is a write of its own.
+	encoded := make([][]byte, len(objs))
+	for i, obj := range objs {
+		attrsJson, err := table.encodeAttributes(nil, tableName, obj)
+		if err != nil {
+			return fmt.Errorf("data: object %d (%s): %w", i, obj.ID, err)
+		}
+		encoded[i] = attrsJson
+	}
+
+	tx, err := table.writer.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for i, obj := range objs {
+		_, err := stmt.Exec(obj.ID, obj.CreatedAt, obj.UpdatedAt, obj.OwnerID, obj.Version, encoded[i], obj.ExpiresAt, obj.HLC)
+		if err != nil {
+			return fmt.Errorf("data: object %d (%s): %w", i, obj.ID, translateError(err))
+		}
+	}
+	return tx.Commit()
+}
+
+// sqlBatchUpsert constructs the SQL query to insert an object or update the
+// existing object with its ID while keeping its creation time.
+func sqlBatchUpsert(tableName string) string {
+	query := `INSERT INTO %s (%s) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(id) DO UPDATE SET updated_at = excluded.updated_at, owner_id = excluded.owner_id,
+	version = excluded.version, attributes = excluded.attributes, expires_at = excluded.expires_at, hlc = excluded.hlc`
+	return fmt.Sprintf(query, tableName, objectColumns)
+}
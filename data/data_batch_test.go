@@ -0,0 +1,158 @@
+package data
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func batchObjects(prefix string, count int) []Object {
+	objs := make([]Object, count)
+	for i := range objs {
+		objs[i] = Object{
+			ID:         fmt.Sprintf("%s-%d", prefix, i),
+			OwnerID:    "owner1",
+			Version:    1,
+			Attributes: map[string]any{"hostname": fmt.Sprintf("host-%d", i), "load": float64(i)},
+		}
+	}
+	return objs
+}
+
+func TestInsertBatch(t *testing.T) {
+	table, err := NewTables(newTestDatabase(t))
+	assert.NoError(t, err)
+
+	objs := batchObjects("d", 3)
+	assert.NoError(t, table.InsertBatch("device", objs))
+	assert.True(t, objs[0].CreatedAt.IsZero())
+	stored, err := table.ListByOwner("device", "owner1")
+	assert.NoError(t, err)
+	assert.Len(t, stored, 3)
+
+	// A conflicting object rolls the whole batch back.
+	err = table.InsertBatch("device", append(batchObjects("e", 2), objs[1]))
+	assert.ErrorIs(t, err, ErrConflict)
+	stored, err = table.ListByOwner("device", "owner1")
+	assert.NoError(t, err)
+	assert.Len(t, stored, 3)
+
+	assert.ErrorIs(t, table.InsertBatch("missing", objs), ErrUnknownTable)
+	assert.NoError(t, table.InsertBatch("device", nil))
+}
+
+func TestUpsertBatch(t *testing.T) {
+	table, err := NewTables(newTestDatabase(t))
+	assert.NoError(t, err)
+
+	objs := batchObjects("d", 2)
+	assert.NoError(t, table.InsertBatch("device", objs[:1]))
+	created, err := table.GetByID("device", "d-0")
+	assert.NoError(t, err)
+
+	objs[0].Version = 2
+	objs[0].Attributes = map[string]any{"hostname": "renamed"}
+	assert.NoError(t, table.UpsertBatch("device", objs))
+
+	updated, err := table.GetByID("device", "d-0")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, updated.Version)
+	assert.Equal(t, "renamed", updated.Attributes["hostname"])
+	assert.Equal(t, created.CreatedAt.Unix(), updated.CreatedAt.Unix())
+	assert.False(t, updated.UpdatedAt.IsZero())
+
+	inserted, err := table.GetByID("device", "d-1")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, inserted.Version)
+}
+
+func TestBatchEncryption(t *testing.T) {
+	database := newTestDatabase(t)
+	table, _ := newEncryptedTables(t, database)
+
+	objs := []Object{{ID: "r1", OwnerID: "org1", Version: 1, Attributes: map[string]any{"email": "a@example.com", "password": "secret"}}}
+	assert.NoError(t, table.UpsertBatch("registration", objs))
+	assert.NotEqual(t, "secret", storedAttribute(t, database, "registration", "r1", "password"))
+	obj, err := table.GetByID("registration", "r1")
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", obj.Attributes["password"])
+}
+
+func TestOpenDatabase(t *testing.T) {
+	database, err := OpenDatabase(filepath.Join(t.TempDir(), "linuxfleet.db"), DatabaseOptions{})
+	assert.NoError(t, err)
+	defer database.Close()
+
+	var journalMode string
+	assert.NoError(t, database.Reader.QueryRow(`PRAGMA journal_mode`).Scan(&journalMode))
+	assert.Equal(t, "wal", journalMode)
+	assert.Equal(t, 1, database.Writer.Stats().MaxOpenConnections)
+
+	table, err := NewDatabaseTables(database)
+	assert.NoError(t, err)
+	assert.NoError(t, table.InsertBatch("device", batchObjects("d", 10)))
+	stored, err := table.ListByOwner("device", "owner1")
+	assert.NoError(t, err)
+	assert.Len(t, stored, 10)
+
+	memory, err := OpenDatabase(":memory:", DatabaseOptions{})
+	assert.NoError(t, err)
+	assert.Same(t, memory.Reader, memory.Writer)
+	assert.NoError(t, memory.Close())
+}
+
+func benchmarkTables(b *testing.B) *Tables {
+	database, err := OpenDatabase(filepath.Join(b.TempDir(), "linuxfleet.db"), DatabaseOptions{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { database.Close() })
+	table, err := NewDatabaseTables(database)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return table
+}
+
+// BenchmarkInsert is the baseline: one autocommitted statement per object.
+func BenchmarkInsert(b *testing.B) {
+	table := benchmarkTables(b)
+	objs := batchObjects("d", b.N)
+	b.ResetTimer()
+	for i := range b.N {
+		err := table.Insert("device", objs[i])
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkInsertBatch(b *testing.B) {
+	for _, size := range []int{100, 1000} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			table := benchmarkTables(b)
+			objs := batchObjects("d", b.N)
+			b.ResetTimer()
+			for start := 0; start < b.N; start += size {
+				err := table.InsertBatch("device", objs[start:min(start+size, b.N)])
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkUpsertBatch(b *testing.B) {
+	table := benchmarkTables(b)
+	objs := batchObjects("d", 1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i += len(objs) {
+		err := table.UpsertBatch("device", objs[:min(len(objs), b.N-i)])
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
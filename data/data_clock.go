@@ -0,0 +1,160 @@
+package data
+
+import (
+	"cmp"
+	"database/sql/driver"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HLC is a hybrid logical clock timestamp. It orders the changes made across
+// server instances even when their clocks disagree: Wall follows the physical
+// time in Unix nanoseconds, Logical counts the changes made at the same wall
+// time, and Node breaks the remaining ties between instances.
+type HLC struct {
+	Wall    int64
+	Logical uint32
+	Node    string
+}
+
+// ParseHLC parses the text form of an HLC returned by String. The empty string is the zero HLC.
+func ParseHLC(value string) (HLC, error) {
+	if value == "" {
+		return HLC{}, nil
+	}
+	parts := strings.SplitN(value, ".", 3)
+	if len(parts) < 2 || len(parts[0]) != 19 || len(parts[1]) != 10 {
+		return HLC{}, fmt.Errorf("data: invalid hybrid logical clock %q", value)
+	}
+	wall, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return HLC{}, fmt.Errorf("data: invalid hybrid logical clock %q: %w", value, err)
+	}
+	logical, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return HLC{}, fmt.Errorf("data: invalid hybrid logical clock %q: %w", value, err)
+	}
+	hlc := HLC{Wall: wall, Logical: uint32(logical)}
+	if len(parts) == 3 {
+		hlc.Node = parts[2]
+	}
+	return hlc, nil
+}
+
+// IsZero reports whether the HLC was never set.
+func (h HLC) IsZero() bool {
+	return h == HLC{}
+}
+
+// Time returns the wall time of the HLC in UTC.
+func (h HLC) Time() time.Time {
+	return time.Unix(0, h.Wall).UTC()
+}
+
+// Compare returns -1, 0 or +1 depending on whether h orders before, with or after other.
+func (h HLC) Compare(other HLC) int {
+	return cmp.Or(
+		cmp.Compare(h.Wall, other.Wall),
+		cmp.Compare(h.Logical, other.Logical),
+		strings.Compare(h.Node, other.Node),
+	)
+}
+
+// String returns the HLC as fixed width decimal fields, so that the text forms
+// of two HLCs compare like the HLCs.
+func (h HLC) String() string {
+	if h.IsZero() {
+		return ""
+	}
+	if h.Node == "" {
+		return fmt.Sprintf("%019d.%010d", h.Wall, h.Logical)
+	}
+	return fmt.Sprintf("%019d.%010d.%s", h.Wall, h.Logical, h.Node)
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (h HLC) MarshalText() ([]byte, error) {
+	return []byte(h.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (h *HLC) UnmarshalText(text []byte) error {
+	parsed, err := ParseHLC(string(text))
+	if err != nil {
+		return err
+	}
+	*h = parsed
+	return nil
+}
+
+// Value implements the driver.Valuer interface.
+func (h HLC) Value() (driver.Value, error) {
+	return h.String(), nil
+}
+
+// Scan implements the sql.Scanner interface.
+func (h *HLC) Scan(value any) error {
+	switch value := value.(type) {
+	case nil:
+		*h = HLC{}
+		return nil
+	case string:
+		return h.UnmarshalText([]byte(value))
+	case []byte:
+		return h.UnmarshalText(value)
+	default:
+		return fmt.Errorf("expected string value for HLC, got %T", value)
+	}
+}
+
+// Clock issues hybrid logical clock timestamps. Every timestamp it issues is
+// after the previous ones and after every timestamp it observed.
+type Clock struct {
+	mu   sync.Mutex
+	last HLC
+	node string
+	now  func() time.Time
+}
+
+// NewClock creates a clock for the node, which may be empty on a single server.
+func NewClock(node string) *Clock {
+	return &Clock{node: node, now: time.Now}
+}
+
+// Now returns a new timestamp.
+func (c *Clock) Now() HLC {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	wall := c.now().UnixNano()
+	if wall > c.last.Wall {
+		c.last = HLC{Wall: wall}
+	} else {
+		c.last.Logical++
+	}
+	c.last.Node = c.node
+	return c.last
+}
+
+// Observe moves the clock past a timestamp issued by another clock.
+func (c *Clock) Observe(remote HLC) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	remote.Node = ""
+	last := c.last
+	last.Node = ""
+	if remote.Compare(last) > 0 {
+		c.last = remote
+	}
+}
+
+// setNode sets the node of the timestamps issued from now on.
+func (c *Clock) setNode(node string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.node = node
+}
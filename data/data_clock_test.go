@@ -0,0 +1,134 @@
+package data
+
+import (
+	"database/sql"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClock(t *testing.T) {
+	wall := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	clock := NewClock("node1")
+	clock.now = func() time.Time { return wall }
+
+	first := clock.Now()
+	assert.Equal(t, HLC{Wall: wall.UnixNano(), Node: "node1"}, first)
+	assert.Equal(t, wall, first.Time())
+
+	// The logical counter orders timestamps issued at the same wall time or
+	// after the wall clock went backwards.
+	second := clock.Now()
+	wall = wall.Add(-time.Second)
+	third := clock.Now()
+	assert.Equal(t, 1, second.Compare(first))
+	assert.Equal(t, 1, third.Compare(second))
+	assert.Equal(t, uint32(2), third.Logical)
+
+	// Observing a timestamp of another node moves the clock past it.
+	remote := HLC{Wall: wall.Add(time.Hour).UnixNano(), Logical: 7, Node: "node2"}
+	clock.Observe(remote)
+	fourth := clock.Now()
+	assert.Equal(t, HLC{Wall: remote.Wall, Logical: 8, Node: "node1"}, fourth)
+	clock.Observe(first)
+	assert.Equal(t, 1, clock.Now().Compare(fourth))
+}
+
+func TestHLCText(t *testing.T) {
+	hlcs := []HLC{
+		{Wall: 1_700_000_000_000_000_000, Logical: 2, Node: "b"},
+		{Wall: 999_999_999, Logical: 10},
+		{Wall: 1_700_000_000_000_000_000, Logical: 2, Node: "a"},
+		{Wall: 1_700_000_000_000_000_000},
+		{},
+	}
+	texts := make([]string, len(hlcs))
+	for i, hlc := range hlcs {
+		texts[i] = hlc.String()
+		parsed, err := ParseHLC(texts[i])
+		assert.NoError(t, err)
+		assert.Equal(t, hlc, parsed)
+	}
+
+	// The text forms sort like the HLCs.
+	sort.Slice(hlcs, func(i, j int) bool { return hlcs[i].Compare(hlcs[j]) < 0 })
+	sort.Strings(texts)
+	for i, hlc := range hlcs {
+		assert.Equal(t, hlc.String(), texts[i])
+	}
+
+	for _, invalid := range []string{"1", "1.2", "000000000000000000x.0000000000", "0000000000000000001.000000000x"} {
+		_, err := ParseHLC(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestWriteOrder(t *testing.T) {
+	tables, err := NewTables(newTestDatabase(t))
+	assert.NoError(t, err)
+
+	var objs []Object
+	for _, id := range []string{"c", "a", "d", "b"} {
+		objs = append(objs, Object{ID: id, OwnerID: "org1", Version: 1})
+	}
+	assert.NoError(t, tables.InsertBatch("device", objs))
+	assert.NoError(t, tables.UpdateByID("device", "c", Object{OwnerID: "org1", Version: 2}))
+
+	// Writes made within the same second are ordered by their HLC.
+	stored, err := tables.ListByOwner("device", "org1")
+	assert.NoError(t, err)
+	sort.Slice(stored, func(i, j int) bool { return stored[i].HLC.Compare(stored[j].HLC) < 0 })
+	assert.Equal(t, []string{"a", "d", "b", "c"}, objectIDs(stored))
+	for _, obj := range stored {
+		assert.Equal(t, obj.HLC.Time(), obj.UpdatedAt.Time)
+	}
+
+	// A new instance on the same database continues after the stored HLCs.
+	reopened, err := NewTables(tables.db)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, reopened.clock.Now().Compare(stored[len(stored)-1].HLC))
+}
+
+func TestTimestampMigration(t *testing.T) {
+	db := newTestDatabase(t)
+	_, err := db.Exec(sqlCreateMigrationTable())
+	assert.NoError(t, err)
+	_, err = db.Exec(sqlCreatTable("device"))
+	assert.NoError(t, err)
+	for _, m := range migrationList()[:2] {
+		assert.NoError(t, applyMigration(db, "device", m))
+	}
+
+	// Rows written with second precision, before Insert set updated_at.
+	for _, row := range [][]any{
+		{"b", "2024-01-02T03:04:05Z", "0001-01-01T00:00:00Z", nil},
+		{"a", "2024-01-02T03:04:05Z", "2024-01-02T03:04:05Z", "2024-01-03T04:05:06+01:00"},
+		{"c", "2024-01-01T00:00:00Z", "2024-01-02T03:04:06Z", nil},
+	} {
+		_, err := db.Exec(`INSERT INTO device (id, created_at, updated_at, owner_id, version, attributes, expires_at) VALUES (?, ?, ?, 'org1', 1, '{}', ?)`, row...)
+		assert.NoError(t, err)
+	}
+
+	tables, err := NewTables(db)
+	assert.NoError(t, err)
+	// The row expired long ago, so GetByID does not find it anymore.
+	_, err = tables.GetByID("device", "a")
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	var text string
+	assert.NoError(t, db.QueryRow(`SELECT updated_at FROM device WHERE id = 'a'`).Scan(&text))
+	assert.Equal(t, "2024-01-02T03:04:05.000000000Z", text)
+
+	stored, err := tables.ListByOwner("device", "org1")
+	assert.NoError(t, err)
+	sort.Slice(stored, func(i, j int) bool { return stored[i].HLC.Compare(stored[j].HLC) < 0 })
+	assert.Equal(t, []string{"b", "a", "c"}, objectIDs(stored))
+	assert.Equal(t, time.Date(2024, 1, 3, 3, 5, 6, 0, time.UTC), stored[1].ExpiresAt.Time)
+	assert.Equal(t, stored[0].CreatedAt, stored[0].UpdatedAt)
+
+	// The expiry of a migrated row is compared with new timestamps.
+	expired, err := tables.DeleteExpired("device", Timestamp{Time: time.Date(2024, 1, 3, 3, 5, 6, 1, time.UTC)}, 10, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, objectIDs(expired))
+}
@@ -0,0 +1,110 @@
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// DatabaseOptions tunes the connections opened by OpenDatabase.
+type DatabaseOptions struct {
+	// BusyTimeout is how long a connection waits for a lock held by another one.
+	BusyTimeout time.Duration
+	// MaxReaders is the maximum number of open read connections.
+	MaxReaders int
+}
+
+// DefaultDatabaseOptions returns the options used when none are configured.
+func DefaultDatabaseOptions() DatabaseOptions {
+	return DatabaseOptions{
+		BusyTimeout: 5 * time.Second,
+		MaxReaders:  4,
+	}
+}
+
+// Database is a SQLite database in WAL mode opened with a pool of read
+// connections and a single dedicated write connection. SQLite allows one
+// writer at a time, so funneling every write through one connection avoids
+// busy errors between writers while readers keep reading the last commit.
+type Database struct {
+	Reader *sql.DB
+	Writer *sql.DB
+}
+
+// OpenDatabase opens the SQLite database file, creating it if needed. The
+// in-memory database ":memory:" is opened with a single connection shared by
+// readers and the writer, since every connection would see its own database.
+func OpenDatabase(filename string, options DatabaseOptions) (*Database, error) {
+	defaults := DefaultDatabaseOptions()
+	if options.BusyTimeout <= 0 {
+		options.BusyTimeout = defaults.BusyTimeout
+	}
+	if options.MaxReaders <= 0 {
+		options.MaxReaders = defaults.MaxReaders
+	}
+
+	if filename == ":memory:" {
+		db, err := sql.Open("sqlite3", filename)
+		if err != nil {
+			return nil, err
+		}
+		db.SetMaxOpenConns(1)
+		return &Database{Reader: db, Writer: db}, nil
+	}
+
+	// The journal mode is stored in the database file, so it is set by the
+	// writer before any reader connects. Write transactions take the lock when
+	// they begin rather than failing when they first write.
+	writer, err := sql.Open("sqlite3", databaseDSN(filename, options, url.Values{
+		"_journal_mode": {"WAL"},
+		"_synchronous":  {"NORMAL"},
+		"_txlock":       {"immediate"},
+	}))
+	if err != nil {
+		return nil, err
+	}
+	writer.SetMaxOpenConns(1)
+	writer.SetMaxIdleConns(1)
+
+	var journalMode string
+	err = writer.QueryRow(`PRAGMA journal_mode`).Scan(&journalMode)
+	if err != nil {
+		writer.Close()
+		return nil, err
+	}
+	if journalMode != "wal" {
+		writer.Close()
+		return nil, fmt.Errorf("data: %s uses journal mode %s instead of wal", filename, journalMode)
+	}
+
+	reader, err := sql.Open("sqlite3", databaseDSN(filename, options, url.Values{}))
+	if err != nil {
+		writer.Close()
+		return nil, err
+	}
+	reader.SetMaxOpenConns(options.MaxReaders)
+	reader.SetMaxIdleConns(options.MaxReaders)
+	return &Database{Reader: reader, Writer: writer}, nil
+}
+
+// Close closes the read and write connections.
+func (database *Database) Close() error {
+	if database.Reader == database.Writer {
+		return database.Writer.Close()
+	}
+	return errors.Join(database.Reader.Close(), database.Writer.Close())
+}
+
+// NewDatabaseTables creates the data tables of a database opened with OpenDatabase.
+// Queries use the read connections and every write goes through the writer.
+func NewDatabaseTables(database *Database) (*Tables, error) {
+	return newTables(database.Reader, database.Writer)
+}
+
+// databaseDSN constructs the go-sqlite3 connection string of a database file.
+func databaseDSN(filename string, options DatabaseOptions, params url.Values) string {
+	params.Set("_busy_timeout", fmt.Sprint(options.BusyTimeout.Milliseconds()))
+	return "file:" + filename + "?" + params.Encode()
+}
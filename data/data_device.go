@@ -0,0 +1,11 @@
+package data
+
+// DeviceTable stores the devices of the fleet.
+var DeviceTable = RegisterTable(TableDefinition{
+	Name: "device",
+	Indexes: []AttributeIndex{
+		{Path: "hostname"},
+		{Path: "os.name"},
+	},
+	Searchable: true,
+})
@@ -0,0 +1,591 @@
+package data
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+
+	"github.com/jrpalma/linuxfleet/secret"
+)
+
+// encryptedValuePrefix marks an attribute value that was encrypted with a data key.
+// The full format is enc:v1:<data key ID>:<base64 nonce and ciphertext>.
+const encryptedValuePrefix = "enc:v1:"
+
+var ErrUnknownDataKey = errors.New("data: unknown data key")
+var ErrMalformedEncryptedValue = errors.New("data: malformed encrypted value")
+
+// keyring holds the unwrapped data keys of every organization. Data keys are
+// stored in the data_key table wrapped by the master key.
+type keyring struct {
+	db     *sql.DB
+	writer *tableWriter
+	mu     sync.RWMutex
+	master []byte
+	keys   map[string][]byte
+	active map[string]string
+}
+
+// EnableEncryption turns on transparent encryption of the sensitive attributes
+// using per-organization data keys wrapped by masterKey. The owner ID of an
+// object identifies its organization.
+func (table *Tables) EnableEncryption(masterKey []byte) error {
+	if len(masterKey) != secret.KeySize {
+		return secret.ErrInvalidKey
+	}
+	_, err := table.writer.db.Exec(sqlCreateDataKeyTable())
+	if err != nil {
+		return err
+	}
+
+	ring := &keyring{db: table.db, writer: table.writer, master: masterKey, keys: map[string][]byte{}, active: map[string]string{}}
+	err = ring.load(nil)
+	if err != nil {
+		return err
+	}
+	table.keys = ring
+	return nil
+}
+
+// EncryptionEnabled reports whether EnableEncryption was called.
+func (table *Tables) EncryptionEnabled() bool {
+	return table.keys != nil
+}
+
+// RotateDataKeys creates a new active data key for every organization. Values
+// encrypted with the previous keys stay readable until they are re-encrypted
+// with ReencryptBatch.
+func (table *Tables) RotateDataKeys() error {
+	if table.keys == nil {
+		return nil
+	}
+	return table.keys.rotate()
+}
+
+// RotateMasterKey wraps every data key with a new master key. Rows do not have
+// to be re-encrypted because the data keys themselves do not change.
+func (table *Tables) RotateMasterKey(masterKey []byte) error {
+	if table.keys == nil {
+		return nil
+	}
+	if len(masterKey) != secret.KeySize {
+		return secret.ErrInvalidKey
+	}
+	return table.keys.rewrap(masterKey)
+}
+
+// ReencryptBatch examines up to limit rows of the table with an ID greater than
+// afterID and rewrites the ones whose sensitive attributes are in plaintext or
+// encrypted with a data key that is no longer active. It returns the last ID
+// examined, which is empty once the table is exhausted, and the number of
+// rewritten rows. Rows changed concurrently are skipped and picked up again on
+// the next pass.
+func (table *Tables) ReencryptBatch(tableName string, afterID string, limit int) (string, int, error) {
+	if table.keys == nil || len(lookupTable(tableName).Sensitive) == 0 {
+		return "", 0, nil
+	}
+
+	rows, err := table.db.Query(sqlListAttributesAfterID(tableName), afterID, limit)
+	if err != nil {
+		return "", 0, err
+	}
+	type storedRow struct {
+		obj    Object
+		stored string
+	}
+	var stored []storedRow
+	for rows.Next() {
+		var row storedRow
+		err := rows.Scan(&row.obj.ID, &row.obj.OwnerID, &row.stored)
+		if err == nil {
+			err = json.Unmarshal([]byte(row.stored), &row.obj.Attributes)
+		}
+		if err != nil {
+			rows.Close()
+			return "", 0, err
+		}
+		stored = append(stored, row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return "", 0, err
+	}
+
+	rewritten := 0
+	for _, row := range stored {
+		if !table.keys.isStale(tableName, row.obj) {
+			continue
+		}
+		obj, err := table.decryptObject(nil, tableName, row.obj)
+		if err != nil {
+			return "", rewritten, err
+		}
+		attrsJson, err := table.encodeAttributes(nil, tableName, obj)
+		if err != nil {
+			return "", rewritten, err
+		}
+		result, err := table.writer.Exec(sqlReplaceAttributes(tableName), attrsJson, obj.ID, row.stored)
+		if err != nil {
+			return "", rewritten, err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return "", rewritten, err
+		}
+		rewritten += int(affected)
+	}
+
+	if len(stored) < limit {
+		return "", rewritten, nil
+	}
+	return stored[len(stored)-1].obj.ID, rewritten, nil
+}
+
+// encodeAttributes returns the JSON stored in the attributes column of the object,
+// with its sensitive attributes encrypted when encryption is enabled.
+func (table *Tables) encodeAttributes(tx *writeTx, tableName string, obj Object) ([]byte, error) {
+	attributes := obj.Attributes
+	sensitive := lookupTable(tableName).Sensitive
+	if table.keys != nil && len(sensitive) > 0 && attributes != nil {
+		attributes = maps.Clone(attributes)
+		for _, name := range sensitive {
+			value, ok := attributes[name]
+			if !ok || isEncryptedValue(value) {
+				continue
+			}
+			encrypted, err := table.keys.encrypt(tx, obj.OwnerID, attributeAAD(tableName, obj.ID, name), value)
+			if err != nil {
+				return nil, err
+			}
+			attributes[name] = encrypted
+		}
+	}
+	return json.Marshal(attributes)
+}
+
+// decryptObject decrypts the sensitive attributes of an object read from the
+// table. When tx is not nil the object was read in the transaction and the data
+// keys are looked up in it.
+func (table *Tables) decryptObject(tx *writeTx, tableName string, obj Object) (Object, error) {
+	sensitive := lookupTable(tableName).Sensitive
+	if table.keys == nil || len(sensitive) == 0 {
+		return obj, nil
+	}
+	for _, name := range sensitive {
+		value, ok := obj.Attributes[name].(string)
+		if !ok || !isEncryptedValue(value) {
+			continue
+		}
+		decrypted, err := table.keys.decrypt(tx, attributeAAD(tableName, obj.ID, name), value)
+		if err != nil {
+			return obj, fmt.Errorf("decrypt %s.%s of %s: %w", tableName, name, obj.ID, err)
+		}
+		obj.Attributes[name] = decrypted
+	}
+	return obj, nil
+}
+
+// decryptObjects decrypts the sensitive attributes of every object read from the table.
+func (table *Tables) decryptObjects(tableName string, objects []Object) ([]Object, error) {
+	for i := range objects {
+		obj, err := table.decryptObject(nil, tableName, objects[i])
+		if err != nil {
+			return nil, err
+		}
+		objects[i] = obj
+	}
+	return objects, nil
+}
+
+// attributeAAD binds an encrypted value to the table, object and attribute it belongs to.
+func attributeAAD(tableName string, id string, attribute string) []byte {
+	return []byte(tableName + "/" + id + "/" + attribute)
+}
+
+func isEncryptedValue(value any) bool {
+	str, ok := value.(string)
+	return ok && strings.HasPrefix(str, encryptedValuePrefix)
+}
+
+// splitEncryptedValue returns the data key ID and the ciphertext of an encrypted value.
+func splitEncryptedValue(value string) (string, []byte, error) {
+	keyID, encoded, found := strings.Cut(strings.TrimPrefix(value, encryptedValuePrefix), ":")
+	if !found {
+		return "", nil, ErrMalformedEncryptedValue
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", nil, ErrMalformedEncryptedValue
+	}
+	return keyID, ciphertext, nil
+}
+
+func (k *keyring) encrypt(tx *writeTx, orgID string, aad []byte, value any) (string, error) {
+	keyID, key, err := k.activeKey(tx, orgID)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := secret.Seal(key, plaintext, aad)
+	if err != nil {
+		return "", err
+	}
+	return encryptedValuePrefix + keyID + ":" + base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+func (k *keyring) decrypt(tx *writeTx, aad []byte, value string) (any, error) {
+	keyID, ciphertext, err := splitEncryptedValue(value)
+	if err != nil {
+		return nil, err
+	}
+	key, err := k.key(tx, keyID)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := secret.Open(key, ciphertext, aad)
+	if err != nil {
+		return nil, err
+	}
+	var decrypted any
+	err = json.Unmarshal(plaintext, &decrypted)
+	return decrypted, err
+}
+
+// isStale reports whether a stored object has sensitive attributes in plaintext
+// or encrypted with a data key other than the active key of its organization.
+func (k *keyring) isStale(tableName string, obj Object) bool {
+	k.mu.RLock()
+	activeID := k.active[obj.OwnerID]
+	k.mu.RUnlock()
+
+	for _, name := range lookupTable(tableName).Sensitive {
+		value, ok := obj.Attributes[name]
+		if !ok {
+			continue
+		}
+		str, isString := value.(string)
+		if !isString || !isEncryptedValue(str) {
+			return true
+		}
+		keyID, _, err := splitEncryptedValue(str)
+		if err != nil || keyID != activeID {
+			return true
+		}
+	}
+	return false
+}
+
+// dataKey is a data key created in a write transaction that is not committed yet.
+type dataKey struct {
+	id  string
+	key []byte
+}
+
+// activeKey returns the active data key of the organization, creating one if it
+// has none. When tx is not nil the key is created in the transaction.
+func (k *keyring) activeKey(tx *writeTx, orgID string) (string, []byte, error) {
+	k.mu.RLock()
+	keyID, ok := k.active[orgID]
+	key := k.keys[keyID]
+	k.mu.RUnlock()
+	if ok {
+		return keyID, key, nil
+	}
+	if tx != nil {
+		return k.createKeyInTx(tx, orgID)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if keyID, ok := k.active[orgID]; ok {
+		return keyID, k.keys[keyID], nil
+	}
+	return k.createKey(orgID)
+}
+
+// createKeyInTx creates the active data key of an organization in a write
+// transaction. The key is used by the rest of the transaction and by the
+// keyring once the transaction is committed.
+func (k *keyring) createKeyInTx(tx *writeTx, orgID string) (string, []byte, error) {
+	if created, ok := tx.keys[orgID]; ok {
+		return created.id, created.key, nil
+	}
+	keyID, key, err := k.storeKey(tx, orgID)
+	if err != nil {
+		return "", nil, err
+	}
+	if tx.keys == nil {
+		tx.keys = map[string]dataKey{}
+	}
+	tx.keys[orgID] = dataKey{id: keyID, key: key}
+	tx.onCommit = append(tx.onCommit, func() {
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		k.keys[keyID] = key
+		k.active[orgID] = keyID
+	})
+	return keyID, key, nil
+}
+
+// key returns a data key by ID, reloading the keys when another instance created
+// it. When tx is not nil the keys created and stored in the transaction are
+// visible as well.
+func (k *keyring) key(tx *writeTx, keyID string) ([]byte, error) {
+	k.mu.RLock()
+	key, ok := k.keys[keyID]
+	k.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+	if tx != nil {
+		for _, created := range tx.keys {
+			if created.id == keyID {
+				return created.key, nil
+			}
+		}
+	}
+
+	err := k.load(tx)
+	if err != nil {
+		return nil, err
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok = k.keys[keyID]
+	if !ok {
+		return nil, ErrUnknownDataKey
+	}
+	return key, nil
+}
+
+// createKey generates, wraps and stores a new active data key. The caller must hold the write lock.
+func (k *keyring) createKey(orgID string) (string, []byte, error) {
+	tx, err := k.writer.Begin()
+	if err != nil {
+		return "", nil, err
+	}
+	defer tx.Rollback()
+
+	keyID, key, err := k.storeKey(tx, orgID)
+	if err != nil {
+		return "", nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return "", nil, err
+	}
+
+	k.keys[keyID] = key
+	k.active[orgID] = keyID
+	return keyID, key, nil
+}
+
+// storeKey generates a data key and stores it wrapped as the active key of the organization.
+func (k *keyring) storeKey(tx *writeTx, orgID string) (string, []byte, error) {
+	key, err := secret.NewKey()
+	if err != nil {
+		return "", nil, err
+	}
+	wrapped, err := secret.Seal(k.master, key, []byte(orgID))
+	if err != nil {
+		return "", nil, err
+	}
+
+	keyID := uuid.NewString()
+	_, err = tx.Exec(sqlDeactivateDataKeys(), orgID)
+	if err != nil {
+		return "", nil, err
+	}
+	_, err = tx.Exec(sqlInsertDataKey(), keyID, orgID, base64.StdEncoding.EncodeToString(wrapped), NowTimestamp())
+	if err != nil {
+		return "", nil, err
+	}
+	return keyID, key, nil
+}
+
+// rotate creates a new active data key for every organization that has one.
+func (k *keyring) rotate() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	organizations := slices.Sorted(maps.Keys(k.active))
+	for _, orgID := range organizations {
+		_, _, err := k.createKey(orgID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewrap re-wraps every stored data key with a new master key.
+func (k *keyring) rewrap(master []byte) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	tx, err := k.writer.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(sqlListDataKeys())
+	if err != nil {
+		return err
+	}
+	type storedKey struct{ id, orgID string }
+	var stored []storedKey
+	for rows.Next() {
+		var s storedKey
+		var wrapped string
+		var active bool
+		err := rows.Scan(&s.id, &s.orgID, &wrapped, &active)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		stored = append(stored, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, s := range stored {
+		key, ok := k.keys[s.id]
+		if !ok {
+			return ErrUnknownDataKey
+		}
+		wrapped, err := secret.Seal(master, key, []byte(s.orgID))
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(sqlUpdateWrappedKey(), base64.StdEncoding.EncodeToString(wrapped), s.id)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	k.master = master
+	return nil
+}
+
+// load unwraps every stored data key with the master key. When tx is not nil
+// the keys are read in the write transaction, which holds the only write
+// connection and may not be visible to the readers yet.
+func (k *keyring) load(tx *writeTx) error {
+	var rows *sql.Rows
+	var err error
+	if tx != nil {
+		rows, err = tx.Query(sqlListDataKeys())
+	} else {
+		rows, err = k.db.Query(sqlListDataKeys())
+	}
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	keys := map[string][]byte{}
+	active := map[string]string{}
+	for rows.Next() {
+		var keyID, orgID, encoded string
+		var isActive bool
+		err := rows.Scan(&keyID, &orgID, &encoded, &isActive)
+		if err != nil {
+			return err
+		}
+		created, inTx := dataKey{}, false
+		if tx != nil {
+			created, inTx = tx.keys[orgID]
+		}
+		if inTx && created.id == keyID {
+			// The keys created in the transaction reach the keyring once it commits.
+			continue
+		}
+		wrapped, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return err
+		}
+
+		k.mu.RLock()
+		master := k.master
+		k.mu.RUnlock()
+		key, err := secret.Open(master, wrapped, []byte(orgID))
+		if err != nil {
+			return fmt.Errorf("unwrap data key %s: %w", keyID, err)
+		}
+		keys[keyID] = key
+		if isActive && !inTx {
+			active[orgID] = keyID
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	maps.Copy(k.keys, keys)
+	maps.Copy(k.active, active)
+	return nil
+}
+
+func sqlCreateDataKeyTable() string {
+	return `
+	CREATE TABLE IF NOT EXISTS data_key(
+		id TEXT NOT NULL,
+		org_id TEXT NOT NULL,
+		wrapped_key TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		active INTEGER NOT NULL,
+		PRIMARY KEY (id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_data_key_org_id ON data_key(org_id);
+	`
+}
+
+func sqlListDataKeys() string {
+	return `SELECT id, org_id, wrapped_key, active FROM data_key ORDER BY rowid`
+}
+
+func sqlInsertDataKey() string {
+	return `INSERT INTO data_key (id, org_id, wrapped_key, created_at, active) VALUES (?, ?, ?, ?, 1)`
+}
+
+func sqlDeactivateDataKeys() string {
+	return `UPDATE data_key SET active = 0 WHERE org_id = ?`
+}
+
+func sqlUpdateWrappedKey() string {
+	return `UPDATE data_key SET wrapped_key = ? WHERE id = ?`
+}
+
+// sqlListAttributesAfterID constructs the SQL query to page through the stored
+// attributes of the specified table by ID.
+func sqlListAttributesAfterID(tableName string) string {
+	query := `SELECT id, owner_id, attributes FROM %s WHERE id > ? ORDER BY id LIMIT ?`
+	return fmt.Sprintf(query, tableName)
+}
+
+// sqlReplaceAttributes constructs the SQL query that replaces the attributes of an
+// object only if they were not changed since they were read.
+func sqlReplaceAttributes(tableName string) string {
+	query := `UPDATE %s SET attributes = ? WHERE id = ? AND CAST(attributes AS TEXT) = ?`
+	return fmt.Sprintf(query, tableName)
+}
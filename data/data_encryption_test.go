@@ -0,0 +1,143 @@
+package data
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jrpalma/linuxfleet/secret"
+)
+
+// newTestDatabase opens an empty database for tests that need their own master key.
+func newTestDatabase(t *testing.T) *sql.DB {
+	database, err := sql.Open("sqlite3", ":memory:")
+	assert.NoError(t, err)
+	database.SetMaxOpenConns(1)
+	t.Cleanup(func() { database.Close() })
+	return database
+}
+
+func newEncryptedTables(t *testing.T, database *sql.DB) (*Tables, []byte) {
+	table, err := NewTables(database)
+	assert.NoError(t, err)
+	masterKey, err := secret.NewKey()
+	assert.NoError(t, err)
+	assert.NoError(t, table.EnableEncryption(masterKey))
+	return table, masterKey
+}
+
+func storedAttribute(t *testing.T, database *sql.DB, tableName string, id string, name string) string {
+	var attrsJson string
+	err := database.QueryRow("SELECT attributes FROM "+tableName+" WHERE id = ?", id).Scan(&attrsJson)
+	assert.NoError(t, err)
+	var attrs map[string]any
+	assert.NoError(t, json.Unmarshal([]byte(attrsJson), &attrs))
+	value, _ := attrs[name].(string)
+	return value
+}
+
+func TestEncryptedAttributes(t *testing.T) {
+	db := newTestDatabase(t)
+	table, _ := newEncryptedTables(t, db)
+
+	ownerID := uuid.NewString()
+	obj := Object{ID: uuid.NewString(), OwnerID: ownerID, Version: 1, Attributes: map[string]any{
+		"email":    "admin@example.com",
+		"password": "hash",
+		"seed":     "12345678",
+	}}
+	assert.NoError(t, table.Insert("admin", obj))
+	assert.Equal(t, "hash", obj.Attributes["password"], "Insert must not modify the caller's attributes")
+
+	stored := storedAttribute(t, db, "admin", obj.ID, "password")
+	assert.True(t, strings.HasPrefix(stored, encryptedValuePrefix))
+	assert.NotContains(t, stored, "hash")
+	assert.Equal(t, "admin@example.com", storedAttribute(t, db, "admin", obj.ID, "email"))
+
+	retrieved, err := table.GetByID("admin", obj.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, obj.Attributes, retrieved.Attributes)
+
+	listed, err := table.ListByOwner("admin", ownerID)
+	assert.NoError(t, err)
+	assert.Len(t, listed, 1)
+	assert.Equal(t, obj.Attributes, listed[0].Attributes)
+
+	obj.Attributes["seed"] = "87654321"
+	assert.NoError(t, table.UpdateByID("admin", obj.ID, obj))
+	retrieved, err = table.GetByID("admin", obj.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "87654321", retrieved.Attributes["seed"])
+}
+
+func TestEncryptedValueIsBoundToItsObject(t *testing.T) {
+	db := newTestDatabase(t)
+	table, _ := newEncryptedTables(t, db)
+
+	first := Object{ID: uuid.NewString(), Version: 1, Attributes: map[string]any{"password": "first"}}
+	second := Object{ID: uuid.NewString(), Version: 1, Attributes: map[string]any{"password": "second"}}
+	assert.NoError(t, table.Insert("admin", first))
+	assert.NoError(t, table.Insert("admin", second))
+
+	stolen := storedAttribute(t, db, "admin", first.ID, "password")
+	_, err := db.Exec("UPDATE admin SET attributes = json_set(attributes, '$.password', ?) WHERE id = ?", stolen, second.ID)
+	assert.NoError(t, err)
+
+	_, err = table.GetByID("admin", second.ID)
+	assert.Error(t, err)
+}
+
+func TestKeyRotation(t *testing.T) {
+	database := newTestDatabase(t)
+	table, masterKey := newEncryptedTables(t, database)
+
+	plain, err := NewTables(database)
+	assert.NoError(t, err)
+	legacy := Object{ID: uuid.NewString(), Version: 1, Attributes: map[string]any{"password": "legacy"}}
+	assert.NoError(t, plain.Insert("admin", legacy))
+
+	var ids []string
+	for i := 0; i < 5; i++ {
+		obj := Object{ID: uuid.NewString(), Version: 1, Attributes: map[string]any{"password": "secret", "salt": "salt"}}
+		assert.NoError(t, table.Insert("admin", obj))
+		ids = append(ids, obj.ID)
+	}
+	before := storedAttribute(t, database, "admin", ids[0], "password")
+
+	rotator := NewKeyRotator(table, KeyRotatorOptions{BatchSize: 2})
+	assert.Equal(t, 1, rotator.Reencrypt(), "only the plaintext row needs to be encrypted")
+	assert.True(t, strings.HasPrefix(storedAttribute(t, database, "admin", legacy.ID, "password"), encryptedValuePrefix))
+
+	assert.NoError(t, rotator.Rotate())
+	assert.Equal(t, 6, rotator.Reencrypt())
+	assert.Equal(t, 0, rotator.Reencrypt())
+
+	after := storedAttribute(t, database, "admin", ids[0], "password")
+	beforeKey, _, err := splitEncryptedValue(before)
+	assert.NoError(t, err)
+	afterKey, _, err := splitEncryptedValue(after)
+	assert.NoError(t, err)
+	assert.NotEqual(t, beforeKey, afterKey)
+
+	for _, id := range ids {
+		obj, err := table.GetByID("admin", id)
+		assert.NoError(t, err)
+		assert.Equal(t, "secret", obj.Attributes["password"])
+	}
+
+	newMasterKey, err := secret.NewKey()
+	assert.NoError(t, err)
+	assert.NoError(t, table.RotateMasterKey(newMasterKey))
+
+	reopened, err := NewTables(database)
+	assert.NoError(t, err)
+	assert.Error(t, reopened.EnableEncryption(masterKey))
+	assert.NoError(t, reopened.EnableEncryption(newMasterKey))
+	obj, err := reopened.GetByID("admin", legacy.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "legacy", obj.Attributes["password"])
+}
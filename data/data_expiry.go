@@ -0,0 +1,99 @@
+package data
+
+import (
+	"fmt"
+)
+
+// DeleteExpired removes up to limit objects whose expiry time is at or before now
+// from the specified table and returns them. When archive is true the objects are
+// copied to the table's archive table in the same transaction before they are deleted.
+func (table *Tables) DeleteExpired(tableName string, now Timestamp, limit int, archive bool) ([]Object, error) {
+	tx, err := table.writer.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(sqlListExpired(tableName), now, limit)
+	if err != nil {
+		return nil, err
+	}
+	objects, err := scanObjects(rows)
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(objects) == 0 {
+		return nil, nil
+	}
+
+	if archive {
+		_, err = tx.Exec(sqlCreateArchiveTable(tableName))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, obj := range objects {
+		if archive {
+			_, err = tx.Exec(sqlArchiveByID(tableName), now, obj.ID)
+			if err != nil {
+				return nil, err
+			}
+		}
+		_, err = tx.Exec(sqlDeleteByID(tableName), obj.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return objects, tx.Commit()
+}
+
+// ListArchived retrieves the archived objects of the specified table by owner ID.
+func (table *Tables) ListArchived(tableName string, ownerID string) ([]Object, error) {
+	rows, err := table.db.Query(sqlListByOwner(archiveTableName(tableName)), ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	objects, err := scanObjects(rows)
+	if err != nil {
+		return nil, err
+	}
+	return table.decryptObjects(tableName, objects)
+}
+
+func archiveTableName(tableName string) string {
+	return tableName + "_archive"
+}
+
+// sqlListExpired constructs the SQL query to list a batch of expired objects from the specified table.
+func sqlListExpired(tableName string) string {
+	query := `SELECT %s FROM %s WHERE expires_at IS NOT NULL AND expires_at <= ? ORDER BY expires_at LIMIT ?`
+	return fmt.Sprintf(query, objectColumns, tableName)
+}
+
+// sqlArchiveByID constructs the SQL query to copy an object into the archive of the specified table.
+func sqlArchiveByID(tableName string) string {
+	query := `INSERT OR REPLACE INTO %s (%s, archived_at) SELECT %s, ? FROM %s WHERE id = ?`
+	return fmt.Sprintf(query, archiveTableName(tableName), objectColumns, objectColumns, tableName)
+}
+
+func sqlCreateArchiveTable(tableName string) string {
+	query := `
+	CREATE TABLE IF NOT EXISTS %s(
+		id TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		updated_at TEXT NOT NULL,
+		owner_id TEXT NOT NULL,
+		version TEXT,
+		attributes TEXT,
+		expires_at TEXT,
+		archived_at TEXT NOT NULL,
+		PRIMARY KEY (id)
+	);
+	`
+	return fmt.Sprintf(query, archiveTableName(tableName))
+}
@@ -0,0 +1,228 @@
+package data
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// ImportMode selects how imported records are written to a table.
+type ImportMode string
+
+const (
+	// ImportInsertOnly fails the records whose ID already exists.
+	ImportInsertOnly ImportMode = "insert"
+	// ImportUpsert inserts new records and overwrites existing ones.
+	ImportUpsert ImportMode = "upsert"
+	// ImportReplace deletes every object of the table before inserting the records.
+	ImportReplace ImportMode = "replace"
+)
+
+var ErrUnknownTable = errors.New("data: unknown table")
+var ErrUnknownImportMode = errors.New("data: unknown import mode")
+
+// maxImportLine is the largest NDJSON record accepted by Import.
+const maxImportLine = 16 << 20
+
+// RecordError reports why one imported record was not written.
+type RecordError struct {
+	Line int    `json:"line"`
+	ID   string `json:"id,omitempty"`
+	Err  string `json:"error"`
+}
+
+// ImportReport summarizes an import.
+type ImportReport struct {
+	Read     int           `json:"read"`
+	Inserted int           `json:"inserted"`
+	Updated  int           `json:"updated"`
+	Failed   int           `json:"failed"`
+	Errors   []RecordError `json:"errors,omitempty"`
+}
+
+// Export streams the objects of a table to w as newline-delimited JSON, one
+// Object per line ordered by ID. When owner IDs are given only their objects
+// are exported. Sensitive attributes are written decrypted.
+func (table *Tables) Export(w io.Writer, tableName string, ownerIDs ...string) (int, error) {
+	if !isDataTable(tableName) {
+		return 0, fmt.Errorf("%w: %s", ErrUnknownTable, tableName)
+	}
+
+	args := make([]any, len(ownerIDs))
+	for i, ownerID := range ownerIDs {
+		args[i] = ownerID
+	}
+	rows, err := table.db.Query(sqlExport(tableName, len(ownerIDs)), args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	buffered := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buffered)
+	exported := 0
+	for rows.Next() {
+		obj, err := scanObject(rows)
+		if err != nil {
+			return exported, err
+		}
+		obj, err = table.decryptObject(nil, tableName, obj)
+		if err != nil {
+			return exported, err
+		}
+		err = encoder.Encode(obj)
+		if err != nil {
+			return exported, err
+		}
+		exported++
+	}
+	if err := rows.Err(); err != nil {
+		return exported, err
+	}
+	return exported, buffered.Flush()
+}
+
+// Import reads newline-delimited JSON objects from r and writes them to the table
+// in a single transaction according to mode. The created and updated timestamps
+// of the records are kept as they are. Records that cannot be parsed or written
+// are reported in the returned ImportReport and do not stop the import; the
+// returned error is reserved for failures of the whole import.
+func (table *Tables) Import(r io.Reader, tableName string, mode ImportMode) (ImportReport, error) {
+	var report ImportReport
+	if !isDataTable(tableName) {
+		return report, fmt.Errorf("%w: %s", ErrUnknownTable, tableName)
+	}
+	if !slices.Contains([]ImportMode{ImportInsertOnly, ImportUpsert, ImportReplace}, mode) {
+		return report, fmt.Errorf("%w: %s", ErrUnknownImportMode, mode)
+	}
+
+	tx, err := table.writer.Begin()
+	if err != nil {
+		return report, err
+	}
+	defer tx.Rollback()
+
+	if mode == ImportReplace {
+		_, err = tx.Exec(sqlDeleteAll(tableName))
+		if err != nil {
+			return report, err
+		}
+	}
+
+	reader := bufio.NewReaderSize(r, 64<<10)
+	for line := 1; ; line++ {
+		record, readErr := readImportLine(reader)
+		if len(strings.TrimSpace(string(record))) > 0 {
+			report.Read++
+			inserted, id, err := table.importRecord(tx, tableName, mode, record)
+			switch {
+			case err != nil:
+				report.Failed++
+				report.Errors = append(report.Errors, RecordError{Line: line, ID: id, Err: err.Error()})
+			case inserted:
+				report.Inserted++
+			default:
+				report.Updated++
+			}
+		}
+		if readErr == io.EOF {
+			break
+		} else if readErr != nil {
+			return report, readErr
+		}
+	}
+
+	return report, tx.Commit()
+}
+
+// importRecord writes one NDJSON record and reports whether it was inserted or updated.
+func (table *Tables) importRecord(tx *writeTx, tableName string, mode ImportMode, record []byte) (bool, string, error) {
+	var obj Object
+	err := json.Unmarshal(record, &obj)
+	if err != nil {
+		return false, "", err
+	}
+	if obj.ID == "" {
+		return false, "", errors.New("record has no id")
+	}
+
+	attrsJson, err := table.encodeAttributes(tx, tableName, obj)
+	if err != nil {
+		return false, obj.ID, err
+	}
+	// Records exported before objects had an HLC are stamped as new writes.
+	if obj.HLC.IsZero() {
+		_, obj.HLC = table.stamp()
+	} else {
+		table.clock.Observe(obj.HLC)
+	}
+
+	exists := false
+	if mode == ImportUpsert {
+		err = tx.QueryRow(sqlExists(tableName), obj.ID).Scan(&exists)
+		if err != nil {
+			return false, obj.ID, err
+		}
+	}
+
+	query := sqlInsert(tableName)
+	if mode == ImportUpsert {
+		query = sqlUpsert(tableName)
+	}
+	_, err = tx.Exec(query, obj.ID, obj.CreatedAt, obj.UpdatedAt, obj.OwnerID, obj.Version, attrsJson, obj.ExpiresAt, obj.HLC)
+	if err != nil {
+		return false, obj.ID, translateError(err)
+	}
+	return !exists, obj.ID, nil
+}
+
+// readImportLine reads one line without its line terminator.
+func readImportLine(reader *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, err := reader.ReadLine()
+		line = append(line, chunk...)
+		if len(line) > maxImportLine {
+			return nil, fmt.Errorf("data: import record longer than %d bytes", maxImportLine)
+		}
+		if err != nil || !isPrefix {
+			return line, err
+		}
+	}
+}
+
+// sqlExport constructs the SQL query to list the objects of the specified table,
+// optionally restricted to a number of owner IDs.
+func sqlExport(tableName string, owners int) string {
+	where := ""
+	if owners > 0 {
+		where = "WHERE owner_id IN (?" + strings.Repeat(", ?", owners-1) + ")"
+	}
+	query := `SELECT %s FROM %s %s ORDER BY id`
+	return fmt.Sprintf(query, objectColumns, tableName, where)
+}
+
+// sqlUpsert constructs the SQL query to insert an object or overwrite the existing object with its ID.
+func sqlUpsert(tableName string) string {
+	query := `INSERT INTO %s (%s) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(id) DO UPDATE SET created_at = excluded.created_at, updated_at = excluded.updated_at,
+	owner_id = excluded.owner_id, version = excluded.version, attributes = excluded.attributes, expires_at = excluded.expires_at,
+	hlc = excluded.hlc`
+	return fmt.Sprintf(query, tableName, objectColumns)
+}
+
+// sqlExists constructs the SQL query to check whether an object exists in the specified table.
+func sqlExists(tableName string) string {
+	query := `SELECT EXISTS (SELECT 1 FROM %s WHERE id = ?)`
+	return fmt.Sprintf(query, tableName)
+}
+
+// sqlDeleteAll constructs the SQL query to delete every object from the specified table.
+func sqlDeleteAll(tableName string) string {
+	query := `DELETE FROM %s`
+	return fmt.Sprintf(query, tableName)
+}
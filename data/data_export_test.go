@@ -0,0 +1,130 @@
+package data
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func exportTestTables(t *testing.T) *Tables {
+	table, err := NewTables(newTestDatabase(t))
+	assert.NoError(t, err)
+	created := Timestamp{Time: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	updated := Timestamp{Time: time.Date(2024, 2, 3, 4, 5, 6, 0, time.UTC)}
+	for _, obj := range []Object{
+		{ID: "a", OwnerID: "owner1", Version: 1, CreatedAt: created, UpdatedAt: updated, Attributes: map[string]any{"hostname": "web-1"}},
+		{ID: "b", OwnerID: "owner2", Version: 2, CreatedAt: created, UpdatedAt: updated, Attributes: map[string]any{"hostname": "web-2"}},
+		{ID: "c", OwnerID: "owner1", Version: 3, CreatedAt: created, UpdatedAt: updated, Attributes: map[string]any{"hostname": "db-1"}},
+	} {
+		_, err := table.db.Exec(sqlInsert("device"), obj.ID, obj.CreatedAt, obj.UpdatedAt, obj.OwnerID, obj.Version, jsonString(obj.Attributes), obj.ExpiresAt, obj.HLC)
+		assert.NoError(t, err)
+	}
+	return table
+}
+
+func TestExport(t *testing.T) {
+	table := exportTestTables(t)
+
+	var all bytes.Buffer
+	count, err := table.Export(&all, "device")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+	lines := strings.Split(strings.TrimSpace(all.String()), "\n")
+	assert.Len(t, lines, 3)
+
+	var first Object
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &first))
+	assert.Equal(t, "a", first.ID)
+	assert.Equal(t, "web-1", first.Attributes["hostname"])
+
+	var owned bytes.Buffer
+	count, err = table.Export(&owned, "device", "owner1")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.NotContains(t, owned.String(), `"id":"b"`)
+
+	_, err = table.Export(&owned, "device; DROP TABLE device")
+	assert.ErrorIs(t, err, ErrUnknownTable)
+}
+
+func TestImportModes(t *testing.T) {
+	source := exportTestTables(t)
+	var exported bytes.Buffer
+	_, err := source.Export(&exported, "device")
+	assert.NoError(t, err)
+
+	t.Run("InsertOnly", func(t *testing.T) {
+		target, err := NewTables(newTestDatabase(t))
+		assert.NoError(t, err)
+
+		report, err := target.Import(bytes.NewReader(exported.Bytes()), "device", ImportInsertOnly)
+		assert.NoError(t, err)
+		assert.Equal(t, ImportReport{Read: 3, Inserted: 3}, report)
+
+		obj, err := target.GetByID("device", "b")
+		assert.NoError(t, err)
+		assert.Equal(t, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), obj.CreatedAt.Time)
+		assert.Equal(t, time.Date(2024, 2, 3, 4, 5, 6, 0, time.UTC), obj.UpdatedAt.Time)
+
+		report, err = target.Import(bytes.NewReader(exported.Bytes()), "device", ImportInsertOnly)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, report.Failed)
+		assert.Equal(t, "a", report.Errors[0].ID)
+	})
+
+	t.Run("Upsert", func(t *testing.T) {
+		target, err := NewTables(newTestDatabase(t))
+		assert.NoError(t, err)
+		assert.NoError(t, target.Insert("device", Object{ID: "a", OwnerID: "owner1", Version: 9, Attributes: map[string]any{"hostname": "old"}}))
+
+		report, err := target.Import(bytes.NewReader(exported.Bytes()), "device", ImportUpsert)
+		assert.NoError(t, err)
+		assert.Equal(t, ImportReport{Read: 3, Inserted: 2, Updated: 1}, report)
+
+		obj, err := target.GetByID("device", "a")
+		assert.NoError(t, err)
+		assert.Equal(t, "web-1", obj.Attributes["hostname"])
+		assert.Equal(t, 1, obj.Version)
+	})
+
+	t.Run("Replace", func(t *testing.T) {
+		target, err := NewTables(newTestDatabase(t))
+		assert.NoError(t, err)
+		assert.NoError(t, target.Insert("device", Object{ID: "z", OwnerID: "owner1", Version: 1}))
+
+		report, err := target.Import(bytes.NewReader(exported.Bytes()), "device", ImportReplace)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, report.Inserted)
+
+		objects, err := target.ListByOwner("device", "owner1")
+		assert.NoError(t, err)
+		assert.Len(t, objects, 2)
+	})
+}
+
+func TestImportRecordErrors(t *testing.T) {
+	target, err := NewTables(newTestDatabase(t))
+	assert.NoError(t, err)
+
+	input := strings.Join([]string{
+		`{"id":"a","owner_id":"owner1","version":1,"attributes":{}}`,
+		`not json`,
+		``,
+		`{"owner_id":"owner1","version":1}`,
+		`{"id":"b","owner_id":"owner1","version":1,"attributes":{}}`,
+	}, "\n")
+	report, err := target.Import(strings.NewReader(input), "device", ImportInsertOnly)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, report.Read)
+	assert.Equal(t, 2, report.Inserted)
+	assert.Equal(t, 2, report.Failed)
+	assert.Equal(t, 2, report.Errors[0].Line)
+	assert.Equal(t, 4, report.Errors[1].Line)
+
+	_, err = target.Import(strings.NewReader(input), "device", "merge")
+	assert.ErrorIs(t, err, ErrUnknownImportMode)
+}
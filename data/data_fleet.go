@@ -0,0 +1,104 @@
+package data
+
+import (
+	"fmt"
+	"time"
+)
+
+// unknownAttribute groups the objects that do not have the counted attribute.
+const unknownAttribute = "unknown"
+
+// FleetStats summarizes the devices and jobs of the fleet.
+type FleetStats struct {
+	DevicesOnline  int
+	DevicesOffline int
+	// DevicesByOS counts the devices by their os.name attribute.
+	DevicesByOS map[string]int
+	// JobsByStatus counts the jobs by their status attribute, so that the
+	// jobs waiting to run are counted under their queued status.
+	JobsByStatus map[string]int
+}
+
+// FleetStats counts the devices and jobs. A device is online when it reported
+// a metric sample at or after onlineSince. Objects without the counted
+// attribute are counted as unknown.
+func (table *Tables) FleetStats(onlineSince time.Time) (FleetStats, error) {
+	return table.fleetStats(nil, onlineSince)
+}
+
+// AccessibleFleetStats counts the devices and jobs that the principal can
+// read, the objects listed by ListAccessible, see FleetStats.
+func (table *Tables) AccessibleFleetStats(principalID string, onlineSince time.Time) (FleetStats, error) {
+	return table.fleetStats(principalID, onlineSince)
+}
+
+// fleetStats counts the devices and jobs readable by the principal, or every
+// device and job when principalID is nil.
+func (table *Tables) fleetStats(principalID any, onlineSince time.Time) (FleetStats, error) {
+	stats := FleetStats{}
+	var total int
+	err := table.db.QueryRow(sqlCountDevices(), principalID, DeviceTable.Name, PermissionRead, PermissionRead, onlineSince.Unix(), principalID).Scan(&total, &stats.DevicesOnline)
+	if err != nil {
+		return stats, err
+	}
+	stats.DevicesOffline = total - stats.DevicesOnline
+
+	stats.DevicesByOS, err = table.countByAttribute(DeviceTable.Name, "$.os.name", principalID)
+	if err != nil {
+		return stats, err
+	}
+	stats.JobsByStatus, err = table.countByAttribute(JobTable.Name, "$.status", principalID)
+	return stats, err
+}
+
+// countByAttribute counts the objects of a table readable by the principal by
+// the value of an attribute.
+func (table *Tables) countByAttribute(tableName string, path string, principalID any) (map[string]int, error) {
+	rows, err := table.db.Query(sqlCountByAttribute(tableName), principalID, tableName, PermissionRead, PermissionRead, path, unknownAttribute, principalID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[string]int{}
+	for rows.Next() {
+		var value string
+		var count int
+		err := rows.Scan(&value, &count)
+		if err != nil {
+			return nil, err
+		}
+		counts[value] = count
+	}
+	return counts, rows.Err()
+}
+
+// sqlCountDevices constructs the SQL query that counts the devices readable
+// by a principal, or every device when NULL, and those with a metric sample
+// at or after a Unix time. The arguments are the principal, the table and the
+// read permission twice of the access checks, the time and the principal.
+func sqlCountDevices() string {
+	query := `
+	WITH RECURSIVE` + sqlPrincipalsCTE + `,` + sqlGrantedCTE + `
+	SELECT COUNT(*), COALESCE(SUM(EXISTS (
+		SELECT 1 FROM metric_series s JOIN metric_sample m ON m.series_id = s.id
+		WHERE s.device_id = d.id AND m.ts >= ?
+	)), 0)
+	FROM %s d
+	WHERE ? IS NULL OR d.owner_id IN (SELECT id FROM principals) OR d.id IN (SELECT id FROM accessible)`
+	return fmt.Sprintf(query, DeviceTable.Name)
+}
+
+// sqlCountByAttribute constructs the SQL query that counts the objects of the
+// specified table readable by a principal, or every object when NULL, by the
+// text of an attribute, or a default text when missing. The arguments are
+// those of the access checks, the attribute path, the default text and the
+// principal.
+func sqlCountByAttribute(tableName string) string {
+	query := `
+	WITH RECURSIVE` + sqlPrincipalsCTE + `,` + sqlGrantedCTE + `
+	SELECT COALESCE(CAST(json_extract(attributes, ?) AS TEXT), ?), COUNT(*) FROM %s
+	WHERE ? IS NULL OR owner_id IN (SELECT id FROM principals) OR id IN (SELECT id FROM accessible)
+	GROUP BY 1`
+	return fmt.Sprintf(query, tableName)
+}
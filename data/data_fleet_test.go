@@ -0,0 +1,69 @@
+package data
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFleetStats(t *testing.T) {
+	tables, err := NewTables(newTestDatabase(t))
+	assert.NoError(t, err)
+	metrics := NewMetricStore(tables, MetricRetention{})
+
+	for id, os := range map[string]string{"d1": "debian", "d2": "debian", "d3": "ubuntu"} {
+		attributes := map[string]any{"os": map[string]any{"name": os}}
+		assert.NoError(t, tables.Insert(DeviceTable.Name, Object{ID: id, OwnerID: "owner1", Version: 1, Attributes: attributes}))
+	}
+	assert.NoError(t, tables.Insert(DeviceTable.Name, Object{ID: "d4", OwnerID: "owner1", Version: 1, Attributes: map[string]any{}}))
+	for id, status := range map[string]string{"j1": "queued", "j2": "queued", "j3": "done"} {
+		assert.NoError(t, tables.Insert(JobTable.Name, Object{ID: id, OwnerID: "owner1", Version: 1, Attributes: map[string]any{"status": status}}))
+	}
+
+	now := time.Now()
+	assert.NoError(t, metrics.Write("d1", []Sample{{Metric: "cpu", Time: now, Value: 1}}))
+	assert.NoError(t, metrics.Write("d2", []Sample{{Metric: "cpu", Time: now.Add(-time.Hour), Value: 1}}))
+
+	stats, err := tables.FleetStats(now.Add(-5 * time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, stats.DevicesOnline)
+	assert.Equal(t, 3, stats.DevicesOffline)
+	assert.Equal(t, map[string]int{"debian": 2, "ubuntu": 1, "unknown": 1}, stats.DevicesByOS)
+	assert.Equal(t, map[string]int{"queued": 2, "done": 1}, stats.JobsByStatus)
+
+	// An administrator of owner2 counts its devices and the devices granted
+	// to it, like ListAccessible.
+	assert.NoError(t, tables.Insert(DeviceTable.Name, Object{ID: "d5", OwnerID: "owner2", Version: 1, Attributes: map[string]any{}}))
+	assert.NoError(t, tables.AddGroupMember("owner2", Member{MemberPrincipal, "admin2"}))
+	assert.NoError(t, tables.Grant(Grant{Table: DeviceTable.Name, ObjectID: "d3", PrincipalID: "admin2", Permissions: PermissionRead}))
+	assert.NoError(t, tables.Grant(Grant{Table: JobTable.Name, ObjectID: "j3", PrincipalID: "admin2", Permissions: PermissionExecute}))
+	stats, err = tables.AccessibleFleetStats("admin2", now.Add(-5*time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, FleetStats{DevicesOffline: 2, DevicesByOS: map[string]int{"ubuntu": 1, "unknown": 1}, JobsByStatus: map[string]int{}}, stats)
+	accessible, err := tables.ListAccessible(DeviceTable.Name, "admin2", PermissionRead)
+	assert.NoError(t, err)
+	assert.Len(t, accessible, stats.DevicesOnline+stats.DevicesOffline)
+	stats, err = tables.FleetStats(now.Add(-5 * time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, stats.DevicesOffline)
+}
+
+func TestTableMetrics(t *testing.T) {
+	tables, err := NewTables(newTestDatabase(t))
+	assert.NoError(t, err)
+
+	assert.NoError(t, tables.Insert(DeviceTable.Name, Object{ID: "d1", OwnerID: "owner1", Version: 1, Attributes: map[string]any{}}))
+	_, err = tables.GetByID(DeviceTable.Name, "d1")
+	assert.NoError(t, err)
+	_, err = tables.GetByID(DeviceTable.Name, "missing")
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	assert.Error(t, tables.Insert(DeviceTable.Name, Object{ID: "d1", OwnerID: "owner1", Version: 1, Attributes: map[string]any{}}))
+
+	assert.Equal(t, uint64(2), tables.metrics.durations.Count("insert", DeviceTable.Name))
+	assert.Equal(t, uint64(2), tables.metrics.durations.Count("get", DeviceTable.Name))
+	// A missing object is not a failure, a duplicate insert is.
+	assert.Zero(t, tables.metrics.errors.Value("get", DeviceTable.Name))
+	assert.Equal(t, float64(1), tables.metrics.errors.Value("insert", DeviceTable.Name))
+}
@@ -0,0 +1,43 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrPendingMigrations is returned by CheckMigrations when a table is behind
+// the migrations of this build.
+var ErrPendingMigrations = errors.New("data: pending migrations")
+
+// Ping verifies that the read and the write connections of the database can
+// be used.
+func (table *Tables) Ping(ctx context.Context) error {
+	err := table.db.PingContext(ctx)
+	if err != nil {
+		return err
+	}
+	return table.writer.db.PingContext(ctx)
+}
+
+// CheckMigrations verifies that every migration known to this build was
+// applied to every data table.
+func (table *Tables) CheckMigrations(ctx context.Context) error {
+	latest := latestSchemaVersion()
+	var pending []string
+	for _, tableName := range dataTableList() {
+		var version int
+		err := table.db.QueryRowContext(ctx, sqlTableSchemaVersion(), tableName).Scan(&version)
+		if err != nil {
+			return err
+		}
+		if version < latest {
+			pending = append(pending, fmt.Sprintf("%s at version %d", tableName, version))
+		}
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("%w: %s, expected version %d", ErrPendingMigrations, strings.Join(pending, ", "), latest)
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+package data
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckMigrations(t *testing.T) {
+	tables, err := NewTables(newTestDatabase(t))
+	assert.NoError(t, err)
+	assert.NoError(t, tables.Ping(context.Background()))
+	assert.NoError(t, tables.CheckMigrations(context.Background()))
+
+	_, err = tables.db.Exec(`DELETE FROM schema_migration WHERE table_name = ? AND version = ?`, DeviceTable.Name, latestSchemaVersion())
+	assert.NoError(t, err)
+	err = tables.CheckMigrations(context.Background())
+	assert.ErrorIs(t, err, ErrPendingMigrations)
+	assert.ErrorContains(t, err, "device at version")
+}
@@ -0,0 +1,167 @@
+package data
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// idempotencySweepInterval is how often the expired idempotency keys are
+// deleted.
+const idempotencySweepInterval = time.Minute
+
+var (
+	// ErrIdempotencyKeyReused is returned when an idempotency key is sent
+	// again with a different request.
+	ErrIdempotencyKeyReused = errors.New("the idempotency key was used for a different request")
+	// ErrIdempotencyKeyInUse is returned when the first request with an
+	// idempotency key is still being handled.
+	ErrIdempotencyKeyInUse = errors.New("the request of the idempotency key is in progress")
+)
+
+// IdempotentResponse is the response stored for an idempotency key and
+// replayed to the retries of its request.
+type IdempotentResponse struct {
+	Status int
+	Header map[string][]string
+	Body   []byte
+}
+
+// IdempotencyStore holds the idempotency keys of the clients with the response
+// to their first request, so that a retried request is answered without being
+// handled again. The keys of a principal, such as an API token, are separate
+// from those of the others. The store is in the database, so that the retries
+// sent to any server sharing the database are recognized.
+type IdempotencyStore struct {
+	tables *Tables
+
+	mu    sync.Mutex
+	swept time.Time
+}
+
+// NewIdempotencyStore creates an idempotency key store in the tables.
+func NewIdempotencyStore(tables *Tables) *IdempotencyStore {
+	return &IdempotencyStore{tables: tables}
+}
+
+// Begin claims the key of the principal for a request identified by its
+// fingerprint until locked, when the request is expected to be handled. It
+// returns the stored response when the request was already handled, and
+// ErrIdempotencyKeyReused or ErrIdempotencyKeyInUse when the key belongs to
+// another request or its request is still being handled. Expired keys are
+// claimed again.
+func (s *IdempotencyStore) Begin(principal string, key string, fingerprint string, now time.Time, locked time.Time) (*IdempotentResponse, error) {
+	err := s.sweep(now)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.tables.writer.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var stored string
+	var response IdempotentResponse
+	var header []byte
+	var expires int64
+	err = tx.QueryRow(sqlGetIdempotencyKey(), principal, key).Scan(&stored, &response.Status, &header, &response.Body, &expires)
+	if err == nil && expires > now.UnixNano() {
+		switch {
+		case stored != fingerprint:
+			return nil, ErrIdempotencyKeyReused
+		case response.Status == 0:
+			return nil, ErrIdempotencyKeyInUse
+		}
+		err = json.Unmarshal(header, &response.Header)
+		if err != nil {
+			return nil, err
+		}
+		return &response, nil
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	_, err = tx.Exec(sqlClaimIdempotencyKey(), principal, key, fingerprint, now.UnixNano(), locked.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	return nil, tx.Commit()
+}
+
+// Complete stores the response to the request of a key claimed by Begin,
+// replayed to its retries until expires.
+func (s *IdempotencyStore) Complete(principal string, key string, response IdempotentResponse, expires time.Time) error {
+	header, err := json.Marshal(response.Header)
+	if err != nil {
+		return err
+	}
+	_, err = s.tables.writer.Exec(sqlCompleteIdempotencyKey(), response.Status, header, response.Body, expires.UnixNano(), principal, key)
+	return err
+}
+
+// Release deletes a key claimed by Begin whose request failed, so that it can
+// be retried.
+func (s *IdempotencyStore) Release(principal string, key string) error {
+	_, err := s.tables.writer.Exec(sqlDeleteIdempotencyKey(), principal, key)
+	return err
+}
+
+// sweep deletes the expired keys once per sweep interval.
+func (s *IdempotencyStore) sweep(now time.Time) error {
+	s.mu.Lock()
+	if now.Sub(s.swept) < idempotencySweepInterval {
+		s.mu.Unlock()
+		return nil
+	}
+	s.swept = now
+	s.mu.Unlock()
+
+	_, err := s.tables.writer.Exec(sqlDeleteExpiredIdempotencyKeys(), now.UnixNano())
+	return err
+}
+
+func sqlCreateIdempotencyKeyTable() string {
+	return `
+	CREATE TABLE IF NOT EXISTS idempotency_key (
+		principal TEXT NOT NULL,
+		key TEXT NOT NULL,
+		fingerprint TEXT NOT NULL,
+		status INTEGER NOT NULL DEFAULT 0,
+		header BLOB,
+		body BLOB,
+		created_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL,
+		PRIMARY KEY (principal, key)
+	) WITHOUT ROWID;
+	CREATE INDEX IF NOT EXISTS idx_idempotency_key_expires_at ON idempotency_key(expires_at);
+	`
+}
+
+func sqlGetIdempotencyKey() string {
+	return `SELECT fingerprint, status, header, body, expires_at FROM idempotency_key WHERE principal = ? AND key = ?`
+}
+
+func sqlClaimIdempotencyKey() string {
+	return `
+	INSERT INTO idempotency_key (principal, key, fingerprint, status, header, body, created_at, expires_at)
+	VALUES (?, ?, ?, 0, NULL, NULL, ?, ?)
+	ON CONFLICT (principal, key) DO UPDATE SET fingerprint = excluded.fingerprint, status = 0, header = NULL,
+		body = NULL, created_at = excluded.created_at, expires_at = excluded.expires_at`
+}
+
+func sqlCompleteIdempotencyKey() string {
+	return `UPDATE idempotency_key SET status = ?, header = ?, body = ?, expires_at = ? WHERE principal = ? AND key = ?`
+}
+
+func sqlDeleteIdempotencyKey() string {
+	return `DELETE FROM idempotency_key WHERE principal = ? AND key = ?`
+}
+
+func sqlDeleteExpiredIdempotencyKeys() string {
+	return `DELETE FROM idempotency_key WHERE expires_at <= ?`
+}
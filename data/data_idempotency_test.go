@@ -0,0 +1,53 @@
+package data
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotencyStore(t *testing.T) {
+	database := newTestDatabase(t)
+	tables, err := NewTables(database)
+	assert.NoError(t, err)
+	store := NewIdempotencyStore(tables)
+	now := time.Unix(1000, 0)
+	locked := now.Add(time.Minute)
+
+	response, err := store.Begin("token:a", "key-1", "request-1", now, locked)
+	assert.NoError(t, err)
+	assert.Nil(t, response)
+
+	_, err = store.Begin("token:a", "key-1", "request-1", now, locked)
+	assert.ErrorIs(t, err, ErrIdempotencyKeyInUse)
+	_, err = store.Begin("token:a", "key-1", "request-2", now, locked)
+	assert.ErrorIs(t, err, ErrIdempotencyKeyReused)
+	// The keys of the principals are separate.
+	response, err = store.Begin("token:b", "key-1", "request-2", now, locked)
+	assert.NoError(t, err)
+	assert.Nil(t, response)
+
+	stored := IdempotentResponse{Status: 201, Header: map[string][]string{"Content-Type": {"application/json"}}, Body: []byte(`{"id":"1"}`)}
+	assert.NoError(t, store.Complete("token:a", "key-1", stored, now.Add(time.Hour)))
+	response, err = store.Begin("token:a", "key-1", "request-1", now.Add(30*time.Minute), locked)
+	assert.NoError(t, err)
+	assert.Equal(t, &stored, response)
+	_, err = store.Begin("token:a", "key-1", "request-2", now.Add(30*time.Minute), locked)
+	assert.ErrorIs(t, err, ErrIdempotencyKeyReused)
+
+	// A released key is claimed again by its retry.
+	assert.NoError(t, store.Release("token:b", "key-1"))
+	response, err = store.Begin("token:b", "key-1", "request-2", now, locked)
+	assert.NoError(t, err)
+	assert.Nil(t, response)
+
+	// An expired key is claimed again, even by another request.
+	later := now.Add(2 * time.Hour)
+	response, err = store.Begin("token:a", "key-1", "request-3", later, later.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Nil(t, response)
+	var count int
+	assert.NoError(t, database.QueryRow(`SELECT COUNT(*) FROM idempotency_key`).Scan(&count))
+	assert.Equal(t, 1, count)
+}
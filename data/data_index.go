@@ -0,0 +1,219 @@
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// ErrConflict is returned when a write violates a primary key or unique attribute index.
+var ErrConflict = errors.New("data: conflicting object")
+var ErrInvalidAttributePath = errors.New("data: invalid attribute path")
+
+// attributePathPattern matches dotted attribute paths such as os.name.
+var attributePathPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)*$`)
+
+// attributeColumnPrefix starts the name of every generated attribute column.
+const attributeColumnPrefix = "attr_"
+
+// AttributeIndex declares an attribute path that is kept in a generated column with an index.
+type AttributeIndex struct {
+	// Path is the dotted path of the attribute, for example os.name.
+	Path string
+	// Unique rejects two objects with the same non-null value.
+	Unique bool
+}
+
+// ListByAttribute retrieves the objects of a table whose attribute at the dotted
+// path equals value. Declared attribute indexes are used when the path has one.
+func (table *Tables) ListByAttribute(tableName string, path string, value any) ([]Object, error) {
+	if !attributePathPattern.MatchString(path) {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidAttributePath, path)
+	}
+
+	var rows *sql.Rows
+	var err error
+	if isIndexedAttribute(tableName, path) {
+		rows, err = table.db.Query(sqlListByAttributeColumn(tableName, attributeColumnName(path)), value)
+	} else {
+		rows, err = table.db.Query(sqlListByAttributePath(tableName), attributeJSONPath(path), value)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	objects, err := scanObjects(rows)
+	if err != nil {
+		return nil, err
+	}
+	return table.decryptObjects(tableName, objects)
+}
+
+func isIndexedAttribute(tableName string, path string) bool {
+	return slices.ContainsFunc(lookupTable(tableName).Indexes, func(index AttributeIndex) bool {
+		return index.Path == path
+	})
+}
+
+// syncAttributeIndexes adds the generated columns and indexes declared for the
+// table and removes the ones that are no longer declared.
+func syncAttributeIndexes(db *sql.DB, tableName string, indexes []AttributeIndex) error {
+	for _, index := range indexes {
+		if !attributePathPattern.MatchString(index.Path) {
+			return fmt.Errorf("%w: %s.%s", ErrInvalidAttributePath, tableName, index.Path)
+		}
+		if slices.Contains(lookupTable(tableName).Sensitive, index.Path) {
+			return fmt.Errorf("data: %s.%s is encrypted and cannot be indexed", tableName, index.Path)
+		}
+	}
+
+	existing, err := attributeColumns(db, tableName)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	declared := map[string]bool{}
+	for _, index := range indexes {
+		column := attributeColumnName(index.Path)
+		declared[column] = true
+		if !slices.Contains(existing, column) {
+			_, err := tx.Exec(sqlAddAttributeColumn(tableName, column, index.Path))
+			if err != nil {
+				return err
+			}
+		}
+		// The index is recreated when its uniqueness changed.
+		unique, found, err := indexUniqueness(tx, attributeIndexName(tableName, column))
+		if err != nil {
+			return err
+		}
+		if found && unique != index.Unique {
+			_, err := tx.Exec(sqlDropAttributeIndex(tableName, column))
+			if err != nil {
+				return err
+			}
+		}
+		_, err = tx.Exec(sqlCreateAttributeIndex(tableName, column, index.Unique))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, column := range existing {
+		if declared[column] {
+			continue
+		}
+		_, err := tx.Exec(sqlDropAttributeIndex(tableName, column))
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(sqlDropAttributeColumn(tableName, column))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// attributeColumns returns the generated attribute columns of the table.
+func attributeColumns(db *sql.DB, tableName string) ([]string, error) {
+	rows, err := db.Query(`SELECT name FROM pragma_table_xinfo(?)`, tableName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var name string
+		err := rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(name, attributeColumnPrefix) {
+			columns = append(columns, name)
+		}
+	}
+	return columns, rows.Err()
+}
+
+// indexUniqueness reports whether the named index exists and is unique.
+func indexUniqueness(tx *sql.Tx, indexName string) (bool, bool, error) {
+	var sqlText string
+	err := tx.QueryRow(`SELECT sql FROM sqlite_master WHERE type = 'index' AND name = ?`, indexName).Scan(&sqlText)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, false, nil
+	} else if err != nil {
+		return false, false, err
+	}
+	return strings.HasPrefix(strings.ToUpper(sqlText), "CREATE UNIQUE"), true, nil
+}
+
+// translateError maps constraint violations reported by SQLite to ErrConflict.
+func translateError(err error) error {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) &&
+		(sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique || sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey) {
+		return fmt.Errorf("%w: %v", ErrConflict, err)
+	}
+	return err
+}
+
+func attributeColumnName(path string) string {
+	return attributeColumnPrefix + strings.ReplaceAll(path, ".", "_")
+}
+
+func attributeIndexName(tableName string, column string) string {
+	return fmt.Sprintf("idx_%s_%s", tableName, column)
+}
+
+func attributeJSONPath(path string) string {
+	return "$." + path
+}
+
+func sqlAddAttributeColumn(tableName string, column string, path string) string {
+	query := `ALTER TABLE %s ADD COLUMN %s GENERATED ALWAYS AS (json_extract(attributes, '%s')) VIRTUAL`
+	return fmt.Sprintf(query, tableName, column, attributeJSONPath(path))
+}
+
+func sqlDropAttributeColumn(tableName string, column string) string {
+	query := `ALTER TABLE %s DROP COLUMN %s`
+	return fmt.Sprintf(query, tableName, column)
+}
+
+func sqlCreateAttributeIndex(tableName string, column string, unique bool) string {
+	query := `CREATE INDEX IF NOT EXISTS %s ON %s(%s)`
+	if unique {
+		query = `CREATE UNIQUE INDEX IF NOT EXISTS %s ON %s(%s)`
+	}
+	return fmt.Sprintf(query, attributeIndexName(tableName, column), tableName, column)
+}
+
+func sqlDropAttributeIndex(tableName string, column string) string {
+	query := `DROP INDEX IF EXISTS %s`
+	return fmt.Sprintf(query, attributeIndexName(tableName, column))
+}
+
+// sqlListByAttributeColumn constructs the SQL query to list objects by a generated attribute column.
+func sqlListByAttributeColumn(tableName string, column string) string {
+	query := `SELECT %s FROM %s WHERE %s = ?`
+	return fmt.Sprintf(query, objectColumns, tableName, column)
+}
+
+// sqlListByAttributePath constructs the SQL query to list objects by an attribute that is not indexed.
+func sqlListByAttributePath(tableName string) string {
+	query := `SELECT %s FROM %s WHERE json_extract(attributes, ?) = ?`
+	return fmt.Sprintf(query, objectColumns, tableName)
+}
@@ -0,0 +1,104 @@
+package data
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func queryPlan(t *testing.T, table *Tables, query string, args ...any) string {
+	rows, err := table.db.Query("EXPLAIN QUERY PLAN "+query, args...)
+	assert.NoError(t, err)
+	defer rows.Close()
+
+	var plan []string
+	for rows.Next() {
+		var id, parent, unused int
+		var detail string
+		assert.NoError(t, rows.Scan(&id, &parent, &unused, &detail))
+		plan = append(plan, detail)
+	}
+	return strings.Join(plan, "\n")
+}
+
+func TestListByAttribute(t *testing.T) {
+	table, err := NewTables(newTestDatabase(t))
+	assert.NoError(t, err)
+
+	devices := []Object{
+		{ID: uuid.NewString(), OwnerID: "owner1", Version: 1, Attributes: map[string]any{"hostname": "web-1", "os": map[string]any{"name": "debian"}, "arch": "amd64"}},
+		{ID: uuid.NewString(), OwnerID: "owner1", Version: 1, Attributes: map[string]any{"hostname": "web-2", "os": map[string]any{"name": "ubuntu"}, "arch": "arm64"}},
+		{ID: uuid.NewString(), OwnerID: "owner1", Version: 1, Attributes: map[string]any{"hostname": "db-1", "os": map[string]any{"name": "debian"}, "arch": "amd64"}},
+	}
+	for _, device := range devices {
+		assert.NoError(t, table.Insert("device", device))
+	}
+
+	objects, err := table.ListByAttribute("device", "os.name", "debian")
+	assert.NoError(t, err)
+	assert.Len(t, objects, 2)
+
+	objects, err = table.ListByAttribute("device", "hostname", "web-2")
+	assert.NoError(t, err)
+	assert.Len(t, objects, 1)
+	assert.Equal(t, devices[1].ID, objects[0].ID)
+
+	objects, err = table.ListByAttribute("device", "arch", "amd64")
+	assert.NoError(t, err)
+	assert.Len(t, objects, 2)
+
+	_, err = table.ListByAttribute("device", "os.name') OR 1=1 --", "x")
+	assert.ErrorIs(t, err, ErrInvalidAttributePath)
+
+	plan := queryPlan(t, table, sqlListByAttributeColumn("device", attributeColumnName("os.name")), "debian")
+	assert.Contains(t, plan, "USING INDEX idx_device_attr_os_name")
+}
+
+func TestUniqueAttributeIndex(t *testing.T) {
+	table, err := NewTables(newTestDatabase(t))
+	assert.NoError(t, err)
+
+	first := Object{ID: uuid.NewString(), Version: 1, Attributes: map[string]any{"email": "admin@example.com"}}
+	second := Object{ID: uuid.NewString(), Version: 1, Attributes: map[string]any{"email": "admin@example.com"}}
+	assert.NoError(t, table.Insert("admin", first))
+	assert.ErrorIs(t, table.Insert("admin", second), ErrConflict)
+	assert.ErrorIs(t, table.Insert("admin", first), ErrConflict)
+
+	second.Attributes["email"] = "other@example.com"
+	assert.NoError(t, table.Insert("admin", second))
+	second.Attributes["email"] = "admin@example.com"
+	assert.ErrorIs(t, table.UpdateByID("admin", second.ID, second), ErrConflict)
+}
+
+func TestSyncAttributeIndexes(t *testing.T) {
+	database := newTestDatabase(t)
+	_, err := NewTables(database)
+	assert.NoError(t, err)
+
+	err = syncAttributeIndexes(database, "user", []AttributeIndex{{Path: "name"}, {Path: "team.id", Unique: true}})
+	assert.NoError(t, err)
+	columns, err := attributeColumns(database, "user")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"attr_name", "attr_team_id"}, columns)
+
+	err = syncAttributeIndexes(database, "user", []AttributeIndex{{Path: "name", Unique: true}})
+	assert.NoError(t, err)
+	columns, err = attributeColumns(database, "user")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"attr_name"}, columns)
+
+	tx, err := database.Begin()
+	assert.NoError(t, err)
+	unique, found, err := indexUniqueness(tx, "idx_user_attr_name")
+	assert.NoError(t, tx.Rollback())
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.True(t, unique)
+
+	err = syncAttributeIndexes(database, "admin", []AttributeIndex{{Path: "password"}})
+	assert.Error(t, err)
+	err = syncAttributeIndexes(database, "user", []AttributeIndex{{Path: "bad path"}})
+	assert.ErrorIs(t, err, ErrInvalidAttributePath)
+}
@@ -0,0 +1,7 @@
+package data
+
+// JobTable stores the jobs scheduled on the devices.
+var JobTable = RegisterTable(TableDefinition{
+	Name:       "job",
+	Searchable: true,
+})
@@ -0,0 +1,107 @@
+package data
+
+import (
+	"time"
+)
+
+// KeyRotatorOptions configures the background re-encryption of sensitive attributes.
+type KeyRotatorOptions struct {
+	// Interval is the time between two re-encryption passes when no rotation is requested.
+	Interval time.Duration
+	// BatchSize is the maximum number of rows examined per query.
+	BatchSize int
+	// OnError is called when a pass over a table fails. It may be nil.
+	OnError func(tableName string, err error)
+}
+
+// DefaultKeyRotatorOptions returns the options used when none are configured.
+func DefaultKeyRotatorOptions() KeyRotatorOptions {
+	return KeyRotatorOptions{
+		Interval:  time.Hour,
+		BatchSize: 100,
+	}
+}
+
+// KeyRotator is a background worker that re-encrypts rows whose sensitive
+// attributes are in plaintext or encrypted with a rotated data key.
+type KeyRotator struct {
+	worker
+	tables  *Tables
+	options KeyRotatorOptions
+	wake    chan struct{}
+}
+
+// NewKeyRotator creates a key rotator for the data tables. Call Start to run it.
+func NewKeyRotator(tables *Tables, options KeyRotatorOptions) *KeyRotator {
+	defaults := DefaultKeyRotatorOptions()
+	if options.Interval <= 0 {
+		options.Interval = defaults.Interval
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = defaults.BatchSize
+	}
+	return &KeyRotator{
+		worker:  newWorker(),
+		tables:  tables,
+		options: options,
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Start runs the key rotator in its own goroutine until Stop is called.
+func (r *KeyRotator) Start() {
+	r.start(r.run)
+}
+
+// Rotate creates a new data key for every organization and wakes the rotator
+// to re-encrypt the existing rows in the background.
+func (r *KeyRotator) Rotate() error {
+	err := r.tables.RotateDataKeys()
+	if err != nil {
+		return err
+	}
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (r *KeyRotator) run() {
+	ticker := time.NewTicker(r.options.Interval)
+	defer ticker.Stop()
+
+	for {
+		r.Reencrypt()
+		select {
+		case <-r.stop:
+			return
+		case <-r.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Reencrypt makes one pass over every table with sensitive attributes and
+// returns the number of rewritten rows.
+func (r *KeyRotator) Reencrypt() int {
+	rewritten := 0
+	if r.tables.Writable() != nil {
+		return rewritten
+	}
+	for _, tableName := range dataTableList() {
+		afterID := ""
+		for !r.stopping() {
+			lastID, count, err := r.tables.ReencryptBatch(tableName, afterID, r.options.BatchSize)
+			rewritten += count
+			if err != nil && r.options.OnError != nil {
+				r.options.OnError(tableName, err)
+			}
+			if err != nil || lastID == "" {
+				break
+			}
+			afterID = lastID
+		}
+	}
+	return rewritten
+}
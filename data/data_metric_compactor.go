@@ -0,0 +1,72 @@
+package data
+
+import (
+	"time"
+)
+
+// MetricCompactorOptions configures how often device metrics are rolled up.
+type MetricCompactorOptions struct {
+	// Interval is the time between two compactions of the metric store.
+	Interval time.Duration
+	// OnError is called when a compaction fails. It may be nil.
+	OnError func(err error)
+}
+
+// DefaultMetricCompactorOptions returns the options used when none are configured.
+func DefaultMetricCompactorOptions() MetricCompactorOptions {
+	return MetricCompactorOptions{
+		Interval: time.Minute,
+	}
+}
+
+// MetricCompactor is a background worker that rolls up device metrics and
+// deletes the points past their retention.
+type MetricCompactor struct {
+	worker
+	metrics *MetricStore
+	options MetricCompactorOptions
+}
+
+// NewMetricCompactor creates a compactor for the metric store. Call Start to run it.
+func NewMetricCompactor(metrics *MetricStore, options MetricCompactorOptions) *MetricCompactor {
+	defaults := DefaultMetricCompactorOptions()
+	if options.Interval <= 0 {
+		options.Interval = defaults.Interval
+	}
+	return &MetricCompactor{
+		worker:  newWorker(),
+		metrics: metrics,
+		options: options,
+	}
+}
+
+// Start runs the compactor in its own goroutine until Stop is called.
+func (c *MetricCompactor) Start() {
+	c.start(c.run)
+}
+
+func (c *MetricCompactor) run() {
+	ticker := time.NewTicker(c.options.Interval)
+	defer ticker.Stop()
+
+	for {
+		c.Compact(time.Now())
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Compact compacts the metric store unless this node cannot write, in which
+// case the leader compacts and replicates the result.
+func (c *MetricCompactor) Compact(now time.Time) {
+	if c.metrics.tables.Writable() != nil {
+		return
+	}
+	err := c.metrics.Compact(now)
+	if err != nil && c.options.OnError != nil {
+		c.options.OnError(err)
+	}
+}
@@ -0,0 +1,412 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+var ErrInvalidMetricQuery = errors.New("data: invalid metric query")
+
+// maxMetricPoints is the largest number of points per series returned by a query.
+const maxMetricPoints = 10000
+
+// MetricResolution is the interval between two stored points of a metric.
+type MetricResolution time.Duration
+
+const (
+	// MetricRaw are the samples as written, usually one per minute.
+	MetricRaw MetricResolution = MetricResolution(time.Minute)
+	// MetricFiveMinutes are aggregates of the raw samples over five minutes.
+	MetricFiveMinutes MetricResolution = MetricResolution(5 * time.Minute)
+	// MetricHourly are aggregates of the five minute aggregates over an hour.
+	MetricHourly MetricResolution = MetricResolution(time.Hour)
+)
+
+// MetricAggregation is the function that combines the samples of a query step.
+type MetricAggregation string
+
+const (
+	MetricAvg   MetricAggregation = "avg"
+	MetricMin   MetricAggregation = "min"
+	MetricMax   MetricAggregation = "max"
+	MetricSum   MetricAggregation = "sum"
+	MetricCount MetricAggregation = "count"
+)
+
+// Sample is one measurement of a device metric such as cpu or memory.
+type Sample struct {
+	Metric string    `json:"metric"`
+	Time   time.Time `json:"time"`
+	Value  float64   `json:"value"`
+}
+
+// MetricRetention is how long the points of each resolution are kept.
+type MetricRetention struct {
+	Raw         time.Duration
+	FiveMinutes time.Duration
+	Hourly      time.Duration
+}
+
+// DefaultMetricRetention returns the retention used when none is configured.
+func DefaultMetricRetention() MetricRetention {
+	return MetricRetention{
+		Raw:         7 * 24 * time.Hour,
+		FiveMinutes: 30 * 24 * time.Hour,
+		Hourly:      400 * 24 * time.Hour,
+	}
+}
+
+// MetricQuery selects the points of the metrics of a device.
+type MetricQuery struct {
+	DeviceID string
+	// Metrics limits the query to some metrics. Every metric is returned when empty.
+	Metrics []string
+	// Start is inclusive and End exclusive.
+	Start time.Time
+	End   time.Time
+	// Step is the interval of the returned points. It must be at least a minute.
+	Step        time.Duration
+	Aggregation MetricAggregation
+}
+
+// MetricPoint is the aggregate of the samples of one step.
+type MetricPoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// MetricSeries are the points of one metric.
+type MetricSeries struct {
+	Metric string        `json:"metric"`
+	Points []MetricPoint `json:"points"`
+}
+
+// MetricStore stores device metrics beside the data tables. Samples are kept
+// as integer timestamps and floating point values keyed by a series number,
+// and rolled up into five minute and hourly aggregates that outlive them.
+// Writes go through the tables, so metrics are replicated like objects.
+type MetricStore struct {
+	tables    *Tables
+	retention MetricRetention
+}
+
+// NewMetricStore creates the metric store of the tables. Zero retentions are
+// replaced by their defaults.
+func NewMetricStore(tables *Tables, retention MetricRetention) *MetricStore {
+	defaults := DefaultMetricRetention()
+	if retention.Raw <= 0 {
+		retention.Raw = defaults.Raw
+	}
+	if retention.FiveMinutes <= 0 {
+		retention.FiveMinutes = defaults.FiveMinutes
+	}
+	if retention.Hourly <= 0 {
+		retention.Hourly = defaults.Hourly
+	}
+	return &MetricStore{tables: tables, retention: retention}
+}
+
+// Write stores the samples of a device in one transaction. A sample replaces
+// the previous one of the same metric at the same second.
+func (m *MetricStore) Write(deviceID string, samples []Sample) error {
+	for _, sample := range samples {
+		if sample.Metric == "" {
+			return fmt.Errorf("%w: sample without a metric name", ErrInvalidMetricQuery)
+		}
+	}
+	if len(samples) == 0 {
+		return nil
+	}
+
+	tx, err := m.tables.writer.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	seriesStmt, err := tx.Prepare(sqlInsertMetricSeries())
+	if err != nil {
+		return err
+	}
+	defer seriesStmt.Close()
+	sampleStmt, err := tx.Prepare(sqlInsertMetricSample())
+	if err != nil {
+		return err
+	}
+	defer sampleStmt.Close()
+
+	for _, sample := range samples {
+		_, err := seriesStmt.Exec(deviceID, sample.Metric)
+		if err != nil {
+			return err
+		}
+		_, err = sampleStmt.Exec(deviceID, sample.Metric, sample.Time.Unix(), sample.Value)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Query returns the points of the metrics of a device, one series per metric
+// ordered by name. Steps without samples are left out. The raw samples are
+// used while the start of the range is within their retention, and the
+// coarser aggregates for older ranges.
+func (m *MetricStore) Query(query MetricQuery) ([]MetricSeries, error) {
+	err := query.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	start, end, step := query.Start.Unix(), query.End.Unix(), int64(query.Step/time.Second)
+	args := []any{start, start, step, step, query.DeviceID}
+	for _, metric := range query.Metrics {
+		args = append(args, metric)
+	}
+	args = append(args, start, end)
+
+	resolution := m.resolutionAt(query.Start, time.Now())
+	rows, err := m.tables.db.Query(sqlQueryMetrics(resolution, query.Aggregation, len(query.Metrics)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var series []MetricSeries
+	for rows.Next() {
+		var metric string
+		var bucket int64
+		var value float64
+		err := rows.Scan(&metric, &bucket, &value)
+		if err != nil {
+			return nil, err
+		}
+		if len(series) == 0 || series[len(series)-1].Metric != metric {
+			series = append(series, MetricSeries{Metric: metric})
+		}
+		last := &series[len(series)-1]
+		last.Points = append(last.Points, MetricPoint{Time: time.Unix(bucket, 0).UTC(), Value: value})
+	}
+	return series, rows.Err()
+}
+
+// Compact rolls up the samples of the buckets completed before now and deletes
+// the points older than their retention. The last bucket rolled up by the
+// previous compaction is rolled up again to include samples that arrived late.
+func (m *MetricStore) Compact(now time.Time) error {
+	tx, err := m.tables.writer.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rollups := []struct {
+		resolution MetricResolution
+		source     MetricResolution
+	}{
+		{MetricFiveMinutes, MetricRaw},
+		{MetricHourly, MetricFiveMinutes},
+	}
+	for _, rollup := range rollups {
+		size := rollup.resolution.seconds()
+		var doneUntil int64
+		err := tx.QueryRow(sqlGetMetricRollupState(), size).Scan(&doneUntil)
+		if err != nil {
+			return err
+		}
+		from := max(doneUntil-size, 0)
+		until := now.Unix() / size * size
+		if until <= from {
+			continue
+		}
+		_, err = tx.Exec(sqlRollupMetrics(rollup.resolution, rollup.source), from, until)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(sqlSetMetricRollupState(), size, until)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(sqlDeleteMetricSamples(), now.Add(-m.retention.Raw).Unix())
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(sqlDeleteMetricRollups(), MetricFiveMinutes.seconds(), now.Add(-m.retention.FiveMinutes).Unix())
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(sqlDeleteMetricRollups(), MetricHourly.seconds(), now.Add(-m.retention.Hourly).Unix())
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(sqlDeleteUnusedMetricSeries())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// resolutionAt returns the finest resolution whose points are still kept at start.
+func (m *MetricStore) resolutionAt(start time.Time, now time.Time) MetricResolution {
+	switch {
+	case !start.Before(now.Add(-m.retention.Raw)):
+		return MetricRaw
+	case !start.Before(now.Add(-m.retention.FiveMinutes)):
+		return MetricFiveMinutes
+	default:
+		return MetricHourly
+	}
+}
+
+func (resolution MetricResolution) seconds() int64 {
+	return int64(time.Duration(resolution) / time.Second)
+}
+
+func (query MetricQuery) validate() error {
+	switch {
+	case query.Step < time.Minute || query.Step%time.Second != 0:
+		return fmt.Errorf("%w: the step must be a whole number of seconds of at least a minute", ErrInvalidMetricQuery)
+	case !query.End.After(query.Start):
+		return fmt.Errorf("%w: the end must be after the start", ErrInvalidMetricQuery)
+	case query.End.Sub(query.Start)/query.Step > maxMetricPoints:
+		return fmt.Errorf("%w: more than %d points per metric", ErrInvalidMetricQuery, maxMetricPoints)
+	case !slices.Contains([]MetricAggregation{MetricAvg, MetricMin, MetricMax, MetricSum, MetricCount}, query.Aggregation):
+		return fmt.Errorf("%w: unknown aggregation %q", ErrInvalidMetricQuery, query.Aggregation)
+	}
+	return nil
+}
+
+// sqlCreateMetricTables constructs the SQL statements that create the metric tables.
+// Samples and aggregates are clustered by series and time without a rowid.
+func sqlCreateMetricTables() string {
+	return `
+	CREATE TABLE IF NOT EXISTS metric_series (
+		id INTEGER PRIMARY KEY,
+		device_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		UNIQUE (device_id, name)
+	);
+	CREATE TABLE IF NOT EXISTS metric_sample (
+		series_id INTEGER NOT NULL,
+		ts INTEGER NOT NULL,
+		value REAL NOT NULL,
+		PRIMARY KEY (series_id, ts)
+	) WITHOUT ROWID;
+	CREATE TABLE IF NOT EXISTS metric_rollup (
+		series_id INTEGER NOT NULL,
+		resolution INTEGER NOT NULL,
+		ts INTEGER NOT NULL,
+		count INTEGER NOT NULL,
+		sum REAL NOT NULL,
+		min REAL NOT NULL,
+		max REAL NOT NULL,
+		PRIMARY KEY (series_id, resolution, ts)
+	) WITHOUT ROWID;
+	CREATE TABLE IF NOT EXISTS metric_rollup_state (
+		resolution INTEGER PRIMARY KEY,
+		done_until INTEGER NOT NULL
+	);
+	`
+}
+
+func sqlInsertMetricSeries() string {
+	return `INSERT OR IGNORE INTO metric_series (device_id, name) VALUES (?, ?)`
+}
+
+func sqlInsertMetricSample() string {
+	return `
+	INSERT INTO metric_sample (series_id, ts, value)
+	VALUES ((SELECT id FROM metric_series WHERE device_id = ? AND name = ?), ?, ?)
+	ON CONFLICT (series_id, ts) DO UPDATE SET value = excluded.value
+	`
+}
+
+// sqlMetricPoints constructs a query returning the points of a resolution as
+// aggregates, so that samples and rollups are aggregated the same way.
+func sqlMetricPoints(resolution MetricResolution) string {
+	if resolution == MetricRaw {
+		return `SELECT series_id, ts, 1 AS count, value AS sum, value AS min, value AS max FROM metric_sample`
+	}
+	return fmt.Sprintf(`SELECT series_id, ts, count, sum, min, max FROM metric_rollup WHERE resolution = %d`, resolution.seconds())
+}
+
+// sqlMetricsAggregate returns the SQL expression that aggregates the points of a step.
+func sqlMetricsAggregate(aggregation MetricAggregation) string {
+	switch aggregation {
+	case MetricMin:
+		return "MIN(p.min)"
+	case MetricMax:
+		return "MAX(p.max)"
+	case MetricSum:
+		return "SUM(p.sum)"
+	case MetricCount:
+		return "SUM(p.count)"
+	default:
+		return "SUM(p.sum) / SUM(p.count)"
+	}
+}
+
+// sqlQueryMetrics constructs the SQL query of MetricStore.Query. The arguments
+// are the start twice and the step twice to align the buckets on the start,
+// then the device ID, the metric names, the start and the end.
+func sqlQueryMetrics(resolution MetricResolution, aggregation MetricAggregation, metrics int) string {
+	names := ""
+	if metrics > 0 {
+		names = "AND s.name IN (?" + strings.Repeat(", ?", metrics-1) + ")"
+	}
+	query := `
+	SELECT s.name, ? + (p.ts - ?) / ? * ? AS bucket, %s
+	FROM metric_series s JOIN (%s) p ON p.series_id = s.id
+	WHERE s.device_id = ? %s AND p.ts >= ? AND p.ts < ?
+	GROUP BY s.name, bucket
+	ORDER BY s.name, bucket
+	`
+	return fmt.Sprintf(query, sqlMetricsAggregate(aggregation), sqlMetricPoints(resolution), names)
+}
+
+func sqlGetMetricRollupState() string {
+	return `SELECT COALESCE((SELECT done_until FROM metric_rollup_state WHERE resolution = ?), 0)`
+}
+
+func sqlSetMetricRollupState() string {
+	return `
+	INSERT INTO metric_rollup_state (resolution, done_until) VALUES (?, ?)
+	ON CONFLICT (resolution) DO UPDATE SET done_until = excluded.done_until
+	`
+}
+
+// sqlRollupMetrics constructs the SQL query that aggregates the points of the
+// source resolution between two times into the buckets of the resolution.
+func sqlRollupMetrics(resolution MetricResolution, source MetricResolution) string {
+	query := `
+	INSERT INTO metric_rollup (series_id, resolution, ts, count, sum, min, max)
+	SELECT p.series_id, %[1]d, p.ts / %[1]d * %[1]d AS bucket, SUM(p.count), SUM(p.sum), MIN(p.min), MAX(p.max)
+	FROM (%[2]s) p
+	WHERE p.ts >= ? AND p.ts < ?
+	GROUP BY p.series_id, bucket
+	ON CONFLICT (series_id, resolution, ts) DO UPDATE SET
+		count = excluded.count, sum = excluded.sum, min = excluded.min, max = excluded.max
+	`
+	return fmt.Sprintf(query, resolution.seconds(), sqlMetricPoints(source))
+}
+
+func sqlDeleteMetricSamples() string {
+	return `DELETE FROM metric_sample WHERE ts < ?`
+}
+
+func sqlDeleteMetricRollups() string {
+	return `DELETE FROM metric_rollup WHERE resolution = ? AND ts < ?`
+}
+
+func sqlDeleteUnusedMetricSeries() string {
+	return `
+	DELETE FROM metric_series
+	WHERE NOT EXISTS (SELECT 1 FROM metric_sample WHERE series_id = metric_series.id)
+	AND NOT EXISTS (SELECT 1 FROM metric_rollup WHERE series_id = metric_series.id)
+	`
+}
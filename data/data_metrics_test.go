@@ -0,0 +1,113 @@
+package data
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeMinutes writes one sample per minute from start with the values 0, 1, 2...
+func writeMinutes(t *testing.T, metrics *MetricStore, deviceID string, metric string, start time.Time, count int) {
+	samples := make([]Sample, count)
+	for i := range samples {
+		samples[i] = Sample{Metric: metric, Time: start.Add(time.Duration(i) * time.Minute), Value: float64(i)}
+	}
+	assert.NoError(t, metrics.Write(deviceID, samples))
+}
+
+func TestMetricQuery(t *testing.T) {
+	tables, err := NewTables(newTestDatabase(t))
+	assert.NoError(t, err)
+	metrics := NewMetricStore(tables, MetricRetention{})
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Hour)
+	writeMinutes(t, metrics, "d1", "cpu", start, 10)
+	writeMinutes(t, metrics, "d1", "memory", start, 10)
+	writeMinutes(t, metrics, "d2", "cpu", start, 10)
+	// A sample at the same second replaces the previous one.
+	assert.NoError(t, metrics.Write("d1", []Sample{{Metric: "memory", Time: start, Value: 100}}))
+
+	query := MetricQuery{DeviceID: "d1", Metrics: []string{"cpu"}, Start: start, End: start.Add(time.Hour), Step: 5 * time.Minute}
+	for aggregation, expected := range map[MetricAggregation][]float64{
+		MetricAvg:   {2, 7},
+		MetricMin:   {0, 5},
+		MetricMax:   {4, 9},
+		MetricSum:   {10, 35},
+		MetricCount: {5, 5},
+	} {
+		query.Aggregation = aggregation
+		series, err := metrics.Query(query)
+		assert.NoError(t, err)
+		assert.Len(t, series, 1)
+		assert.Equal(t, "cpu", series[0].Metric)
+		assert.Equal(t, []MetricPoint{
+			{Time: start.UTC(), Value: expected[0]},
+			{Time: start.Add(5 * time.Minute).UTC(), Value: expected[1]},
+		}, series[0].Points, aggregation)
+	}
+
+	// Without metric names every metric of the device is returned by name.
+	series, err := metrics.Query(MetricQuery{DeviceID: "d1", Start: start, End: start.Add(time.Hour), Step: time.Hour, Aggregation: MetricMax})
+	assert.NoError(t, err)
+	assert.Len(t, series, 2)
+	assert.Equal(t, "memory", series[1].Metric)
+	assert.Equal(t, []MetricPoint{{Time: start.UTC(), Value: 100}}, series[1].Points)
+
+	for _, invalid := range []MetricQuery{
+		{Start: start, End: start.Add(time.Hour), Step: time.Second, Aggregation: MetricAvg},
+		{Start: start, End: start, Step: time.Minute, Aggregation: MetricAvg},
+		{Start: start.Add(-365 * 24 * time.Hour), End: start, Step: time.Minute, Aggregation: MetricAvg},
+		{Start: start, End: start.Add(time.Hour), Step: time.Minute, Aggregation: "median"},
+	} {
+		_, err := metrics.Query(invalid)
+		assert.ErrorIs(t, err, ErrInvalidMetricQuery)
+	}
+	assert.ErrorIs(t, metrics.Write("d1", []Sample{{Time: start}}), ErrInvalidMetricQuery)
+}
+
+func TestMetricCompact(t *testing.T) {
+	tables, err := NewTables(newTestDatabase(t))
+	assert.NoError(t, err)
+	metrics := NewMetricStore(tables, MetricRetention{})
+
+	now := time.Now()
+	// The recent samples end an hour before now at the latest, so that the
+	// late sample below is not counted in their range.
+	recent := now.Add(-3 * time.Hour).Truncate(time.Hour)
+	fiveMinutes := now.Add(-10 * 24 * time.Hour).Truncate(time.Hour)
+	hourly := now.Add(-60 * 24 * time.Hour).Truncate(time.Hour)
+	for _, start := range []time.Time{recent, fiveMinutes, hourly} {
+		writeMinutes(t, metrics, "d1", "cpu", start, 120)
+	}
+	writeMinutes(t, metrics, "d1", "expired", now.Add(-500*24*time.Hour), 10)
+
+	assert.NoError(t, metrics.Compact(now))
+	// A late sample is included when the last bucket is rolled up again.
+	assert.NoError(t, metrics.Write("d1", []Sample{{Metric: "cpu", Time: now.Truncate(5 * time.Minute).Add(-time.Second), Value: 1000}}))
+	assert.NoError(t, metrics.Compact(now))
+
+	var samples, series int
+	assert.NoError(t, tables.db.QueryRow("SELECT COUNT(*) FROM metric_sample WHERE ts < ?", now.Add(-7*24*time.Hour).Unix()).Scan(&samples))
+	assert.Zero(t, samples)
+	assert.NoError(t, tables.db.QueryRow("SELECT COUNT(*) FROM metric_series WHERE name = 'expired'").Scan(&series))
+	assert.Zero(t, series)
+
+	// Older ranges are answered from the rollups with the same aggregates.
+	for _, start := range []time.Time{recent, fiveMinutes, hourly} {
+		result, err := metrics.Query(MetricQuery{DeviceID: "d1", Start: start, End: start.Add(2 * time.Hour), Step: time.Hour, Aggregation: MetricAvg})
+		assert.NoError(t, err)
+		assert.Len(t, result, 1)
+		assert.Equal(t, []MetricPoint{{Time: start.UTC(), Value: 29.5}, {Time: start.Add(time.Hour).UTC(), Value: 89.5}}, result[0].Points)
+	}
+
+	var maximum float64
+	err = tables.db.QueryRow("SELECT max FROM metric_rollup WHERE resolution = 300 ORDER BY ts DESC LIMIT 1").Scan(&maximum)
+	assert.NoError(t, err)
+	assert.Equal(t, 1000.0, maximum)
+
+	// Followers leave the compaction to the leader.
+	tables.SetReplicator(&loopbackReplicator{})
+	compactor := NewMetricCompactor(metrics, MetricCompactorOptions{OnError: func(err error) { t.Error(err) }})
+	compactor.Compact(now)
+}
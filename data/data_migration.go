@@ -0,0 +1,155 @@
+package data
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// migration is a schema change applied in order to every data table.
+type migration struct {
+	version     int
+	description string
+	statements  func(tableName string) []string
+}
+
+// migrationList returns the schema changes made after the initial table layout.
+// New migrations must be appended with the next version number.
+func migrationList() []migration {
+	return []migration{
+		{
+			version:     1,
+			description: "add object expiry",
+			statements: func(tableName string) []string {
+				return []string{
+					fmt.Sprintf(`ALTER TABLE %s ADD COLUMN expires_at TEXT`, tableName),
+					fmt.Sprintf(`CREATE INDEX IF NOT EXISTS idx_%s_expires_at ON %s(expires_at)`, tableName, tableName),
+				}
+			},
+		},
+		{
+			version:     2,
+			description: "index owner IDs per table",
+			statements: func(tableName string) []string {
+				return []string{
+					`DROP INDEX IF EXISTS idx_owner_id`,
+					fmt.Sprintf(`CREATE INDEX IF NOT EXISTS idx_%s_owner_id ON %s(owner_id)`, tableName, tableName),
+				}
+			},
+		},
+		{
+			version:     3,
+			description: "store timestamps with nanoseconds and add hybrid logical clocks",
+			statements: func(tableName string) []string {
+				archive := archiveTableName(tableName)
+				return []string{
+					fmt.Sprintf(`ALTER TABLE %s ADD COLUMN hlc TEXT NOT NULL DEFAULT ''`, tableName),
+					// Objects inserted before Insert set updated_at have the zero time.
+					fmt.Sprintf(`UPDATE %s SET updated_at = created_at WHERE updated_at LIKE '0001-01-01%%'`, tableName),
+					// Rows updated in the same second are ordered by rowid, which follows the insertion order.
+					fmt.Sprintf(`UPDATE %s SET hlc = printf('%%019d.%%010d', CAST(strftime('%%s', updated_at) AS INTEGER) * 1000000000, rowid)`, tableName),
+					fmt.Sprintf(`UPDATE %s SET %s`, tableName, sqlNanosecondTimestamps("created_at", "updated_at", "expires_at")),
+					fmt.Sprintf(`CREATE INDEX IF NOT EXISTS idx_%s_hlc ON %s(hlc)`, tableName, tableName),
+					sqlCreateArchiveTable(tableName),
+					fmt.Sprintf(`ALTER TABLE %s ADD COLUMN hlc TEXT NOT NULL DEFAULT ''`, archive),
+					fmt.Sprintf(`UPDATE %s SET %s`, archive, sqlNanosecondTimestamps("created_at", "updated_at", "expires_at", "archived_at")),
+				}
+			},
+		},
+	}
+}
+
+// sqlNanosecondTimestamps constructs the SET clause that rewrites timestamp
+// columns stored as RFC 3339 text with seconds in the layout of Timestamp.
+// SQLite converts the time zone offsets to UTC.
+func sqlNanosecondTimestamps(columns ...string) string {
+	assignments := make([]string, len(columns))
+	for i, column := range columns {
+		assignments[i] = fmt.Sprintf(`%[1]s = strftime('%%Y-%%m-%%dT%%H:%%M:%%S', %[1]s) || '.000000000Z'`, column)
+	}
+	return strings.Join(assignments, ", ")
+}
+
+// migrateTable applies the migrations that have not been recorded for the table yet.
+func migrateTable(db *sql.DB, tableName string) error {
+	current, err := tableSchemaVersion(db, tableName)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrationList() {
+		if m.version <= current {
+			continue
+		}
+		err := applyMigration(db, tableName, m)
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) on %s: %w", m.version, m.description, tableName, err)
+		}
+	}
+	return nil
+}
+
+// applyMigration runs the statements of one migration and records it in a single transaction.
+func applyMigration(db *sql.DB, tableName string, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range m.statements(tableName) {
+		_, err := tx.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(sqlInsertMigration(), tableName, m.version, NowTimestamp())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// tableSchemaVersion returns the highest migration version applied to the table.
+func tableSchemaVersion(db *sql.DB, tableName string) (int, error) {
+	var version int
+	err := db.QueryRow(sqlTableSchemaVersion(), tableName).Scan(&version)
+	return version, err
+}
+
+// schemaVersion returns the highest migration version applied to any table of the database.
+func schemaVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow(sqlSchemaVersion()).Scan(&version)
+	return version, err
+}
+
+// latestSchemaVersion returns the version of the last migration known to this build.
+func latestSchemaVersion() int {
+	migrations := migrationList()
+	return migrations[len(migrations)-1].version
+}
+
+func sqlCreateMigrationTable() string {
+	return `
+	CREATE TABLE IF NOT EXISTS schema_migration(
+		table_name TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		applied_at TEXT NOT NULL,
+		PRIMARY KEY (table_name, version)
+	);
+	`
+}
+
+func sqlInsertMigration() string {
+	return `INSERT INTO schema_migration (table_name, version, applied_at) VALUES (?, ?, ?)`
+}
+
+func sqlTableSchemaVersion() string {
+	return `SELECT COALESCE(MAX(version), 0) FROM schema_migration WHERE table_name = ?`
+}
+
+func sqlSchemaVersion() string {
+	return `SELECT COALESCE(MAX(version), 0) FROM schema_migration`
+}
@@ -0,0 +1,399 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidPatch = errors.New("data: invalid patch")
+
+// ErrPatchTestFailed is returned when a test operation of a JSON Patch does not match.
+var ErrPatchTestFailed = errors.New("data: patch test failed")
+
+// PatchType is the format of a patch, named after its media type.
+type PatchType string
+
+const (
+	// MergePatch is a JSON Merge Patch (RFC 7396).
+	MergePatch PatchType = "application/merge-patch+json"
+	// JSONPatch is a JSON Patch (RFC 6902).
+	JSONPatch PatchType = "application/json-patch+json"
+)
+
+// PatchOperation is one operation of a JSON Patch.
+type PatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// Patch applies a patch to the attributes of an object and returns the object
+// as stored. The attributes are the document being patched, so the JSON
+// pointer /hostname is the hostname attribute. The object is read, patched and
+// written in one write transaction, so concurrent writes cannot interleave and
+// a failed test operation leaves the object unchanged. The patch is applied in
+// Go rather than with the json_patch SQL function, which cannot see the
+// encrypted sensitive attributes and only implements merge patches. Since the
+// document is patched outside SQLite, the update also requires the version
+// that was read and returns ErrConflict when a write that did not go through
+// this writer, such as a replicated one, changed the object in between. A
+// successful patch increments the version of the object.
+func (table *Tables) Patch(tableName string, id string, patchType PatchType, patch []byte) (_ Object, err error) {
+	defer table.observe("patch", tableName, time.Now(), &err)
+	if !isDataTable(tableName) {
+		return Object{}, fmt.Errorf("%w: %s", ErrUnknownTable, tableName)
+	}
+	apply, err := parsePatch(patchType, patch)
+	if err != nil {
+		return Object{}, err
+	}
+
+	tx, err := table.writer.Begin()
+	if err != nil {
+		return Object{}, err
+	}
+	defer tx.Rollback()
+
+	obj, err := scanObject(tx.QueryRow(sqlGetByID(tableName), id, NowTimestamp()))
+	if err != nil {
+		return Object{}, err
+	}
+	obj, err = table.decryptObject(tx, tableName, obj)
+	if err != nil {
+		return Object{}, err
+	}
+
+	document := map[string]any{}
+	if obj.Attributes != nil {
+		document = obj.Attributes
+	}
+	patched, err := apply(document)
+	if err != nil {
+		return Object{}, err
+	}
+	attributes, ok := patched.(map[string]any)
+	if !ok {
+		return Object{}, fmt.Errorf("%w: the attributes must remain an object", ErrInvalidPatch)
+	}
+
+	readVersion := obj.Version
+	obj.Attributes = attributes
+	obj.Version++
+	obj.UpdatedAt, obj.HLC = table.stamp()
+	attrsJson, err := table.encodeAttributes(tx, tableName, obj)
+	if err != nil {
+		return Object{}, err
+	}
+	result, err := tx.Exec(sqlPatchByID(tableName), obj.UpdatedAt, obj.Version, attrsJson, obj.HLC, id, readVersion)
+	if err != nil {
+		return Object{}, translateError(err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return Object{}, err
+	}
+	if affected == 0 {
+		return Object{}, fmt.Errorf("%w: %s %s changed while it was patched", ErrConflict, tableName, id)
+	}
+	return obj, tx.Commit()
+}
+
+// parsePatch validates a patch and returns the function that applies it to a document.
+func parsePatch(patchType PatchType, patch []byte) (func(any) (any, error), error) {
+	switch patchType {
+	case MergePatch:
+		var merge any
+		err := json.Unmarshal(patch, &merge)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+		}
+		return func(document any) (any, error) {
+			return mergePatch(document, merge), nil
+		}, nil
+	case JSONPatch:
+		var operations []PatchOperation
+		err := json.Unmarshal(patch, &operations)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+		}
+		values := make([]any, len(operations))
+		for i, operation := range operations {
+			values[i], err = operation.validate()
+			if err != nil {
+				return nil, fmt.Errorf("%w: operation %d: %v", ErrInvalidPatch, i, err)
+			}
+		}
+		return func(document any) (any, error) {
+			for i, operation := range operations {
+				var err error
+				document, err = operation.apply(document, values[i])
+				if err != nil {
+					return nil, fmt.Errorf("operation %d (%s %s): %w", i, operation.Op, operation.Path, err)
+				}
+			}
+			return document, nil
+		}, nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported patch type %q", ErrInvalidPatch, patchType)
+	}
+}
+
+// mergePatch applies a JSON Merge Patch to target as described in RFC 7396.
+func mergePatch(target any, patch any) any {
+	patchObject, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]any)
+	if !ok {
+		targetObject = map[string]any{}
+	}
+	for name, value := range patchObject {
+		if value == nil {
+			delete(targetObject, name)
+		} else {
+			targetObject[name] = mergePatch(targetObject[name], value)
+		}
+	}
+	return targetObject
+}
+
+// validate checks the operation and returns its decoded value.
+func (operation PatchOperation) validate() (any, error) {
+	_, err := parsePointer(operation.Path)
+	if err != nil {
+		return nil, err
+	}
+	switch operation.Op {
+	case "add", "replace", "test":
+		if operation.Value == nil {
+			return nil, errors.New("missing value")
+		}
+		var value any
+		err := json.Unmarshal(operation.Value, &value)
+		return value, err
+	case "remove":
+		return nil, nil
+	case "move", "copy":
+		from, err := parsePointer(operation.From)
+		if err != nil {
+			return nil, err
+		}
+		path, _ := parsePointer(operation.Path)
+		if operation.Op == "move" && len(from) < len(path) && slices.Equal(from, path[:len(from)]) {
+			return nil, errors.New("cannot move a value into itself")
+		}
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown operation %q", operation.Op)
+	}
+}
+
+// apply applies the operation to document and returns the new document.
+func (operation PatchOperation) apply(document any, value any) (any, error) {
+	path, _ := parsePointer(operation.Path)
+	switch operation.Op {
+	case "add":
+		return addValue(document, path, value)
+	case "remove":
+		document, _, err := removeValue(document, path)
+		return document, err
+	case "replace":
+		if len(path) == 0 {
+			return value, nil
+		}
+		document, _, err := removeValue(document, path)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(document, path, value)
+	case "move":
+		from, _ := parsePointer(operation.From)
+		document, moved, err := removeValue(document, from)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(document, path, moved)
+	case "copy":
+		from, _ := parsePointer(operation.From)
+		copied, err := getValue(document, from)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(document, path, deepCopy(copied))
+	default: // test
+		actual, err := getValue(document, path)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrPatchTestFailed, err)
+		}
+		if !reflect.DeepEqual(actual, value) {
+			return nil, ErrPatchTestFailed
+		}
+		return document, nil
+	}
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into its unescaped reference tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses the index of an array element. The index may be one past
+// the last element when end is true.
+func arrayIndex(token string, length int, end bool) (int, error) {
+	if end && token == "-" {
+		return length, nil
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	if index > length || (!end && index == length) {
+		return 0, fmt.Errorf("array index %d out of range", index)
+	}
+	return index, nil
+}
+
+func getValue(document any, path []string) (any, error) {
+	for _, token := range path {
+		switch node := document.(type) {
+		case map[string]any:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("%w: no member %q", ErrInvalidPatch, token)
+			}
+			document = value
+		case []any:
+			index, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+			}
+			document = node[index]
+		default:
+			return nil, fmt.Errorf("%w: %q is not in an object or array", ErrInvalidPatch, token)
+		}
+	}
+	return document, nil
+}
+
+// addValue adds value at path, replacing the member of an object or
+// inserting the element of an array, and returns the new document.
+func addValue(document any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, err := getValue(document, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	token := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]any:
+		node[token] = value
+		return document, nil
+	case []any:
+		index, err := arrayIndex(token, len(node), true)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+		}
+		return setValue(document, path[:len(path)-1], slices.Insert(node, index, value))
+	default:
+		return nil, fmt.Errorf("%w: %q is not in an object or array", ErrInvalidPatch, token)
+	}
+}
+
+// removeValue removes the value at path and returns the new document and the removed value.
+func removeValue(document any, path []string) (any, any, error) {
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("%w: cannot remove the whole document", ErrInvalidPatch)
+	}
+	parent, err := getValue(document, path[:len(path)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+	token := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]any:
+		value, ok := node[token]
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: no member %q", ErrInvalidPatch, token)
+		}
+		delete(node, token)
+		return document, value, nil
+	case []any:
+		index, err := arrayIndex(token, len(node), false)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+		}
+		value := node[index]
+		document, err = setValue(document, path[:len(path)-1], slices.Delete(slices.Clone(node), index, index+1))
+		return document, value, err
+	default:
+		return nil, nil, fmt.Errorf("%w: %q is not in an object or array", ErrInvalidPatch, token)
+	}
+}
+
+// setValue replaces the value at an existing path and returns the new document.
+// It is used for arrays, whose length changes when an element is added or removed.
+func setValue(document any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, err := getValue(document, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	token := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]any:
+		node[token] = value
+	case []any:
+		index, _ := arrayIndex(token, len(node), false)
+		node[index] = value
+	}
+	return document, nil
+}
+
+// deepCopy copies a decoded JSON value so that copies do not share maps or slices.
+func deepCopy(value any) any {
+	switch node := value.(type) {
+	case map[string]any:
+		copied := make(map[string]any, len(node))
+		for name, element := range node {
+			copied[name] = deepCopy(element)
+		}
+		return copied
+	case []any:
+		copied := make([]any, len(node))
+		for i, element := range node {
+			copied[i] = deepCopy(element)
+		}
+		return copied
+	default:
+		return value
+	}
+}
+
+// sqlPatchByID constructs the SQL query that writes the patched attributes of
+// an object only if its version is still the one that was patched.
+func sqlPatchByID(tableName string) string {
+	query := `UPDATE %s SET updated_at = ?, version = ?, attributes = ?, hlc = ? WHERE id = ? AND version = ?`
+	return fmt.Sprintf(query, tableName)
+}
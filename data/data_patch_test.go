@@ -0,0 +1,134 @@
+package data
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergePatch(t *testing.T) {
+	tables, err := NewTables(newTestDatabase(t))
+	assert.NoError(t, err)
+	obj := Object{ID: "d1", OwnerID: "org1", Version: 1, Attributes: map[string]any{
+		"hostname": "web-1",
+		"os":       map[string]any{"name": "debian", "version": "11"},
+		"tags":     []any{"web"},
+	}}
+	assert.NoError(t, tables.Insert("device", obj))
+
+	patched, err := tables.Patch("device", "d1", MergePatch, []byte(`{"os": {"version": "12", "kernel": "6.1"}, "tags": ["web", "prod"], "hostname": null}`))
+	assert.NoError(t, err)
+	expected := map[string]any{
+		"os":   map[string]any{"name": "debian", "version": "12", "kernel": "6.1"},
+		"tags": []any{"web", "prod"},
+	}
+	assert.Equal(t, expected, patched.Attributes)
+	assert.Equal(t, 2, patched.Version)
+
+	stored, err := tables.GetByID("device", "d1")
+	assert.NoError(t, err)
+	assert.Equal(t, expected, stored.Attributes)
+	assert.Equal(t, 2, stored.Version)
+	assert.False(t, stored.UpdatedAt.IsZero())
+
+	_, err = tables.Patch("device", "d1", MergePatch, []byte(`["not", "an", "object"]`))
+	assert.ErrorIs(t, err, ErrInvalidPatch)
+	_, err = tables.Patch("device", "d1", MergePatch, []byte(`{`))
+	assert.ErrorIs(t, err, ErrInvalidPatch)
+	_, err = tables.Patch("device", "d1", "text/plain", []byte(`{}`))
+	assert.ErrorIs(t, err, ErrInvalidPatch)
+	_, err = tables.Patch("device", "missing", MergePatch, []byte(`{}`))
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+func TestJSONPatch(t *testing.T) {
+	tables, err := NewTables(newTestDatabase(t))
+	assert.NoError(t, err)
+	obj := Object{ID: "d1", OwnerID: "org1", Version: 1, Attributes: map[string]any{
+		"hostname": "web-1",
+		"os":       map[string]any{"name": "debian", "version": "11"},
+		"tags":     []any{"web", "prod"},
+		"a/b":      "escaped",
+	}}
+	assert.NoError(t, tables.Insert("device", obj))
+
+	patched, err := tables.Patch("device", "d1", JSONPatch, []byte(`[
+		{"op": "test", "path": "/os/version", "value": "11"},
+		{"op": "replace", "path": "/os/version", "value": "12"},
+		{"op": "add", "path": "/tags/1", "value": "eu"},
+		{"op": "add", "path": "/tags/-", "value": "last"},
+		{"op": "remove", "path": "/tags/0"},
+		{"op": "copy", "from": "/hostname", "path": "/name"},
+		{"op": "move", "from": "/a~1b", "path": "/moved"},
+		{"op": "add", "path": "/cpus", "value": null}
+	]`))
+	assert.NoError(t, err)
+	expected := map[string]any{
+		"hostname": "web-1",
+		"name":     "web-1",
+		"os":       map[string]any{"name": "debian", "version": "12"},
+		"tags":     []any{"eu", "prod", "last"},
+		"moved":    "escaped",
+		"cpus":     nil,
+	}
+	assert.Equal(t, expected, patched.Attributes)
+
+	// A failed test or operation leaves the object unchanged.
+	for patch, expectedErr := range map[string]error{
+		`[{"op": "replace", "path": "/hostname", "value": "web-2"}, {"op": "test", "path": "/os/version", "value": "11"}]`: ErrPatchTestFailed,
+		`[{"op": "replace", "path": "/hostname", "value": "web-2"}, {"op": "test", "path": "/missing", "value": 1}]`:       ErrPatchTestFailed,
+		`[{"op": "replace", "path": "/hostname", "value": "web-2"}, {"op": "remove", "path": "/missing"}]`:                 ErrInvalidPatch,
+		`[{"op": "add", "path": "/tags/9", "value": "x"}]`:                                                                 ErrInvalidPatch,
+		`[{"op": "add", "path": "", "value": []}]`:                                                                         ErrInvalidPatch,
+		`[{"op": "move", "from": "/os", "path": "/os/name"}]`:                                                              ErrInvalidPatch,
+		`[{"op": "add", "path": "/hostname"}]`:                                                                             ErrInvalidPatch,
+		`[{"op": "increment", "path": "/cpus"}]`:                                                                           ErrInvalidPatch,
+		`[{"op": "remove", "path": "hostname"}]`:                                                                           ErrInvalidPatch,
+	} {
+		_, err := tables.Patch("device", "d1", JSONPatch, []byte(patch))
+		assert.ErrorIs(t, err, expectedErr, patch)
+	}
+	stored, err := tables.GetByID("device", "d1")
+	assert.NoError(t, err)
+	assert.Equal(t, expected, stored.Attributes)
+	assert.Equal(t, 2, stored.Version)
+
+	// The test operation compares values, not their encoding.
+	_, err = tables.Patch("device", "d1", JSONPatch, []byte(`[{"op": "test", "path": "/os", "value": {"version": "12", "name": "debian"}}]`))
+	assert.NoError(t, err)
+}
+
+func TestPatchSensitiveAttributes(t *testing.T) {
+	db := newTestDatabase(t)
+	tables, _ := newEncryptedTables(t, db)
+	admin := Object{ID: "a1", OwnerID: "org1", Version: 1, Attributes: map[string]any{"email": "admin@example.com", "password": "old"}}
+	assert.NoError(t, tables.Insert("admin", admin))
+
+	patched, err := tables.Patch("admin", "a1", JSONPatch, []byte(`[{"op": "test", "path": "/password", "value": "old"}, {"op": "replace", "path": "/password", "value": "new"}]`))
+	assert.NoError(t, err)
+	assert.Equal(t, "new", patched.Attributes["password"])
+	assert.NotEqual(t, "new", storedAttribute(t, db, "admin", "a1", "password"))
+
+	stored, err := tables.GetByID("admin", "a1")
+	assert.NoError(t, err)
+	assert.Equal(t, "new", stored.Attributes["password"])
+}
+
+func TestPatchWithKeyOfAnotherInstance(t *testing.T) {
+	db := newTestDatabase(t)
+	tables, masterKey := newEncryptedTables(t, db)
+	other, err := NewTables(db)
+	assert.NoError(t, err)
+	assert.NoError(t, other.EnableEncryption(masterKey))
+
+	// The data key of org1 is created by the other instance, so the keys are
+	// loaded in the write transaction of the patch on its single connection.
+	admin := Object{ID: "a1", OwnerID: "org1", Version: 1, Attributes: map[string]any{"email": "admin@example.com", "password": "old"}}
+	assert.NoError(t, other.Insert("admin", admin))
+
+	patched, err := tables.Patch("admin", "a1", MergePatch, []byte(`{"email": "new@example.com"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "old", patched.Attributes["password"])
+	assert.Equal(t, "new@example.com", patched.Attributes["email"])
+}
@@ -0,0 +1,149 @@
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/jrpalma/linuxfleet/ratelimit"
+)
+
+// rateLimitSweepInterval is how often the full buckets are deleted.
+const rateLimitSweepInterval = time.Minute
+
+// RateLimitStore holds the token buckets of the rate limits in a SQLite
+// database of their own, so that taking a token never waits for the writes of
+// the data tables. The server instances that open the same rate limit
+// database file share the limits; the instances on other hosts or with
+// another file each keep their own. Every request is a write transaction that
+// reads and charges all of its buckets, so that concurrent requests cannot
+// take the same token and a rejected request is charged nothing. The buckets
+// are not replicated, so that taking a token does not wait for the followers
+// and works on every node of a cluster.
+type RateLimitStore struct {
+	db *sql.DB
+
+	mu    sync.Mutex
+	swept time.Time
+}
+
+// OpenRateLimitStore opens the rate limit database file, creating it if
+// needed. The in-memory database ":memory:" is only seen by the store.
+func OpenRateLimitStore(filename string) (*RateLimitStore, error) {
+	dsn := filename
+	if filename != ":memory:" {
+		options := DefaultDatabaseOptions()
+		dsn = databaseDSN(filename, options, url.Values{
+			"_journal_mode": {"WAL"},
+			"_synchronous":  {"NORMAL"},
+			"_txlock":       {"immediate"},
+		})
+	}
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	store, err := NewRateLimitStore(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// NewRateLimitStore creates a rate limit store in the database, which should
+// not be the database of the data tables.
+func NewRateLimitStore(db *sql.DB) (*RateLimitStore, error) {
+	_, err := db.Exec(sqlCreateRateLimitTable())
+	if err != nil {
+		return nil, err
+	}
+	return &RateLimitStore{db: db}, nil
+}
+
+// Take takes a token from the buckets of the requests at now, or from none of
+// them, see ratelimit.TakeAll. The buckets that are full again are deleted from
+// time to time, since a missing bucket is full.
+func (s *RateLimitStore) Take(requests []ratelimit.Request, now time.Time) ([]ratelimit.Result, error) {
+	err := s.sweep(now)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	buckets := make([]ratelimit.Bucket, len(requests))
+	limits := make([]ratelimit.Limit, len(requests))
+	for i, request := range requests {
+		var updated int64
+		err = tx.QueryRow(sqlGetRateLimit(), request.Key).Scan(&buckets[i].Tokens, &updated)
+		if err == nil {
+			buckets[i].Updated = time.Unix(0, updated)
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		limits[i] = request.Limit
+	}
+
+	buckets, results := ratelimit.TakeAll(buckets, limits, now)
+	for i, request := range requests {
+		full := now.Add(results[i].Reset)
+		_, err = tx.Exec(sqlUpsertRateLimit(), request.Key, buckets[i].Tokens, buckets[i].Updated.UnixNano(), full.UnixNano())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, tx.Commit()
+}
+
+// Close closes the database of the store.
+func (s *RateLimitStore) Close() error {
+	return s.db.Close()
+}
+
+// sweep deletes the full buckets once per sweep interval.
+func (s *RateLimitStore) sweep(now time.Time) error {
+	s.mu.Lock()
+	if now.Sub(s.swept) < rateLimitSweepInterval {
+		s.mu.Unlock()
+		return nil
+	}
+	s.swept = now
+	s.mu.Unlock()
+
+	_, err := s.db.Exec(sqlDeleteFullRateLimits(), now.UnixNano())
+	return err
+}
+
+func sqlCreateRateLimitTable() string {
+	return `
+	CREATE TABLE IF NOT EXISTS rate_limit (
+		key TEXT PRIMARY KEY,
+		tokens REAL NOT NULL,
+		updated_at INTEGER NOT NULL,
+		full_at INTEGER NOT NULL
+	) WITHOUT ROWID;
+	CREATE INDEX IF NOT EXISTS idx_rate_limit_full_at ON rate_limit(full_at);
+	`
+}
+
+func sqlGetRateLimit() string {
+	return `SELECT tokens, updated_at FROM rate_limit WHERE key = ?`
+}
+
+func sqlUpsertRateLimit() string {
+	return `
+	INSERT INTO rate_limit (key, tokens, updated_at, full_at) VALUES (?, ?, ?, ?)
+	ON CONFLICT (key) DO UPDATE SET tokens = excluded.tokens, updated_at = excluded.updated_at, full_at = excluded.full_at`
+}
+
+func sqlDeleteFullRateLimits() string {
+	return `DELETE FROM rate_limit WHERE full_at <= ?`
+}
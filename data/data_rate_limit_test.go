@@ -0,0 +1,58 @@
+package data
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jrpalma/linuxfleet/ratelimit"
+)
+
+func TestRateLimitStore(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "linuxfleet.db-ratelimit")
+	// Two stores on the same database file share the buckets, like two servers.
+	first, err := OpenRateLimitStore(filename)
+	assert.NoError(t, err)
+	t.Cleanup(func() { first.Close() })
+	second, err := OpenRateLimitStore(filename)
+	assert.NoError(t, err)
+	t.Cleanup(func() { second.Close() })
+	limit := ratelimit.Every(2, time.Second, 2)
+	now := time.Unix(1000, 0)
+	take := func(store *RateLimitStore, now time.Time, keys ...string) []ratelimit.Result {
+		var requests []ratelimit.Request
+		for _, key := range keys {
+			requests = append(requests, ratelimit.Request{Key: key, Limit: limit})
+		}
+		results, err := store.Take(requests, now)
+		assert.NoError(t, err)
+		return results
+	}
+
+	for i, expected := range []bool{true, true, false} {
+		store := first
+		if i%2 == 1 {
+			store = second
+		}
+		assert.Equal(t, expected, take(store, now, "ip:192.0.2.1")[0].Allowed, i)
+	}
+	assert.True(t, take(first, now, "ip:192.0.2.2")[0].Allowed)
+	assert.True(t, take(second, now.Add(500*time.Millisecond), "ip:192.0.2.1")[0].Allowed)
+
+	// A request rejected by one of its buckets takes no token from the others.
+	results := take(first, now.Add(500*time.Millisecond), "ip:192.0.2.1", "admin:a1")
+	assert.False(t, results[0].Allowed)
+	assert.True(t, results[1].Allowed)
+	assert.Equal(t, 2, results[1].Remaining)
+	results = take(second, now.Add(500*time.Millisecond), "admin:a1")
+	assert.True(t, results[0].Allowed)
+	assert.Equal(t, 1, results[0].Remaining)
+
+	// The full buckets are deleted when the store sweeps them.
+	take(first, now.Add(time.Hour), "ip:192.0.2.3")
+	var count int
+	assert.NoError(t, first.db.QueryRow(`SELECT COUNT(*) FROM rate_limit`).Scan(&count))
+	assert.Equal(t, 1, count)
+}
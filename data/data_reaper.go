@@ -0,0 +1,116 @@
+package data
+
+import (
+	"time"
+)
+
+// ExpiryEvent is emitted by the reaper for every object it removes.
+type ExpiryEvent struct {
+	Table    string
+	Object   Object
+	Archived bool
+}
+
+// ReaperOptions configures how often and how much the reaper removes.
+type ReaperOptions struct {
+	// Interval is the time between two sweeps over the data tables.
+	Interval time.Duration
+	// BatchSize is the maximum number of objects removed per transaction.
+	BatchSize int
+	// Archive copies expired objects to <table>_archive instead of only deleting them.
+	Archive bool
+	// OnExpire is called for every removed object. It may be nil.
+	OnExpire func(ExpiryEvent)
+	// OnError is called when a sweep fails. It may be nil.
+	OnError func(tableName string, err error)
+}
+
+// DefaultReaperOptions returns the options used when none are configured.
+func DefaultReaperOptions() ReaperOptions {
+	return ReaperOptions{
+		Interval:  time.Minute,
+		BatchSize: 100,
+	}
+}
+
+// Reaper is a background worker that removes expired objects from every data table.
+type Reaper struct {
+	worker
+	tables  *Tables
+	options ReaperOptions
+}
+
+// NewReaper creates a reaper for the data tables. Call Start to run it.
+func NewReaper(tables *Tables, options ReaperOptions) *Reaper {
+	defaults := DefaultReaperOptions()
+	if options.Interval <= 0 {
+		options.Interval = defaults.Interval
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = defaults.BatchSize
+	}
+	return &Reaper{
+		worker:  newWorker(),
+		tables:  tables,
+		options: options,
+	}
+}
+
+// Start runs the reaper in its own goroutine until Stop is called.
+func (r *Reaper) Start() {
+	r.start(r.run)
+}
+
+func (r *Reaper) run() {
+	ticker := time.NewTicker(r.options.Interval)
+	defer ticker.Stop()
+
+	for {
+		r.Sweep(NowTimestamp())
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sweep removes the objects expired at now from every data table and returns how many were removed.
+func (r *Reaper) Sweep(now Timestamp) int {
+	removed := 0
+	// Only the replication leader writes; the followers apply its deletions.
+	if r.tables.Writable() != nil {
+		return removed
+	}
+	for _, tableName := range dataTableList() {
+		count, err := r.ReapTable(tableName, now)
+		removed += count
+		if err != nil && r.options.OnError != nil {
+			r.options.OnError(tableName, err)
+		}
+	}
+	return removed
+}
+
+// ReapTable removes the objects expired at now from one table in batches until none are left
+// or the reaper is stopped.
+func (r *Reaper) ReapTable(tableName string, now Timestamp) (int, error) {
+	removed := 0
+	for {
+		objects, err := r.tables.DeleteExpired(tableName, now, r.options.BatchSize, r.options.Archive)
+		if err != nil {
+			return removed, err
+		}
+
+		removed += len(objects)
+		for _, obj := range objects {
+			if r.options.OnExpire != nil {
+				r.options.OnExpire(ExpiryEvent{Table: tableName, Object: obj, Archived: r.options.Archive})
+			}
+		}
+
+		if len(objects) < r.options.BatchSize || r.stopping() {
+			return removed, nil
+		}
+	}
+}
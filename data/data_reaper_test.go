@@ -0,0 +1,91 @@
+package data
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReapTable(t *testing.T) {
+	table, err := NewTables(db)
+	assert.NoError(t, err)
+
+	for _, tableName := range dataTableList() {
+		ownerID := uuid.NewString()
+		expired := Object{ID: uuid.NewString(), OwnerID: ownerID, Version: 1, ExpiresAt: TimestampAfter(-time.Hour)}
+		live := Object{ID: uuid.NewString(), OwnerID: ownerID, Version: 1, ExpiresAt: TimestampAfter(time.Hour)}
+		forever := Object{ID: uuid.NewString(), OwnerID: ownerID, Version: 1}
+		for _, obj := range []Object{expired, live, forever} {
+			assert.NoError(t, table.Insert(tableName, obj))
+		}
+
+		var events []ExpiryEvent
+		reaper := NewReaper(table, ReaperOptions{BatchSize: 1, OnExpire: func(e ExpiryEvent) { events = append(events, e) }})
+		removed, err := reaper.ReapTable(tableName, NowTimestamp())
+		assert.NoError(t, err)
+		assert.Equal(t, 1, removed)
+		assert.Len(t, events, 1)
+		assert.Equal(t, expired.ID, events[0].Object.ID)
+		assert.False(t, events[0].Archived)
+
+		_, err = table.GetByID(tableName, expired.ID)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+
+		remaining, err := table.ListByOwner(tableName, ownerID)
+		assert.NoError(t, err)
+		assert.Len(t, remaining, 2)
+	}
+}
+
+func TestReapTableArchive(t *testing.T) {
+	table, err := NewTables(db)
+	assert.NoError(t, err)
+
+	ownerID := uuid.NewString()
+	for i := 0; i < 5; i++ {
+		obj := Object{ID: uuid.NewString(), OwnerID: ownerID, Version: 1, ExpiresAt: TimestampAfter(-time.Minute)}
+		assert.NoError(t, table.Insert("registration", obj))
+	}
+
+	reaper := NewReaper(table, ReaperOptions{BatchSize: 2, Archive: true})
+	removed, err := reaper.ReapTable("registration", NowTimestamp())
+	assert.NoError(t, err)
+	assert.Equal(t, 5, removed)
+
+	remaining, err := table.ListByOwner("registration", ownerID)
+	assert.NoError(t, err)
+	assert.Len(t, remaining, 0)
+
+	archived, err := table.ListArchived("registration", ownerID)
+	assert.NoError(t, err)
+	assert.Len(t, archived, 5)
+}
+
+func TestReaperStartStop(t *testing.T) {
+	table, err := NewTables(db)
+	assert.NoError(t, err)
+
+	obj := Object{ID: uuid.NewString(), OwnerID: uuid.NewString(), Version: 1, ExpiresAt: TimestampAfter(-time.Second)}
+	assert.NoError(t, table.Insert("device", obj))
+
+	expired := make(chan ExpiryEvent, 1)
+	reaper := NewReaper(table, ReaperOptions{
+		Interval: 10 * time.Millisecond,
+		OnExpire: func(e ExpiryEvent) { expired <- e },
+	})
+	reaper.Start()
+
+	select {
+	case event := <-expired:
+		assert.Equal(t, "device", event.Table)
+		assert.Equal(t, obj.ID, event.Object.ID)
+	case <-time.After(time.Second):
+		t.Fatal("the reaper did not expire the object")
+	}
+
+	reaper.Stop()
+	reaper.Stop()
+}
@@ -0,0 +1,23 @@
+package data
+
+import "time"
+
+// RegistrationTable stores the administrator registrations waiting to be completed.
+var RegistrationTable = RegisterTable(TableDefinition{
+	Name:      "registration",
+	Sensitive: []string{"password", "salt"},
+})
+
+// Registration is a pending registration stored in RegistrationTable.
+type Registration struct {
+	ID        string     `data:"id,meta"`
+	ExpiresAt *Timestamp `data:"expires_at,meta"`
+	Email     string     `data:"email"`
+	Password  string     `data:"password"`
+	Salt      string     `data:"salt"`
+}
+
+// IsExpired reports whether the registration expired at or before now.
+func (registration Registration) IsExpired(now time.Time) bool {
+	return Object{ExpiresAt: registration.ExpiresAt}.IsExpired(now)
+}
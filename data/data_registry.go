@@ -0,0 +1,89 @@
+package data
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sync"
+)
+
+// tableNamePattern matches the names accepted by RegisterTable. Table names are
+// formatted into SQL statements, so nothing else is allowed.
+var tableNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// TableDefinition describes a data table and the features enabled on it.
+type TableDefinition struct {
+	// Name is the SQL name of the table.
+	Name string
+	// Sensitive lists the attributes stored encrypted when encryption is enabled.
+	Sensitive []string
+	// Indexes lists the attribute paths kept in generated columns with an index.
+	Indexes []AttributeIndex
+	// Searchable keeps a full-text index of the attribute values.
+	Searchable bool
+}
+
+var registry struct {
+	mu     sync.RWMutex
+	tables []TableDefinition
+}
+
+// RegisterTable adds a table to the ones created and migrated by NewTables and
+// returns its definition. It is meant to be called while initializing package
+// variables and panics when the name is invalid or already registered.
+func RegisterTable(definition TableDefinition) TableDefinition {
+	if !tableNamePattern.MatchString(definition.Name) {
+		panic(fmt.Sprintf("data: invalid table name %q", definition.Name))
+	}
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	for _, registered := range registry.tables {
+		if registered.Name == definition.Name {
+			panic(fmt.Sprintf("data: table %q registered twice", definition.Name))
+		}
+	}
+	registry.tables = append(registry.tables, definition)
+	return definition
+}
+
+// lookupTable returns the definition of a registered table, or a zero definition
+// when there is none.
+func lookupTable(tableName string) TableDefinition {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	for _, definition := range registry.tables {
+		if definition.Name == tableName {
+			return definition
+		}
+	}
+	return TableDefinition{}
+}
+
+// dataTableList returns the names of the registered tables in registration order.
+func dataTableList() []string {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	names := make([]string, len(registry.tables))
+	for i, definition := range registry.tables {
+		names[i] = definition.Name
+	}
+	return names
+}
+
+// searchableTableList returns the registered tables with a full-text index.
+func searchableTableList() []string {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	var names []string
+	for _, definition := range registry.tables {
+		if definition.Searchable {
+			names = append(names, definition.Name)
+		}
+	}
+	return names
+}
+
+func isDataTable(tableName string) bool {
+	return slices.Contains(dataTableList(), tableName)
+}
@@ -0,0 +1,430 @@
+package data
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrNotLeader is returned by writes on a replicated node that cannot accept them.
+var ErrNotLeader = errors.New("data: not the replication leader")
+
+// ErrUnknownStatement is returned for a replicated statement that is not one
+// of the writes made by the data tables.
+var ErrUnknownStatement = errors.New("data: unknown replicated statement")
+
+// Replicator commits the writes of the data tables on a cluster of nodes.
+type Replicator interface {
+	// Writable returns nil when this node accepts writes, or an error wrapping
+	// ErrNotLeader when it does not.
+	Writable() error
+	// Replicate appends the statements of a transaction to the replicated log
+	// and calls commit with the log index once a majority of the nodes stored
+	// them. It returns the error of commit, or an error without calling commit
+	// when the statements could not be committed.
+	Replicate(statements []Statement, commit func(index uint64) error) error
+}
+
+// Statement is a SQL statement written to the database and its arguments.
+type Statement struct {
+	SQL  string     `json:"sql"`
+	Args []Argument `json:"args,omitempty"`
+}
+
+// ArgumentKind is the SQLite storage class of a statement argument.
+type ArgumentKind string
+
+const (
+	ArgumentNull    ArgumentKind = "null"
+	ArgumentInteger ArgumentKind = "integer"
+	ArgumentReal    ArgumentKind = "real"
+	ArgumentText    ArgumentKind = "text"
+	ArgumentBlob    ArgumentKind = "blob"
+)
+
+// Argument is a statement argument that keeps its storage class when it is
+// encoded to JSON, so that replayed statements store the same values.
+type Argument struct {
+	Kind    ArgumentKind `json:"kind"`
+	Integer int64        `json:"integer,omitempty"`
+	Real    float64      `json:"real,omitempty"`
+	Text    string       `json:"text,omitempty"`
+	Blob    []byte       `json:"blob,omitempty"`
+}
+
+// newArgument converts a query argument as database/sql would before it reaches the driver.
+func newArgument(arg any) (Argument, error) {
+	value, err := driver.DefaultParameterConverter.ConvertValue(arg)
+	if err != nil {
+		return Argument{}, err
+	}
+	switch v := value.(type) {
+	case nil:
+		return Argument{Kind: ArgumentNull}, nil
+	case int64:
+		return Argument{Kind: ArgumentInteger, Integer: v}, nil
+	case bool:
+		if v {
+			return Argument{Kind: ArgumentInteger, Integer: 1}, nil
+		}
+		return Argument{Kind: ArgumentInteger}, nil
+	case float64:
+		return Argument{Kind: ArgumentReal, Real: v}, nil
+	case string:
+		return Argument{Kind: ArgumentText, Text: v}, nil
+	case []byte:
+		return Argument{Kind: ArgumentBlob, Blob: v}, nil
+	default:
+		return Argument{}, fmt.Errorf("data: cannot replicate argument of type %T", arg)
+	}
+}
+
+// Value returns the argument as a query argument.
+func (a Argument) Value() any {
+	switch a.Kind {
+	case ArgumentInteger:
+		return a.Integer
+	case ArgumentReal:
+		return a.Real
+	case ArgumentText:
+		return a.Text
+	case ArgumentBlob:
+		if a.Blob == nil {
+			return []byte{}
+		}
+		return a.Blob
+	default:
+		return nil
+	}
+}
+
+// SetReplicator routes every write through the replicator. Writes fail with
+// ErrNotLeader unless the replicator accepts them, and the statements they
+// execute are replayed on the other nodes with ApplyReplicated. Schema changes
+// made by NewTables and EnableEncryption stay local, since every node makes them.
+// It must be called before the tables are used.
+func (table *Tables) SetReplicator(replicator Replicator) {
+	table.writer.replicator = replicator
+}
+
+// Writable returns nil when writes are accepted, or an error wrapping
+// ErrNotLeader when the tables are replicated and this node is not the leader.
+func (table *Tables) Writable() error {
+	if table.writer.replicator == nil {
+		return nil
+	}
+	return table.writer.replicator.Writable()
+}
+
+// AppliedIndex returns the index of the last replicated log entry written to the tables.
+func (table *Tables) AppliedIndex() (uint64, error) {
+	var index uint64
+	err := table.writer.db.QueryRow(sqlAppliedIndex()).Scan(&index)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return index, err
+}
+
+// ApplyReplicated executes the statements of a committed log entry made on
+// another node and records its index in the same transaction. Entries at or
+// below the applied index are skipped, and entries with a statement that the
+// data tables do not make fail with ErrUnknownStatement before any is executed.
+func (table *Tables) ApplyReplicated(index uint64, statements []Statement) error {
+	table.writer.mu.Lock()
+	defer table.writer.mu.Unlock()
+
+	tx, err := table.writer.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var applied uint64
+	err = tx.QueryRow(sqlAppliedIndex()).Scan(&applied)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if index <= applied {
+		return nil
+	}
+
+	for _, statement := range statements {
+		if !table.writer.statements[statement.SQL] {
+			return fmt.Errorf("data: apply log entry %d: %w: %.80q", index, ErrUnknownStatement, statement.SQL)
+		}
+	}
+	for _, statement := range statements {
+		args := make([]any, len(statement.Args))
+		for i, arg := range statement.Args {
+			args[i] = arg.Value()
+		}
+		_, err := tx.Exec(statement.SQL, args...)
+		if err != nil {
+			return fmt.Errorf("data: apply log entry %d: %w", index, err)
+		}
+	}
+	_, err = tx.Exec(sqlSetAppliedIndex(), index)
+	if err != nil {
+		return err
+	}
+	// The clock of a follower must stay ahead of the leader's for the
+	// writes it makes once it is elected.
+	err = table.observeHLCs(tx)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// tableWriter executes the writes of the data tables. Without a replicator the
+// writes go straight to the database. With one, the statements of every write
+// transaction are recorded and committed through the replicator, one
+// transaction at a time so that the log order is the commit order.
+type tableWriter struct {
+	db         *sql.DB
+	mu         sync.Mutex
+	replicator Replicator
+	// statements is the set of statements that may be replicated, see replicatedStatements.
+	statements map[string]bool
+}
+
+// Exec executes one statement in its own transaction.
+func (w *tableWriter) Exec(query string, args ...any) (sql.Result, error) {
+	if w.replicator == nil {
+		return w.db.Exec(query, args...)
+	}
+	tx, err := w.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return result, tx.Commit()
+}
+
+// Begin starts a write transaction.
+func (w *tableWriter) Begin() (*writeTx, error) {
+	replicator := w.replicator
+	if replicator != nil {
+		err := replicator.Writable()
+		if err != nil {
+			return nil, err
+		}
+		w.mu.Lock()
+	}
+	tx, err := w.db.Begin()
+	if err != nil {
+		if replicator != nil {
+			w.mu.Unlock()
+		}
+		return nil, err
+	}
+	return &writeTx{tx: tx, writer: w, replicator: replicator}, nil
+}
+
+// writeTx is a write transaction that records its statements when the tables
+// are replicated.
+type writeTx struct {
+	tx         *sql.Tx
+	writer     *tableWriter
+	replicator Replicator
+	statements []Statement
+	finished   bool
+
+	// keys holds the data keys created in the transaction by organization,
+	// and onCommit the functions that run once the transaction is committed.
+	keys     map[string]dataKey
+	onCommit []func()
+}
+
+// Exec executes a statement in the transaction.
+func (t *writeTx) Exec(query string, args ...any) (sql.Result, error) {
+	result, err := t.tx.Exec(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return result, t.record(query, args)
+}
+
+// Query runs a query in the transaction. Queries are not replicated.
+func (t *writeTx) Query(query string, args ...any) (*sql.Rows, error) {
+	return t.tx.Query(query, args...)
+}
+
+// QueryRow runs a query returning one row in the transaction. Queries are not replicated.
+func (t *writeTx) QueryRow(query string, args ...any) *sql.Row {
+	return t.tx.QueryRow(query, args...)
+}
+
+// Prepare creates a prepared statement executed in the transaction.
+func (t *writeTx) Prepare(query string) (*writeStmt, error) {
+	stmt, err := t.tx.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return &writeStmt{stmt: stmt, tx: t, query: query}, nil
+}
+
+// Commit commits the transaction, through the replicator when there is one.
+func (t *writeTx) Commit() error {
+	if t.finished {
+		return sql.ErrTxDone
+	}
+	defer t.finish()
+
+	var err error
+	if t.replicator == nil || len(t.statements) == 0 {
+		err = t.tx.Commit()
+	} else {
+		err = t.replicator.Replicate(t.statements, func(index uint64) error {
+			_, err := t.tx.Exec(sqlSetAppliedIndex(), index)
+			if err != nil {
+				return err
+			}
+			return t.tx.Commit()
+		})
+	}
+	if err != nil {
+		return err
+	}
+	for _, fn := range t.onCommit {
+		fn()
+	}
+	return nil
+}
+
+// Rollback aborts the transaction. It does nothing after Commit.
+func (t *writeTx) Rollback() error {
+	if t.finished {
+		return nil
+	}
+	defer t.finish()
+	return t.tx.Rollback()
+}
+
+func (t *writeTx) finish() {
+	if t.finished {
+		return
+	}
+	t.finished = true
+	// A failed replication leaves the transaction open.
+	t.tx.Rollback()
+	if t.replicator != nil {
+		t.writer.mu.Unlock()
+	}
+}
+
+func (t *writeTx) record(query string, args []any) error {
+	if t.replicator == nil {
+		return nil
+	}
+	if !t.writer.statements[query] {
+		return fmt.Errorf("%w: %.80q", ErrUnknownStatement, query)
+	}
+	statement := Statement{SQL: query, Args: make([]Argument, len(args))}
+	for i, arg := range args {
+		converted, err := newArgument(arg)
+		if err != nil {
+			return err
+		}
+		statement.Args[i] = converted
+	}
+	t.statements = append(t.statements, statement)
+	return nil
+}
+
+// writeStmt is a prepared statement of a write transaction.
+type writeStmt struct {
+	stmt  *sql.Stmt
+	tx    *writeTx
+	query string
+}
+
+// Exec executes the prepared statement with the arguments.
+func (s *writeStmt) Exec(args ...any) (sql.Result, error) {
+	result, err := s.stmt.Exec(args...)
+	if err != nil {
+		return nil, err
+	}
+	return result, s.tx.record(s.query, args)
+}
+
+// Close closes the prepared statement.
+func (s *writeStmt) Close() error {
+	return s.stmt.Close()
+}
+
+// replicatedStatements returns the set of statements executed by the writes of
+// the data tables. Followers only apply log entries made of these statements,
+// so that a log entry cannot run arbitrary SQL.
+func replicatedStatements() map[string]bool {
+	statements := map[string]bool{}
+	for _, query := range []string{
+		sqlAddGroupMember(),
+		sqlRemoveGroupMember(),
+		sqlGrant(),
+		sqlRevoke(),
+		sqlInsertDataKey(),
+		sqlDeactivateDataKeys(),
+		sqlUpdateWrappedKey(),
+		sqlClaimIdempotencyKey(),
+		sqlCompleteIdempotencyKey(),
+		sqlDeleteIdempotencyKey(),
+		sqlDeleteExpiredIdempotencyKeys(),
+		sqlInsertMetricSeries(),
+		sqlInsertMetricSample(),
+		sqlRollupMetrics(MetricFiveMinutes, MetricRaw),
+		sqlRollupMetrics(MetricHourly, MetricFiveMinutes),
+		sqlSetMetricRollupState(),
+		sqlDeleteMetricSamples(),
+		sqlDeleteMetricRollups(),
+		sqlDeleteUnusedMetricSeries(),
+		sqlAcceptTOTPStep(),
+	} {
+		statements[query] = true
+	}
+	for _, tableName := range dataTableList() {
+		for _, query := range []string{
+			sqlInsert(tableName),
+			sqlUpsert(tableName),
+			sqlBatchUpsert(tableName),
+			sqlUpdateByID(tableName),
+			sqlPatchByID(tableName),
+			sqlReplaceAttributes(tableName),
+			sqlDeleteByID(tableName),
+			sqlDeleteAll(tableName),
+			sqlCreateArchiveTable(tableName),
+			sqlArchiveByID(tableName),
+		} {
+			statements[query] = true
+		}
+	}
+	for _, tableName := range searchableTableList() {
+		statements[sqlClearSearchTable(tableName)] = true
+		statements[sqlFillSearchTable(tableName)] = true
+	}
+	return statements
+}
+
+func sqlCreateReplicationStateTable() string {
+	return `CREATE TABLE IF NOT EXISTS replication_state (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		applied_index INTEGER NOT NULL
+	)`
+}
+
+func sqlAppliedIndex() string {
+	return `SELECT applied_index FROM replication_state WHERE id = 1`
+}
+
+func sqlSetAppliedIndex() string {
+	return `INSERT INTO replication_state (id, applied_index) VALUES (1, ?)
+	ON CONFLICT(id) DO UPDATE SET applied_index = excluded.applied_index`
+}
@@ -0,0 +1,122 @@
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// loopbackReplicator commits every entry and applies it to a second set of tables.
+type loopbackReplicator struct {
+	follower *Tables
+	index    uint64
+	leader   bool
+}
+
+func (r *loopbackReplicator) Writable() error {
+	if !r.leader {
+		return ErrNotLeader
+	}
+	return nil
+}
+
+func (r *loopbackReplicator) Replicate(statements []Statement, commit func(index uint64) error) error {
+	r.index++
+	err := r.follower.ApplyReplicated(r.index, statements)
+	if err != nil {
+		return err
+	}
+	return commit(r.index)
+}
+
+func TestReplicatedWrites(t *testing.T) {
+	leader, masterKey := newEncryptedTables(t, newTestDatabase(t))
+	follower, err := NewTables(newTestDatabase(t))
+	assert.NoError(t, err)
+	assert.NoError(t, follower.EnableEncryption(masterKey))
+	replicator := &loopbackReplicator{follower: follower, leader: true}
+	leader.SetReplicator(replicator)
+
+	obj := Object{ID: "r1", OwnerID: "org1", Version: 1, Attributes: map[string]any{"email": "a@example.com", "password": "secret"}, ExpiresAt: TimestampAfter(time.Hour)}
+	assert.NoError(t, leader.Insert("registration", obj))
+	assert.NoError(t, leader.UpsertBatch("device", []Object{{ID: "d1", OwnerID: "org1", Version: 1}}))
+	_, err = leader.Patch("device", "d1", MergePatch, []byte(`{"hostname": "d1"}`))
+	assert.NoError(t, err)
+
+	// The follower stores the same bytes, including the encrypted attributes
+	// and the data key that wraps them.
+	for _, query := range []string{
+		"SELECT attributes FROM registration WHERE id = 'r1'",
+		"SELECT wrapped_key FROM data_key",
+		"SELECT created_at FROM device WHERE id = 'd1'",
+		"SELECT attributes || version FROM device WHERE id = 'd1'",
+	} {
+		var expected, actual string
+		assert.NoError(t, leader.db.QueryRow(query).Scan(&expected))
+		assert.NoError(t, follower.db.QueryRow(query).Scan(&actual))
+		assert.Equal(t, expected, actual)
+	}
+
+	applied, err := leader.AppliedIndex()
+	assert.NoError(t, err)
+	assert.Equal(t, replicator.index, applied)
+	applied, err = follower.AppliedIndex()
+	assert.NoError(t, err)
+	assert.Equal(t, replicator.index, applied)
+
+	// The follower continues after the HLCs written by the leader.
+	stored, err := leader.GetByID("device", "d1")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, follower.clock.Now().Compare(stored.HLC))
+
+	// Entries already applied are skipped.
+	assert.NoError(t, follower.ApplyReplicated(1, []Statement{{SQL: "DELETE FROM registration"}}))
+	_, err = follower.GetByID("registration", "r1")
+	assert.NoError(t, err)
+
+	// Entries with statements that the tables do not make are rejected whole.
+	err = follower.ApplyReplicated(replicator.index+1, []Statement{
+		{SQL: sqlDeleteByID("device"), Args: []Argument{{Kind: ArgumentText, Text: "d1"}}},
+		{SQL: "DROP TABLE registration"},
+	})
+	assert.ErrorIs(t, err, ErrUnknownStatement)
+	_, err = follower.GetByID("device", "d1")
+	assert.NoError(t, err)
+
+	replicator.leader = false
+	assert.ErrorIs(t, leader.Insert("device", Object{ID: "d2"}), ErrNotLeader)
+	assert.ErrorIs(t, leader.Writable(), ErrNotLeader)
+	assert.Zero(t, NewReaper(leader, DefaultReaperOptions()).Sweep(NowTimestamp()))
+}
+
+func TestReplicationFailure(t *testing.T) {
+	leader, err := NewTables(newTestDatabase(t))
+	assert.NoError(t, err)
+	leader.SetReplicator(failingReplicator{})
+
+	assert.Error(t, leader.Insert("device", Object{ID: "d1"}))
+	_, err = leader.GetByID("device", "d1")
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+type failingReplicator struct{}
+
+func (failingReplicator) Writable() error { return nil }
+
+func (failingReplicator) Replicate([]Statement, func(uint64) error) error {
+	return errors.New("no quorum")
+}
+
+func TestArgument(t *testing.T) {
+	for _, arg := range []any{nil, 42, int64(-1), 1.5, true, "text", []byte("blob"), NowTimestamp(), (*Timestamp)(nil)} {
+		converted, err := newArgument(arg)
+		assert.NoError(t, err)
+		expected, _ := newArgument(converted.Value())
+		assert.Equal(t, expected, converted)
+	}
+	_, err := newArgument(struct{}{})
+	assert.Error(t, err)
+}
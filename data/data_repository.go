@@ -0,0 +1,255 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Repository stores values of the struct type T as objects of one table.
+//
+// Fields are mapped with the data struct tag. A tag names the attribute the
+// field is stored in, and the omitempty option leaves zero values out of the
+// attributes. Object fields are mapped with the meta option and one of the
+// names id, created_at, updated_at, owner_id, version, expires_at or hlc, for
+// example `data:"id,meta"`. Fields without a tag or tagged with "-" are not
+// stored. Attribute values are converted with encoding/json.
+type Repository[T any] struct {
+	tables     *Tables
+	definition TableDefinition
+	fields     []repositoryField
+	id         []int
+}
+
+type repositoryField struct {
+	name      string
+	index     []int
+	meta      bool
+	omitEmpty bool
+}
+
+// metaFieldTypes are the Object fields that can be mapped with the meta option.
+var metaFieldTypes = map[string]reflect.Type{
+	"id":         reflect.TypeFor[string](),
+	"created_at": reflect.TypeFor[Timestamp](),
+	"updated_at": reflect.TypeFor[Timestamp](),
+	"owner_id":   reflect.TypeFor[string](),
+	"version":    reflect.TypeFor[int](),
+	"expires_at": reflect.TypeFor[*Timestamp](),
+	"hlc":        reflect.TypeFor[HLC](),
+}
+
+// NewRepository creates a repository for the registered table. It panics when T
+// is not a struct with an id meta field or when its data tags are invalid.
+func NewRepository[T any](tables *Tables, definition TableDefinition) *Repository[T] {
+	typ := reflect.TypeFor[T]()
+	if typ.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("data: repository type %v is not a struct", typ))
+	}
+
+	repository := &Repository[T]{tables: tables, definition: definition}
+	seen := map[string]bool{}
+	for _, structField := range reflect.VisibleFields(typ) {
+		tag, ok := structField.Tag.Lookup("data")
+		if !ok || tag == "-" || !structField.IsExported() {
+			continue
+		}
+		field, err := parseRepositoryTag(tag)
+		if err != nil {
+			panic(fmt.Sprintf("data: %v.%s: %v", typ, structField.Name, err))
+		}
+		if field.meta {
+			expected, ok := metaFieldTypes[field.name]
+			if !ok {
+				panic(fmt.Sprintf("data: %v.%s: unknown meta field %q", typ, structField.Name, field.name))
+			}
+			if structField.Type != expected {
+				panic(fmt.Sprintf("data: %v.%s: meta field %s must be %v", typ, structField.Name, field.name, expected))
+			}
+		}
+		key := field.name
+		if field.meta {
+			key = "meta:" + key
+		}
+		if seen[key] {
+			panic(fmt.Sprintf("data: %v.%s: %s is mapped twice", typ, structField.Name, field.name))
+		}
+		seen[key] = true
+
+		field.index = structField.Index
+		if field.meta && field.name == "id" {
+			repository.id = field.index
+		}
+		repository.fields = append(repository.fields, field)
+	}
+	if repository.id == nil {
+		panic(fmt.Sprintf("data: %v has no id meta field", typ))
+	}
+	return repository
+}
+
+func parseRepositoryTag(tag string) (repositoryField, error) {
+	name, options, _ := strings.Cut(tag, ",")
+	field := repositoryField{name: name}
+	if name == "" {
+		return field, fmt.Errorf("empty name in data tag %q", tag)
+	}
+	for option := range strings.SplitSeq(options, ",") {
+		switch option {
+		case "":
+		case "meta":
+			field.meta = true
+		case "omitempty":
+			field.omitEmpty = true
+		default:
+			return field, fmt.Errorf("unknown option %q in data tag %q", option, tag)
+		}
+	}
+	return field, nil
+}
+
+// Get retrieves the value stored with the ID.
+func (repository *Repository[T]) Get(id string) (T, error) {
+	var value T
+	obj, err := repository.tables.GetByID(repository.definition.Name, id)
+	if err != nil {
+		return value, err
+	}
+	return repository.fromObject(obj)
+}
+
+// List retrieves the values of an owner.
+func (repository *Repository[T]) List(ownerID string) ([]T, error) {
+	objects, err := repository.tables.ListByOwner(repository.definition.Name, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	return repository.fromObjects(objects)
+}
+
+// ListByAttribute retrieves the values whose attribute at the dotted path
+// equals value, see Tables.ListByAttribute.
+func (repository *Repository[T]) ListByAttribute(path string, value any) ([]T, error) {
+	objects, err := repository.tables.ListByAttribute(repository.definition.Name, path, value)
+	if err != nil {
+		return nil, err
+	}
+	return repository.fromObjects(objects)
+}
+
+// Insert stores a new value. The version is set to 1 when it is not mapped or zero.
+func (repository *Repository[T]) Insert(value T) error {
+	obj, err := repository.toObject(value)
+	if err != nil {
+		return err
+	}
+	if obj.Version == 0 {
+		obj.Version = 1
+	}
+	return repository.tables.Insert(repository.definition.Name, obj)
+}
+
+// Update overwrites the stored value with the same ID. Object fields that T does
+// not map are stored with their zero value.
+func (repository *Repository[T]) Update(value T) error {
+	obj, err := repository.toObject(value)
+	if err != nil {
+		return err
+	}
+	if obj.Version == 0 {
+		obj.Version = 1
+	}
+	return repository.tables.UpdateByID(repository.definition.Name, obj.ID, obj)
+}
+
+// Delete deletes the value stored with the ID.
+func (repository *Repository[T]) Delete(id string) error {
+	return repository.tables.DeleteByID(repository.definition.Name, id)
+}
+
+// fromObjects converts the objects stored in the table to values.
+func (repository *Repository[T]) fromObjects(objects []Object) ([]T, error) {
+	values := make([]T, 0, len(objects))
+	for _, obj := range objects {
+		value, err := repository.fromObject(obj)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// toObject converts a value to the object stored in the table.
+func (repository *Repository[T]) toObject(value T) (Object, error) {
+	obj := Object{Attributes: map[string]any{}}
+	source := reflect.ValueOf(value)
+	meta := reflect.ValueOf(&obj).Elem()
+	for _, field := range repository.fields {
+		fieldValue := source.FieldByIndex(field.index)
+		if field.meta {
+			meta.FieldByIndex(objectFieldIndex(field.name)).Set(fieldValue)
+			continue
+		}
+		if field.omitEmpty && fieldValue.IsZero() {
+			continue
+		}
+		attribute, err := convertAttribute[any](fieldValue.Interface())
+		if err != nil {
+			return obj, fmt.Errorf("data: attribute %s: %w", field.name, err)
+		}
+		obj.Attributes[field.name] = attribute
+	}
+	return obj, nil
+}
+
+// fromObject converts an object of the table to a value.
+func (repository *Repository[T]) fromObject(obj Object) (T, error) {
+	var value T
+	target := reflect.ValueOf(&value).Elem()
+	meta := reflect.ValueOf(obj)
+	for _, field := range repository.fields {
+		fieldValue := target.FieldByIndex(field.index)
+		if field.meta {
+			fieldValue.Set(meta.FieldByIndex(objectFieldIndex(field.name)))
+			continue
+		}
+		attribute, ok := obj.Attributes[field.name]
+		if !ok || attribute == nil {
+			continue
+		}
+		encoded, err := json.Marshal(attribute)
+		if err != nil {
+			return value, fmt.Errorf("data: attribute %s: %w", field.name, err)
+		}
+		err = json.Unmarshal(encoded, fieldValue.Addr().Interface())
+		if err != nil {
+			return value, fmt.Errorf("data: attribute %s: %w", field.name, err)
+		}
+	}
+	return value, nil
+}
+
+// convertAttribute converts a value to T through its JSON encoding, the same
+// conversion attributes go through when they are stored.
+func convertAttribute[T any](value any) (T, error) {
+	var converted T
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return converted, err
+	}
+	err = json.Unmarshal(encoded, &converted)
+	return converted, err
+}
+
+// objectFieldIndex returns the index of the Object field with the JSON name.
+func objectFieldIndex(name string) []int {
+	for _, field := range reflect.VisibleFields(reflect.TypeFor[Object]()) {
+		jsonName, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if jsonName == name {
+			return field.Index
+		}
+	}
+	panic(fmt.Sprintf("data: Object has no field %s", name))
+}
@@ -0,0 +1,141 @@
+package data
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testDevice struct {
+	ID       string            `data:"id,meta"`
+	OwnerID  string            `data:"owner_id,meta"`
+	Version  int               `data:"version,meta"`
+	Hostname string            `data:"hostname"`
+	OS       testOS            `data:"os"`
+	Labels   map[string]string `data:"labels,omitempty"`
+	Memory   int64             `data:"memory,omitempty"`
+	Ignored  string            `data:"-"`
+	Untagged string
+}
+
+type testOS struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+func TestRepository(t *testing.T) {
+	table, _ := newEncryptedTables(t, newTestDatabase(t))
+	devices := NewRepository[testDevice](table, DeviceTable)
+
+	device := testDevice{
+		ID:       "d1",
+		OwnerID:  "owner1",
+		Hostname: "web-1",
+		OS:       testOS{Name: "debian", Version: "12"},
+		Memory:   1 << 33,
+		Ignored:  "ignored",
+		Untagged: "untagged",
+	}
+	assert.NoError(t, devices.Insert(device))
+	assert.ErrorIs(t, devices.Insert(device), ErrConflict)
+
+	stored, err := devices.Get("d1")
+	assert.NoError(t, err)
+	device.Version = 1
+	device.Ignored = ""
+	device.Untagged = ""
+	assert.Equal(t, device, stored)
+
+	obj, err := table.GetByID("device", "d1")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]any{"name": "debian", "version": "12"}, obj.Attributes["os"])
+	assert.NotContains(t, obj.Attributes, "labels")
+
+	objects, err := table.ListByAttribute("device", "os.name", "debian")
+	assert.NoError(t, err)
+	assert.Len(t, objects, 1)
+
+	stored.Labels = map[string]string{"role": "web"}
+	stored.Version++
+	assert.NoError(t, devices.Update(stored))
+	list, err := devices.List("owner1")
+	assert.NoError(t, err)
+	assert.Equal(t, []testDevice{stored}, list)
+	list, err = devices.ListByAttribute("hostname", "web-1")
+	assert.NoError(t, err)
+	assert.Equal(t, []testDevice{stored}, list)
+
+	assert.NoError(t, devices.Delete("d1"))
+	_, err = devices.Get("d1")
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+func TestRepositorySensitiveAttributes(t *testing.T) {
+	database := newTestDatabase(t)
+	table, _ := newEncryptedTables(t, database)
+	registrations := NewRepository[Registration](table, RegistrationTable)
+
+	registration := Registration{ID: "r1", Email: "user@example.com", Password: "hash", Salt: "salt", ExpiresAt: TimestampAfter(time.Hour)}
+	assert.NoError(t, registrations.Insert(registration))
+	assert.NotEqual(t, "hash", storedAttribute(t, database, "registration", "r1", "password"))
+
+	stored, err := registrations.Get("r1")
+	assert.NoError(t, err)
+	assert.Equal(t, registration.Password, stored.Password)
+	assert.Equal(t, registration.ExpiresAt.Unix(), stored.ExpiresAt.Unix())
+}
+
+func TestRepositoryTags(t *testing.T) {
+	testCases := []struct {
+		name   string
+		create func()
+	}{
+		{"NoID", func() {
+			NewRepository[struct {
+				Name string `data:"name"`
+			}](nil, DeviceTable)
+		}},
+		{"UnknownMeta", func() {
+			NewRepository[struct {
+				ID   string `data:"id,meta"`
+				Name string `data:"name,meta"`
+			}](nil, DeviceTable)
+		}},
+		{"MetaType", func() {
+			NewRepository[struct {
+				ID      string `data:"id,meta"`
+				Version string `data:"version,meta"`
+			}](nil, DeviceTable)
+		}},
+		{"UnknownOption", func() {
+			NewRepository[struct {
+				ID   string `data:"id,meta"`
+				Name string `data:"name,required"`
+			}](nil, DeviceTable)
+		}},
+		{"Duplicate", func() {
+			NewRepository[struct {
+				ID    string `data:"id,meta"`
+				Name  string `data:"name"`
+				Alias string `data:"name"`
+			}](nil, DeviceTable)
+		}},
+		{"NotStruct", func() { NewRepository[string](nil, DeviceTable) }},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Panics(t, tc.create)
+		})
+	}
+}
+
+func TestRegisterTable(t *testing.T) {
+	assert.Panics(t, func() { RegisterTable(TableDefinition{Name: "device"}) })
+	assert.Panics(t, func() { RegisterTable(TableDefinition{Name: "device; DROP TABLE admin"}) })
+	assert.Equal(t, []string{"device", "job", "user"}, searchableTableList())
+	assert.Equal(t, []string{"password", "salt"}, lookupTable("registration").Sensitive)
+	assert.Empty(t, lookupTable("missing").Name)
+}
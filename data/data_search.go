@@ -0,0 +1,292 @@
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// ErrSearchUnavailable is returned by Search when SQLite was built without FTS5.
+// The mattn/go-sqlite3 driver includes FTS5 with the sqlite_fts5 build tag.
+var ErrSearchUnavailable = errors.New("data: full-text search requires SQLite FTS5 (build with -tags sqlite_fts5)")
+var ErrEmptySearch = errors.New("data: empty search query")
+
+// defaultSearchLimit is the number of results per table when none is given.
+const defaultSearchLimit = 20
+
+// SearchOptions restricts a full-text search.
+type SearchOptions struct {
+	// Tables limits the search to some searchable tables. All of them are searched when empty.
+	Tables []string
+	// OwnerID limits the search to the objects of one owner when not empty.
+	OwnerID string
+	// PrincipalID limits the search to the objects the principal can read,
+	// as an owner or through grants, when not empty.
+	PrincipalID string
+	// Limit is the maximum number of results per table.
+	Limit int
+}
+
+// SearchResult is an object that matched a full-text search.
+type SearchResult struct {
+	Table string `json:"table"`
+	// Rank is the BM25 score of the match. Lower is better.
+	Rank    float64 `json:"rank"`
+	Snippet string  `json:"snippet"`
+	Object  Object  `json:"object"`
+}
+
+// SearchEnabled reports whether the full-text indexes could be created.
+func (table *Tables) SearchEnabled() bool {
+	return table.search
+}
+
+// Search finds the objects whose attribute values match every word of query.
+// Words are matched as prefixes, so "ngin 1.1" matches "nginx 1.18". The
+// results of all searched tables are returned ordered by rank.
+func (table *Tables) Search(query string, options SearchOptions) ([]SearchResult, error) {
+	if !table.search {
+		return nil, ErrSearchUnavailable
+	}
+	match := searchMatchExpression(query)
+	if match == "" {
+		return nil, ErrEmptySearch
+	}
+
+	tableNames := options.Tables
+	if len(tableNames) == 0 {
+		tableNames = searchableTableList()
+	}
+	limit := options.Limit
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+
+	var results []SearchResult
+	for _, tableName := range tableNames {
+		if !slices.Contains(searchableTableList(), tableName) {
+			return nil, fmt.Errorf("%w: %s is not searchable", ErrUnknownTable, tableName)
+		}
+		tableResults, err := table.searchTable(tableName, match, options, limit)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, tableResults...)
+	}
+
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Rank < results[j].Rank })
+	return results, nil
+}
+
+// RebuildSearchIndex recreates the full-text index of a table from its rows.
+func (table *Tables) RebuildSearchIndex(tableName string) error {
+	if !table.search {
+		return ErrSearchUnavailable
+	}
+	tx, err := table.writer.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(sqlClearSearchTable(tableName))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(sqlFillSearchTable(tableName))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (table *Tables) searchTable(tableName string, match string, options SearchOptions, limit int) ([]SearchResult, error) {
+	args := []any{
+		options.PrincipalID, tableName, PermissionRead, PermissionRead,
+		match, options.OwnerID, options.OwnerID, options.PrincipalID, limit,
+	}
+	rows, err := table.db.Query(sqlSearch(tableName), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []SearchResult
+	for rows.Next() {
+		result := SearchResult{Table: tableName}
+		obj, err := scanObject(prefixScanner{row: rows, dest: []any{&result.Rank, &result.Snippet}})
+		if err != nil {
+			return nil, err
+		}
+		result.Object, err = table.decryptObject(nil, tableName, obj)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// createSearchIndexes creates the FTS5 tables and the triggers that keep them in
+// sync with the searchable tables. It returns false when FTS5 is not available.
+// The triggers of a database created by a build with FTS5 fail every write
+// without it, so they are dropped in that case, and the indexes are rebuilt
+// when a build with FTS5 finds them missing.
+func createSearchIndexes(db *sql.DB) (bool, error) {
+	var enabled bool
+	err := db.QueryRow(sqlFTS5Enabled()).Scan(&enabled)
+	if err != nil {
+		return false, err
+	}
+	if !enabled {
+		return false, dropSearchTriggers(db)
+	}
+
+	for _, tableName := range searchableTableList() {
+		var exists bool
+		err := db.QueryRow(sqlTableExists(), searchTableName(tableName)+"_insert").Scan(&exists)
+		if err != nil {
+			return false, err
+		}
+		if exists {
+			continue
+		}
+
+		_, err = db.Exec(sqlCreateSearchTable(tableName))
+		if err != nil {
+			return false, err
+		}
+		_, err = db.Exec(sqlClearSearchTable(tableName))
+		if err != nil {
+			return false, err
+		}
+		_, err = db.Exec(sqlFillSearchTable(tableName))
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// dropSearchTriggers drops the triggers that keep the FTS5 tables in sync. The
+// FTS5 tables are kept, so that a build with FTS5 only has to rebuild them.
+func dropSearchTriggers(db *sql.DB) error {
+	for _, tableName := range searchableTableList() {
+		_, err := db.Exec(sqlDropSearchTriggers(tableName))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// searchMatchExpression turns free text into an FTS5 query where every word is a
+// quoted prefix phrase, so that punctuation typed by users is never parsed as
+// FTS5 syntax.
+func searchMatchExpression(query string) string {
+	var terms []string
+	for _, word := range strings.Fields(query) {
+		word = strings.ReplaceAll(word, `"`, "")
+		if word != "" {
+			terms = append(terms, `"`+word+`"*`)
+		}
+	}
+	return strings.Join(terms, " ")
+}
+
+// prefixScanner scans leading columns into dest before the object columns.
+type prefixScanner struct {
+	row  rowScanner
+	dest []any
+}
+
+func (p prefixScanner) Scan(dest ...any) error {
+	return p.row.Scan(append(p.dest, dest...)...)
+}
+
+// prefixedObjectColumns returns objectColumns qualified with a table alias.
+func prefixedObjectColumns(alias string) string {
+	columns := strings.Split(objectColumns, ", ")
+	for i := range columns {
+		columns[i] = alias + "." + columns[i]
+	}
+	return strings.Join(columns, ", ")
+}
+
+func searchTableName(tableName string) string {
+	return tableName + "_fts"
+}
+
+// sqlSearchContent is the text indexed for a row: every scalar value of its attributes.
+func sqlSearchContent(row string) string {
+	return fmt.Sprintf(`(SELECT group_concat(value, ' ') FROM json_tree(%s.attributes) WHERE type NOT IN ('object', 'array'))`, row)
+}
+
+// sqlFTS5Enabled is the SQL query that reports whether SQLite was built with FTS5.
+func sqlFTS5Enabled() string {
+	return `SELECT sqlite_compileoption_used('ENABLE_FTS5')`
+}
+
+func sqlTableExists() string {
+	return `SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE name = ?)`
+}
+
+// sqlCreateSearchTable constructs the SQL statements that create the FTS5 index of the
+// specified table. Index rows share the rowid of the object they index.
+func sqlCreateSearchTable(tableName string) string {
+	query := `
+	CREATE VIRTUAL TABLE IF NOT EXISTS %[2]s USING fts5(content);
+	CREATE TRIGGER IF NOT EXISTS %[2]s_insert AFTER INSERT ON %[1]s BEGIN
+		INSERT INTO %[2]s(rowid, content) VALUES (new.rowid, %[3]s);
+	END;
+	CREATE TRIGGER IF NOT EXISTS %[2]s_update AFTER UPDATE OF attributes ON %[1]s BEGIN
+		DELETE FROM %[2]s WHERE rowid = old.rowid;
+		INSERT INTO %[2]s(rowid, content) VALUES (new.rowid, %[3]s);
+	END;
+	CREATE TRIGGER IF NOT EXISTS %[2]s_delete AFTER DELETE ON %[1]s BEGIN
+		DELETE FROM %[2]s WHERE rowid = old.rowid;
+	END;
+	`
+	return fmt.Sprintf(query, tableName, searchTableName(tableName), sqlSearchContent("new"))
+}
+
+// sqlDropSearchTriggers constructs the SQL statements that drop the triggers
+// of the FTS5 index of the specified table.
+func sqlDropSearchTriggers(tableName string) string {
+	query := `
+	DROP TRIGGER IF EXISTS %[1]s_insert;
+	DROP TRIGGER IF EXISTS %[1]s_update;
+	DROP TRIGGER IF EXISTS %[1]s_delete;
+	`
+	return fmt.Sprintf(query, searchTableName(tableName))
+}
+
+// sqlClearSearchTable constructs the SQL query that empties the full-text index of the specified table.
+func sqlClearSearchTable(tableName string) string {
+	return fmt.Sprintf(`DELETE FROM %s`, searchTableName(tableName))
+}
+
+// sqlFillSearchTable constructs the SQL query that indexes every row of the specified table.
+func sqlFillSearchTable(tableName string) string {
+	query := `INSERT INTO %s(rowid, content) SELECT rowid, %s FROM %s`
+	return fmt.Sprintf(query, searchTableName(tableName), sqlSearchContent(tableName), tableName)
+}
+
+// sqlSearch constructs the SQL query that ranks the objects of the specified table
+// matching an FTS5 expression, optionally restricted to one owner and to the
+// objects a principal can read. The arguments are the principal, the table and
+// the permission twice for the access checks, then the expression, the owner
+// twice, the principal and the limit.
+func sqlSearch(tableName string) string {
+	query := `
+	WITH RECURSIVE` + sqlPrincipalsCTE + `,` + sqlGrantedCTE + `
+	SELECT bm25(%[2]s), snippet(%[2]s, 0, '[', ']', '...', 12), %[3]s
+	FROM %[2]s JOIN %[1]s AS t ON t.rowid = %[2]s.rowid
+	WHERE %[2]s MATCH ? AND (? = '' OR t.owner_id = ?)
+	AND (? = '' OR t.owner_id IN (SELECT id FROM principals) OR t.id IN (SELECT id FROM accessible))
+	ORDER BY bm25(%[2]s) LIMIT ?`
+	return fmt.Sprintf(query, tableName, searchTableName(tableName), prefixedObjectColumns("t"))
+}
@@ -0,0 +1,122 @@
+package data
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSearchMatchExpression(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"Words", "nginx 1.18", `"nginx"* "1.18"*`},
+		{"Quotes", `web" OR "db`, `"web"* "OR"* "db"*`},
+		{"Blank", "   ", ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, searchMatchExpression(tc.input))
+		})
+	}
+}
+
+func TestSearch(t *testing.T) {
+	table, err := NewTables(newTestDatabase(t))
+	assert.NoError(t, err)
+	if !table.SearchEnabled() {
+		_, err := table.Search("nginx", SearchOptions{})
+		assert.ErrorIs(t, err, ErrSearchUnavailable)
+		t.Skip("SQLite was built without FTS5")
+	}
+
+	devices := []Object{
+		{ID: "web-1", OwnerID: "owner1", Version: 1, Attributes: map[string]any{"hostname": "web-1.example.com", "packages": []any{"nginx 1.18.0", "openssl 3.0"}}},
+		{ID: "web-2", OwnerID: "owner2", Version: 1, Attributes: map[string]any{"hostname": "web-2.example.com", "packages": []any{"nginx 1.24.0"}}},
+		{ID: "db-1", OwnerID: "owner1", Version: 1, Attributes: map[string]any{"hostname": "db-1.example.com", "os": map[string]any{"name": "debian"}}},
+	}
+	for _, device := range devices {
+		assert.NoError(t, table.Insert("device", device))
+	}
+	assert.NoError(t, table.Insert("user", Object{ID: "u1", OwnerID: "owner1", Version: 1, Attributes: map[string]any{"name": "nginx admin"}}))
+
+	results, err := table.Search("nginx 1.18", SearchOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+	assert.Equal(t, "web-1", results[0].Object.ID)
+	assert.Contains(t, results[0].Snippet, "[nginx]")
+
+	results, err = table.Search("nginx", SearchOptions{Tables: []string{"device"}, OwnerID: "owner2"})
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+	assert.Equal(t, "web-2", results[0].Object.ID)
+
+	assert.NoError(t, table.AddGroupMember("owner2", Member{Kind: MemberPrincipal, ID: "alice"}))
+	assert.NoError(t, table.Grant(Grant{Table: "device", ObjectID: "db-1", PrincipalID: "alice", Permissions: PermissionRead}))
+	results, err = table.Search("example", SearchOptions{PrincipalID: "alice"})
+	assert.NoError(t, err)
+	assert.Len(t, results, 2)
+	for _, result := range results {
+		assert.Contains(t, []string{"web-2", "db-1"}, result.Object.ID)
+	}
+	results, err = table.Search("example", SearchOptions{PrincipalID: "bob"})
+	assert.NoError(t, err)
+	assert.Empty(t, results)
+
+	results, err = table.Search("deb", SearchOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+	assert.Equal(t, "db-1", results[0].Object.ID)
+
+	results, err = table.Search("nginx", SearchOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, results, 3)
+
+	devices[1].Attributes["packages"] = []any{"apache 2.4"}
+	assert.NoError(t, table.UpdateByID("device", "web-2", devices[1]))
+	assert.NoError(t, table.DeleteByID("user", "u1"))
+	results, err = table.Search("nginx", SearchOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+
+	assert.NoError(t, table.RebuildSearchIndex("device"))
+	results, err = table.Search("apache", SearchOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+
+	_, err = table.Search("", SearchOptions{})
+	assert.ErrorIs(t, err, ErrEmptySearch)
+	_, err = table.Search("nginx", SearchOptions{Tables: []string{"admin"}})
+	assert.ErrorIs(t, err, ErrUnknownTable)
+}
+
+func TestSearchIndexesOfAnotherBuild(t *testing.T) {
+	database := newTestDatabase(t)
+	table, err := NewTables(database)
+	assert.NoError(t, err)
+	device := Object{ID: "web-1", OwnerID: "owner1", Version: 1, Attributes: map[string]any{"hostname": "web-1"}}
+
+	if !table.SearchEnabled() {
+		// A database created by a build with FTS5 has triggers that fail without it.
+		_, err := database.Exec(`CREATE TRIGGER device_fts_insert AFTER INSERT ON device BEGIN INSERT INTO device_fts(rowid) VALUES (new.rowid); END`)
+		assert.NoError(t, err)
+		table, err = NewTables(database)
+		assert.NoError(t, err)
+		assert.False(t, table.SearchEnabled())
+		assert.NoError(t, table.Insert("device", device))
+		return
+	}
+
+	// A database written by a build without FTS5 has no triggers and stale indexes.
+	_, err = database.Exec(sqlDropSearchTriggers("device"))
+	assert.NoError(t, err)
+	assert.NoError(t, table.Insert("device", device))
+	table, err = NewTables(database)
+	assert.NoError(t, err)
+	results, err := table.Search("web", SearchOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+}
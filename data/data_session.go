@@ -0,0 +1,24 @@
+package data
+
+// SessionTable stores the login sessions of the administrators in the web
+// console and the API. The sessions are removed by the reaper when they expire.
+var SessionTable = RegisterTable(TableDefinition{
+	Name:      "session",
+	Sensitive: []string{"csrf_token"},
+	Indexes: []AttributeIndex{
+		{Path: "admin_id"},
+	},
+})
+
+// Session is a login session stored in SessionTable. The ID is the hash of
+// the session cookie or API token, so that the sessions cannot be taken over
+// with the content of the table. The owner ID is the organization of the
+// administrator, and the CSRF token must be sent with the forms of the
+// console sessions.
+type Session struct {
+	ID        string     `data:"id,meta"`
+	OwnerID   string     `data:"owner_id,meta"`
+	ExpiresAt *Timestamp `data:"expires_at,meta"`
+	AdminID   string     `data:"admin_id"`
+	CSRFToken string     `data:"csrf_token"`
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"time"
 )
 
 type Object struct {
@@ -13,27 +14,120 @@ type Object struct {
 	OwnerID    string         `json:"owner_id"`
 	Version    int            `json:"version"`
 	Attributes map[string]any `json:"attributes"`
+	ExpiresAt  *Timestamp     `json:"expires_at,omitempty"`
+	// HLC orders the changes of the object across server instances. It is set
+	// by every write, together with UpdatedAt.
+	HLC HLC `json:"hlc"`
+}
+
+// IsExpired reports whether the object has an expiry time at or before now.
+func (obj Object) IsExpired(now time.Time) bool {
+	return obj.ExpiresAt != nil && !obj.ExpiresAt.Time.After(now)
 }
 
 type Tables struct {
-	db *sql.DB
+	db      *sql.DB
+	writer  *tableWriter
+	keys    *keyring
+	search  bool
+	clock   *Clock
+	metrics *tableMetrics
 }
 
 // NewTables creates a new data tables object from the sql DB.
 func NewTables(db *sql.DB) (*Tables, error) {
+	return newTables(db, db)
+}
+
+// newTables creates the data tables reading from db and writing through writer.
+func newTables(db *sql.DB, writer *sql.DB) (*Tables, error) {
+	_, err := writer.Exec(sqlCreateMigrationTable())
+	if err != nil {
+		return nil, err
+	}
+
 	for _, tableName := range dataTableList() {
 		query := sqlCreatTable(tableName)
-		_, err := db.Exec(query)
+		_, err := writer.Exec(query)
+		if err != nil {
+			return nil, err
+		}
+		err = migrateTable(writer, tableName)
 		if err != nil {
 			return nil, err
 		}
+		err = syncAttributeIndexes(writer, tableName, lookupTable(tableName).Indexes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = writer.Exec(sqlCreateReplicationStateTable())
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = writer.Exec(sqlCreateMetricTables())
+	if err != nil {
+		return nil, err
 	}
 
-	return &Tables{db: db}, nil
+	_, err = writer.Exec(sqlCreateIdempotencyKeyTable())
+	if err != nil {
+		return nil, err
+	}
+
+	err = createACLTables(writer)
+	if err != nil {
+		return nil, err
+	}
+
+	search, err := createSearchIndexes(writer)
+	if err != nil {
+		return nil, err
+	}
+	table := &Tables{db: db, writer: &tableWriter{db: writer, statements: replicatedStatements()}, search: search, clock: NewClock(""), metrics: newTableMetrics()}
+	err = table.observeHLCs(writer)
+	if err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// SetNodeID sets the node that breaks ties between the HLCs of objects written
+// at the same time on different server instances.
+func (table *Tables) SetNodeID(id string) {
+	table.clock.setNode(id)
+}
+
+// stamp returns the time and HLC of a write.
+func (table *Tables) stamp() (Timestamp, HLC) {
+	hlc := table.clock.Now()
+	return Timestamp{Time: hlc.Time()}, hlc
+}
+
+// hlcQuerier is implemented by *sql.DB and *sql.Tx.
+type hlcQuerier interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// observeHLCs moves the clock past the latest HLC stored in the data tables,
+// so that the writes made after those of another node are ordered after them.
+func (table *Tables) observeHLCs(db hlcQuerier) error {
+	for _, tableName := range dataTableList() {
+		var latest HLC
+		err := db.QueryRow(sqlLatestHLC(tableName)).Scan(&latest)
+		if err != nil {
+			return err
+		}
+		table.clock.Observe(latest)
+	}
+	return nil
 }
 
 // ListByOwner retrieves a list of objects by owner ID and object type from the database.
-func (table *Tables) ListByOwner(tableName string, ownerID string) ([]Object, error) {
+func (table *Tables) ListByOwner(tableName string, ownerID string) (_ []Object, err error) {
+	defer table.observe("list", tableName, time.Now(), &err)
 	query := sqlListByOwner(tableName)
 	rows, err := table.db.Query(query, ownerID)
 	if err != nil {
@@ -41,60 +135,71 @@ func (table *Tables) ListByOwner(tableName string, ownerID string) ([]Object, er
 	}
 	defer rows.Close()
 
-	var objects []Object
-	for rows.Next() {
-		var obj Object
-		var attrsJson string
-		err := rows.Scan(&obj.ID, &obj.CreatedAt, &obj.UpdatedAt, &obj.OwnerID, &obj.Version, &attrsJson)
-		if err != nil {
-			return nil, err
-		}
-		err = json.Unmarshal([]byte(attrsJson), &obj.Attributes)
-		if err != nil {
-			return nil, err
-		}
-		objects = append(objects, obj)
+	objects, err := scanObjects(rows)
+	if err != nil {
+		return nil, err
 	}
-	return objects, rows.Err()
+	return table.decryptObjects(tableName, objects)
 }
 
 // Insert inserts a new object into the specified table in the database.
-func (table *Tables) Insert(tableName string, obj Object) error {
-	attrsJson, err := json.Marshal(obj.Attributes)
+func (table *Tables) Insert(tableName string, obj Object) (err error) {
+	defer table.observe("insert", tableName, time.Now(), &err)
+	attrsJson, err := table.encodeAttributes(nil, tableName, obj)
 	if err != nil {
 		return err
 	}
 	query := sqlInsert(tableName)
-	obj.CreatedAt = NowTimestamp()
-	_, err = table.db.Exec(query, obj.ID, obj.CreatedAt, obj.UpdatedAt, obj.OwnerID, obj.Version, attrsJson)
-	return err
+	obj.CreatedAt, obj.HLC = table.stamp()
+	obj.UpdatedAt = obj.CreatedAt
+	_, err = table.writer.Exec(query, obj.ID, obj.CreatedAt, obj.UpdatedAt, obj.OwnerID, obj.Version, attrsJson, obj.ExpiresAt, obj.HLC)
+	return translateError(err)
 }
 
 // DeleteByID deletes an object from the specified table in the database by its ID.
-func (table *Tables) DeleteByID(tableName string, id string) error {
+func (table *Tables) DeleteByID(tableName string, id string) (err error) {
+	defer table.observe("delete", tableName, time.Now(), &err)
 	query := sqlDeleteByID(tableName)
-	_, err := table.db.Exec(query, id)
+	_, err = table.writer.Exec(query, id)
 	return err
 }
 
 // UpdateByID updates an existing object in the specified table in the database by its ID.
-func (table *Tables) UpdateByID(tableName string, id string, obj Object) error {
-	attrsJson, err := json.Marshal(obj.Attributes)
+func (table *Tables) UpdateByID(tableName string, id string, obj Object) (err error) {
+	defer table.observe("update", tableName, time.Now(), &err)
+	obj.ID = id
+	attrsJson, err := table.encodeAttributes(nil, tableName, obj)
 	if err != nil {
 		return err
 	}
 	query := sqlUpdateByID(tableName)
-	obj.UpdatedAt = NowTimestamp()
-	_, err = table.db.Exec(query, obj.UpdatedAt, obj.OwnerID, obj.Version, attrsJson, id)
-	return err
+	obj.UpdatedAt, obj.HLC = table.stamp()
+	_, err = table.writer.Exec(query, obj.UpdatedAt, obj.OwnerID, obj.Version, attrsJson, obj.ExpiresAt, obj.HLC, id)
+	return translateError(err)
 }
 
-// GetByID retrieves an object from the specified table in the database by its ID.
-func (table *Tables) GetByID(tableName, id string) (Object, error) {
+// GetByID retrieves an object from the specified table in the database by its
+// ID. sql.ErrNoRows is returned when there is none or when it expired.
+func (table *Tables) GetByID(tableName, id string) (_ Object, err error) {
+	defer table.observe("get", tableName, time.Now(), &err)
 	query := sqlGetByID(tableName)
+	obj, err := scanObject(table.db.QueryRow(query, id, NowTimestamp()))
+	if err != nil {
+		return obj, err
+	}
+	return table.decryptObject(nil, tableName, obj)
+}
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanObject reads a single object selected with the objectColumns column list.
+func scanObject(row rowScanner) (Object, error) {
 	var obj Object
 	var attrsJson string
-	err := table.db.QueryRow(query, id).Scan(&obj.ID, &obj.CreatedAt, &obj.UpdatedAt, &obj.OwnerID, &obj.Version, &attrsJson)
+	err := row.Scan(&obj.ID, &obj.CreatedAt, &obj.UpdatedAt, &obj.OwnerID, &obj.Version, &attrsJson, &obj.ExpiresAt, &obj.HLC)
 	if err != nil {
 		return obj, err
 	}
@@ -102,15 +207,33 @@ func (table *Tables) GetByID(tableName, id string) (Object, error) {
 	return obj, err
 }
 
-// sqlGetByID constructs the SQL query to retrieve an object by its ID from the specified table.
+// scanObjects reads all the objects from rows selected with the objectColumns column list.
+func scanObjects(rows *sql.Rows) ([]Object, error) {
+	var objects []Object
+	for rows.Next() {
+		obj, err := scanObject(rows)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, obj)
+	}
+	return objects, rows.Err()
+}
+
+// objectColumns is the column list used by every query that reads whole objects.
+const objectColumns = `id, created_at, updated_at, owner_id, version, attributes, expires_at, hlc`
+
+// sqlGetByID constructs the SQL query to retrieve an object by its ID from the
+// specified table. The objects that expired at or before the time given after
+// the ID are not found, even before the reaper deletes them.
 func sqlGetByID(tableName string) string {
-	query := `SELECT id, created_at, updated_at, owner_id, version, attributes FROM %s WHERE id = ?`
-	return fmt.Sprintf(query, tableName)
+	query := `SELECT %s FROM %s WHERE id = ? AND (expires_at IS NULL OR expires_at > ?)`
+	return fmt.Sprintf(query, objectColumns, tableName)
 }
 
 // sqlUpdateByID constructs the SQL query to update an object by its ID in the specified table.
 func sqlUpdateByID(tableName string) string {
-	query := `UPDATE %s SET updated_at = ?, owner_id = ?, version = ?, attributes = ? WHERE id = ?`
+	query := `UPDATE %s SET updated_at = ?, owner_id = ?, version = ?, attributes = ?, expires_at = ?, hlc = ? WHERE id = ?`
 	return fmt.Sprintf(query, tableName)
 }
 
@@ -122,14 +245,20 @@ func sqlDeleteByID(tableName string) string {
 
 // sqlInsert constructs the SQL query to insert a new object into the specified table.
 func sqlInsert(tableName string) string {
-	query := `INSERT INTO %s (id, created_at, updated_at, owner_id, version, attributes) VALUES (?, ?, ?, ?, ?, ?)`
+	query := `INSERT INTO %s (%s) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	return fmt.Sprintf(query, tableName, objectColumns)
+}
+
+// sqlLatestHLC constructs the SQL query to find the latest HLC of the specified table.
+func sqlLatestHLC(tableName string) string {
+	query := `SELECT COALESCE(MAX(hlc), '') FROM %s`
 	return fmt.Sprintf(query, tableName)
 }
 
 // sqlListByOwner constructs the SQL query to list objects by their owner ID from the specified table.
 func sqlListByOwner(tableName string) string {
-	query := `SELECT id, created_at, updated_at, owner_id, version, attributes FROM %s WHERE owner_id = ?`
-	return fmt.Sprintf(query, tableName)
+	query := `SELECT %s FROM %s WHERE owner_id = ?`
+	return fmt.Sprintf(query, objectColumns, tableName)
 }
 
 func sqlCreatTable(tableName string) string {
@@ -143,16 +272,7 @@ func sqlCreatTable(tableName string) string {
 		attributes TEXT,
 		PRIMARY KEY (id)
 	);
-	CREATE INDEX IF NOT EXISTS idx_owner_id ON %s(owner_id);
+	CREATE INDEX IF NOT EXISTS idx_%s_owner_id ON %s(owner_id);
 	`
-	return fmt.Sprintf(query, tableName, tableName)
-}
-
-func dataTableList() []string {
-	return []string{
-		"admin",
-		"user",
-		"device",
-		"registration",
-	}
+	return fmt.Sprintf(query, tableName, tableName, tableName)
 }
@@ -39,10 +39,10 @@ func TestListByOwner(t *testing.T) {
 		obj2 := Object{ID: id2, OwnerID: "owner1", Version: 2, Attributes: map[string]any{"attr2": "val2"}}
 
 		// Insert test objects
-		_, err := db.Exec(query, obj1.ID, obj1.CreatedAt, obj1.UpdatedAt, obj1.OwnerID, obj1.Version, jsonString(obj1.Attributes))
+		_, err := db.Exec(query, obj1.ID, obj1.CreatedAt, obj1.UpdatedAt, obj1.OwnerID, obj1.Version, jsonString(obj1.Attributes), obj1.ExpiresAt, obj1.HLC)
 		assert.NoError(t, err)
 
-		_, err = db.Exec(query, obj2.ID, obj2.CreatedAt, obj2.UpdatedAt, obj2.OwnerID, obj2.Version, jsonString(obj2.Attributes))
+		_, err = db.Exec(query, obj2.ID, obj2.CreatedAt, obj2.UpdatedAt, obj2.OwnerID, obj2.Version, jsonString(obj2.Attributes), obj2.ExpiresAt, obj2.HLC)
 		assert.NoError(t, err)
 
 		objects, err := table.ListByOwner(tableName, "owner1")
@@ -73,13 +73,18 @@ func TestCreate(t *testing.T) {
 		var updatedAt Timestamp
 		var version int
 		var attrsJson string
-		err = db.QueryRow(query, obj.ID).Scan(&id, &createdAt, &updatedAt, &ownerID, &version, &attrsJson)
+		var expiresAt *Timestamp
+		var hlc HLC
+		err = db.QueryRow(query, obj.ID, NowTimestamp()).Scan(&id, &createdAt, &updatedAt, &ownerID, &version, &attrsJson, &expiresAt, &hlc)
 		assert.NoError(t, err)
+		assert.False(t, createdAt.IsZero())
+		assert.Equal(t, createdAt, updatedAt)
+		assert.Equal(t, createdAt.Time, hlc.Time())
 
 		var retrievedAttrs map[string]any
 		err = json.Unmarshal([]byte(attrsJson), &retrievedAttrs)
 		assert.NoError(t, err)
-		assert.Equal(t, obj, Object{ID: id, OwnerID: ownerID, Version: version, Attributes: retrievedAttrs})
+		assert.Equal(t, obj, Object{ID: id, OwnerID: ownerID, Version: version, Attributes: retrievedAttrs, ExpiresAt: expiresAt})
 	}
 
 }
@@ -95,7 +100,7 @@ func TestDeleteByID(t *testing.T) {
 		obj := Object{ID: objectID, OwnerID: "owner1", Version: 1, Attributes: map[string]any{"attr1": "val1"}}
 
 		// Insert test object
-		_, err := db.Exec(insertQuery, obj.ID, obj.CreatedAt, obj.UpdatedAt, obj.OwnerID, obj.Version, jsonString(obj.Attributes))
+		_, err := db.Exec(insertQuery, obj.ID, obj.CreatedAt, obj.UpdatedAt, obj.OwnerID, obj.Version, jsonString(obj.Attributes), obj.ExpiresAt, obj.HLC)
 		assert.NoError(t, err)
 
 		err = table.DeleteByID(tableName, objectID)
@@ -120,7 +125,7 @@ func TestUpdateByID(t *testing.T) {
 		obj := Object{ID: objectID, OwnerID: "owner1", Version: 1, Attributes: map[string]any{"attr1": "val1"}}
 
 		// Insert test object
-		_, err := db.Exec(inserQuery, obj.ID, obj.CreatedAt, obj.UpdatedAt, obj.OwnerID, obj.Version, jsonString(obj.Attributes))
+		_, err := db.Exec(inserQuery, obj.ID, obj.CreatedAt, obj.UpdatedAt, obj.OwnerID, obj.Version, jsonString(obj.Attributes), obj.ExpiresAt, obj.HLC)
 		assert.NoError(t, err)
 
 		obj.OwnerID = "updatedOwner"
@@ -156,7 +161,7 @@ func TestGetByID(t *testing.T) {
 		obj := Object{ID: objectID, OwnerID: "owner1", Version: 1, Attributes: map[string]any{"attr1": "val1"}}
 
 		// Insert test object
-		_, err := db.Exec(query, obj.ID, obj.CreatedAt, obj.UpdatedAt, obj.OwnerID, obj.Version, jsonString(obj.Attributes))
+		_, err := db.Exec(query, obj.ID, obj.CreatedAt, obj.UpdatedAt, obj.OwnerID, obj.Version, jsonString(obj.Attributes), obj.ExpiresAt, obj.HLC)
 		assert.NoError(t, err)
 
 		retrievedObj, err := table.GetByID(tableName, objectID)
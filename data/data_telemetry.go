@@ -0,0 +1,39 @@
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jrpalma/linuxfleet/telemetry"
+)
+
+// tableMetrics measures the operations on the data tables.
+type tableMetrics struct {
+	durations *telemetry.Histogram
+	errors    *telemetry.Counter
+}
+
+func newTableMetrics() *tableMetrics {
+	return &tableMetrics{
+		durations: telemetry.NewHistogram("linuxfleet_db_operation_duration_seconds",
+			"Duration of the operations on the data tables.", nil, "operation", "table"),
+		errors: telemetry.NewCounter("linuxfleet_db_operation_errors_total",
+			"Operations on the data tables that failed.", "operation", "table"),
+	}
+}
+
+// Collectors returns the collectors of the operation metrics of the tables.
+func (table *Tables) Collectors() []telemetry.Collector {
+	return []telemetry.Collector{table.metrics.durations, table.metrics.errors}
+}
+
+// observe records an operation on a table that started at start. It is
+// deferred with the error result of the operation; a missing object is not
+// counted as a failure.
+func (table *Tables) observe(operation string, tableName string, start time.Time, err *error) {
+	table.metrics.durations.Observe(time.Since(start).Seconds(), operation, tableName)
+	if *err != nil && !errors.Is(*err, sql.ErrNoRows) {
+		table.metrics.errors.Inc(operation, tableName)
+	}
+}
@@ -0,0 +1,7 @@
+package data
+
+// UserTable stores the users managed by the administrators.
+var UserTable = RegisterTable(TableDefinition{
+	Name:       "user",
+	Searchable: true,
+})
@@ -0,0 +1,46 @@
+package data
+
+import (
+	"sync"
+)
+
+// worker implements the Start and Stop lifecycle shared by the background workers
+// of the data package. The run function must return when stop is closed.
+type worker struct {
+	stop    chan struct{}
+	done    chan struct{}
+	started sync.Once
+	stopped sync.Once
+}
+
+func newWorker() worker {
+	return worker{stop: make(chan struct{}), done: make(chan struct{})}
+}
+
+// start runs fn in its own goroutine the first time it is called.
+func (w *worker) start(fn func()) {
+	w.started.Do(func() {
+		go func() {
+			defer close(w.done)
+			fn()
+		}()
+	})
+}
+
+// Stop signals the worker to stop and waits for it to finish.
+// Stopping a worker that was never started returns immediately.
+func (w *worker) Stop() {
+	w.stopped.Do(func() { close(w.stop) })
+	w.started.Do(func() { close(w.done) })
+	<-w.done
+}
+
+// stopping reports whether Stop was called.
+func (w *worker) stopping() bool {
+	select {
+	case <-w.stop:
+		return true
+	default:
+		return false
+	}
+}
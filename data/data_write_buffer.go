@@ -0,0 +1,200 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrBufferFull = errors.New("data: write buffer is full")
+var ErrBufferClosed = errors.New("data: write buffer is stopped")
+
+// WriteBufferOptions configures the write-behind buffer.
+type WriteBufferOptions struct {
+	// Capacity is the number of queued objects after which writers wait.
+	Capacity int
+	// BatchSize is the maximum number of objects written per transaction.
+	BatchSize int
+	// FlushInterval is the longest time an object waits in the buffer.
+	FlushInterval time.Duration
+	// OnError is called with the objects of a batch that could not be written. It may be nil.
+	OnError func(tableName string, objs []Object, err error)
+}
+
+// DefaultWriteBufferOptions returns the options used when none are configured.
+func DefaultWriteBufferOptions() WriteBufferOptions {
+	return WriteBufferOptions{
+		Capacity:      10000,
+		BatchSize:     500,
+		FlushInterval: 100 * time.Millisecond,
+	}
+}
+
+// WriteBuffer is a background worker that queues upserts and writes them in
+// batches with UpsertBatch. Writers wait when the queue is full, so a slow
+// database slows the producers down instead of growing memory without bound.
+// Objects still queued when the buffer is stopped are written before Stop
+// returns.
+type WriteBuffer struct {
+	worker
+	tables  *Tables
+	options WriteBufferOptions
+	queue   chan bufferedWrite
+
+	// mu is held for reading while queueing and for writing while stopping,
+	// so that nothing is queued after the worker drained the queue.
+	mu     sync.RWMutex
+	closed bool
+}
+
+// bufferedWrite is a queued object, or a flush request when flushed is set.
+type bufferedWrite struct {
+	tableName string
+	obj       Object
+	flushed   chan struct{}
+}
+
+// NewWriteBuffer creates a write buffer for the data tables. Call Start to run it.
+func NewWriteBuffer(tables *Tables, options WriteBufferOptions) *WriteBuffer {
+	defaults := DefaultWriteBufferOptions()
+	if options.Capacity <= 0 {
+		options.Capacity = defaults.Capacity
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = defaults.BatchSize
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = defaults.FlushInterval
+	}
+	return &WriteBuffer{
+		worker:  newWorker(),
+		tables:  tables,
+		options: options,
+		queue:   make(chan bufferedWrite, options.Capacity),
+	}
+}
+
+// Start runs the write buffer in its own goroutine until Stop is called.
+func (b *WriteBuffer) Start() {
+	b.start(b.run)
+}
+
+// Stop writes the queued objects and stops the write buffer.
+func (b *WriteBuffer) Stop() {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	b.worker.Stop()
+}
+
+// Upsert queues an object to be inserted or updated. It waits while the buffer
+// is full until ctx is done.
+func (b *WriteBuffer) Upsert(ctx context.Context, tableName string, obj Object) error {
+	return b.enqueue(ctx, bufferedWrite{tableName: tableName, obj: obj})
+}
+
+// TryUpsert queues an object to be inserted or updated, or returns
+// ErrBufferFull without waiting when the buffer is full.
+func (b *WriteBuffer) TryUpsert(tableName string, obj Object) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return ErrBufferClosed
+	}
+	select {
+	case b.queue <- bufferedWrite{tableName: tableName, obj: obj}:
+		return nil
+	default:
+		return ErrBufferFull
+	}
+}
+
+// Flush waits until the objects queued before the call have been written.
+func (b *WriteBuffer) Flush(ctx context.Context) error {
+	flushed := make(chan struct{})
+	err := b.enqueue(ctx, bufferedWrite{flushed: flushed})
+	if err != nil {
+		return err
+	}
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Len returns the number of queued objects.
+func (b *WriteBuffer) Len() int {
+	return len(b.queue)
+}
+
+func (b *WriteBuffer) enqueue(ctx context.Context, write bufferedWrite) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return ErrBufferClosed
+	}
+	select {
+	case b.queue <- write:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *WriteBuffer) run() {
+	ticker := time.NewTicker(b.options.FlushInterval)
+	defer ticker.Stop()
+
+	pending := map[string][]Object{}
+	count := 0
+	flush := func() {
+		for tableName, objs := range pending {
+			b.write(tableName, objs)
+		}
+		clear(pending)
+		count = 0
+	}
+	add := func(write bufferedWrite) {
+		if write.flushed != nil {
+			flush()
+			close(write.flushed)
+			return
+		}
+		pending[write.tableName] = append(pending[write.tableName], write.obj)
+		count++
+		if count >= b.options.BatchSize {
+			flush()
+		}
+	}
+
+	for {
+		select {
+		case write := <-b.queue:
+			add(write)
+		case <-ticker.C:
+			flush()
+		case <-b.stop:
+			// Stop holds the lock until closed is set, so nothing is queued
+			// after the queue is drained here.
+			for {
+				select {
+				case write := <-b.queue:
+					add(write)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (b *WriteBuffer) write(tableName string, objs []Object) {
+	err := b.tables.UpsertBatch(tableName, objs)
+	if err != nil && b.options.OnError != nil {
+		b.options.OnError(tableName, objs, err)
+	}
+}
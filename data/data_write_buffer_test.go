@@ -0,0 +1,96 @@
+package data
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteBuffer(t *testing.T) {
+	table, err := NewTables(newTestDatabase(t))
+	assert.NoError(t, err)
+
+	var mu sync.Mutex
+	var failed []string
+	buffer := NewWriteBuffer(table, WriteBufferOptions{
+		BatchSize:     10,
+		FlushInterval: time.Hour,
+		OnError: func(tableName string, objs []Object, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			failed = append(failed, tableName)
+		},
+	})
+	buffer.Start()
+
+	ctx := context.Background()
+	for _, obj := range batchObjects("d", 25) {
+		assert.NoError(t, buffer.Upsert(ctx, "device", obj))
+	}
+	assert.NoError(t, buffer.Upsert(ctx, "missing", Object{ID: "x"}))
+	assert.NoError(t, buffer.Flush(ctx))
+
+	stored, err := table.ListByOwner("device", "owner1")
+	assert.NoError(t, err)
+	assert.Len(t, stored, 25)
+	mu.Lock()
+	assert.Equal(t, []string{"missing"}, failed)
+	mu.Unlock()
+
+	// Objects queued before Stop are written.
+	assert.NoError(t, buffer.TryUpsert("device", Object{ID: "last", OwnerID: "owner1", Version: 1}))
+	buffer.Stop()
+	_, err = table.GetByID("device", "last")
+	assert.NoError(t, err)
+
+	assert.ErrorIs(t, buffer.Upsert(ctx, "device", Object{ID: "late"}), ErrBufferClosed)
+	assert.ErrorIs(t, buffer.Flush(ctx), ErrBufferClosed)
+}
+
+func TestWriteBufferBackpressure(t *testing.T) {
+	table, err := NewTables(newTestDatabase(t))
+	assert.NoError(t, err)
+
+	// The buffer is not started, so nothing drains the queue.
+	buffer := NewWriteBuffer(table, WriteBufferOptions{Capacity: 2})
+	assert.NoError(t, buffer.TryUpsert("device", Object{ID: "a"}))
+	assert.NoError(t, buffer.TryUpsert("device", Object{ID: "b"}))
+	assert.ErrorIs(t, buffer.TryUpsert("device", Object{ID: "c"}), ErrBufferFull)
+	assert.Equal(t, 2, buffer.Len())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, buffer.Upsert(ctx, "device", Object{ID: "c"}), context.DeadlineExceeded)
+
+	buffer.Start()
+	assert.NoError(t, buffer.Upsert(context.Background(), "device", Object{ID: "c", Version: 1}))
+	buffer.Stop()
+	for _, id := range []string{"a", "b", "c"} {
+		_, err := table.GetByID("device", id)
+		assert.NoError(t, err)
+	}
+}
+
+func BenchmarkWriteBuffer(b *testing.B) {
+	table := benchmarkTables(b)
+	buffer := NewWriteBuffer(table, DefaultWriteBufferOptions())
+	buffer.Start()
+	objs := batchObjects("d", b.N)
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := range b.N {
+		err := buffer.Upsert(ctx, "device", objs[i])
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	err := buffer.Flush(ctx)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.StopTimer()
+	buffer.Stop()
+}
@@ -6,6 +6,10 @@ import (
 	"time"
 )
 
+// timestampLayout stores timestamps in UTC with nanoseconds and a fixed width,
+// so that they can be compared and ordered as text in SQL.
+const timestampLayout = "2006-01-02T15:04:05.000000000Z"
+
 type Timestamp struct {
 	time.Time
 }
@@ -14,13 +18,20 @@ func NowTimestamp() Timestamp {
 	return Timestamp{Time: time.Now()}
 }
 
-// Value implements the driver.Valuer interface.
+// TimestampAfter returns a timestamp d after the current time.
+func TimestampAfter(d time.Duration) *Timestamp {
+	return &Timestamp{Time: time.Now().Add(d)}
+}
+
+// Value implements the driver.Valuer interface. Timestamps are stored in UTC
+// so that they can be compared as text in SQL.
 func (ct Timestamp) Value() (driver.Value, error) {
-	str := ct.Time.Format(time.RFC3339)
+	str := ct.Time.UTC().Format(timestampLayout)
 	return str, nil
 }
 
-// Scan implements the sql.Scanner interface.
+// Scan implements the sql.Scanner interface. Timestamps written before they
+// had nanoseconds are accepted too.
 func (ct *Timestamp) Scan(value interface{}) error {
 	if value == nil {
 		ct.Time = time.Time{}
@@ -32,7 +43,7 @@ func (ct *Timestamp) Scan(value interface{}) error {
 		return fmt.Errorf("expected string value for CustomTime, got %T", value)
 	}
 
-	parsedTime, err := time.Parse(time.RFC3339, strValue)
+	parsedTime, err := time.Parse(time.RFC3339Nano, strValue)
 	if err != nil {
 		return err
 	}
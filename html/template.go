@@ -3,15 +3,28 @@ package html
 import (
 	"bytes"
 	"embed"
+	"encoding/json"
+	"fmt"
 	"html/template"
+	"io"
+	"io/fs"
 	"log"
+	"path"
+	"strings"
 )
 
 //go:embed templates
 var templateFiles embed.FS
 
+//go:embed static
+var staticFiles embed.FS
+
+// Templates renders the emails and the pages of the web console. A page is
+// rendered with the base layout of the console and its partials, and defines
+// the content block of the layout.
 type Templates struct {
-	list *template.Template
+	list  *template.Template
+	pages map[string]*template.Template
 }
 
 func NewTemplates() *Templates {
@@ -20,7 +33,26 @@ func NewTemplates() *Templates {
 		log.Fatal(err)
 	}
 
-	return &Templates{list}
+	base, err := template.New("console").Funcs(consoleFuncs).ParseFS(templateFiles,
+		"templates/console/layout.tmpl", "templates/console/partials/*.tmpl")
+	if err != nil {
+		log.Fatal(err)
+	}
+	names, err := fs.Glob(templateFiles, "templates/console/pages/*.tmpl")
+	if err != nil {
+		log.Fatal(err)
+	}
+	pages := map[string]*template.Template{}
+	for _, name := range names {
+		page := template.Must(base.Clone())
+		_, err = page.ParseFS(templateFiles, name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pages[strings.TrimSuffix(path.Base(name), ".tmpl")] = page
+	}
+
+	return &Templates{list: list, pages: pages}
 }
 
 func (t *Templates) Execute(name string, data any) (string, error) {
@@ -28,3 +60,68 @@ func (t *Templates) Execute(name string, data any) (string, error) {
 	err := t.list.ExecuteTemplate(output, name, data)
 	return output.String(), err
 }
+
+// Render writes the page of the console named after its file, such as
+// devices, in the base layout.
+func (t *Templates) Render(w io.Writer, page string, data any) error {
+	tmpl, ok := t.pages[page]
+	if !ok {
+		return fmt.Errorf("html: unknown page %q", page)
+	}
+	return tmpl.ExecuteTemplate(w, "layout", data)
+}
+
+// Static returns the static assets of the console, such as its stylesheet.
+func Static() fs.FS {
+	static, err := fs.Sub(staticFiles, "static")
+	if err != nil {
+		log.Fatal(err)
+	}
+	return static
+}
+
+// consoleFuncs are the functions of the console templates.
+var consoleFuncs = template.FuncMap{
+	"attr": attribute,
+	"dict": dict,
+	"json": indentJSON,
+}
+
+// attribute returns the attribute of an object at a dotted path such as
+// os.name, or an empty string when it has none.
+func attribute(attributes map[string]any, path string) any {
+	var value any = attributes
+	for name := range strings.SplitSeq(path, ".") {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return ""
+		}
+		if value, ok = object[name]; !ok || value == nil {
+			return ""
+		}
+	}
+	return value
+}
+
+// dict returns a map of pairs of keys and values, to pass several values to a
+// partial.
+func dict(pairs ...any) (map[string]any, error) {
+	if len(pairs)%2 != 0 {
+		return nil, fmt.Errorf("html: dict expects pairs of keys and values")
+	}
+	values := map[string]any{}
+	for i := 0; i < len(pairs); i += 2 {
+		key, ok := pairs[i].(string)
+		if !ok {
+			return nil, fmt.Errorf("html: dict key %v is not a string", pairs[i])
+		}
+		values[key] = pairs[i+1]
+	}
+	return values, nil
+}
+
+// indentJSON returns a value as indented JSON.
+func indentJSON(value any) (string, error) {
+	data, err := json.MarshalIndent(value, "", "  ")
+	return string(data), err
+}
@@ -0,0 +1,324 @@
+// Package openapi generates an OpenAPI 3 document from the routes of the
+// server.
+//
+// A Route describes an operation with Go values: the fields of its Request
+// struct tagged with param or query are its parameters, its other fields are
+// the JSON request body, and its Response is the JSON response. Schemas are
+// derived from the types with reflection, and the validate tags of the
+// validator package are translated into schema constraints:
+//
+//	builder := openapi.NewBuilder("LinuxFleet API", "1.0.0")
+//	builder.Add(openapi.Route{
+//		Method:   http.MethodPost,
+//		Path:     "/api/registration/initiate",
+//		Request:  initiateRegistrationRequest{},
+//		Response: initiateRegistrationResponse{},
+//		Errors:   []int{http.StatusBadRequest},
+//	})
+//	document := builder.Document()
+package openapi
+
+import (
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Version is the version of the OpenAPI specification of the documents.
+const Version = "3.0.3"
+
+// Document is an OpenAPI document.
+type Document struct {
+	OpenAPI    string              `json:"openapi"`
+	Info       Info                `json:"info"`
+	Paths      map[string]PathItem `json:"paths"`
+	Components Components          `json:"components"`
+}
+
+// Info describes the API.
+type Info struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+// PathItem holds the operations of a path by lower case HTTP method.
+type PathItem map[string]*Operation
+
+// Operation describes an HTTP method on a path.
+type Operation struct {
+	OperationID string              `json:"operationId,omitempty"`
+	Summary     string              `json:"summary,omitempty"`
+	Tags        []string            `json:"tags,omitempty"`
+	Parameters  []Parameter         `json:"parameters,omitempty"`
+	RequestBody *RequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]Response `json:"responses"`
+	Deprecated  bool                `json:"deprecated,omitempty"`
+	// Security lists the security schemes that authenticate the operation.
+	Security []map[string][]string `json:"security,omitempty"`
+}
+
+// Parameter is a path or query parameter of an operation.
+type Parameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required,omitempty"`
+	Schema   *Schema `json:"schema"`
+}
+
+// RequestBody holds the schemas of the request body by media type.
+type RequestBody struct {
+	Required bool                 `json:"required,omitempty"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+// Response describes a response of an operation.
+type Response struct {
+	Description string               `json:"description"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+// MediaType holds the schema of a body.
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Components holds the schemas of the named types and the security schemes,
+// referenced by the operations.
+type Components struct {
+	Schemas         map[string]*Schema        `json:"schemas"`
+	SecuritySchemes map[string]SecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+// SecurityScheme describes how the requests of an operation are authenticated,
+// such as a bearer token in the Authorization header.
+type SecurityScheme struct {
+	Type         string `json:"type"`
+	Scheme       string `json:"scheme,omitempty"`
+	BearerFormat string `json:"bearerFormat,omitempty"`
+	Description  string `json:"description,omitempty"`
+}
+
+// Schema describes a JSON value. The empty schema accepts any value.
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Enum                 []any              `json:"enum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+}
+
+// Route describes an operation of the API.
+type Route struct {
+	Method  string
+	Path    string
+	Summary string
+	Tags    []string
+	// Request is a struct whose fields tagged with param are the path
+	// parameters, whose fields tagged with query are the query parameters
+	// and whose other fields are the JSON request body. Path parameters that
+	// are not fields of Request are documented as strings.
+	Request any
+	// Headers are the header parameters of the request.
+	Headers []Parameter
+	// Body maps the media types of a request body that is not JSON to an
+	// example of its value, such as the patches of an object.
+	Body map[string]any
+	// Response is the body of the successful response, nil when it has none.
+	Response any
+	// ResponseType is the media type of Response, application/json when empty.
+	ResponseType string
+	// Status is the status of the successful response, 200 when zero.
+	Status int
+	// Errors are the statuses of the error responses, whose body is the error
+	// of the builder.
+	Errors []int
+	// Responses are other responses of the route with their own body.
+	Responses map[int]any
+	// Deprecated marks the operations that will be removed.
+	Deprecated bool
+	// Security names the security scheme that authenticates the route, empty
+	// for the public routes.
+	Security string
+}
+
+// Builder collects the routes of the API and generates its document.
+type Builder struct {
+	mu        sync.Mutex
+	info      Info
+	routes    []Route
+	errorBody any
+	errorType string
+	security  map[string]SecurityScheme
+}
+
+// NewBuilder creates a builder for the API with the title and the version.
+func NewBuilder(title string, version string) *Builder {
+	return &Builder{info: Info{Title: title, Version: version}}
+}
+
+// SetError sets the body and its media type of the error responses.
+func (b *Builder) SetError(body any, mediaType string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.errorBody = body
+	b.errorType = mediaType
+}
+
+// AddSecurityScheme adds a security scheme that routes name in their Security.
+func (b *Builder) AddSecurityScheme(name string, scheme SecurityScheme) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.security == nil {
+		b.security = map[string]SecurityScheme{}
+	}
+	b.security[name] = scheme
+}
+
+// Add adds routes to the document.
+func (b *Builder) Add(routes ...Route) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.routes = append(b.routes, routes...)
+}
+
+// Document generates the document of the routes.
+func (b *Builder) Document() Document {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	schemas := newSchemaGenerator()
+	document := Document{
+		OpenAPI: Version,
+		Info:    b.info,
+		Paths:   map[string]PathItem{},
+	}
+	for _, route := range b.routes {
+		path := Path(route.Path)
+		item, ok := document.Paths[path]
+		if !ok {
+			item = PathItem{}
+			document.Paths[path] = item
+		}
+		item[strings.ToLower(route.Method)] = b.operation(schemas, route)
+	}
+	document.Components.Schemas = schemas.components
+	document.Components.SecuritySchemes = b.security
+	return document
+}
+
+// Documented reports whether the document has an operation for the method on
+// the path, given with echo parameters such as /api/devices/:id.
+func (d Document) Documented(method string, path string) bool {
+	_, ok := d.Paths[Path(path)][strings.ToLower(method)]
+	return ok
+}
+
+// Path converts a path with echo parameters such as /api/devices/:id into an
+// OpenAPI path such as /api/devices/{id}.
+func Path(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if name, ok := strings.CutPrefix(segment, ":"); ok {
+			segments[i] = "{" + name + "}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func (b *Builder) operation(schemas *schemaGenerator, route Route) *Operation {
+	operation := &Operation{
+		OperationID: operationID(route.Method, route.Path),
+		Summary:     route.Summary,
+		Tags:        route.Tags,
+		Responses:   map[string]Response{},
+		Deprecated:  route.Deprecated,
+	}
+	if route.Security != "" {
+		operation.Security = []map[string][]string{{route.Security: {}}}
+	}
+
+	var body *Schema
+	if route.Request != nil {
+		operation.Parameters, body = schemas.request(reflect.TypeOf(route.Request))
+	}
+	operation.Parameters = append(operation.Parameters, missingPathParameters(route.Path, operation.Parameters)...)
+	operation.Parameters = append(operation.Parameters, route.Headers...)
+	if body != nil {
+		operation.RequestBody = &RequestBody{Required: true, Content: map[string]MediaType{"application/json": {Schema: body}}}
+	}
+	if len(route.Body) > 0 {
+		operation.RequestBody = &RequestBody{Required: true, Content: map[string]MediaType{}}
+		for mediaType, value := range route.Body {
+			operation.RequestBody.Content[mediaType] = MediaType{Schema: schemas.value(value)}
+		}
+	}
+
+	status := route.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	responseType := route.ResponseType
+	if responseType == "" {
+		responseType = "application/json"
+	}
+	operation.Responses[strconv.Itoa(status)] = response(schemas, status, route.Response, responseType)
+	for _, status := range route.Errors {
+		operation.Responses[strconv.Itoa(status)] = response(schemas, status, b.errorBody, b.errorType)
+	}
+	for status, body := range route.Responses {
+		operation.Responses[strconv.Itoa(status)] = response(schemas, status, body, "application/json")
+	}
+	return operation
+}
+
+func response(schemas *schemaGenerator, status int, body any, mediaType string) Response {
+	response := Response{Description: http.StatusText(status)}
+	if body != nil {
+		response.Content = map[string]MediaType{mediaType: {Schema: schemas.value(body)}}
+	}
+	return response
+}
+
+// missingPathParameters returns the string parameters of the path that are
+// not in parameters.
+func missingPathParameters(path string, parameters []Parameter) []Parameter {
+	var missing []Parameter
+	for _, segment := range strings.Split(path, "/") {
+		name, ok := strings.CutPrefix(segment, ":")
+		if !ok {
+			continue
+		}
+		declared := slices.ContainsFunc(parameters, func(p Parameter) bool {
+			return p.In == "path" && p.Name == name
+		})
+		if !declared {
+			missing = append(missing, Parameter{Name: name, In: "path", Required: true, Schema: &Schema{Type: "string"}})
+		}
+	}
+	return missing
+}
+
+// operationID derives a unique operation ID from the method and the path,
+// such as patchApiDevicesId for PATCH /api/devices/:id.
+func operationID(method string, path string) string {
+	var id strings.Builder
+	id.WriteString(strings.ToLower(method))
+	for _, word := range strings.FieldsFunc(path, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+	}) {
+		id.WriteString(strings.ToUpper(word[:1]) + word[1:])
+	}
+	return id.String()
+}
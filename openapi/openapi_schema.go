@@ -0,0 +1,308 @@
+package openapi
+
+import (
+	"encoding"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	timeType          = reflect.TypeFor[time.Time]()
+	rawMessageType    = reflect.TypeFor[json.RawMessage]()
+	jsonMarshalerType = reflect.TypeFor[json.Marshaler]()
+	textMarshalerType = reflect.TypeFor[encoding.TextMarshaler]()
+)
+
+// schemaGenerator derives the schemas of Go types. Named struct types are
+// added to the components and referenced, so that recursive types terminate.
+type schemaGenerator struct {
+	components map[string]*Schema
+	names      map[reflect.Type]string
+}
+
+func newSchemaGenerator() *schemaGenerator {
+	return &schemaGenerator{components: map[string]*Schema{}, names: map[reflect.Type]string{}}
+}
+
+// value returns the schema of the type of a value.
+func (g *schemaGenerator) value(value any) *Schema {
+	return g.schema(reflect.TypeOf(value))
+}
+
+// request returns the parameters of a request struct and the schema of its
+// JSON body, nil when every field is a parameter.
+func (g *schemaGenerator) request(t reflect.Type) ([]Parameter, *Schema) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	var parameters []Parameter
+	body := &Schema{Type: "object", Properties: map[string]*Schema{}}
+	for _, field := range reflect.VisibleFields(t) {
+		if !field.IsExported() || field.Anonymous {
+			continue
+		}
+		rules := parseRules(field.Tag.Get("validate"))
+		for _, in := range []string{"param", "query"} {
+			name, ok := field.Tag.Lookup(in)
+			if !ok {
+				continue
+			}
+			parameter := Parameter{Name: name, In: in, Required: in == "param" || rules.required, Schema: g.field(field.Type, rules)}
+			if in == "param" {
+				parameter.In = "path"
+			}
+			parameters = append(parameters, parameter)
+		}
+		if field.Tag.Get("param") != "" || field.Tag.Get("query") != "" {
+			continue
+		}
+		g.addProperty(body, field, rules)
+	}
+	if len(body.Properties) == 0 {
+		return parameters, nil
+	}
+	return parameters, body
+}
+
+// schema returns the schema of a type, or a reference to it for named structs.
+func (g *schemaGenerator) schema(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if schema, ok := marshalerSchema(t); ok {
+		return schema
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		return &Schema{Type: "array", Items: g.schema(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		return &Schema{Ref: "#/components/schemas/" + g.component(t)}
+	default:
+		return &Schema{}
+	}
+}
+
+// component adds the schema of a named struct to the components and returns
+// its name. Types of different packages with the same name are prefixed with
+// the name of their package.
+func (g *schemaGenerator) component(t reflect.Type) string {
+	if name, ok := g.names[t]; ok {
+		return name
+	}
+	name := t.Name()
+	if _, taken := g.components[name]; taken {
+		name = pathBase(t.PkgPath()) + "." + name
+	}
+	g.names[t] = name
+	g.components[name] = &Schema{}
+	*g.components[name] = *g.object(t)
+	return name
+}
+
+// object returns the schema of the JSON properties of a struct.
+func (g *schemaGenerator) object(t reflect.Type) *Schema {
+	schema := &Schema{Type: "object", Properties: map[string]*Schema{}}
+	for _, field := range reflect.VisibleFields(t) {
+		if !field.IsExported() || field.Anonymous && field.Type.Kind() == reflect.Struct {
+			continue
+		}
+		g.addProperty(schema, field, parseRules(field.Tag.Get("validate")))
+	}
+	return schema
+}
+
+// addProperty adds a struct field to the properties of an object under its
+// JSON name. Required fields without omitempty are required properties.
+func (g *schemaGenerator) addProperty(schema *Schema, field reflect.StructField, rules rules) {
+	name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "-" && options == "" {
+		return
+	}
+	if name == "" {
+		name = field.Name
+	}
+	schema.Properties[name] = g.field(field.Type, rules)
+	if rules.required {
+		schema.Required = append(schema.Required, name)
+	}
+}
+
+// field returns the schema of a field type constrained by its validation rules.
+func (g *schemaGenerator) field(t reflect.Type, rules rules) *Schema {
+	schema := g.schema(t)
+	if len(rules.field) == 0 && len(rules.items) == 0 {
+		return schema
+	}
+	if schema.Ref != "" {
+		return schema
+	}
+	constrained := *schema
+	applyRules(&constrained, rules.field)
+	if constrained.Items != nil && len(rules.items) > 0 {
+		items := *constrained.Items
+		applyRules(&items, rules.items)
+		constrained.Items = &items
+	}
+	return &constrained
+}
+
+// marshalerSchema returns the schema of the types with their own JSON
+// encoding: times are date-time strings, raw JSON is any value and text
+// marshalers are strings.
+func marshalerSchema(t reflect.Type) (*Schema, bool) {
+	switch {
+	case t == timeType || embedsTime(t):
+		return &Schema{Type: "string", Format: "date-time"}, true
+	case t == rawMessageType:
+		return &Schema{}, true
+	case implements(t, textMarshalerType):
+		return &Schema{Type: "string"}, true
+	case implements(t, jsonMarshalerType):
+		return &Schema{}, true
+	}
+	return nil, false
+}
+
+// embedsTime reports whether a struct embeds time.Time, and so is encoded as
+// a time.
+func embedsTime(t reflect.Type) bool {
+	if t.Kind() != reflect.Struct {
+		return false
+	}
+	for i := range t.NumField() {
+		field := t.Field(i)
+		if field.Anonymous && field.Type == timeType {
+			return true
+		}
+	}
+	return false
+}
+
+func implements(t reflect.Type, iface reflect.Type) bool {
+	return t.Implements(iface) || reflect.PointerTo(t).Implements(iface)
+}
+
+func pathBase(path string) string {
+	return path[strings.LastIndex(path, "/")+1:]
+}
+
+// rules are the validate tag of a field. The rules after dive apply to the
+// items of a slice.
+type rules struct {
+	required bool
+	field    []rule
+	items    []rule
+}
+
+type rule struct {
+	name  string
+	param string
+}
+
+func parseRules(tag string) rules {
+	var parsed rules
+	dive := false
+	for _, part := range strings.Split(tag, ",") {
+		name, param, _ := strings.Cut(part, "=")
+		switch {
+		case name == "":
+		case name == "dive":
+			dive = true
+		case name == "required" && !dive:
+			parsed.required = true
+		case dive:
+			parsed.items = append(parsed.items, rule{name: name, param: param})
+		default:
+			parsed.field = append(parsed.field, rule{name: name, param: param})
+		}
+	}
+	return parsed
+}
+
+// formats maps the validate rules to the formats of the strings they accept.
+var formats = map[string]string{
+	"email":    "email",
+	"uuid":     "uuid",
+	"uuid4":    "uuid",
+	"url":      "uri",
+	"http_url": "uri",
+	"uri":      "uri",
+	"hostname": "hostname",
+	"ipv4":     "ipv4",
+	"ipv6":     "ipv6",
+	"base64":   "byte",
+}
+
+// applyRules translates validation rules into constraints of the schema:
+// lengths for strings, bounds for numbers and sizes for arrays.
+func applyRules(schema *Schema, rules []rule) {
+	for _, rule := range rules {
+		if format := formats[rule.name]; format != "" && schema.Type == "string" {
+			schema.Format = format
+			continue
+		}
+		switch rule.name {
+		case "min", "gte":
+			setBound(schema, rule.param, &schema.MinLength, &schema.Minimum, &schema.MinItems)
+		case "max", "lte":
+			setBound(schema, rule.param, &schema.MaxLength, &schema.Maximum, &schema.MaxItems)
+		case "len":
+			setBound(schema, rule.param, &schema.MinLength, &schema.Minimum, &schema.MinItems)
+			setBound(schema, rule.param, &schema.MaxLength, &schema.Maximum, &schema.MaxItems)
+		case "oneof":
+			for _, value := range strings.Fields(rule.param) {
+				schema.Enum = append(schema.Enum, enumValue(schema.Type, value))
+			}
+		}
+	}
+}
+
+// setBound sets the length, the bound or the size of the schema, depending on
+// its type.
+func setBound(schema *Schema, param string, length **int, bound **float64, size **int) {
+	value, err := strconv.ParseFloat(param, 64)
+	if err != nil {
+		return
+	}
+	switch schema.Type {
+	case "string":
+		*length = new(int)
+		**length = int(value)
+	case "integer", "number":
+		*bound = &value
+	case "array":
+		*size = new(int)
+		**size = int(value)
+	}
+}
+
+// enumValue converts a value of oneof to the type of the schema.
+func enumValue(schemaType string, value string) any {
+	if schemaType == "integer" || schemaType == "number" {
+		if number, err := strconv.ParseFloat(value, 64); err == nil {
+			return number
+		}
+	}
+	return value
+}
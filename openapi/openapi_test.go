@@ -0,0 +1,91 @@
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type testTimestamp struct {
+	time.Time
+}
+
+type testNode struct {
+	Name     string     `json:"name" validate:"required,max=64"`
+	Children []testNode `json:"children,omitempty" validate:"max=10,dive,required"`
+	Weight   float64    `json:"weight" validate:"gte=0,lte=1"`
+	Kind     int        `json:"kind" validate:"oneof=1 2"`
+	Updated  testTimestamp
+	Raw      json.RawMessage `json:"raw"`
+	Secret   string          `json:"-"`
+	internal string
+}
+
+type testRequest struct {
+	ID    string   `param:"id" validate:"required,uuid"`
+	Tags  []string `query:"tag" validate:"dive,max=8"`
+	Limit int      `query:"limit" validate:"omitempty,min=1,max=100"`
+	Node  testNode `json:"node" validate:"required"`
+}
+
+func TestDocument(t *testing.T) {
+	Convey("Scenario: A document is generated from the routes", t, func() {
+		builder := NewBuilder("Test API", "1.0.0")
+		builder.SetError(map[string]string{}, "application/problem+json")
+		builder.AddSecurityScheme("bearerAuth", SecurityScheme{Type: "http", Scheme: "bearer"})
+		builder.Add(
+			Route{Method: http.MethodPut, Path: "/nodes/:id", Request: testRequest{}, Response: testNode{}, Errors: []int{http.StatusNotFound}, Security: "bearerAuth"},
+			Route{Method: http.MethodDelete, Path: "/nodes/:id", Status: http.StatusNoContent, Deprecated: true,
+				Headers: []Parameter{{Name: "If-Match", In: "header", Schema: &Schema{Type: "string"}}}},
+		)
+		document := builder.Document()
+
+		Convey("When the operations are read", func() {
+			item := document.Paths["/nodes/{id}"]
+			put := item["put"]
+
+			Convey("Then the parameters, the body and the responses are described", func() {
+				So(document.OpenAPI, ShouldEqual, Version)
+				So(document.Documented(http.MethodDelete, "/nodes/:id"), ShouldBeTrue)
+				So(document.Documented(http.MethodGet, "/nodes/:id"), ShouldBeFalse)
+				So(put.OperationID, ShouldEqual, "putNodesId")
+				So(put.Parameters, ShouldHaveLength, 3)
+				So(put.Parameters[0], ShouldResemble, Parameter{Name: "id", In: "path", Required: true, Schema: &Schema{Type: "string", Format: "uuid"}})
+				So(put.Parameters[1].Schema.Items.MaxLength, ShouldNotBeNil)
+				So(put.Parameters[2].Required, ShouldBeFalse)
+				So(*put.Parameters[2].Schema.Maximum, ShouldEqual, 100)
+				body := put.RequestBody.Content["application/json"].Schema
+				So(body.Required, ShouldResemble, []string{"node"})
+				So(body.Properties["node"].Ref, ShouldEqual, "#/components/schemas/testNode")
+				So(put.Responses["404"].Content, ShouldContainKey, "application/problem+json")
+				So(put.Security, ShouldResemble, []map[string][]string{{"bearerAuth": {}}})
+				So(document.Components.SecuritySchemes["bearerAuth"].Scheme, ShouldEqual, "bearer")
+				So(item["delete"].Security, ShouldBeNil)
+				So(item["delete"].Deprecated, ShouldBeTrue)
+				So(item["delete"].Parameters[0].Name, ShouldEqual, "id")
+				So(item["delete"].Parameters[1].In, ShouldEqual, "header")
+				So(item["delete"].Responses["204"].Content, ShouldBeNil)
+			})
+		})
+		Convey("When the schema of a recursive struct is read", func() {
+			node := document.Components.Schemas["testNode"]
+
+			Convey("Then it references itself and its fields are constrained", func() {
+				So(node.Required, ShouldResemble, []string{"name"})
+				So(*node.Properties["name"].MaxLength, ShouldEqual, 64)
+				So(node.Properties["children"].Items.Ref, ShouldEqual, "#/components/schemas/testNode")
+				So(*node.Properties["children"].MaxItems, ShouldEqual, 10)
+				So(*node.Properties["weight"].Minimum, ShouldEqual, 0)
+				So(*node.Properties["weight"].Maximum, ShouldEqual, 1)
+				So(node.Properties["kind"].Enum, ShouldResemble, []any{1.0, 2.0})
+				So(node.Properties["Updated"], ShouldResemble, &Schema{Type: "string", Format: "date-time"})
+				So(node.Properties["raw"], ShouldResemble, &Schema{})
+				So(node.Properties, ShouldNotContainKey, "Secret")
+				So(node.Properties, ShouldNotContainKey, "internal")
+			})
+		})
+	})
+}
@@ -1,13 +1,325 @@
 package opts
 
 import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"net/mail"
+	"net/url"
 	"os"
+	"reflect"
+	"slices"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
+// Mail providers that deliver the emails sent by the server.
+const (
+	// MailProviderSendGrid sends emails with the SendGrid API.
+	MailProviderSendGrid = "sendgrid"
+	// MailProviderLog writes emails to the server log instead of sending them.
+	MailProviderLog = "log"
+)
+
+// Formats of the server log.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// minClusterSecretLength is the minimum length of the database cluster secret.
+const minClusterSecretLength = 32
+
+// minMetricsTokenLength is the minimum length of the metrics token.
+const minMetricsTokenLength = 32
+
+// redacted replaces the value of secret options when they are printed.
+const redacted = "REDACTED"
+
+// ServerOptions holds the settings of the server. Options are layered: the
+// defaults are overridden by the options file, then by the environment and
+// finally by the command line, see LoadServerOptions. Options tagged as secret
+// are redacted when the options are printed, and options tagged with restart
+// only change when the server is restarted, see Reloaded.
 type ServerOptions struct {
-	DatabaseCluster []string `yaml:"database_cluster"`
+	// ListenAddress is the address the server listens on for API requests.
+	ListenAddress string `yaml:"listen_address,omitempty" restart:"true"`
+	// TLSCertFile and TLSKeyFile are the PEM certificate and private key. The
+	// server listens for HTTPS requests when both are set.
+	TLSCertFile string `yaml:"tls_cert_file,omitempty" restart:"true"`
+	TLSKeyFile  string `yaml:"tls_key_file,omitempty" restart:"true"`
+	// ShutdownDrainDelay is how long the server keeps accepting requests after
+	// /readyz starts failing when it shuts down, so that load balancers stop
+	// sending it requests before its listeners close. ShutdownTimeout is then
+	// how long it waits for the requests in flight.
+	ShutdownDrainDelay time.Duration `yaml:"shutdown_drain_delay,omitempty"`
+	ShutdownTimeout    time.Duration `yaml:"shutdown_timeout,omitempty"`
+	// BaseURL is the external URL of the server, used for the links in emails.
+	BaseURL string `yaml:"base_url,omitempty"`
+	// TrustedProxies are the CIDR ranges of the reverse proxies in front of
+	// the server. The address of a client is read from the X-Forwarded-For
+	// header of the requests forwarded by these proxies, and is the address of
+	// the connection otherwise.
+	TrustedProxies []string `yaml:"trusted_proxies,omitempty" restart:"true"`
+	// MetricsToken is the bearer token that the scrapers send to /metrics,
+	// whose gauges cover the devices and the jobs of every organization.
+	// /metrics is not served when it is empty.
+	MetricsToken string `yaml:"metrics_token,omitempty" secret:"true"`
+
+	// DatabasePath is the path of the SQLite database.
+	DatabasePath string `yaml:"database_path,omitempty" restart:"true"`
+	// DatabaseCluster lists the replication addresses of every database node.
+	// With more than one node the writes are replicated by the leader elected
+	// among them, and DatabaseNode is the address of this node in the list.
+	// The node listens for replication on the host and port of DatabaseNode.
+	DatabaseCluster []string `yaml:"database_cluster" restart:"true"`
+	DatabaseNode    string   `yaml:"database_node,omitempty" restart:"true"`
+	// DatabaseClusterSecret signs the replication messages between the nodes.
+	// Every node of the cluster must have the same secret.
+	DatabaseClusterSecret string `yaml:"database_cluster_secret,omitempty" restart:"true" secret:"true"`
+	// MasterKeyFile holds the base64 encoded key that wraps the data encryption
+	// keys. The LINUXFLEET_MASTER_KEY environment variable takes precedence.
+	MasterKeyFile string `yaml:"master_key_file,omitempty" restart:"true"`
+	// BackupDirectory enables scheduled online backups into the directory.
+	BackupDirectory string        `yaml:"backup_directory,omitempty" restart:"true"`
+	BackupInterval  time.Duration `yaml:"backup_interval,omitempty" restart:"true"`
+	BackupKeep      int           `yaml:"backup_keep,omitempty" restart:"true"`
+
+	// MailProvider is MailProviderSendGrid or MailProviderLog.
+	MailProvider   string `yaml:"mail_provider,omitempty"`
+	SendGridAPIKey string `yaml:"sendgrid_api_key,omitempty" secret:"true"`
+	// MailFromName and MailFromAddress are the sender of the emails.
+	MailFromName    string `yaml:"mail_from_name,omitempty"`
+	MailFromAddress string `yaml:"mail_from_address,omitempty"`
+
+	// SessionLifetime is how long a login session stays valid.
+	SessionLifetime time.Duration `yaml:"session_lifetime,omitempty"`
+	// TokenLifetime is how long the tokens sent by email, such as registration
+	// links, stay valid.
+	TokenLifetime time.Duration `yaml:"token_lifetime,omitempty"`
+
+	// IdempotencyKeyLifetime is how long the response to a request sent with
+	// an Idempotency-Key header is replayed to the retries of the request.
+	IdempotencyKeyLifetime time.Duration `yaml:"idempotency_key_lifetime,omitempty"`
+
+	// RateLimits are the rate limits of the API by route group, such as
+	// registration, with the default group applying to the groups without a
+	// limit. Each client address and each authenticated administrator has its
+	// own limit in every group. RateLimitOrganization is the limit of
+	// all the clients of an organization together.
+	RateLimits            map[string]RateLimit `yaml:"rate_limits,omitempty"`
+	RateLimitOrganization RateLimit            `yaml:"rate_limit_organization,omitempty"`
+	// RateLimitStore is RateLimitStoreMemory or RateLimitStoreDatabase.
+	RateLimitStore string `yaml:"rate_limit_store,omitempty" restart:"true"`
+
+	// LogLevel is the minimum level of the logged messages: debug, info, warn
+	// or error. LogFormat is LogFormatText or LogFormatJSON.
+	LogLevel  string `yaml:"log_level,omitempty"`
+	LogFormat string `yaml:"log_format,omitempty" restart:"true"`
+}
+
+// DefaultServerOptions returns the options used for the settings that are not
+// given in the options file, the environment or the command line.
+func DefaultServerOptions() ServerOptions {
+	return ServerOptions{
+		ListenAddress:          ":8080",
+		ShutdownDrainDelay:     5 * time.Second,
+		ShutdownTimeout:        30 * time.Second,
+		BaseURL:                "http://localhost:8080",
+		DatabasePath:           "linuxfleet.db",
+		MailProvider:           MailProviderLog,
+		MailFromName:           "LinuxFleet Support",
+		MailFromAddress:        "support@linuxfleet.com",
+		SessionLifetime:        12 * time.Hour,
+		TokenLifetime:          24 * time.Hour,
+		IdempotencyKeyLifetime: 24 * time.Hour,
+		RateLimits: map[string]RateLimit{
+			DefaultRateLimitGroup: {Requests: 600, Period: time.Minute},
+			"registration":        {Requests: 10, Period: time.Minute},
+			"login":               {Requests: 10, Period: time.Minute},
+		},
+		RateLimitOrganization: RateLimit{Requests: 6000, Period: time.Minute},
+		RateLimitStore:        RateLimitStoreMemory,
+		LogLevel:              "info",
+		LogFormat:             LogFormatText,
+	}
+}
+
+// TLSEnabled reports whether the server listens for HTTPS requests.
+func (o *ServerOptions) TLSEnabled() bool {
+	return o.TLSCertFile != "" && o.TLSKeyFile != ""
+}
+
+// Validate checks every option and returns an error that describes all the
+// invalid ones, each prefixed with the name of the option in the options file.
+func (o *ServerOptions) Validate() error {
+	var errs []error
+	invalid := func(name string, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", name, fmt.Sprintf(format, args...)))
+	}
+
+	if _, _, err := net.SplitHostPort(o.ListenAddress); err != nil {
+		invalid("listen_address", "%q is not a host:port address", o.ListenAddress)
+	}
+	if (o.TLSCertFile == "") != (o.TLSKeyFile == "") {
+		invalid("tls_cert_file", "tls_cert_file and tls_key_file must be set together")
+	}
+	if o.TLSCertFile != "" {
+		if _, err := os.Stat(o.TLSCertFile); err != nil {
+			invalid("tls_cert_file", "%v", err)
+		}
+	}
+	if o.TLSKeyFile != "" {
+		if _, err := os.Stat(o.TLSKeyFile); err != nil {
+			invalid("tls_key_file", "%v", err)
+		}
+	}
+	if o.ShutdownDrainDelay < 0 {
+		invalid("shutdown_drain_delay", "must not be negative, got %v", o.ShutdownDrainDelay)
+	}
+	if o.ShutdownTimeout <= 0 {
+		invalid("shutdown_timeout", "must be positive, got %v", o.ShutdownTimeout)
+	}
+	if baseURL, err := url.Parse(o.BaseURL); err != nil || (baseURL.Scheme != "http" && baseURL.Scheme != "https") || baseURL.Host == "" {
+		invalid("base_url", "%q is not an absolute http or https URL", o.BaseURL)
+	}
+	for _, proxy := range o.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil {
+			invalid("trusted_proxies", "%q is not a CIDR range", proxy)
+		}
+	}
+	if o.MetricsToken != "" && len(o.MetricsToken) < minMetricsTokenLength {
+		invalid("metrics_token", "must have at least %d characters", minMetricsTokenLength)
+	}
+
+	if o.DatabasePath == "" {
+		invalid("database_path", "must not be empty")
+	}
+	if len(o.DatabaseCluster) > 1 && !slices.Contains(o.DatabaseCluster, o.DatabaseNode) {
+		invalid("database_node", "%q is not in database_cluster", o.DatabaseNode)
+	}
+	if len(o.DatabaseCluster) > 1 && len(o.DatabaseClusterSecret) < minClusterSecretLength {
+		invalid("database_cluster_secret", "must have at least %d characters when database_cluster has more than one node", minClusterSecretLength)
+	}
+	if o.BackupInterval < 0 {
+		invalid("backup_interval", "must not be negative, got %v", o.BackupInterval)
+	}
+	if o.BackupKeep < 0 {
+		invalid("backup_keep", "must not be negative, got %d", o.BackupKeep)
+	}
+
+	switch o.MailProvider {
+	case MailProviderSendGrid:
+		if o.SendGridAPIKey == "" {
+			invalid("sendgrid_api_key", "must be set when mail_provider is %s", MailProviderSendGrid)
+		}
+	case MailProviderLog:
+	default:
+		invalid("mail_provider", "must be %s or %s, got %q", MailProviderSendGrid, MailProviderLog, o.MailProvider)
+	}
+	if address, err := mail.ParseAddress(o.MailFromAddress); err != nil || address.Address != o.MailFromAddress {
+		invalid("mail_from_address", "%q is not an email address", o.MailFromAddress)
+	}
+
+	if o.SessionLifetime <= 0 {
+		invalid("session_lifetime", "must be positive, got %v", o.SessionLifetime)
+	}
+	if o.TokenLifetime <= 0 {
+		invalid("token_lifetime", "must be positive, got %v", o.TokenLifetime)
+	}
+	if o.IdempotencyKeyLifetime <= 0 {
+		invalid("idempotency_key_lifetime", "must be positive, got %v", o.IdempotencyKeyLifetime)
+	}
+
+	for _, group := range slices.Sorted(maps.Keys(o.RateLimits)) {
+		if limit := o.RateLimits[group]; !limit.valid() {
+			invalid("rate_limits", "invalid rate limit of %s: %v", group, limit)
+		}
+	}
+	if !o.RateLimitOrganization.valid() {
+		invalid("rate_limit_organization", "invalid rate limit %v", o.RateLimitOrganization)
+	}
+	if o.RateLimitStore != RateLimitStoreMemory && o.RateLimitStore != RateLimitStoreDatabase {
+		invalid("rate_limit_store", "must be %s or %s, got %q", RateLimitStoreMemory, RateLimitStoreDatabase, o.RateLimitStore)
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(o.LogLevel)); err != nil {
+		invalid("log_level", "must be debug, info, warn or error, got %q", o.LogLevel)
+	}
+	if o.LogFormat != LogFormatText && o.LogFormat != LogFormatJSON {
+		invalid("log_format", "must be %s or %s, got %q", LogFormatText, LogFormatJSON, o.LogFormat)
+	}
+	return errors.Join(errs...)
+}
+
+// Reloaded returns the options to run with when next is loaded while the
+// server runs with o. The options that need a restart keep their value in o,
+// and the names of those that differ in next are returned.
+func (o ServerOptions) Reloaded(next ServerOptions) (ServerOptions, []string) {
+	var ignored []string
+	current := reflect.ValueOf(o)
+	reloaded := reflect.ValueOf(&next).Elem()
+	for _, field := range optionFields() {
+		if !field.restart {
+			continue
+		}
+		value := current.FieldByIndex(field.index)
+		if !reflect.DeepEqual(value.Interface(), reloaded.FieldByIndex(field.index).Interface()) {
+			ignored = append(ignored, field.name)
+			reloaded.FieldByIndex(field.index).Set(value)
+		}
+	}
+	return next, ignored
+}
+
+// Redacted returns a copy of the options with the secret options that are set
+// replaced by REDACTED.
+func (o ServerOptions) Redacted() ServerOptions {
+	value := reflect.ValueOf(&o).Elem()
+	for _, field := range optionFields() {
+		fieldValue := value.FieldByIndex(field.index)
+		if field.secret && !fieldValue.IsZero() {
+			fieldValue.SetString(redacted)
+		}
+	}
+	return o
+}
+
+// String returns the options in YAML format with the secrets redacted.
+func (o ServerOptions) String() string {
+	redactedOptions := o.Redacted()
+	yamlData, err := redactedOptions.Marshal()
+	if err != nil {
+		return err.Error()
+	}
+	return string(yamlData)
+}
+
+// LogValue logs the options as a group of attributes named after the options,
+// with the secrets redacted.
+func (o ServerOptions) LogValue() slog.Value {
+	value := reflect.ValueOf(o.Redacted())
+	var attrs []slog.Attr
+	for _, field := range optionFields() {
+		fieldValue := value.FieldByIndex(field.index)
+		if !fieldValue.IsZero() {
+			attrs = append(attrs, slog.Any(field.name, fieldValue.Interface()))
+		}
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// SlogLevel returns the level of LogLevel, or info when it is invalid.
+func (o *ServerOptions) SlogLevel() slog.Level {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(o.LogLevel)); err != nil {
+		return slog.LevelInfo
+	}
+	return level
 }
 
 // Marshal the Options struct to YAML format
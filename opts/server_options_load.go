@@ -0,0 +1,220 @@
+package opts
+
+import (
+	"flag"
+	"fmt"
+	"maps"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvPrefix starts the name of the environment variable of every option. The
+// variable is named after the option in upper case, so base_url is set with
+// LINUXFLEET_BASE_URL.
+const EnvPrefix = "LINUXFLEET_"
+
+// ConfigEnv names the options file when the -config flag is not given.
+const ConfigEnv = EnvPrefix + "CONFIG"
+
+// optionUsage describes the options in the command line help.
+var optionUsage = map[string]string{
+	"listen_address":           "address to listen on for API requests",
+	"tls_cert_file":            "PEM certificate file; serves HTTPS together with -tls-key-file",
+	"tls_key_file":             "PEM private key file of the certificate",
+	"shutdown_drain_delay":     "time to keep serving after /readyz fails when shutting down",
+	"shutdown_timeout":         "time to wait for requests in flight when shutting down",
+	"base_url":                 "external URL of the server, used for the links in emails",
+	"trusted_proxies":          "comma separated CIDR ranges of the proxies whose X-Forwarded-For header is trusted",
+	"metrics_token":            "bearer token required to scrape /metrics; /metrics is disabled when empty",
+	"database_path":            "path of the database",
+	"database_cluster":         "comma separated replication addresses of every database node",
+	"database_node":            "replication address of this node in the database cluster",
+	"database_cluster_secret":  "secret shared by the database nodes to sign replication messages",
+	"master_key_file":          "file with the base64 encoded master encryption key",
+	"backup_directory":         "directory of the scheduled database backups",
+	"backup_interval":          "time between two database backups",
+	"backup_keep":              "number of database backups to keep",
+	"mail_provider":            "provider that delivers emails: sendgrid or log",
+	"sendgrid_api_key":         "SendGrid API key",
+	"mail_from_name":           "name of the sender of the emails",
+	"mail_from_address":        "email address of the sender of the emails",
+	"session_lifetime":         "how long a login session stays valid",
+	"token_lifetime":           "how long the tokens sent by email stay valid",
+	"idempotency_key_lifetime": "how long the responses to the requests with an Idempotency-Key are replayed",
+	"rate_limits":              "comma separated group=requests/period[:burst] rate limits of the API route groups",
+	"rate_limit_organization":  "requests/period[:burst] rate limit of all the clients of an organization",
+	"rate_limit_store":         "store of the rate limits: memory, or database to share them between the servers using the same database_path on one host",
+	"log_level":                "minimum level of the logged messages: debug, info, warn or error",
+	"log_format":               "format of the log: text or json",
+}
+
+// optionField is a field of ServerOptions that can be set from a string.
+type optionField struct {
+	name    string
+	index   []int
+	secret  bool
+	restart bool
+}
+
+// optionFields returns the fields of ServerOptions in declaration order.
+func optionFields() []optionField {
+	var fields []optionField
+	for _, structField := range reflect.VisibleFields(reflect.TypeFor[ServerOptions]()) {
+		name, _, _ := strings.Cut(structField.Tag.Get("yaml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		fields = append(fields, optionField{
+			name:    name,
+			index:   structField.Index,
+			secret:  structField.Tag.Get("secret") == "true",
+			restart: structField.Tag.Get("restart") == "true",
+		})
+	}
+	return fields
+}
+
+// envName returns the environment variable of the option.
+func (field optionField) envName() string {
+	return EnvPrefix + strings.ToUpper(field.name)
+}
+
+// flagName returns the command line flag of the option.
+func (field optionField) flagName() string {
+	return strings.ReplaceAll(field.name, "_", "-")
+}
+
+// set parses value into the field of options. Lists are comma separated and
+// the rate limits are group=limit pairs, which replace the limits of those
+// groups only.
+func (field optionField) set(options *ServerOptions, value string) error {
+	fieldValue := reflect.ValueOf(options).Elem().FieldByIndex(field.index)
+	switch fieldValue.Interface().(type) {
+	case string:
+		fieldValue.SetString(value)
+	case []string:
+		var list []string
+		for element := range strings.SplitSeq(value, ",") {
+			if element = strings.TrimSpace(element); element != "" {
+				list = append(list, element)
+			}
+		}
+		fieldValue.Set(reflect.ValueOf(list))
+	case time.Duration:
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", value)
+		}
+		fieldValue.SetInt(int64(duration))
+	case int:
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		fieldValue.SetInt(int64(number))
+	case RateLimit:
+		var limit RateLimit
+		if err := limit.UnmarshalText([]byte(value)); err != nil {
+			return err
+		}
+		fieldValue.Set(reflect.ValueOf(limit))
+	case map[string]RateLimit:
+		limits := maps.Clone(fieldValue.Interface().(map[string]RateLimit))
+		if limits == nil {
+			limits = map[string]RateLimit{}
+		}
+		for pair := range strings.SplitSeq(value, ",") {
+			if pair = strings.TrimSpace(pair); pair == "" {
+				continue
+			}
+			group, text, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("invalid rate limit %q, expected group=requests/period[:burst]", pair)
+			}
+			var limit RateLimit
+			if err := limit.UnmarshalText([]byte(text)); err != nil {
+				return err
+			}
+			limits[strings.TrimSpace(group)] = limit
+		}
+		fieldValue.Set(reflect.ValueOf(limits))
+	default:
+		return fmt.Errorf("unsupported option type %v", fieldValue.Type())
+	}
+	return nil
+}
+
+// ApplyEnv overrides the options with the environment variables that are set,
+// using lookupEnv to read them. os.LookupEnv reads the process environment.
+func (o *ServerOptions) ApplyEnv(lookupEnv func(string) (string, bool)) error {
+	for _, field := range optionFields() {
+		value, ok := lookupEnv(field.envName())
+		if !ok {
+			continue
+		}
+		err := field.set(o, value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", field.envName(), err)
+		}
+	}
+	return nil
+}
+
+// LoadServerOptions loads the options from every layer, each overriding the
+// previous one: the defaults, the options file, the environment variables and
+// the command line arguments. The options file is named by the -config flag
+// or the LINUXFLEET_CONFIG environment variable. Every option has a flag named
+// after it, with dashes instead of underscores, such as -base-url. The loaded
+// options are validated. flag.ErrHelp is returned when the arguments ask for
+// help, after the usage is printed.
+func LoadServerOptions(name string, args []string, lookupEnv func(string) (string, bool)) (ServerOptions, error) {
+	options := DefaultServerOptions()
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	configFile := flags.String("config", "", "path of the YAML options file (env "+ConfigEnv+")")
+	// The flags are parsed first to find the options file, but they are
+	// applied last, on top of the file and the environment.
+	flagOptions := DefaultServerOptions()
+	type flagValue struct {
+		field optionField
+		value string
+	}
+	var flagged []flagValue
+	for _, field := range optionFields() {
+		usage := fmt.Sprintf("%s (env %s)", optionUsage[field.name], field.envName())
+		flags.Func(field.flagName(), usage, func(value string) error {
+			flagged = append(flagged, flagValue{field, value})
+			return field.set(&flagOptions, value)
+		})
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return options, err
+	}
+	if flags.NArg() > 0 {
+		return options, fmt.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+
+	if *configFile == "" {
+		*configFile, _ = lookupEnv(ConfigEnv)
+	}
+	if *configFile != "" {
+		err = options.ReadOptions(*configFile)
+		if err != nil {
+			return options, err
+		}
+	}
+	err = options.ApplyEnv(lookupEnv)
+	if err != nil {
+		return options, err
+	}
+	for _, flagged := range flagged {
+		err = flagged.field.set(&options, flagged.value)
+		if err != nil {
+			return options, err
+		}
+	}
+	return options, options.Validate()
+}
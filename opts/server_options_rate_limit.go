@@ -0,0 +1,113 @@
+package opts
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jrpalma/linuxfleet/ratelimit"
+)
+
+// Stores of the rate limit buckets.
+const (
+	// RateLimitStoreMemory keeps the buckets in the memory of each server, so
+	// that every server of a deployment enforces the limits on its own.
+	RateLimitStoreMemory = "memory"
+	// RateLimitStoreDatabase keeps the buckets in a SQLite file next to the
+	// database, named after database_path with a -ratelimit suffix. Only the
+	// servers on one host that open the same file share the limits. The
+	// buckets are not replicated, so every node of a database cluster has its
+	// own.
+	RateLimitStoreDatabase = "database"
+)
+
+// DefaultRateLimitGroup is the route group whose limit applies to the route
+// groups without a limit of their own.
+const DefaultRateLimitGroup = "default"
+
+// unlimited is the text of the zero RateLimit.
+const unlimited = "unlimited"
+
+// RateLimit allows Requests requests per Period, with bursts of up to Burst
+// requests, or Requests when Burst is zero. The zero RateLimit is unlimited.
+//
+// A rate limit is written as requests/period[:burst], such as 60/1m or
+// 60/1m:120, or as unlimited.
+type RateLimit struct {
+	Requests int
+	Period   time.Duration
+	Burst    int
+}
+
+// Unlimited reports whether the rate limit allows every request.
+func (r RateLimit) Unlimited() bool {
+	return r.Requests == 0
+}
+
+// valid reports whether the rate limit is unlimited or has a positive period.
+func (r RateLimit) valid() bool {
+	return r.Requests >= 0 && r.Burst >= 0 && (r.Unlimited() || r.Period > 0)
+}
+
+// Limit returns the limit of the token buckets of the rate limit.
+func (r RateLimit) Limit() ratelimit.Limit {
+	return ratelimit.Every(r.Requests, r.Period, r.Burst)
+}
+
+// String returns the rate limit as requests/period[:burst].
+func (r RateLimit) String() string {
+	if r.Unlimited() {
+		return unlimited
+	}
+	text := fmt.Sprintf("%d/%v", r.Requests, r.Period)
+	if r.Burst != 0 {
+		text += ":" + strconv.Itoa(r.Burst)
+	}
+	return text
+}
+
+// MarshalText returns the rate limit as requests/period[:burst].
+func (r RateLimit) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalText parses a rate limit written as requests/period[:burst] or
+// unlimited.
+func (r *RateLimit) UnmarshalText(text []byte) error {
+	value := strings.TrimSpace(string(text))
+	if value == unlimited || value == "" {
+		*r = RateLimit{}
+		return nil
+	}
+
+	requests, period, ok := strings.Cut(value, "/")
+	if !ok {
+		return fmt.Errorf("invalid rate limit %q, expected requests/period[:burst]", value)
+	}
+	period, burst, hasBurst := strings.Cut(period, ":")
+	var limit RateLimit
+	var err error
+	if limit.Requests, err = strconv.Atoi(requests); err != nil || limit.Requests <= 0 {
+		return fmt.Errorf("invalid rate limit %q, the requests must be a positive integer", value)
+	}
+	if limit.Period, err = time.ParseDuration(period); err != nil || limit.Period <= 0 {
+		return fmt.Errorf("invalid rate limit %q, the period must be a positive duration", value)
+	}
+	if hasBurst {
+		if limit.Burst, err = strconv.Atoi(burst); err != nil || limit.Burst <= 0 {
+			return fmt.Errorf("invalid rate limit %q, the burst must be a positive integer", value)
+		}
+	}
+	*r = limit
+	return nil
+}
+
+// RateLimit returns the rate limit of the route group, or the limit of the
+// default group when the group has none.
+func (o *ServerOptions) RateLimit(group string) RateLimit {
+	if limit, ok := o.RateLimits[group]; ok {
+		return limit
+	}
+	return o.RateLimits[DefaultRateLimitGroup]
+}
@@ -1,8 +1,12 @@
 package opts
 
 import (
+	"fmt"
+	"log/slog"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -37,6 +41,11 @@ func TestUnmarshal(t *testing.T) {
 			[]byte("database_cluster: [db1, db2]\n"),
 			ServerOptions{DatabaseCluster: []string{"db1", "db2"}},
 		},
+		{
+			"BackupTest",
+			[]byte("backup_directory: /var/backups/linuxfleet\nbackup_interval: 12h\nbackup_keep: 14\n"),
+			ServerOptions{BackupDirectory: "/var/backups/linuxfleet", BackupInterval: 12 * time.Hour, BackupKeep: 14},
+		},
 	}
 
 	for _, tc := range testCases {
@@ -78,3 +87,228 @@ func TestWriteAndReadOptions(t *testing.T) {
 		})
 	}
 }
+
+func TestLoadServerOptions(t *testing.T) {
+	configFile, err := os.CreateTemp("", "test_options")
+	assert.NoError(t, err)
+	defer os.Remove(configFile.Name())
+	_, err = configFile.WriteString("listen_address: :9000\nbase_url: https://file.example.com\ndatabase_path: file.db\ntoken_lifetime: 1h\n")
+	assert.NoError(t, err)
+	assert.NoError(t, configFile.Close())
+
+	env := map[string]string{
+		ConfigEnv:                            configFile.Name(),
+		"LINUXFLEET_BASE_URL":                "https://env.example.com",
+		"LINUXFLEET_BACKUP_KEEP":             "7",
+		"LINUXFLEET_DATABASE_PATH":           "env.db",
+		"LINUXFLEET_DATABASE_CLUSTER_SECRET": "0123456789abcdef0123456789abcdef",
+	}
+	lookupEnv := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+
+	options, err := LoadServerOptions("test", []string{"-database-path", "flag.db", "-database-cluster", "db1:7946, db2:7946", "-database-node", "db1:7946"}, lookupEnv)
+	assert.NoError(t, err)
+
+	expected := DefaultServerOptions()
+	expected.ListenAddress = ":9000"
+	expected.TokenLifetime = time.Hour
+	expected.BaseURL = "https://env.example.com"
+	expected.BackupKeep = 7
+	expected.DatabasePath = "flag.db"
+	expected.DatabaseCluster = []string{"db1:7946", "db2:7946"}
+	expected.DatabaseNode = "db1:7946"
+	expected.DatabaseClusterSecret = "0123456789abcdef0123456789abcdef"
+	assert.Equal(t, expected, options)
+}
+
+func TestLoadServerOptionsErrors(t *testing.T) {
+	noEnv := func(string) (string, bool) { return "", false }
+	testCases := []struct {
+		name     string
+		args     []string
+		env      map[string]string
+		expected string
+	}{
+		{"InvalidFlag", []string{"-backup-interval", "daily"}, nil, `invalid duration "daily"`},
+		{"InvalidEnv", nil, map[string]string{"LINUXFLEET_BACKUP_KEEP": "many"}, `LINUXFLEET_BACKUP_KEEP: invalid integer "many"`},
+		{"MissingConfig", []string{"-config", "/nonexistent/linuxfleet.yaml"}, nil, "no such file or directory"},
+		{"Argument", []string{"serve"}, nil, `unexpected argument "serve"`},
+		{"Invalid", []string{"-mail-provider", "smtp"}, nil, "mail_provider: must be sendgrid or log"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			lookupEnv := noEnv
+			if tc.env != nil {
+				lookupEnv = func(name string) (string, bool) {
+					value, ok := tc.env[name]
+					return value, ok
+				}
+			}
+			_, err := LoadServerOptions("test", tc.args, lookupEnv)
+			assert.ErrorContains(t, err, tc.expected)
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	options := DefaultServerOptions()
+	assert.NoError(t, options.Validate())
+
+	options.ListenAddress = "8080"
+	options.TLSCertFile = "/nonexistent/cert.pem"
+	options.BaseURL = "localhost:8080"
+	options.TrustedProxies = []string{"10.0.0.0/8", "10.0.0.1"}
+	options.DatabaseCluster = []string{"db1:7946", "db2:7946"}
+	options.DatabaseNode = "db3:7946"
+	options.MailProvider = MailProviderSendGrid
+	options.MailFromAddress = "LinuxFleet <support@linuxfleet.com>"
+	options.TokenLifetime = 0
+
+	err := options.Validate()
+	assert.Error(t, err)
+	lines := strings.Split(err.Error(), "\n")
+	assert.Equal(t, []string{
+		`listen_address: "8080" is not a host:port address`,
+		"tls_cert_file: tls_cert_file and tls_key_file must be set together",
+		"tls_cert_file: stat /nonexistent/cert.pem: no such file or directory",
+		`base_url: "localhost:8080" is not an absolute http or https URL`,
+		`trusted_proxies: "10.0.0.1" is not a CIDR range`,
+		`database_node: "db3:7946" is not in database_cluster`,
+		"database_cluster_secret: must have at least 32 characters when database_cluster has more than one node",
+		"sendgrid_api_key: must be set when mail_provider is sendgrid",
+		`mail_from_address: "LinuxFleet <support@linuxfleet.com>" is not an email address`,
+		"token_lifetime: must be positive, got 0s",
+	}, lines)
+}
+
+func TestRedacted(t *testing.T) {
+	options := DefaultServerOptions()
+	options.MailProvider = MailProviderSendGrid
+	options.SendGridAPIKey = "SG.secret"
+
+	redactedOptions := options.Redacted()
+	assert.Equal(t, "REDACTED", redactedOptions.SendGridAPIKey)
+	assert.Equal(t, "SG.secret", options.SendGridAPIKey)
+
+	printed := fmt.Sprint(options)
+	assert.Contains(t, printed, "sendgrid_api_key: REDACTED")
+	assert.NotContains(t, printed, "SG.secret")
+
+	options.SendGridAPIKey = ""
+	assert.Empty(t, options.Redacted().SendGridAPIKey)
+}
+
+func TestReloaded(t *testing.T) {
+	current := DefaultServerOptions()
+	next := current
+	next.ListenAddress = ":9090"
+	next.DatabaseCluster = []string{"db1:7946", "db2:7946"}
+	next.BaseURL = "https://fleet.example.com"
+	next.TokenLifetime = time.Hour
+
+	reloaded, ignored := current.Reloaded(next)
+	assert.Equal(t, []string{"listen_address", "database_cluster"}, ignored)
+
+	expected := current
+	expected.BaseURL = "https://fleet.example.com"
+	expected.TokenLifetime = time.Hour
+	assert.Equal(t, expected, reloaded)
+
+	_, ignored = current.Reloaded(current)
+	assert.Empty(t, ignored)
+}
+
+func TestLogValue(t *testing.T) {
+	options := DefaultServerOptions()
+	options.MailProvider = MailProviderSendGrid
+	options.SendGridAPIKey = "SG.secret"
+
+	var buffer strings.Builder
+	logger := slog.New(slog.NewTextHandler(&buffer, nil))
+	logger.Info("starting", "options", options)
+
+	assert.Contains(t, buffer.String(), "options.listen_address=:8080")
+	assert.Contains(t, buffer.String(), "options.sendgrid_api_key=REDACTED")
+	assert.NotContains(t, buffer.String(), "SG.secret")
+	assert.NotContains(t, buffer.String(), "options.tls_cert_file")
+}
+
+func TestSlogLevel(t *testing.T) {
+	options := DefaultServerOptions()
+	assert.Equal(t, slog.LevelInfo, options.SlogLevel())
+	options.LogLevel = "debug"
+	assert.Equal(t, slog.LevelDebug, options.SlogLevel())
+
+	options.LogLevel = "verbose"
+	assert.ErrorContains(t, options.Validate(), `log_level: must be debug, info, warn or error, got "verbose"`)
+}
+
+func TestRateLimit(t *testing.T) {
+	testCases := []struct {
+		text     string
+		expected RateLimit
+		err      string
+	}{
+		{"60/1m0s", RateLimit{Requests: 60, Period: time.Minute}, ""},
+		{"10/1s:50", RateLimit{Requests: 10, Period: time.Second, Burst: 50}, ""},
+		{"unlimited", RateLimit{}, ""},
+		{"60", RateLimit{}, "expected requests/period[:burst]"},
+		{"0/1m", RateLimit{}, "the requests must be a positive integer"},
+		{"60/soon", RateLimit{}, "the period must be a positive duration"},
+		{"60/1m:-1", RateLimit{}, "the burst must be a positive integer"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.text, func(t *testing.T) {
+			var limit RateLimit
+			err := limit.UnmarshalText([]byte(tc.text))
+			if tc.err != "" {
+				assert.ErrorContains(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, limit)
+			assert.Equal(t, tc.text, limit.String())
+		})
+	}
+}
+
+func TestLoadRateLimits(t *testing.T) {
+	configFile, err := os.CreateTemp("", "test_options")
+	assert.NoError(t, err)
+	defer os.Remove(configFile.Name())
+	_, err = configFile.WriteString("rate_limits:\n  search: 30/1m\n  devices: unlimited\nrate_limit_store: database\n")
+	assert.NoError(t, err)
+	assert.NoError(t, configFile.Close())
+
+	env := map[string]string{"LINUXFLEET_RATE_LIMIT_ORGANIZATION": "100/1s:500"}
+	lookupEnv := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+	options, err := LoadServerOptions("test", []string{"-config", configFile.Name(), "-rate-limits", "registration=5/1h, default=100/1m"}, lookupEnv)
+	assert.NoError(t, err)
+
+	assert.Equal(t, RateLimitStoreDatabase, options.RateLimitStore)
+	assert.Equal(t, RateLimit{Requests: 100, Period: time.Second, Burst: 500}, options.RateLimitOrganization)
+	assert.Equal(t, RateLimit{Requests: 5, Period: time.Hour}, options.RateLimit("registration"))
+	assert.Equal(t, RateLimit{Requests: 100, Period: time.Minute}, options.RateLimit(DefaultRateLimitGroup))
+	assert.True(t, options.RateLimit("devices").Unlimited())
+	// The groups without a limit have the limit of the default group.
+	assert.Equal(t, RateLimit{Requests: 100, Period: time.Minute}, options.RateLimit("jobs"))
+
+	yamlData, err := options.Marshal()
+	assert.NoError(t, err)
+	var unmarshaled ServerOptions
+	assert.NoError(t, unmarshaled.Unmarshal(yamlData))
+	assert.Equal(t, options.RateLimitOrganization, unmarshaled.RateLimitOrganization)
+	assert.Equal(t, options.RateLimits, unmarshaled.RateLimits)
+
+	options.RateLimitStore = "redis"
+	options.RateLimits["search"] = RateLimit{Requests: 10}
+	assert.EqualError(t, options.Validate(), "rate_limits: invalid rate limit of search: 10/0s\n"+
+		`rate_limit_store: must be memory or database, got "redis"`)
+}
@@ -0,0 +1,182 @@
+// Package ratelimit limits the rate of requests with token buckets.
+//
+// A bucket holds up to Burst tokens and is refilled at Rate tokens per second.
+// Every request takes a token and is rejected when the bucket is empty, so a
+// client can send a burst of requests and then Rate requests per second. A
+// Store holds the buckets of the clients by key, and a request takes a token
+// from all of its buckets or from none:
+//
+//	store := ratelimit.NewMemoryStore()
+//	limit := ratelimit.Every(60, time.Minute, 0)
+//	results, err := store.Take([]ratelimit.Request{{Key: "ip:192.0.2.1", Limit: limit}}, time.Now())
+//	if err == nil && !results[0].Allowed {
+//		// retry after results[0].RetryAfter
+//	}
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often a memory store forgets the full buckets.
+const sweepInterval = time.Minute
+
+// Limit is the rate and the burst of a bucket.
+type Limit struct {
+	// Rate is the number of tokens added to the bucket every second.
+	Rate float64
+	// Burst is the number of tokens of a full bucket.
+	Burst float64
+}
+
+// Every returns the limit of requests per period, with a burst of burst
+// requests, or requests when burst is zero.
+func Every(requests int, period time.Duration, burst int) Limit {
+	if burst <= 0 {
+		burst = requests
+	}
+	return Limit{Rate: float64(requests) / period.Seconds(), Burst: float64(burst)}
+}
+
+// Result is the outcome of taking a token from a bucket.
+type Result struct {
+	Allowed bool
+	// Limit is the number of tokens of a full bucket and Remaining the
+	// number of whole tokens left.
+	Limit     int
+	Remaining int
+	// Reset is the time until the bucket is full again.
+	Reset time.Duration
+	// RetryAfter is the time until a token is available when the request is
+	// not allowed.
+	RetryAfter time.Duration
+}
+
+// Bucket is the state of a token bucket. The zero bucket is full.
+type Bucket struct {
+	Tokens  float64
+	Updated time.Time
+}
+
+// Take refills the bucket for the time elapsed since it was updated and takes
+// a token at now. It returns the bucket after the request.
+func (b Bucket) Take(limit Limit, now time.Time) (Bucket, Result) {
+	if b.Updated.IsZero() {
+		b.Tokens = limit.Burst
+	} else if elapsed := now.Sub(b.Updated); elapsed > 0 {
+		b.Tokens = math.Min(limit.Burst, b.Tokens+elapsed.Seconds()*limit.Rate)
+	}
+	b.Updated = now
+
+	result := Result{Limit: int(limit.Burst)}
+	if b.Tokens >= 1 {
+		b.Tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = seconds((1 - b.Tokens) / limit.Rate)
+	}
+	result.Remaining = int(b.Tokens)
+	result.Reset = b.untilFull(limit)
+	return b, result
+}
+
+// TakeAll takes a token from every bucket at now when all of them have one,
+// so that a request rejected by one bucket does not use up the others. When
+// one is empty no token is taken: the results of the empty buckets are not
+// allowed and the others report the tokens they still hold. It returns the
+// buckets after the request with their results.
+func TakeAll(buckets []Bucket, limits []Limit, now time.Time) ([]Bucket, []Result) {
+	taken := make([]Bucket, len(buckets))
+	results := make([]Result, len(buckets))
+	allowed := true
+	for i, bucket := range buckets {
+		taken[i], results[i] = bucket.Take(limits[i], now)
+		allowed = allowed && results[i].Allowed
+	}
+	if allowed {
+		return taken, results
+	}
+	for i := range taken {
+		if results[i].Allowed {
+			taken[i].Tokens++
+			results[i].Remaining = int(taken[i].Tokens)
+			results[i].Reset = taken[i].untilFull(limits[i])
+		}
+	}
+	return taken, results
+}
+
+// untilFull returns the time until the bucket is full again.
+func (b Bucket) untilFull(limit Limit) time.Duration {
+	return seconds((limit.Burst - b.Tokens) / limit.Rate)
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(math.Ceil(s * float64(time.Second)))
+}
+
+// Request is the limit of the bucket of a key that a request takes a token from.
+type Request struct {
+	Key   string
+	Limit Limit
+}
+
+// Store holds the buckets of the clients by key.
+type Store interface {
+	// Take takes a token from the buckets of the requests at now as one
+	// operation, see TakeAll. The results are in the order of the requests.
+	Take(requests []Request, now time.Time) ([]Result, error)
+}
+
+// MemoryStore holds the buckets in memory, for a single server instance.
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]memoryBucket
+	swept   time.Time
+}
+
+type memoryBucket struct {
+	bucket Bucket
+	full   time.Time
+}
+
+// NewMemoryStore creates an empty memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: map[string]memoryBucket{}}
+}
+
+// Take takes a token from the buckets of the requests at now, see TakeAll. The
+// buckets that are full again are forgotten, since a missing bucket is full.
+func (s *MemoryStore) Take(requests []Request, now time.Time) ([]Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.swept) >= sweepInterval {
+		for key, bucket := range s.buckets {
+			if !bucket.full.After(now) {
+				delete(s.buckets, key)
+			}
+		}
+		s.swept = now
+	}
+
+	buckets := make([]Bucket, len(requests))
+	limits := make([]Limit, len(requests))
+	for i, request := range requests {
+		buckets[i] = s.buckets[request.Key].bucket
+		limits[i] = request.Limit
+	}
+	buckets, results := TakeAll(buckets, limits, now)
+	for i, request := range requests {
+		s.buckets[request.Key] = memoryBucket{bucket: buckets[i], full: now.Add(results[i].Reset)}
+	}
+	return results, nil
+}
+
+// Len returns the number of buckets held by the store.
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.buckets)
+}
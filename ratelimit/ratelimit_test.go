@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBucket(t *testing.T) {
+	Convey("Scenario: A client takes tokens from its bucket", t, func() {
+		limit := Every(60, time.Minute, 3)
+		now := time.Unix(1000, 0)
+		var bucket Bucket
+		var result Result
+
+		Convey("When it sends a burst of requests", func() {
+			for range 3 {
+				bucket, result = bucket.Take(limit, now)
+				So(result.Allowed, ShouldBeTrue)
+			}
+			So(result.Remaining, ShouldEqual, 0)
+			So(result.Limit, ShouldEqual, 3)
+			So(result.Reset, ShouldEqual, 3*time.Second)
+			bucket, result = bucket.Take(limit, now)
+
+			Convey("Then the next request is rejected until a token is added", func() {
+				So(result.Allowed, ShouldBeFalse)
+				So(result.RetryAfter, ShouldEqual, time.Second)
+				bucket, result = bucket.Take(limit, now.Add(time.Second))
+				So(result.Allowed, ShouldBeTrue)
+				So(result.Remaining, ShouldEqual, 0)
+			})
+			Convey("Then the bucket never holds more than the burst", func() {
+				_, result = bucket.Take(limit, now.Add(time.Hour))
+				So(result.Allowed, ShouldBeTrue)
+				So(result.Remaining, ShouldEqual, 2)
+			})
+		})
+	})
+}
+
+func TestMemoryStore(t *testing.T) {
+	Convey("Scenario: The buckets of the clients are held in memory", t, func() {
+		store := NewMemoryStore()
+		limit := Every(1, time.Second, 1)
+		now := time.Unix(1000, 0)
+
+		take := func(now time.Time, keys ...string) []Result {
+			var requests []Request
+			for _, key := range keys {
+				requests = append(requests, Request{Key: key, Limit: limit})
+			}
+			results, err := store.Take(requests, now)
+			So(err, ShouldBeNil)
+			return results
+		}
+
+		Convey("When two clients send requests", func() {
+			first := take(now, "a")
+			second := take(now, "a")
+			other := take(now, "b")
+
+			Convey("Then each has its own bucket", func() {
+				So(first[0].Allowed, ShouldBeTrue)
+				So(second[0].Allowed, ShouldBeFalse)
+				So(other[0].Allowed, ShouldBeTrue)
+			})
+			Convey("Then the full buckets are forgotten", func() {
+				take(now.Add(time.Hour), "c")
+				So(store.Len(), ShouldEqual, 1)
+			})
+		})
+		Convey("When a request takes from an empty bucket and a full one", func() {
+			take(now, "a")
+			results := take(now, "a", "b")
+
+			Convey("Then it is rejected without taking from the full bucket", func() {
+				So(results[0].Allowed, ShouldBeFalse)
+				So(results[1].Allowed, ShouldBeTrue)
+				So(results[1].Remaining, ShouldEqual, 1)
+				So(results[1].Reset, ShouldEqual, 0)
+				So(take(now, "b")[0].Allowed, ShouldBeTrue)
+			})
+		})
+	})
+}
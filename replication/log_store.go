@@ -0,0 +1,117 @@
+package replication
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"github.com/jrpalma/linuxfleet/data"
+)
+
+// LogEntry is a write transaction in the replicated log. Entries without
+// statements are appended by new leaders to commit the entries of earlier terms.
+type LogEntry struct {
+	Index      uint64           `json:"index"`
+	Term       uint64           `json:"term"`
+	Statements []data.Statement `json:"statements,omitempty"`
+}
+
+// logStore persists the replicated log, the current term and the vote of a node.
+// It uses its own database so that appending to the log never waits for a
+// write transaction of the data tables.
+type logStore struct {
+	db *sql.DB
+}
+
+func openLogStore(db *sql.DB) (*logStore, error) {
+	_, err := db.Exec(sqlCreateLogTables())
+	if err != nil {
+		return nil, err
+	}
+	return &logStore{db: db}, nil
+}
+
+// load returns the persisted term, vote and log.
+func (s *logStore) load() (uint64, string, []LogEntry, error) {
+	var term uint64
+	var votedFor string
+	err := s.db.QueryRow(`SELECT term, voted_for FROM replication_term WHERE id = 1`).Scan(&term, &votedFor)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, "", nil, err
+	}
+
+	rows, err := s.db.Query(`SELECT idx, term, statements FROM replication_log ORDER BY idx`)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	defer rows.Close()
+
+	var entries []LogEntry
+	for rows.Next() {
+		var entry LogEntry
+		var statements []byte
+		err := rows.Scan(&entry.Index, &entry.Term, &statements)
+		if err != nil {
+			return 0, "", nil, err
+		}
+		err = json.Unmarshal(statements, &entry.Statements)
+		if err != nil {
+			return 0, "", nil, err
+		}
+		if entry.Index != uint64(len(entries))+1 {
+			return 0, "", nil, errors.New("replication: log has a gap")
+		}
+		entries = append(entries, entry)
+	}
+	return term, votedFor, entries, rows.Err()
+}
+
+// saveTerm persists the current term and the vote cast in it.
+func (s *logStore) saveTerm(term uint64, votedFor string) error {
+	_, err := s.db.Exec(`INSERT INTO replication_term (id, term, voted_for) VALUES (1, ?, ?)
+	ON CONFLICT(id) DO UPDATE SET term = excluded.term, voted_for = excluded.voted_for`, term, votedFor)
+	return err
+}
+
+// append replaces the entries from the index of the first entry onwards.
+func (s *logStore) append(entries []LogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM replication_log WHERE idx >= ?`, entries[0].Index)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		statements, err := json.Marshal(entry.Statements)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO replication_log (idx, term, statements) VALUES (?, ?, ?)`, entry.Index, entry.Term, statements)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func sqlCreateLogTables() string {
+	return `
+	CREATE TABLE IF NOT EXISTS replication_term (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		term INTEGER NOT NULL,
+		voted_for TEXT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS replication_log (
+		idx INTEGER PRIMARY KEY,
+		term INTEGER NOT NULL,
+		statements BLOB NOT NULL
+	);
+	`
+}
@@ -0,0 +1,709 @@
+// Package replication replicates the writes of the data tables across the
+// database cluster with the Raft consensus algorithm.
+//
+// The leader records the statements of every write transaction made through
+// data.Tables and commits the transaction once a majority of the nodes stored
+// them in their log. Followers apply the committed entries to their own tables.
+// When the leader fails, the remaining majority elects a new one. Writes on
+// other nodes fail with data.ErrNotLeader.
+package replication
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jrpalma/linuxfleet/data"
+)
+
+var ErrCommitTimeout = errors.New("replication: entry was not committed in time")
+var ErrStopped = errors.New("replication: node is stopped")
+
+// maxAppendEntries is the maximum number of log entries sent per message.
+const maxAppendEntries = 256
+
+// Role is the role of a node in the current term.
+type Role string
+
+const (
+	Follower  Role = "follower"
+	Candidate Role = "candidate"
+	Leader    Role = "leader"
+)
+
+// Options configures a replication node.
+type Options struct {
+	// ID is the address of this node. It must be one of Peers.
+	ID string
+	// Peers are the addresses of every node of the cluster, this one included.
+	Peers []string
+	// HeartbeatInterval is the time between two messages of the leader to a follower.
+	HeartbeatInterval time.Duration
+	// ElectionTimeout is the minimum time without a leader before a follower
+	// starts an election. Each wait is randomized between one and two timeouts.
+	ElectionTimeout time.Duration
+	// CommitTimeout is how long a write waits for a majority of the nodes.
+	CommitTimeout time.Duration
+	// Secret signs the messages between the nodes. It must be the same on
+	// every node of the cluster, and the Handler rejects messages not signed with it.
+	Secret []byte
+	// Transport sends the messages to the peers. It defaults to an HTTPTransport.
+	Transport Transport
+	// OnError is called when a message or a log entry fails. It may be nil.
+	OnError func(err error)
+}
+
+// DefaultOptions returns the options used when none are configured.
+func DefaultOptions() Options {
+	return Options{
+		HeartbeatInterval: 50 * time.Millisecond,
+		ElectionTimeout:   500 * time.Millisecond,
+		CommitTimeout:     5 * time.Second,
+	}
+}
+
+// Status describes the state of a node.
+type Status struct {
+	ID           string `json:"id"`
+	Role         Role   `json:"role"`
+	Term         uint64 `json:"term"`
+	Leader       string `json:"leader,omitempty"`
+	LastIndex    uint64 `json:"last_index"`
+	CommitIndex  uint64 `json:"commit_index"`
+	AppliedIndex uint64 `json:"applied_index"`
+}
+
+// Node is a member of the replicated database cluster.
+type Node struct {
+	tables  *data.Tables
+	store   *logStore
+	options Options
+	peers   []string
+
+	mu       sync.Mutex
+	role     Role
+	term     uint64
+	votedFor string
+	leaderID string
+	log      []LogEntry
+	// commitIndex is the last entry stored by a majority and lastApplied the
+	// last entry written to the tables.
+	commitIndex uint64
+	lastApplied uint64
+	// readyIndex is the entry appended by the leader when it was elected. The
+	// leader accepts writes once it applied it.
+	readyIndex uint64
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	lastAck    map[string]time.Time
+	sending    map[string]bool
+	deadline   time.Time
+	// changed is closed and replaced whenever the role, term or commit index changes.
+	changed chan struct{}
+
+	replicate chan struct{}
+	apply     chan struct{}
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	started   sync.Once
+	stopped   sync.Once
+}
+
+// NewNode creates the replication node of tables and routes their writes
+// through it. The log is kept in logDB, which must not be the database of the
+// tables. Call Start to join the cluster.
+func NewNode(tables *data.Tables, logDB *sql.DB, options Options) (*Node, error) {
+	defaults := DefaultOptions()
+	if options.HeartbeatInterval <= 0 {
+		options.HeartbeatInterval = defaults.HeartbeatInterval
+	}
+	if options.ElectionTimeout <= 0 {
+		options.ElectionTimeout = defaults.ElectionTimeout
+	}
+	if options.CommitTimeout <= 0 {
+		options.CommitTimeout = defaults.CommitTimeout
+	}
+	if len(options.Secret) == 0 {
+		return nil, errors.New("replication: the cluster secret is empty")
+	}
+	if options.Transport == nil {
+		options.Transport = NewHTTPTransport(options.ElectionTimeout, options.Secret)
+	}
+	if !slices.Contains(options.Peers, options.ID) {
+		return nil, fmt.Errorf("replication: node %q is not one of the peers %v", options.ID, options.Peers)
+	}
+
+	store, err := openLogStore(logDB)
+	if err != nil {
+		return nil, err
+	}
+	term, votedFor, entries, err := store.load()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := tables.AppliedIndex()
+	if err != nil {
+		return nil, err
+	}
+	if applied > uint64(len(entries)) {
+		return nil, fmt.Errorf("replication: tables applied entry %d but the log ends at %d", applied, len(entries))
+	}
+
+	n := &Node{
+		tables:      tables,
+		store:       store,
+		options:     options,
+		role:        Follower,
+		term:        term,
+		votedFor:    votedFor,
+		log:         entries,
+		commitIndex: applied,
+		lastApplied: applied,
+		changed:     make(chan struct{}),
+		replicate:   make(chan struct{}, 1),
+		apply:       make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+	}
+	for _, peer := range options.Peers {
+		if peer != options.ID {
+			n.peers = append(n.peers, peer)
+		}
+	}
+	tables.SetReplicator(n)
+	tables.SetNodeID(options.ID)
+	return n, nil
+}
+
+// Start runs the node in the background until Stop is called.
+func (n *Node) Start() {
+	n.started.Do(func() {
+		n.mu.Lock()
+		n.resetDeadlineLocked()
+		n.mu.Unlock()
+
+		n.wg.Add(2)
+		go n.run()
+		go n.runApplier()
+	})
+}
+
+// Stop stops the node and waits for it to finish. Writes in progress fail with ErrStopped.
+func (n *Node) Stop() {
+	n.stopped.Do(func() { close(n.stop) })
+	n.wg.Wait()
+}
+
+// Status returns the current state of the node.
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return Status{
+		ID:           n.options.ID,
+		Role:         n.role,
+		Term:         n.term,
+		Leader:       n.leaderID,
+		LastIndex:    n.lastIndexLocked(),
+		CommitIndex:  n.commitIndex,
+		AppliedIndex: n.lastApplied,
+	}
+}
+
+// Writable implements data.Replicator.
+func (n *Node) Writable() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.writableLocked()
+}
+
+func (n *Node) writableLocked() error {
+	switch {
+	case n.role != Leader && n.leaderID != "":
+		return fmt.Errorf("%w: the leader is %s", data.ErrNotLeader, n.leaderID)
+	case n.role != Leader:
+		return fmt.Errorf("%w: no leader is elected", data.ErrNotLeader)
+	case n.lastApplied < n.readyIndex:
+		return fmt.Errorf("%w: the leader is applying earlier entries", data.ErrNotLeader)
+	}
+	return nil
+}
+
+// Replicate implements data.Replicator. The entry is stored in the log of the
+// leader, sent to the followers and committed once a majority stored it.
+func (n *Node) Replicate(statements []data.Statement, commit func(index uint64) error) error {
+	n.mu.Lock()
+	err := n.writableLocked()
+	if err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	entry := LogEntry{Index: n.lastIndexLocked() + 1, Term: n.term, Statements: statements}
+	err = n.store.append([]LogEntry{entry})
+	if err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	n.log = append(n.log, entry)
+	n.advanceCommitLocked()
+	n.mu.Unlock()
+	n.signal(n.replicate)
+
+	err = n.waitCommitted(entry)
+	if err == nil {
+		err = commit(entry.Index)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err != nil {
+		// The entry may still be committed by the cluster. Stepping down lets
+		// the tables apply it like any other entry if it is.
+		if n.role == Leader && n.term == entry.Term {
+			n.becomeFollowerLocked(n.term, "")
+		}
+		return err
+	}
+	n.lastApplied = entry.Index
+	return nil
+}
+
+// waitCommitted waits until the entry is committed in its term.
+func (n *Node) waitCommitted(entry LogEntry) error {
+	timeout := time.NewTimer(n.options.CommitTimeout)
+	defer timeout.Stop()
+	for {
+		n.mu.Lock()
+		if n.term != entry.Term || n.role != Leader {
+			n.mu.Unlock()
+			return fmt.Errorf("%w: lost the leadership before the entry was committed", data.ErrNotLeader)
+		}
+		if n.commitIndex >= entry.Index {
+			n.mu.Unlock()
+			return nil
+		}
+		changed := n.changed
+		n.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-timeout.C:
+			return ErrCommitTimeout
+		case <-n.stop:
+			return ErrStopped
+		}
+	}
+}
+
+// RequestVote handles the vote request of a candidate.
+func (n *Node) RequestVote(request VoteRequest) VoteResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if request.Term < n.term {
+		return VoteResponse{Term: n.term}
+	}
+	if request.Term > n.term {
+		n.becomeFollowerLocked(request.Term, "")
+	}
+
+	lastIndex, lastTerm := n.lastIndexLocked(), n.lastTermLocked()
+	upToDate := request.LastTerm > lastTerm || request.LastTerm == lastTerm && request.LastIndex >= lastIndex
+	if upToDate && (n.votedFor == "" || n.votedFor == request.CandidateID) {
+		if n.votedFor == "" {
+			n.votedFor = request.CandidateID
+			err := n.store.saveTerm(n.term, n.votedFor)
+			if err != nil {
+				n.votedFor = ""
+				n.reportError(err)
+				return VoteResponse{Term: n.term}
+			}
+		}
+		n.resetDeadlineLocked()
+		return VoteResponse{Term: n.term, Granted: true}
+	}
+	return VoteResponse{Term: n.term}
+}
+
+// AppendEntries handles the entries or the heartbeat sent by the leader.
+func (n *Node) AppendEntries(request AppendRequest) (AppendResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if request.Term < n.term {
+		return AppendResponse{Term: n.term, LastIndex: n.lastIndexLocked()}, nil
+	}
+	if request.Term > n.term || n.role != Follower {
+		n.becomeFollowerLocked(request.Term, request.LeaderID)
+	}
+	if n.leaderID != request.LeaderID {
+		n.leaderID = request.LeaderID
+		n.notifyLocked()
+	}
+	n.resetDeadlineLocked()
+
+	lastIndex := n.lastIndexLocked()
+	if request.PrevIndex > lastIndex || n.termAtLocked(request.PrevIndex) != request.PrevTerm {
+		return AppendResponse{Term: n.term, LastIndex: min(lastIndex, request.PrevIndex-1)}, nil
+	}
+
+	// Entries already in the log are skipped, and the log is truncated at the
+	// first entry whose term differs.
+	entries := request.Entries
+	for len(entries) > 0 && entries[0].Index <= lastIndex && n.termAtLocked(entries[0].Index) == entries[0].Term {
+		entries = entries[1:]
+	}
+	if len(entries) > 0 {
+		if entries[0].Index <= n.commitIndex {
+			return AppendResponse{}, fmt.Errorf("replication: leader %s rewrites committed entry %d", request.LeaderID, entries[0].Index)
+		}
+		err := n.store.append(entries)
+		if err != nil {
+			return AppendResponse{}, err
+		}
+		n.log = append(n.log[:entries[0].Index-1], entries...)
+	}
+
+	matched := request.PrevIndex + uint64(len(request.Entries))
+	if request.CommitIndex > n.commitIndex {
+		n.commitIndex = min(request.CommitIndex, matched)
+		n.notifyLocked()
+		n.signal(n.apply)
+	}
+	return AppendResponse{Term: n.term, Success: true, LastIndex: n.lastIndexLocked()}, nil
+}
+
+func (n *Node) run() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.options.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.stop:
+			n.mu.Lock()
+			n.notifyLocked()
+			n.mu.Unlock()
+			return
+		case <-n.replicate:
+			n.sendEntries()
+		case <-ticker.C:
+			n.tick()
+		}
+	}
+}
+
+// tick sends heartbeats on the leader and starts an election on the other
+// nodes when the leader has been silent for too long. A leader that has not
+// heard from a majority within the election timeout steps down, so that a
+// partitioned leader stops accepting writes.
+func (n *Node) tick() {
+	n.mu.Lock()
+	now := time.Now()
+	if n.role == Leader {
+		acked := 1
+		for _, peer := range n.peers {
+			if now.Sub(n.lastAck[peer]) < n.options.ElectionTimeout {
+				acked++
+			}
+		}
+		if acked < n.quorum() {
+			n.becomeFollowerLocked(n.term, "")
+			n.mu.Unlock()
+			return
+		}
+		n.mu.Unlock()
+		n.sendEntries()
+		return
+	}
+	if now.Before(n.deadline) {
+		n.mu.Unlock()
+		return
+	}
+	n.startElectionLocked()
+	n.mu.Unlock()
+}
+
+// startElectionLocked votes for this node in a new term and asks the peers for their votes.
+func (n *Node) startElectionLocked() {
+	n.role = Candidate
+	n.term++
+	n.votedFor = n.options.ID
+	n.leaderID = ""
+	n.resetDeadlineLocked()
+	n.notifyLocked()
+	err := n.store.saveTerm(n.term, n.votedFor)
+	if err != nil {
+		n.reportError(err)
+		n.becomeFollowerLocked(n.term, "")
+		return
+	}
+	if len(n.peers) == 0 {
+		n.becomeLeaderLocked()
+		return
+	}
+
+	request := VoteRequest{
+		Term:        n.term,
+		CandidateID: n.options.ID,
+		LastIndex:   n.lastIndexLocked(),
+		LastTerm:    n.lastTermLocked(),
+	}
+	votes := 1
+	for _, peer := range n.peers {
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), n.options.ElectionTimeout)
+			defer cancel()
+			response, err := n.options.Transport.RequestVote(ctx, peer, request)
+			if err != nil {
+				return
+			}
+
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if response.Term > n.term {
+				n.becomeFollowerLocked(response.Term, "")
+				return
+			}
+			if n.role != Candidate || n.term != request.Term || !response.Granted {
+				return
+			}
+			votes++
+			if votes >= n.quorum() {
+				n.becomeLeaderLocked()
+			}
+		}()
+	}
+}
+
+// becomeLeaderLocked takes the leadership and appends an empty entry that
+// commits the entries of earlier terms once a majority stored it.
+func (n *Node) becomeLeaderLocked() {
+	entry := LogEntry{Index: n.lastIndexLocked() + 1, Term: n.term}
+	err := n.store.append([]LogEntry{entry})
+	if err != nil {
+		n.reportError(err)
+		n.becomeFollowerLocked(n.term, "")
+		return
+	}
+	n.log = append(n.log, entry)
+
+	n.role = Leader
+	n.leaderID = n.options.ID
+	n.readyIndex = entry.Index
+	n.nextIndex = map[string]uint64{}
+	n.matchIndex = map[string]uint64{}
+	n.lastAck = map[string]time.Time{}
+	n.sending = map[string]bool{}
+	now := time.Now()
+	for _, peer := range n.peers {
+		n.nextIndex[peer] = entry.Index
+		n.lastAck[peer] = now
+	}
+	n.advanceCommitLocked()
+	n.notifyLocked()
+	n.signal(n.replicate)
+}
+
+// becomeFollowerLocked follows the leader of the term, which may not be known yet.
+func (n *Node) becomeFollowerLocked(term uint64, leaderID string) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		err := n.store.saveTerm(n.term, n.votedFor)
+		if err != nil {
+			n.reportError(err)
+		}
+	}
+	n.role = Follower
+	n.leaderID = leaderID
+	n.readyIndex = 0
+	n.resetDeadlineLocked()
+	n.notifyLocked()
+	n.signal(n.apply)
+}
+
+// sendEntries sends the missing entries, or a heartbeat, to every follower
+// that has no message in flight.
+func (n *Node) sendEntries() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.role != Leader {
+		return
+	}
+	for _, peer := range n.peers {
+		if n.sending[peer] {
+			continue
+		}
+		n.sending[peer] = true
+		request := n.appendRequestLocked(peer)
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			n.sendAppend(peer, request)
+		}()
+	}
+}
+
+func (n *Node) appendRequestLocked(peer string) AppendRequest {
+	next := n.nextIndex[peer]
+	last := min(n.lastIndexLocked(), next-1+maxAppendEntries)
+	return AppendRequest{
+		Term:        n.term,
+		LeaderID:    n.options.ID,
+		PrevIndex:   next - 1,
+		PrevTerm:    n.termAtLocked(next - 1),
+		Entries:     slices.Clone(n.log[next-1 : last]),
+		CommitIndex: n.commitIndex,
+	}
+}
+
+func (n *Node) sendAppend(peer string, request AppendRequest) {
+	ctx, cancel := context.WithTimeout(context.Background(), n.options.ElectionTimeout)
+	defer cancel()
+	response, err := n.options.Transport.AppendEntries(ctx, peer, request)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.sending != nil {
+		n.sending[peer] = false
+	}
+	if err != nil {
+		return
+	}
+	if response.Term > n.term {
+		n.becomeFollowerLocked(response.Term, "")
+		return
+	}
+	if n.role != Leader || n.term != request.Term {
+		return
+	}
+
+	n.lastAck[peer] = time.Now()
+	if response.Success {
+		matched := request.PrevIndex + uint64(len(request.Entries))
+		if matched > n.matchIndex[peer] {
+			n.matchIndex[peer] = matched
+		}
+		n.nextIndex[peer] = max(n.nextIndex[peer], matched+1)
+		n.advanceCommitLocked()
+	} else {
+		n.nextIndex[peer] = max(1, min(request.PrevIndex, response.LastIndex+1))
+	}
+	if n.nextIndex[peer] <= n.lastIndexLocked() {
+		n.signal(n.replicate)
+	}
+}
+
+// advanceCommitLocked commits the last entry of the current term stored by a majority.
+func (n *Node) advanceCommitLocked() {
+	for index := n.lastIndexLocked(); index > n.commitIndex; index-- {
+		if n.termAtLocked(index) != n.term {
+			break
+		}
+		stored := 1
+		for _, peer := range n.peers {
+			if n.matchIndex[peer] >= index {
+				stored++
+			}
+		}
+		if stored >= n.quorum() {
+			n.commitIndex = index
+			n.notifyLocked()
+			n.signal(n.apply)
+			return
+		}
+	}
+}
+
+// runApplier writes the committed entries to the tables. On the leader it only
+// applies the entries up to the one appended when it was elected, since the
+// writes made on the leader are applied by their own transaction.
+func (n *Node) runApplier() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.options.ElectionTimeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-n.apply:
+		case <-ticker.C:
+		}
+
+		for {
+			n.mu.Lock()
+			limit := n.commitIndex
+			if n.role == Leader {
+				limit = min(limit, n.readyIndex)
+			}
+			if n.lastApplied >= limit {
+				n.mu.Unlock()
+				break
+			}
+			entry := n.log[n.lastApplied]
+			n.mu.Unlock()
+
+			err := n.tables.ApplyReplicated(entry.Index, entry.Statements)
+			if err != nil {
+				n.reportError(err)
+				break
+			}
+
+			n.mu.Lock()
+			if entry.Index == n.lastApplied+1 {
+				n.lastApplied = entry.Index
+				n.notifyLocked()
+			}
+			n.mu.Unlock()
+		}
+	}
+}
+
+func (n *Node) quorum() int {
+	return len(n.options.Peers)/2 + 1
+}
+
+func (n *Node) lastIndexLocked() uint64 {
+	return uint64(len(n.log))
+}
+
+func (n *Node) lastTermLocked() uint64 {
+	return n.termAtLocked(n.lastIndexLocked())
+}
+
+func (n *Node) termAtLocked(index uint64) uint64 {
+	if index == 0 || index > uint64(len(n.log)) {
+		return 0
+	}
+	return n.log[index-1].Term
+}
+
+func (n *Node) resetDeadlineLocked() {
+	timeout := n.options.ElectionTimeout
+	n.deadline = time.Now().Add(timeout + rand.N(timeout))
+}
+
+func (n *Node) notifyLocked() {
+	close(n.changed)
+	n.changed = make(chan struct{})
+}
+
+func (n *Node) signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (n *Node) reportError(err error) {
+	if n.options.OnError != nil {
+		n.options.OnError(err)
+	}
+}
@@ -0,0 +1,329 @@
+package replication
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jrpalma/linuxfleet/data"
+	"github.com/jrpalma/linuxfleet/secret"
+)
+
+// partitionTransport is an HTTPTransport that drops the messages between
+// partitioned nodes.
+type partitionTransport struct {
+	*HTTPTransport
+	from    string
+	network *testNetwork
+}
+
+func (t *partitionTransport) RequestVote(ctx context.Context, peer string, request VoteRequest) (VoteResponse, error) {
+	if t.network.blocked(t.from, peer) {
+		return VoteResponse{}, errors.New("partitioned")
+	}
+	return t.HTTPTransport.RequestVote(ctx, peer, request)
+}
+
+func (t *partitionTransport) AppendEntries(ctx context.Context, peer string, request AppendRequest) (AppendResponse, error) {
+	if t.network.blocked(t.from, peer) {
+		return AppendResponse{}, errors.New("partitioned")
+	}
+	return t.HTTPTransport.AppendEntries(ctx, peer, request)
+}
+
+type testNetwork struct {
+	mu       sync.Mutex
+	isolated map[string]bool
+}
+
+func (n *testNetwork) blocked(from string, to string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.isolated[from] != n.isolated[to]
+}
+
+// isolate separates the node from the rest of the cluster.
+func (n *testNetwork) isolate(id string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.isolated[id] = true
+}
+
+func (n *testNetwork) isIsolated(id string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.isolated[id]
+}
+
+func (n *testNetwork) heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	clear(n.isolated)
+}
+
+type testNode struct {
+	*Node
+	tables *data.Tables
+}
+
+type testCluster struct {
+	network *testNetwork
+	nodes   []testNode
+}
+
+// newTestCluster starts nodes that share a master key and talk over loopback.
+func newTestCluster(t *testing.T, size int) *testCluster {
+	masterKey, err := secret.NewKey()
+	require.NoError(t, err)
+
+	listeners := make([]net.Listener, size)
+	peers := make([]string, size)
+	for i := range listeners {
+		listeners[i], err = net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		peers[i] = listeners[i].Addr().String()
+	}
+
+	cluster := &testCluster{network: &testNetwork{isolated: map[string]bool{}}}
+	for i, listener := range listeners {
+		dir := t.TempDir()
+		database, err := data.OpenDatabase(filepath.Join(dir, "linuxfleet.db"), data.DatabaseOptions{})
+		require.NoError(t, err)
+		tables, err := data.NewDatabaseTables(database)
+		require.NoError(t, err)
+		require.NoError(t, tables.EnableEncryption(masterKey))
+		logDB, err := sql.Open("sqlite3", filepath.Join(dir, "replication.db"))
+		require.NoError(t, err)
+		logDB.SetMaxOpenConns(1)
+
+		options := Options{
+			ID:                peers[i],
+			Peers:             peers,
+			HeartbeatInterval: 20 * time.Millisecond,
+			ElectionTimeout:   150 * time.Millisecond,
+			CommitTimeout:     time.Second,
+			Secret:            []byte("test cluster secret"),
+		}
+		options.Transport = &partitionTransport{HTTPTransport: NewHTTPTransport(options.ElectionTimeout, options.Secret), from: peers[i], network: cluster.network}
+		node, err := NewNode(tables, logDB, options)
+		require.NoError(t, err)
+
+		server := httptest.NewUnstartedServer(node.Handler())
+		server.Listener.Close()
+		server.Listener = listener
+		server.Start()
+		node.Start()
+		t.Cleanup(func() {
+			node.Stop()
+			server.Close()
+			logDB.Close()
+			database.Close()
+		})
+		cluster.nodes = append(cluster.nodes, testNode{Node: node, tables: tables})
+	}
+	return cluster
+}
+
+// leader waits until exactly one of the nodes accepts writes and returns it.
+func (c *testCluster) leader(t *testing.T) testNode {
+	var leader testNode
+	require.Eventually(t, func() bool {
+		leaders := 0
+		for _, node := range c.nodes {
+			status := node.Status()
+			if status.Role == Leader && node.Writable() == nil && !c.network.isIsolated(status.ID) {
+				leader = node
+				leaders++
+			}
+		}
+		return leaders == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	return leader
+}
+
+func (c *testCluster) followers(leader testNode) []testNode {
+	var followers []testNode
+	for _, node := range c.nodes {
+		if node.Node != leader.Node {
+			followers = append(followers, node)
+		}
+	}
+	return followers
+}
+
+func device(id string) data.Object {
+	return data.Object{ID: id, OwnerID: "org1", Version: 1, Attributes: map[string]any{"hostname": id}}
+}
+
+func waitForObject(t *testing.T, node testNode, tableName string, id string) data.Object {
+	var obj data.Object
+	require.Eventually(t, func() bool {
+		var err error
+		obj, err = node.tables.GetByID(tableName, id)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond, "%s did not apply %s", node.Status().ID, id)
+	return obj
+}
+
+func TestReplication(t *testing.T) {
+	cluster := newTestCluster(t, 3)
+	leader := cluster.leader(t)
+
+	require.NoError(t, leader.tables.Insert("device", device("d1")))
+	require.NoError(t, leader.tables.InsertBatch("device", []data.Object{device("d2"), device("d3")}))
+	admin := data.Object{ID: "a1", OwnerID: "org1", Version: 1, Attributes: map[string]any{"email": "admin@example.com", "password": "hash"}}
+	require.NoError(t, leader.tables.Insert("admin", admin))
+	require.NoError(t, leader.tables.DeleteByID("device", "d3"))
+
+	for _, follower := range cluster.followers(leader) {
+		waitForObject(t, follower, "device", "d2")
+		// Sensitive attributes are replicated encrypted with replicated data keys.
+		stored := waitForObject(t, follower, "admin", "a1")
+		assert.Equal(t, "hash", stored.Attributes["password"])
+		_, err := follower.tables.GetByID("device", "d3")
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+
+		err = follower.tables.Insert("device", device("d4"))
+		assert.ErrorIs(t, err, data.ErrNotLeader)
+		assert.Equal(t, leader.Status().ID, follower.Status().Leader)
+	}
+
+	// Constraint violations fail on the leader and are not replicated.
+	assert.ErrorIs(t, leader.tables.Insert("device", device("d1")), data.ErrConflict)
+	require.NoError(t, leader.tables.Insert("device", device("d5")))
+	for _, follower := range cluster.followers(leader) {
+		waitForObject(t, follower, "device", "d5")
+		require.Eventually(t, func() bool {
+			return follower.Status().AppliedIndex == leader.Status().AppliedIndex
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+}
+
+func TestLeaderPartition(t *testing.T) {
+	cluster := newTestCluster(t, 3)
+	oldLeader := cluster.leader(t)
+	require.NoError(t, oldLeader.tables.Insert("device", device("before")))
+	oldStatus := oldLeader.Status()
+
+	cluster.network.isolate(oldStatus.ID)
+
+	// The isolated leader cannot reach a majority, so its writes fail and it
+	// steps down.
+	err := oldLeader.tables.Insert("device", device("lost"))
+	assert.Error(t, err)
+	require.Eventually(t, func() bool {
+		return oldLeader.Status().Role != Leader
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.ErrorIs(t, oldLeader.tables.Insert("device", device("lost")), data.ErrNotLeader)
+
+	newLeader := cluster.leader(t)
+	assert.NotEqual(t, oldStatus.ID, newLeader.Status().ID)
+	assert.Greater(t, newLeader.Status().Term, oldStatus.Term)
+	waitForObject(t, newLeader, "device", "before")
+	require.NoError(t, newLeader.tables.Insert("device", device("after")))
+
+	cluster.network.heal()
+
+	// The old leader catches up and drops the entry that was never committed.
+	waitForObject(t, oldLeader, "device", "after")
+	for _, node := range cluster.nodes {
+		_, err := node.tables.GetByID("device", "lost")
+		assert.ErrorIs(t, err, sql.ErrNoRows, "%s has an uncommitted write", node.Status().ID)
+	}
+	assert.Equal(t, newLeader.Status().ID, oldLeader.Status().Leader)
+}
+
+func TestFollowerPartition(t *testing.T) {
+	cluster := newTestCluster(t, 3)
+	leader := cluster.leader(t)
+	follower := cluster.followers(leader)[0]
+	cluster.network.isolate(follower.Status().ID)
+
+	// A majority is still connected, so writes keep working.
+	for i := range 20 {
+		require.NoError(t, leader.tables.Insert("device", device(fmt.Sprintf("d%d", i))))
+	}
+	_, err := follower.tables.GetByID("device", "d19")
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+
+	// The isolated follower keeps starting elections in higher terms, which
+	// it cannot win with a shorter log once it is reconnected.
+	time.Sleep(500 * time.Millisecond)
+	cluster.network.heal()
+	waitForObject(t, follower, "device", "d19")
+	leader = cluster.leader(t)
+	assert.NotEqual(t, follower.Status().ID, leader.Status().ID)
+}
+
+func TestSingleNode(t *testing.T) {
+	cluster := newTestCluster(t, 1)
+	leader := cluster.leader(t)
+	require.NoError(t, leader.tables.Insert("device", device("d1")))
+	index, err := leader.tables.AppliedIndex()
+	require.NoError(t, err)
+	assert.Equal(t, leader.Status().LastIndex, index)
+}
+
+func TestNewNode(t *testing.T) {
+	tables, err := data.NewTables(openMemory(t))
+	require.NoError(t, err)
+	_, err = NewNode(tables, openMemory(t), Options{ID: "a:1", Peers: []string{"b:1", "c:1"}, Secret: []byte("secret")})
+	assert.Error(t, err)
+	_, err = NewNode(tables, openMemory(t), Options{ID: "a:1", Peers: []string{"a:1", "b:1"}})
+	assert.Error(t, err)
+}
+
+func TestSignedMessages(t *testing.T) {
+	tables, err := data.NewTables(openMemory(t))
+	require.NoError(t, err)
+	node, err := NewNode(tables, openMemory(t), Options{ID: "a:1", Peers: []string{"a:1", "b:1"}, Secret: []byte("secret")})
+	require.NoError(t, err)
+	server := httptest.NewServer(node.Handler())
+	t.Cleanup(server.Close)
+
+	request := AppendRequest{Term: 7, LeaderID: "b:1"}
+	response, err := NewHTTPTransport(time.Second, []byte("secret")).AppendEntries(context.Background(), server.URL, request)
+	require.NoError(t, err)
+	assert.True(t, response.Success)
+
+	// Messages signed with another secret or without a signature are rejected
+	// before they change the term of the node.
+	_, err = NewHTTPTransport(time.Second, []byte("other")).AppendEntries(context.Background(), server.URL, AppendRequest{Term: 9, LeaderID: "b:1"})
+	assert.ErrorContains(t, err, "401")
+	unsigned, err := http.Post(server.URL+appendPath, "application/json", strings.NewReader(`{"term":9,"leader_id":"b:1"}`))
+	require.NoError(t, err)
+	unsigned.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, unsigned.StatusCode)
+	assert.Equal(t, uint64(7), node.Status().Term)
+
+	// Responses signed with another secret are rejected too.
+	_, err = NewHTTPTransport(time.Second, []byte("secret")).RequestVote(context.Background(), server.URL, VoteRequest{Term: 7, CandidateID: "b:1"})
+	require.NoError(t, err)
+	impostor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeMessage(w, []byte("other"), votePath, VoteResponse{Term: 7, Granted: true})
+	}))
+	t.Cleanup(impostor.Close)
+	_, err = NewHTTPTransport(time.Second, []byte("secret")).RequestVote(context.Background(), impostor.URL, VoteRequest{Term: 7, CandidateID: "a:1"})
+	assert.ErrorIs(t, err, ErrBadSignature)
+}
+
+func openMemory(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
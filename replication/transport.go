@@ -0,0 +1,210 @@
+package replication
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	votePath   = "/replication/vote"
+	appendPath = "/replication/append"
+
+	// signatureHeader carries the HMAC-SHA256 of a message, keyed with the
+	// cluster secret, as a hex string.
+	signatureHeader = "X-Replication-Signature"
+)
+
+// ErrBadSignature is returned for a message without a valid signature.
+var ErrBadSignature = errors.New("replication: message signature is invalid")
+
+// VoteRequest asks a node to vote for a candidate.
+type VoteRequest struct {
+	Term        uint64 `json:"term"`
+	CandidateID string `json:"candidate_id"`
+	LastIndex   uint64 `json:"last_index"`
+	LastTerm    uint64 `json:"last_term"`
+}
+
+// VoteResponse is the answer to a VoteRequest.
+type VoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+// AppendRequest replicates log entries from the leader. Without entries it is a heartbeat.
+type AppendRequest struct {
+	Term        uint64     `json:"term"`
+	LeaderID    string     `json:"leader_id"`
+	PrevIndex   uint64     `json:"prev_index"`
+	PrevTerm    uint64     `json:"prev_term"`
+	Entries     []LogEntry `json:"entries,omitempty"`
+	CommitIndex uint64     `json:"commit_index"`
+}
+
+// AppendResponse is the answer to an AppendRequest. LastIndex is the last log
+// index of the follower, which lets the leader skip back over missing entries.
+type AppendResponse struct {
+	Term      uint64 `json:"term"`
+	Success   bool   `json:"success"`
+	LastIndex uint64 `json:"last_index"`
+}
+
+// Transport sends the messages of a node to its peers.
+type Transport interface {
+	RequestVote(ctx context.Context, peer string, request VoteRequest) (VoteResponse, error)
+	AppendEntries(ctx context.Context, peer string, request AppendRequest) (AppendResponse, error)
+}
+
+// HTTPTransport sends messages as JSON over HTTP to the handler of the peer.
+// Peers are addresses such as 10.0.0.2:7946 or base URLs such as https://db2:7946.
+// Requests and responses are signed with the cluster secret, and responses
+// without a valid signature are rejected.
+type HTTPTransport struct {
+	Client *http.Client
+	Secret []byte
+}
+
+// NewHTTPTransport creates a transport whose requests time out after timeout.
+func NewHTTPTransport(timeout time.Duration, secret []byte) *HTTPTransport {
+	return &HTTPTransport{Client: &http.Client{Timeout: timeout}, Secret: secret}
+}
+
+// RequestVote implements Transport.
+func (t *HTTPTransport) RequestVote(ctx context.Context, peer string, request VoteRequest) (VoteResponse, error) {
+	var response VoteResponse
+	err := t.post(ctx, peer, votePath, request, &response)
+	return response, err
+}
+
+// AppendEntries implements Transport.
+func (t *HTTPTransport) AppendEntries(ctx context.Context, peer string, request AppendRequest) (AppendResponse, error) {
+	var response AppendResponse
+	err := t.post(ctx, peer, appendPath, request, &response)
+	return response, err
+}
+
+func (t *HTTPTransport) post(ctx context.Context, peer string, path string, request any, response any) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, peerURL(peer)+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	httpRequest.Header.Set(signatureHeader, sign(t.Secret, http.MethodPost, path, body))
+
+	httpResponse, err := t.Client.Do(httpRequest)
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode != http.StatusOK {
+		return fmt.Errorf("replication: %s%s returned %s", peer, path, httpResponse.Status)
+	}
+	body, err = io.ReadAll(httpResponse.Body)
+	if err != nil {
+		return err
+	}
+	if !verify(t.Secret, httpResponse.Header.Get(signatureHeader), "", path, body) {
+		return fmt.Errorf("%w: response of %s%s", ErrBadSignature, peer, path)
+	}
+	return json.Unmarshal(body, response)
+}
+
+// sign returns the signature of a message. Requests are signed with their
+// method and responses without one, so that a response cannot be replayed as a
+// request. The path binds the message to its type.
+func sign(secret []byte, method string, path string, body []byte) string {
+	return hex.EncodeToString(messageMAC(secret, method, path, body))
+}
+
+// verify reports whether signature is the signature of a message.
+func verify(secret []byte, signature string, method string, path string, body []byte) bool {
+	decoded, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(decoded, messageMAC(secret, method, path, body))
+}
+
+func messageMAC(secret []byte, method string, path string, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(method + " " + path + "\n"))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+func peerURL(peer string) string {
+	if strings.Contains(peer, "://") {
+		return strings.TrimSuffix(peer, "/")
+	}
+	return "http://" + peer
+}
+
+// Handler serves the messages sent to the node by the HTTPTransport of its
+// peers. Messages without a valid signature are rejected with 401.
+func (n *Node) Handler() http.Handler {
+	secret := n.options.Secret
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+votePath, func(w http.ResponseWriter, r *http.Request) {
+		var request VoteRequest
+		if !decodeMessage(w, r, secret, votePath, &request) {
+			return
+		}
+		writeMessage(w, secret, votePath, n.RequestVote(request))
+	})
+	mux.HandleFunc("POST "+appendPath, func(w http.ResponseWriter, r *http.Request) {
+		var request AppendRequest
+		if !decodeMessage(w, r, secret, appendPath, &request) {
+			return
+		}
+		response, err := n.AppendEntries(request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeMessage(w, secret, appendPath, response)
+	})
+	return mux
+}
+
+func decodeMessage(w http.ResponseWriter, r *http.Request, secret []byte, path string, message any) bool {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	if !verify(secret, r.Header.Get(signatureHeader), r.Method, path, body) {
+		http.Error(w, ErrBadSignature.Error(), http.StatusUnauthorized)
+		return false
+	}
+	err = json.Unmarshal(body, message)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeMessage(w http.ResponseWriter, secret []byte, path string, message any) {
+	body, err := json.Marshal(message)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(signatureHeader, sign(secret, "", path, body))
+	w.Write(body)
+}
@@ -0,0 +1,93 @@
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// KeySize is the size in bytes of master keys and data keys.
+const KeySize = 32
+
+// MasterKeyEnv is the environment variable that holds the base64 encoded master key.
+const MasterKeyEnv = "LINUXFLEET_MASTER_KEY"
+
+var ErrInvalidKey = errors.New("secret: key must be 32 bytes")
+var ErrCiphertextTooShort = errors.New("secret: ciphertext too short")
+
+// LoadMasterKey loads the master key from the MasterKeyEnv environment variable
+// or, when it is not set, from filename. The key is base64 encoded in both cases.
+func LoadMasterKey(filename string) ([]byte, error) {
+	encoded := os.Getenv(MasterKeyEnv)
+	if encoded == "" {
+		if filename == "" {
+			return nil, fmt.Errorf("secret: %s is not set and no master key file was given", MasterKeyEnv)
+		}
+		content, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(content)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("secret: master key is not base64 encoded: %w", err)
+	}
+	if len(key) != KeySize {
+		return nil, ErrInvalidKey
+	}
+	return key, nil
+}
+
+// NewKey generates a random key suitable for Seal and Open.
+func NewKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	_, err := rand.Read(key)
+	return key, err
+}
+
+// Seal encrypts and authenticates plaintext with AES-256-GCM. The additional
+// data is authenticated but not encrypted and must be given again to Open.
+// The random nonce is prepended to the returned ciphertext.
+func Seal(key []byte, plaintext []byte, additionalData []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// Open decrypts and verifies a ciphertext produced by Seal.
+func Open(key []byte, ciphertext []byte, additionalData []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, ErrCiphertextTooShort
+	}
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, additionalData)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, ErrInvalidKey
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,70 @@
+package secret
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestEnvelope(t *testing.T) {
+	Convey("Scenario: A value is sealed with a data key", t, func() {
+		key, err := NewKey()
+		So(err, ShouldBeNil)
+		sealed, err := Seal(key, []byte("password hash"), []byte("admin/1/password"))
+		So(err, ShouldBeNil)
+
+		Convey("When it is opened with the same key and additional data", func() {
+			opened, err := Open(key, sealed, []byte("admin/1/password"))
+			So(err, ShouldBeNil)
+			So(string(opened), ShouldEqual, "password hash")
+		})
+		Convey("When it is opened with different additional data", func() {
+			_, err := Open(key, sealed, []byte("admin/2/password"))
+			So(err, ShouldNotBeNil)
+		})
+		Convey("When it is opened with another key", func() {
+			other, err := NewKey()
+			So(err, ShouldBeNil)
+			_, err = Open(other, sealed, []byte("admin/1/password"))
+			So(err, ShouldNotBeNil)
+		})
+		Convey("When it is truncated", func() {
+			_, err := Open(key, sealed[:4], nil)
+			So(err, ShouldEqual, ErrCiphertextTooShort)
+		})
+	})
+
+	Convey("Scenario: The master key is loaded", t, func() {
+		key, err := NewKey()
+		So(err, ShouldBeNil)
+		encoded := base64.StdEncoding.EncodeToString(key)
+
+		Convey("When it is set in the environment", func() {
+			t.Setenv(MasterKeyEnv, encoded)
+			loaded, err := LoadMasterKey("")
+			So(err, ShouldBeNil)
+			So(loaded, ShouldResemble, key)
+		})
+		Convey("When it is stored in a file", func() {
+			t.Setenv(MasterKeyEnv, "")
+			filename := filepath.Join(t.TempDir(), "master.key")
+			So(os.WriteFile(filename, []byte(encoded+"\n"), 0600), ShouldBeNil)
+			loaded, err := LoadMasterKey(filename)
+			So(err, ShouldBeNil)
+			So(loaded, ShouldResemble, key)
+		})
+		Convey("When it has the wrong size", func() {
+			t.Setenv(MasterKeyEnv, base64.StdEncoding.EncodeToString([]byte("short")))
+			_, err := LoadMasterKey("")
+			So(err, ShouldEqual, ErrInvalidKey)
+		})
+		Convey("When it is not configured", func() {
+			t.Setenv(MasterKeyEnv, "")
+			_, err := LoadMasterKey("")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -3,8 +3,12 @@ package secret
 import (
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/subtle"
 	"encoding/base32"
+	"strings"
+	"time"
 
+	"github.com/pquerna/otp"
 	"github.com/pquerna/otp/totp"
 )
 
@@ -21,3 +25,47 @@ func ValidateCodeForTOTP(userUUID string, saltUUID string, code string) bool {
 	result := totp.Validate(code, seed)
 	return result
 }
+
+// minSeedSizeForTOTP is the minimum size in bytes of a TOTP seed, see RFC 4226.
+const minSeedSizeForTOTP = 10
+
+// ValidateSeedForTOTP reports whether seed is a base32 TOTP seed of at least
+// 80 bits, as shown by the authenticator apps.
+func ValidateSeedForTOTP(seed string) bool {
+	decoded, err := b32NoPadding.DecodeString(strings.ToUpper(strings.TrimRight(seed, "=")))
+	return err == nil && len(decoded) >= minSeedSizeForTOTP
+}
+
+// periodForTOTP is the number of seconds of a TOTP time step.
+const periodForTOTP = 30
+
+// ValidateSeedCodeForTOTP reports whether code is the current TOTP code of a
+// base32 seed.
+func ValidateSeedCodeForTOTP(seed string, code string) bool {
+	_, ok := ValidateSeedCodeStepForTOTP(seed, code, time.Now())
+	return ok
+}
+
+// ValidateSeedCodeStepForTOTP returns the time step of the TOTP code of a
+// base32 seed, accepting the steps before and after the one of now for clock
+// skew. The step lets the caller reject a code that was already used.
+func ValidateSeedCodeStepForTOTP(seed string, code string, now time.Time) (uint64, bool) {
+	if seed == "" || len(code) != int(otp.DigitsSix) {
+		return 0, false
+	}
+	current := uint64(now.Unix()) / periodForTOTP
+	for _, step := range []uint64{current - 1, current, current + 1} {
+		expected, err := totp.GenerateCodeCustom(seed, time.Unix(int64(step*periodForTOTP), 0), totp.ValidateOpts{
+			Period:    periodForTOTP,
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
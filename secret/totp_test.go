@@ -24,3 +24,42 @@ func TestTOTP(t *testing.T) {
 		So(valid, ShouldBeTrue)
 	})
 }
+
+func TestSeedTOTP(t *testing.T) {
+	Convey("Scenario: The administrator logs in with the code of an authenticator app", t, func() {
+		seed := "JBSWY3DPEHPK3PXP"
+		code, err := totp.GenerateCode(seed, time.Now())
+		So(err, ShouldBeNil)
+
+		So(ValidateSeedForTOTP(seed), ShouldBeTrue)
+		So(ValidateSeedForTOTP("jbswy3dpehpk3pxp"), ShouldBeTrue)
+		So(ValidateSeedForTOTP("12345678"), ShouldBeFalse)
+		So(ValidateSeedForTOTP("JBSWY3DP"), ShouldBeFalse)
+
+		So(ValidateSeedCodeForTOTP(seed, code), ShouldBeTrue)
+		So(ValidateSeedCodeForTOTP(seed, "000000"), ShouldEqual, code == "000000")
+		So(ValidateSeedCodeForTOTP("", code), ShouldBeFalse)
+	})
+}
+
+func TestSeedStepTOTP(t *testing.T) {
+	Convey("Scenario: The step of a TOTP code is returned so that it cannot be reused", t, func() {
+		seed := "JBSWY3DPEHPK3PXP"
+		now := time.Unix(1_800_000_015, 0)
+		code, err := totp.GenerateCode(seed, now)
+		So(err, ShouldBeNil)
+
+		step, ok := ValidateSeedCodeStepForTOTP(seed, code, now)
+		So(ok, ShouldBeTrue)
+		So(step, ShouldEqual, uint64(60_000_000))
+
+		step, ok = ValidateSeedCodeStepForTOTP(seed, code, now.Add(30*time.Second))
+		So(ok, ShouldBeTrue)
+		So(step, ShouldEqual, uint64(60_000_000))
+
+		_, ok = ValidateSeedCodeStepForTOTP(seed, code, now.Add(90*time.Second))
+		So(ok, ShouldBeFalse)
+		_, ok = ValidateSeedCodeStepForTOTP("", code, now)
+		So(ok, ShouldBeFalse)
+	})
+}
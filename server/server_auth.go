@@ -0,0 +1,139 @@
+package server
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/jrpalma/linuxfleet/data"
+	"github.com/jrpalma/linuxfleet/openapi"
+)
+
+// bearerAuth is the security scheme of the API routes that require a login
+// session. The token of the session is sent in the Authorization header.
+const bearerAuth = "bearerAuth"
+
+var bearerAuthScheme = openapi.SecurityScheme{
+	Type:        "http",
+	Scheme:      "bearer",
+	Description: "The token of a login session, created by POST /login.",
+}
+
+type loginRequest struct {
+	Email    string `validate:"required,email"`
+	Password string `validate:"required,min=8"`
+	TOTP     string `validate:"required"`
+}
+
+type loginResponse struct {
+	Token     string    `json:"token" secret:"true"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// loginHandler logs an administrator in with the email, the password and the
+// TOTP code, and returns the token of a session that lasts SessionLifetime.
+func (h *Server) loginHandler(c echo.Context) error {
+	sc := h.ServerContext(c)
+
+	var request loginRequest
+	if err := sc.BindModel(&request); err != nil {
+		return sc.InvalidRequest(err)
+	}
+
+	admin, err := h.authenticate(request.Email, request.Password, request.TOTP)
+	if errors.Is(err, sql.ErrNoRows) {
+		return sc.Unauthorized("Invalid email, password or code")
+	} else if err != nil {
+		return sc.InternalError("Failed to authenticate the administrator", err)
+	}
+
+	token, session, err := h.startSession(admin, "")
+	if err != nil {
+		return sc.InternalError("Failed to store the session", err)
+	}
+	return sc.OKJSON(loginResponse{Token: token, ExpiresAt: session.ExpiresAt.Time})
+}
+
+// logoutHandler ends the session of the request.
+func (h *Server) logoutHandler(c echo.Context) error {
+	sc := h.ServerContext(c)
+	token, _ := bearerToken(c.Request())
+	err := h.sessions.Delete(hashKey(token))
+	if err != nil {
+		return sc.InternalError("Failed to delete the session", err)
+	}
+	return sc.OK("The session was ended")
+}
+
+// startSession stores a new session of the administrator and returns its
+// token. Only the hash of the token is stored.
+func (s *Server) startSession(admin data.Admin, csrfToken string) (string, data.Session, error) {
+	token := rand.Text()
+	session := data.Session{
+		ID:        hashKey(token),
+		OwnerID:   admin.OwnerID,
+		ExpiresAt: data.TimestampAfter(s.Options().SessionLifetime),
+		AdminID:   admin.ID,
+		CSRFToken: csrfToken,
+	}
+	return token, session, s.sessions.Insert(session)
+}
+
+// session returns the session of a token. sql.ErrNoRows is returned when there
+// is none or when it expired.
+func (s *Server) session(token string) (data.Session, error) {
+	if token == "" {
+		return data.Session{}, sql.ErrNoRows
+	}
+	session, err := s.sessions.Get(hashKey(token))
+	if err != nil {
+		return data.Session{}, err
+	}
+	if (data.Object{ExpiresAt: session.ExpiresAt}).IsExpired(time.Now()) {
+		return data.Session{}, sql.ErrNoRows
+	}
+	return session, nil
+}
+
+// authenticateAPI identifies the principal of an API request by the session
+// token of its Authorization header, and sets it with its organization in the
+// context. Requests without a valid token are anonymous, see requireSession.
+func (s *Server) authenticateAPI(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, _ := bearerToken(c.Request())
+		session, err := s.session(token)
+		if err == nil {
+			c.Set(principalKey, session.AdminID)
+			c.Set(organizationKey, session.OwnerID)
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return s.ServerContext(c).InternalError("Failed to load the session", err)
+		}
+		return next(c)
+	}
+}
+
+// requireSession rejects the anonymous requests with 401. It runs after the
+// rate limits, so that the requests with invalid tokens are limited too.
+func (s *Server) requireSession(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if s.ServerContext(c).Principal() == "" {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer realm="linuxfleet"`)
+			return s.ServerContext(c).Unauthorized("A valid session token is required")
+		}
+		return next(c)
+	}
+}
+
+// bearerToken returns the token of the Bearer Authorization header of a request.
+func bearerToken(request *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(request.Header.Get(echo.HeaderAuthorization), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return token, true
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pquerna/otp/totp"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/jrpalma/linuxfleet/data"
+)
+
+func TestLogin(t *testing.T) {
+	Convey("Scenario: An administrator logs in to the API", t, func() {
+		server := testServer()
+		hash := sha256.Sum256([]byte("salt" + "password1"))
+		admin := data.Admin{ID: "admin1", OwnerID: "org1", Email: "admin@example.com", Password: hex.EncodeToString(hash[:]), Salt: "salt", Seed: testSeed}
+		So(server.admins.Insert(admin), ShouldBeNil)
+		code, err := totp.GenerateCode(testSeed, time.Now())
+		So(err, ShouldBeNil)
+		wrongCode := "000000"
+		if code == wrongCode {
+			wrongCode = "111111"
+		}
+
+		send := func(path string, token string, body string) *httptest.ResponseRecorder {
+			request := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+			request.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			if token != "" {
+				request.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+			}
+			recorder := httptest.NewRecorder()
+			server.echo.ServeHTTP(recorder, request)
+			return recorder
+		}
+
+		Convey("When POST /api/v1/login with the password and the code of the administrator", func() {
+			recorder := send("/api/v1/login", "", `{"email": "admin@example.com", "password": "password1", "totp": "`+code+`"}`)
+
+			Convey("Then a session of the administrator is created", func() {
+				So(recorder.Code, ShouldEqual, http.StatusOK)
+				var response loginResponse
+				So((&TestContext{HttpResponse: recorder}).UnmarshalResponse(&response), ShouldBeNil)
+				session, err := server.sessions.Get(hashKey(response.Token))
+				So(err, ShouldBeNil)
+				So(session.AdminID, ShouldEqual, "admin1")
+				So(session.OwnerID, ShouldEqual, "org1")
+
+				Convey("And it ends with POST /api/v1/logout", func() {
+					So(send("/api/v1/logout", response.Token, "").Code, ShouldEqual, http.StatusOK)
+					So(send("/api/v1/logout", response.Token, "").Code, ShouldEqual, http.StatusUnauthorized)
+				})
+			})
+		})
+		Convey("When POST /api/v1/login twice with the same code", func() {
+			first := send("/api/v1/login", "", `{"email": "admin@example.com", "password": "password1", "totp": "`+code+`"}`)
+			second := send("/api/v1/login", "", `{"email": "admin@example.com", "password": "password1", "totp": "`+code+`"}`)
+
+			Convey("Then the code is not accepted again", func() {
+				So(first.Code, ShouldEqual, http.StatusOK)
+				So(second.Code, ShouldEqual, http.StatusUnauthorized)
+				sessions, err := server.sessions.ListByAttribute("admin_id", "admin1")
+				So(err, ShouldBeNil)
+				So(sessions, ShouldHaveLength, 1)
+			})
+		})
+		Convey("When POST /api/v1/login with a wrong password", func() {
+			recorder := send("/api/v1/login", "", `{"email": "admin@example.com", "password": "password2", "totp": "`+code+`"}`)
+
+			Convey("Then it is rejected", func() {
+				So(recorder.Code, ShouldEqual, http.StatusUnauthorized)
+			})
+		})
+		Convey("When POST /api/v1/login with a wrong code", func() {
+			recorder := send("/api/v1/login", "", `{"email": "admin@example.com", "password": "password1", "totp": "`+wrongCode+`"}`)
+
+			Convey("Then it is rejected", func() {
+				So(recorder.Code, ShouldEqual, http.StatusUnauthorized)
+			})
+		})
+		Convey("When POST /api/v1/login with an unknown email", func() {
+			recorder := send("/api/v1/login", "", `{"email": "nobody@example.com", "password": "password1", "totp": "`+code+`"}`)
+
+			Convey("Then it is rejected like a wrong password", func() {
+				So(recorder.Code, ShouldEqual, http.StatusUnauthorized)
+				So(recorder.Body.String(), ShouldContainSubstring, "Invalid email, password or code")
+			})
+		})
+	})
+}
@@ -2,45 +2,248 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"log"
+	"log/slog"
+	"net/http"
 	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/labstack/echo/v4"
 
 	"github.com/jrpalma/linuxfleet/data"
 	"github.com/jrpalma/linuxfleet/html"
+	"github.com/jrpalma/linuxfleet/openapi"
+	"github.com/jrpalma/linuxfleet/opts"
+	"github.com/jrpalma/linuxfleet/ratelimit"
+	"github.com/jrpalma/linuxfleet/telemetry"
 )
 
+// Worker is a background task that runs while the server is listening.
+type Worker interface {
+	Start()
+	Stop()
+}
+
+// OptionsListener is told about the new options when the server reloads them.
+type OptionsListener interface {
+	OptionsChanged(options opts.ServerOptions)
+}
+
 type Server struct {
+	options   atomic.Pointer[opts.ServerOptions]
 	tables    *data.Tables
 	email     EmailSender
 	echo      *echo.Echo
+	logger    *slog.Logger
 	templates *html.Templates
 	validator *validator.Validate
+	workers   []Worker
+
+	healthMu        sync.Mutex
+	readinessChecks []readinessCheck
+	workersRunning  atomic.Bool
+	shuttingDown    atomic.Bool
+
+	reloadMu  sync.Mutex
+	listeners []OptionsListener
+
+	admins        *data.Repository[data.Admin]
+	registrations *data.Repository[data.Registration]
+	sessions      *data.Repository[data.Session]
+	metrics       *data.MetricStore
+
+	keyRotator *data.KeyRotator
+
+	rateLimits      ratelimit.Store
+	idempotencyKeys *data.IdempotencyStore
+
+	api       *openapi.Builder
+	routes    map[string]bool
+	registry  *telemetry.Registry
+	telemetry *serverMetrics
 }
 
-func NewServer(tables *data.Tables, templates *html.Templates, email EmailSender) *Server {
+func NewServer(options opts.ServerOptions, tables *data.Tables, templates *html.Templates, email EmailSender) *Server {
 	server := &Server{
 		validator: validator.New(validator.WithRequiredStructEnabled()),
 		templates: templates,
 		echo:      echo.New(),
+		logger:    slog.Default(),
 		tables:    tables,
 		email:     email,
+
+		admins:        data.NewRepository[data.Admin](tables, data.AdminTable),
+		registrations: data.NewRepository[data.Registration](tables, data.RegistrationTable),
+		sessions:      data.NewRepository[data.Session](tables, data.SessionTable),
+		metrics:       data.NewMetricStore(tables, data.DefaultMetricRetention()),
+
+		rateLimits:      newRateLimitStore(options, slog.Default()),
+		idempotencyKeys: data.NewIdempotencyStore(tables),
+
+		api:       openapi.NewBuilder(apiTitle, apiVersion),
+		routes:    map[string]bool{},
+		registry:  telemetry.NewRegistry(),
+		telemetry: newServerMetrics(),
 	}
+	server.options.Store(&options)
 	server.echo.HideBanner = true
-	server.echo.POST("/api/registration/initiate", server.initiateRegistrationHandler)
-	server.echo.POST("/api/registration/complete", server.completeRegistrationHandler)
+	server.echo.HidePort = true
+	server.echo.IPExtractor = ipExtractor(options.TrustedProxies)
+	server.echo.HTTPErrorHandler = server.errorHandler
+	server.validator.RegisterTagNameFunc(fieldName)
+	server.echo.Use(server.requestMiddleware)
+	server.registerRoutes()
+	server.registerTelemetry()
+	server.registerHealth()
+
+	reaperOptions := data.DefaultReaperOptions()
+	reaperOptions.OnExpire = func(e data.ExpiryEvent) {
+		server.logger.Info("expired object", "table", e.Table, "id", e.Object.ID)
+	}
+	reaperOptions.OnError = func(tableName string, err error) {
+		server.logger.Error("failed to expire objects", "table", tableName, "error", err)
+	}
+	server.AddWorker(data.NewReaper(tables, reaperOptions))
+
+	compactorOptions := data.DefaultMetricCompactorOptions()
+	compactorOptions.OnError = func(err error) {
+		server.logger.Error("failed to compact metrics", "error", err)
+	}
+	server.AddWorker(data.NewMetricCompactor(server.metrics, compactorOptions))
+
+	if tables.EncryptionEnabled() {
+		rotatorOptions := data.DefaultKeyRotatorOptions()
+		rotatorOptions.OnError = func(tableName string, err error) {
+			server.logger.Error("failed to re-encrypt objects", "table", tableName, "error", err)
+		}
+		server.keyRotator = data.NewKeyRotator(tables, rotatorOptions)
+		server.AddWorker(server.keyRotator)
+	}
 	return server
 }
 
+// Options returns the options the server currently runs with.
+func (s *Server) Options() opts.ServerOptions {
+	return *s.options.Load()
+}
+
+// AddOptionsListener registers a listener that is told about the options every
+// time they are reloaded.
+func (s *Server) AddOptionsListener(listener OptionsListener) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	s.listeners = append(s.listeners, listener)
+}
+
+// ReloadOptions validates the options and replaces the current ones at once,
+// so that a request sees either the old or the new options. Options that need
+// a restart keep their current value and a warning is logged when they
+// changed. The options are left unchanged when they are invalid. The listeners
+// are told about the new options after they are replaced.
+func (s *Server) ReloadOptions(options opts.ServerOptions) error {
+	err := options.Validate()
+	if err != nil {
+		return err
+	}
+
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	reloaded, ignored := s.Options().Reloaded(options)
+	if len(ignored) > 0 {
+		s.logger.Warn("some options only change when the server restarts", "options", ignored)
+	}
+	s.options.Store(&reloaded)
+	for _, listener := range s.listeners {
+		listener.OptionsChanged(reloaded)
+	}
+	return nil
+}
+
+// RotateDataKeys creates new data encryption keys and re-encrypts the sensitive
+// attributes in the background. It does nothing when encryption is disabled.
+func (s *Server) RotateDataKeys() error {
+	if s.keyRotator == nil {
+		return nil
+	}
+	return s.keyRotator.Rotate()
+}
+
+// AddWorker registers a background worker that is started with the server and
+// stopped when it shuts down.
+func (s *Server) AddWorker(worker Worker) {
+	s.workers = append(s.workers, worker)
+}
+
+// Start starts the background workers and listens for HTTP requests on address.
+// It blocks until the server is shut down.
+func (s *Server) Start(address string) error {
+	s.startWorkers()
+	err := s.echo.Start(address)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// StartTLS starts the background workers and listens for HTTPS requests on
+// address with the certificate and key in the PEM files. It blocks until the
+// server is shut down.
+func (s *Server) StartTLS(address string, certFile string, keyFile string) error {
+	s.startWorkers()
+	err := s.echo.StartTLS(address, certFile, keyFile)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// startWorkers starts the background workers.
+func (s *Server) startWorkers() {
+	for _, worker := range s.workers {
+		worker.Start()
+	}
+	s.workersRunning.Store(true)
+}
+
+// Shutdown reports the server as not ready, keeps serving requests for the
+// drain delay of the options, stops accepting requests, waits for in-flight
+// requests until ctx is done, stops the background workers in reverse order
+// and closes the rate limit store.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.shuttingDown.Store(true)
+	drain := time.NewTimer(s.Options().ShutdownDrainDelay)
+	select {
+	case <-drain.C:
+	case <-ctx.Done():
+		drain.Stop()
+	}
+	err := s.echo.Shutdown(ctx)
+	s.workersRunning.Store(false)
+	for i := len(s.workers) - 1; i >= 0; i-- {
+		s.workers[i].Stop()
+	}
+	if closer, ok := s.rateLimits.(io.Closer); ok {
+		err = errors.Join(err, closer.Close())
+	}
+	return err
+}
+
 func (s *Server) ServerContext(c echo.Context) *ServerContext {
 	return &ServerContext{
+		logger:    s.requestLogger(c),
+		options:   s.Options(),
 		validator: s.validator,
 		templates: s.templates,
 		tables:    s.tables,
 		email:     s.email,
+		telemetry: s.telemetry,
 		ec:        c,
 	}
 }
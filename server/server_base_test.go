@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/jrpalma/linuxfleet/opts"
+)
+
+type optionsListenerMock struct {
+	changes []opts.ServerOptions
+}
+
+func (l *optionsListenerMock) OptionsChanged(options opts.ServerOptions) {
+	l.changes = append(l.changes, options)
+}
+
+func TestReloadOptions(t *testing.T) {
+	Convey("Scenario: The options of a running server are reloaded", t, func() {
+		server := testServer()
+		listener := &optionsListenerMock{}
+		server.AddOptionsListener(listener)
+		current := server.Options()
+
+		Convey("When the reloaded options are valid", func() {
+			options := current
+			options.BaseURL = "https://fleet.example.com"
+			options.TokenLifetime = time.Hour
+			So(server.ReloadOptions(options), ShouldBeNil)
+
+			Convey("Then they are used by new requests and the listeners are told", func() {
+				So(server.Options(), ShouldResemble, options)
+				tc := server.EchoTestContext(http.MethodGet, "/", nil)
+				So(server.ServerContext(tc.EchoContext).FormatURL("/registration"), ShouldEqual, "https://fleet.example.com/registration")
+				So(listener.changes, ShouldResemble, []opts.ServerOptions{options})
+			})
+		})
+		Convey("When the reloaded options are invalid", func() {
+			options := current
+			options.BaseURL = "https://fleet.example.com"
+			options.MailProvider = "smtp"
+			err := server.ReloadOptions(options)
+
+			Convey("Then the reload is rejected and the options are unchanged", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "mail_provider")
+				So(server.Options(), ShouldResemble, current)
+				So(listener.changes, ShouldBeEmpty)
+			})
+		})
+		Convey("When options that need a restart are changed", func() {
+			options := current
+			options.ListenAddress = ":9090"
+			options.DatabasePath = "other.db"
+			options.SessionLifetime = time.Hour
+			So(server.ReloadOptions(options), ShouldBeNil)
+
+			Convey("Then only the other options are applied", func() {
+				So(server.Options().ListenAddress, ShouldEqual, current.ListenAddress)
+				So(server.Options().DatabasePath, ShouldEqual, current.DatabasePath)
+				So(server.Options().SessionLifetime, ShouldEqual, time.Hour)
+			})
+		})
+	})
+}
@@ -0,0 +1,325 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/jrpalma/linuxfleet/data"
+	"github.com/jrpalma/linuxfleet/html"
+	"github.com/jrpalma/linuxfleet/secret"
+)
+
+const (
+	// consolePath is the path of the web console, whose pages are under it.
+	consolePath = "/console"
+	// csrfCookie holds the CSRF token of the login form, before the session
+	// holds it.
+	csrfCookie = "linuxfleet_csrf"
+	// csrfField is the form field of the CSRF token.
+	csrfField = "csrf_token"
+	// consoleSessionKey holds the session of a console request.
+	consoleSessionKey = "console_session"
+)
+
+// consolePage is the data of a page of the console. Page names the page for
+// the navigation, and Admin is nil on the pages shown before logging in.
+type consolePage struct {
+	Title     string
+	Page      string
+	Admin     *data.Admin
+	CSRFToken string
+	Error     string
+	Data      any
+}
+
+// consoleSession is the session of a logged in administrator.
+type consoleSession struct {
+	session data.Session
+	admin   data.Admin
+}
+
+// settingsPage is the data of the settings page.
+type settingsPage struct {
+	SessionExpires time.Time
+	Options        string
+}
+
+// registerConsole registers the pages of the web console. The console is not
+// part of the API, so its pages are not documented. The login attempts have
+// the rate limits of the login group.
+func (s *Server) registerConsole() {
+	static := http.StripPrefix(consolePath+"/static/", http.FileServer(http.FS(html.Static())))
+	s.page(http.MethodGet, consolePath+"/static/*", echo.WrapHandler(static))
+	s.page(http.MethodGet, consolePath+"/login", s.consoleLoginPage)
+	s.page(http.MethodPost, consolePath+"/login", s.rateLimit("login", s.consoleLogin))
+	s.page(http.MethodPost, consolePath+"/logout", s.consoleSession(s.consoleLogout))
+	s.page(http.MethodGet, consolePath, s.consoleSession(s.consoleDashboard))
+	s.page(http.MethodGet, consolePath+"/devices", s.consoleSession(s.consoleDevices))
+	s.page(http.MethodGet, consolePath+"/devices/:id", s.consoleSession(s.consoleDevice))
+	s.page(http.MethodGet, consolePath+"/jobs", s.consoleSession(s.consoleJobs))
+	s.page(http.MethodGet, consolePath+"/settings", s.consoleSession(s.consoleSettings))
+}
+
+// page registers the handler of a page of the console.
+func (s *Server) page(method string, path string, handler echo.HandlerFunc) {
+	s.echo.Add(method, path, handler)
+	s.routes[path] = true
+}
+
+// renderPage responds with a page of the console. The pages are not cached
+// and cannot be framed by other sites.
+func (s *Server) renderPage(c echo.Context, status int, name string, page consolePage) error {
+	if session, ok := c.Get(consoleSessionKey).(*consoleSession); ok {
+		page.Admin = &session.admin
+		page.CSRFToken = session.session.CSRFToken
+	}
+	var body bytes.Buffer
+	err := s.templates.Render(&body, name, page)
+	if err != nil {
+		return err
+	}
+	header := c.Response().Header()
+	header.Set(echo.HeaderCacheControl, "no-store")
+	header.Set(echo.HeaderXFrameOptions, "DENY")
+	header.Set(echo.HeaderContentSecurityPolicy, "default-src 'self'; frame-ancestors 'none'")
+	return c.HTMLBlob(status, body.Bytes())
+}
+
+// renderError responds with the error page of the console.
+func (s *Server) renderError(c echo.Context, status int, message string) error {
+	return s.renderPage(c, status, "error", consolePage{Title: http.StatusText(status), Data: message})
+}
+
+// consoleSession authenticates the console requests with the session cookie.
+// The requests without a valid session are redirected to the login page, and
+// the forms must carry the CSRF token of the session.
+func (s *Server) consoleSession(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		session, err := s.loadSession(c)
+		if errors.Is(err, sql.ErrNoRows) {
+			s.clearCookie(c, sessionCookie)
+			return c.Redirect(http.StatusSeeOther, consolePath+"/login")
+		} else if err != nil {
+			s.requestLogger(c).Error("failed to load the console session", "error", err)
+			return s.renderError(c, http.StatusInternalServerError, "Failed to load the session")
+		}
+		c.Set(consoleSessionKey, session)
+		c.Set(principalKey, session.admin.ID)
+		c.Set(organizationKey, session.session.OwnerID)
+
+		switch c.Request().Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			if !sameToken(c.FormValue(csrfField), session.session.CSRFToken) {
+				return s.renderError(c, http.StatusForbidden, "The form expired, reload the page and try again")
+			}
+		}
+		return next(c)
+	}
+}
+
+// loadSession returns the session of the cookie of a request and its
+// administrator. sql.ErrNoRows is returned when the request has no session,
+// when it expired or when its administrator was removed.
+func (s *Server) loadSession(c echo.Context) (*consoleSession, error) {
+	cookie, err := c.Cookie(sessionCookie)
+	if err != nil {
+		return nil, sql.ErrNoRows
+	}
+	session, err := s.session(cookie.Value)
+	if err != nil {
+		return nil, err
+	}
+	admin, err := s.admins.Get(session.AdminID)
+	if err != nil {
+		return nil, err
+	}
+	return &consoleSession{session: session, admin: admin}, nil
+}
+
+// consoleLoginPage shows the login form. The CSRF token of the form is also
+// sent in a cookie, since there is no session to hold it yet.
+func (s *Server) consoleLoginPage(c echo.Context) error {
+	if _, err := s.loadSession(c); err == nil {
+		return c.Redirect(http.StatusSeeOther, consolePath)
+	}
+	token := rand.Text()
+	s.setCookie(c, csrfCookie, token, time.Time{})
+	return s.renderPage(c, http.StatusOK, "login", consolePage{Title: "Log in", CSRFToken: token, Data: loginForm{}})
+}
+
+// loginForm is the data of the login page.
+type loginForm struct {
+	Email string
+}
+
+// consoleLogin logs an administrator in with the email, the password and the
+// TOTP code, and starts a session that lasts SessionLifetime.
+func (s *Server) consoleLogin(c echo.Context) error {
+	cookie, err := c.Cookie(csrfCookie)
+	if err != nil || !sameToken(c.FormValue(csrfField), cookie.Value) {
+		return s.renderError(c, http.StatusForbidden, "The form expired, reload the page and try again")
+	}
+
+	email := strings.TrimSpace(c.FormValue("email"))
+	admin, err := s.authenticate(email, c.FormValue("password"), strings.TrimSpace(c.FormValue("totp")))
+	if errors.Is(err, sql.ErrNoRows) {
+		page := consolePage{Title: "Log in", CSRFToken: cookie.Value, Error: "Invalid email, password or code", Data: loginForm{Email: email}}
+		return s.renderPage(c, http.StatusUnauthorized, "login", page)
+	} else if err != nil {
+		s.requestLogger(c).Error("failed to authenticate the administrator", "error", err)
+		return s.renderError(c, http.StatusInternalServerError, "Failed to log in")
+	}
+
+	token, session, err := s.startSession(admin, rand.Text())
+	if err != nil {
+		s.requestLogger(c).Error("failed to store the console session", "error", err)
+		return s.renderError(c, http.StatusInternalServerError, "Failed to log in")
+	}
+	s.setCookie(c, sessionCookie, token, session.ExpiresAt.Time)
+	s.clearCookie(c, csrfCookie)
+	return c.Redirect(http.StatusSeeOther, consolePath)
+}
+
+// authenticate returns the administrator with the email, the password and
+// the current TOTP code of its seed. sql.ErrNoRows is returned when there is
+// none, or when the administrator already logged in with a code of the same
+// time step, so that an observed code cannot be replayed. The password is
+// hashed even when no administrator has the email, so that the response time
+// does not tell which emails are registered.
+func (s *Server) authenticate(email string, password string, code string) (data.Admin, error) {
+	admins, err := s.admins.ListByAttribute("email", email)
+	if err != nil {
+		return data.Admin{}, err
+	}
+	if len(admins) == 0 {
+		admins = []data.Admin{{Salt: rand.Text()}}
+	}
+	for _, admin := range admins {
+		hash := sha256.New()
+		hash.Write([]byte(admin.Salt))
+		hash.Write([]byte(password))
+		if !sameToken(hex.EncodeToString(hash.Sum(nil)), admin.Password) {
+			continue
+		}
+		step, ok := secret.ValidateSeedCodeStepForTOTP(admin.Seed, code, time.Now())
+		if !ok {
+			continue
+		}
+		accepted, err := s.tables.AcceptTOTPStep(admin.ID, step)
+		if err != nil {
+			return data.Admin{}, err
+		}
+		if accepted {
+			return admin, nil
+		}
+	}
+	return data.Admin{}, sql.ErrNoRows
+}
+
+// consoleLogout ends the session.
+func (s *Server) consoleLogout(c echo.Context) error {
+	session := c.Get(consoleSessionKey).(*consoleSession)
+	err := s.sessions.Delete(session.session.ID)
+	if err != nil {
+		s.requestLogger(c).Error("failed to delete the console session", "error", err)
+	}
+	s.clearCookie(c, sessionCookie)
+	return c.Redirect(http.StatusSeeOther, consolePath+"/login")
+}
+
+// consoleDashboard shows the devices and the jobs the administrator can read
+// by state, so that the counts match the lists.
+func (s *Server) consoleDashboard(c echo.Context) error {
+	session := c.Get(consoleSessionKey).(*consoleSession)
+	stats, err := s.tables.AccessibleFleetStats(session.admin.ID, time.Now().Add(-deviceOnlineWindow))
+	if err != nil {
+		s.requestLogger(c).Error("failed to count the fleet", "error", err)
+		return s.renderError(c, http.StatusInternalServerError, "Failed to load the dashboard")
+	}
+	return s.renderPage(c, http.StatusOK, "dashboard", consolePage{Title: "Dashboard", Page: "dashboard", Data: stats})
+}
+
+// consoleDevices lists the devices the administrator can read.
+func (s *Server) consoleDevices(c echo.Context) error {
+	return s.consoleList(c, data.DeviceTable, "devices", "Devices")
+}
+
+// consoleJobs lists the jobs the administrator can read.
+func (s *Server) consoleJobs(c echo.Context) error {
+	return s.consoleList(c, data.JobTable, "jobs", "Jobs")
+}
+
+// consoleList shows the objects the administrator can read in a table.
+func (s *Server) consoleList(c echo.Context, table data.TableDefinition, name string, title string) error {
+	session := c.Get(consoleSessionKey).(*consoleSession)
+	objects, err := s.tables.ListAccessible(table.Name, session.admin.ID, data.PermissionRead)
+	if err != nil {
+		s.requestLogger(c).Error("failed to list the objects", "table", table.Name, "error", err)
+		return s.renderError(c, http.StatusInternalServerError, "Failed to load the "+name)
+	}
+	return s.renderPage(c, http.StatusOK, name, consolePage{Title: title, Page: name, Data: objects})
+}
+
+// consoleDevice shows a device the administrator can read.
+func (s *Server) consoleDevice(c echo.Context) error {
+	sc := s.ServerContext(c)
+	err := sc.DataAuthorize(data.DeviceTable.Name, c.Param("id"), data.PermissionRead)
+	if errors.Is(err, sql.ErrNoRows) {
+		return s.renderError(c, http.StatusNotFound, "Device not found")
+	} else if err != nil {
+		s.requestLogger(c).Error("failed to authorize the device", "error", err)
+		return s.renderError(c, http.StatusInternalServerError, "Failed to load the device")
+	}
+
+	device, err := sc.DataGetByID(data.DeviceTable.Name, c.Param("id"))
+	if err != nil {
+		s.requestLogger(c).Error("failed to get the device", "error", err)
+		return s.renderError(c, http.StatusInternalServerError, "Failed to load the device")
+	}
+	return s.renderPage(c, http.StatusOK, "device", consolePage{Title: "Device " + device.ID, Page: "devices", Data: device})
+}
+
+// consoleSettings shows the account of the administrator and the options of
+// the server, with the secrets redacted.
+func (s *Server) consoleSettings(c echo.Context) error {
+	session := c.Get(consoleSessionKey).(*consoleSession)
+	settings := settingsPage{SessionExpires: session.session.ExpiresAt.Time, Options: s.Options().String()}
+	return s.renderPage(c, http.StatusOK, "settings", consolePage{Title: "Settings", Page: "settings", Data: settings})
+}
+
+// setCookie sets a cookie of the console, only sent to the console by the
+// browser and hidden from its scripts. The cookie lasts until expires, or
+// until the browser is closed when zero.
+func (s *Server) setCookie(c echo.Context, name string, value string, expires time.Time) {
+	c.SetCookie(&http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     consolePath,
+		Expires:  expires,
+		Secure:   strings.HasPrefix(s.Options().BaseURL, "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// clearCookie deletes a cookie of the console.
+func (s *Server) clearCookie(c echo.Context, name string) {
+	c.SetCookie(&http.Cookie{Name: name, Path: consolePath, MaxAge: -1, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+}
+
+// sameToken reports whether a token sent by a client is the expected one, in
+// constant time.
+func sameToken(token string, expected string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
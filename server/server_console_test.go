@@ -0,0 +1,171 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pquerna/otp/totp"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/jrpalma/linuxfleet/data"
+)
+
+// csrfPattern finds the CSRF token of the forms of a page.
+var csrfPattern = regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+
+// browser sends the requests of a browser to the server, keeping its cookies.
+type browser struct {
+	server  *Server
+	cookies map[string]*http.Cookie
+}
+
+func (b *browser) send(method string, target string, form url.Values) *httptest.ResponseRecorder {
+	var request *http.Request
+	if form != nil {
+		request = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		request = httptest.NewRequest(method, target, nil)
+	}
+	for _, cookie := range b.cookies {
+		request.AddCookie(cookie)
+	}
+	recorder := httptest.NewRecorder()
+	b.server.echo.ServeHTTP(recorder, request)
+	for _, cookie := range recorder.Result().Cookies() {
+		if cookie.MaxAge < 0 {
+			delete(b.cookies, cookie.Name)
+		} else {
+			b.cookies[cookie.Name] = cookie
+		}
+	}
+	return recorder
+}
+
+func csrfToken(recorder *httptest.ResponseRecorder) string {
+	match := csrfPattern.FindStringSubmatch(recorder.Body.String())
+	So(match, ShouldHaveLength, 2)
+	return match[1]
+}
+
+func TestConsole(t *testing.T) {
+	Convey("Scenario: An administrator uses the web console", t, func() {
+		server := testServer()
+		hash := sha256.Sum256([]byte("salt" + "abc123#8"))
+		So(server.admins.Insert(data.Admin{ID: "admin-1", OwnerID: "org-1", Email: "admin@example.com", Password: hex.EncodeToString(hash[:]), Salt: "salt", Seed: testSeed}), ShouldBeNil)
+		So(server.tables.AddGroupMember("org-1", data.Member{Kind: data.MemberPrincipal, ID: "admin-1"}), ShouldBeNil)
+		So(server.tables.Insert(data.DeviceTable.Name, data.Object{ID: "web-1", OwnerID: "org-1", Version: 1,
+			Attributes: map[string]any{"hostname": "web-1.example.com", "os": map[string]any{"name": "debian"}}}), ShouldBeNil)
+		So(server.tables.Insert(data.DeviceTable.Name, data.Object{ID: "db-1", OwnerID: "other-org", Version: 1,
+			Attributes: map[string]any{"hostname": "db-1.example.com"}}), ShouldBeNil)
+		So(server.tables.Insert(data.DeviceTable.Name, data.Object{ID: "shared-1", OwnerID: "other-org", Version: 1,
+			Attributes: map[string]any{"hostname": "shared-1.example.com"}}), ShouldBeNil)
+		So(server.tables.Grant(data.Grant{Table: data.DeviceTable.Name, ObjectID: "shared-1", PrincipalID: "org-1", Permissions: data.PermissionRead}), ShouldBeNil)
+		So(server.tables.Insert(data.JobTable.Name, data.Object{ID: "job-1", OwnerID: "org-1", Version: 1,
+			Attributes: map[string]any{"status": "queued", "device_id": "web-1"}}), ShouldBeNil)
+		client := &browser{server: server, cookies: map[string]*http.Cookie{}}
+		code, err := totp.GenerateCode(testSeed, time.Now())
+		So(err, ShouldBeNil)
+		login := func(password string, code string) *httptest.ResponseRecorder {
+			page := client.send(http.MethodGet, "/console/login", nil)
+			form := url.Values{"csrf_token": {csrfToken(page)}, "email": {"admin@example.com"}, "password": {password}, "totp": {code}}
+			return client.send(http.MethodPost, "/console/login", form)
+		}
+
+		Convey("When a page is requested without a session", func() {
+			recorder := client.send(http.MethodGet, "/console/devices", nil)
+
+			Convey("Then the browser is redirected to the login page", func() {
+				So(recorder.Code, ShouldEqual, http.StatusSeeOther)
+				So(recorder.Header().Get("Location"), ShouldEqual, "/console/login")
+			})
+		})
+		Convey("When the login form is sent without its CSRF token", func() {
+			client.send(http.MethodGet, "/console/login", nil)
+			form := url.Values{"email": {"admin@example.com"}, "password": {"abc123#8"}}
+			recorder := client.send(http.MethodPost, "/console/login", form)
+
+			Convey("Then it is rejected", func() {
+				So(recorder.Code, ShouldEqual, http.StatusForbidden)
+				So(client.cookies, ShouldNotContainKey, sessionCookie)
+			})
+		})
+		Convey("When the password is wrong", func() {
+			recorder := login("wrong-password", code)
+
+			Convey("Then the login form is shown again with an error", func() {
+				So(recorder.Code, ShouldEqual, http.StatusUnauthorized)
+				So(recorder.Body.String(), ShouldContainSubstring, "Invalid email, password or code")
+				So(recorder.Body.String(), ShouldContainSubstring, `value="admin@example.com"`)
+			})
+		})
+		Convey("When the authentication code is missing", func() {
+			recorder := login("abc123#8", "")
+
+			Convey("Then the login is rejected", func() {
+				So(recorder.Code, ShouldEqual, http.StatusUnauthorized)
+				So(client.cookies, ShouldNotContainKey, sessionCookie)
+			})
+		})
+		Convey("When the administrator logs in", func() {
+			recorder := login("abc123#8", code)
+			So(recorder.Code, ShouldEqual, http.StatusSeeOther)
+			So(recorder.Header().Get("Location"), ShouldEqual, "/console")
+			cookie := client.cookies[sessionCookie]
+			So(cookie, ShouldNotBeNil)
+			So(cookie.HttpOnly, ShouldBeTrue)
+			_, err := server.sessions.Get(hashKey(cookie.Value))
+			So(err, ShouldBeNil)
+
+			Convey("Then the pages show the fleet of the organization", func() {
+				dashboard := client.send(http.MethodGet, "/console", nil)
+				So(dashboard.Code, ShouldEqual, http.StatusOK)
+				So(dashboard.Header().Get("Cache-Control"), ShouldEqual, "no-store")
+				// The shared device is counted, as it is listed.
+				So(dashboard.Body.String(), ShouldContainSubstring, "<strong>2</strong> devices offline")
+				So(dashboard.Body.String(), ShouldContainSubstring, "admin@example.com")
+
+				devices := client.send(http.MethodGet, "/console/devices", nil)
+				So(devices.Body.String(), ShouldContainSubstring, "web-1.example.com")
+				So(devices.Body.String(), ShouldNotContainSubstring, "db-1.example.com")
+				So(devices.Body.String(), ShouldContainSubstring, "shared-1.example.com")
+
+				device := client.send(http.MethodGet, "/console/devices/web-1", nil)
+				So(device.Code, ShouldEqual, http.StatusOK)
+				So(device.Body.String(), ShouldContainSubstring, "debian")
+				So(client.send(http.MethodGet, "/console/devices/db-1", nil).Code, ShouldEqual, http.StatusNotFound)
+				So(client.send(http.MethodGet, "/console/devices/shared-1", nil).Code, ShouldEqual, http.StatusOK)
+
+				jobs := client.send(http.MethodGet, "/console/jobs", nil)
+				So(jobs.Body.String(), ShouldContainSubstring, "queued")
+
+				settings := client.send(http.MethodGet, "/console/settings", nil)
+				So(settings.Body.String(), ShouldContainSubstring, "session_lifetime: 12h0m0s")
+			})
+			Convey("Then the static assets are served", func() {
+				stylesheet := client.send(http.MethodGet, "/console/static/console.css", nil)
+				So(stylesheet.Code, ShouldEqual, http.StatusOK)
+				So(stylesheet.Header().Get("Content-Type"), ShouldStartWith, "text/css")
+			})
+			Convey("Then logging out requires the CSRF token of the session", func() {
+				token := csrfToken(client.send(http.MethodGet, "/console", nil))
+				So(client.send(http.MethodPost, "/console/logout", url.Values{"csrf_token": {"forged"}}).Code, ShouldEqual, http.StatusForbidden)
+
+				recorder := client.send(http.MethodPost, "/console/logout", url.Values{"csrf_token": {token}})
+				So(recorder.Code, ShouldEqual, http.StatusSeeOther)
+				So(client.cookies, ShouldNotContainKey, sessionCookie)
+				_, err := server.sessions.Get(hashKey(cookie.Value))
+				So(err, ShouldNotBeNil)
+				So(client.send(http.MethodGet, "/console", nil).Code, ShouldEqual, http.StatusSeeOther)
+			})
+		})
+	})
+}
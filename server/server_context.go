@@ -1,10 +1,12 @@
 package server
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
-	"os"
-	"path/filepath"
+	"strings"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/labstack/echo/v4"
@@ -13,34 +15,84 @@ import (
 
 	"github.com/jrpalma/linuxfleet/data"
 	"github.com/jrpalma/linuxfleet/html"
+	"github.com/jrpalma/linuxfleet/opts"
 )
 
 type EmailSender interface {
 	Send(email *mail.SGMailV3) (*rest.Response, error)
 }
 
+// messageBody is the body of the responses that only carry a message.
+type messageBody struct {
+	Message string `json:"message"`
+}
+
 type ServerContext struct {
 	ec        echo.Context
+	logger    *slog.Logger
+	options   opts.ServerOptions
 	tables    *data.Tables
 	email     EmailSender
+	telemetry *serverMetrics
 	templates *html.Templates
 	validator *validator.Validate
 }
 
+// Error responds with a problem of the status, the code and the message.
+func (sc *ServerContext) Error(status int, code ErrorCode, message string) error {
+	return writeProblem(sc.ec, newProblem(status, code, message))
+}
+
 func (sc *ServerContext) BadRequest(message string) error {
-	return sc.errorResponse(http.StatusBadRequest, message)
+	return sc.Error(http.StatusBadRequest, CodeInvalidRequest, message)
+}
+
+func (sc *ServerContext) Unauthorized(message string) error {
+	return sc.Error(http.StatusUnauthorized, CodeUnauthorized, message)
+}
+
+func (sc *ServerContext) Forbidden(message string) error {
+	return sc.Error(http.StatusForbidden, CodeForbidden, message)
 }
 
 func (sc *ServerContext) NotFound(message string) error {
-	return sc.errorResponse(http.StatusNotFound, message)
+	return sc.Error(http.StatusNotFound, CodeNotFound, message)
+}
+
+func (sc *ServerContext) Conflict(message string) error {
+	return sc.Error(http.StatusConflict, CodeConflict, message)
+}
+
+func (sc *ServerContext) UnsupportedMediaType(message string) error {
+	return sc.Error(http.StatusUnsupportedMediaType, CodeUnsupportedMediaType, message)
+}
+
+func (sc *ServerContext) ServiceUnavailable(message string) error {
+	return sc.Error(http.StatusServiceUnavailable, CodeServiceUnavailable, message)
+}
+
+// InvalidRequest responds to a request that BindModel rejected. The fields
+// that failed validation are listed in the problem.
+func (sc *ServerContext) InvalidRequest(err error) error {
+	var validationErrors validator.ValidationErrors
+	if !errors.As(err, &validationErrors) {
+		return sc.BadRequest("Invalid request payload")
+	}
+	problem := newProblem(http.StatusBadRequest, CodeValidationFailed, "The request has invalid fields")
+	problem.Errors = fieldErrors(validationErrors)
+	return writeProblem(sc.ec, problem)
 }
 
-func (sc *ServerContext) InternalError(message string) error {
-	return sc.errorResponse(http.StatusInternalServerError, message)
+// InternalError logs the error with the ID of the request and responds with
+// the message and the request ID only, so that the details of the error are
+// not disclosed and the client can still report the ID to correlate it.
+func (sc *ServerContext) InternalError(message string, err error) error {
+	sc.logger.Error(message, "error", err)
+	return sc.Error(http.StatusInternalServerError, CodeInternal, message)
 }
 
 func (sc *ServerContext) OK(message string) error {
-	return sc.ec.JSON(http.StatusOK, map[string]string{"message": message})
+	return sc.ec.JSON(http.StatusOK, messageBody{Message: message})
 }
 
 func (sc *ServerContext) OKJSON(body any) error {
@@ -48,7 +100,12 @@ func (sc *ServerContext) OKJSON(body any) error {
 }
 
 func (sc *ServerContext) SendEmail(email *mail.SGMailV3) error {
-	_, err := sc.email.Send(email)
+	response, err := sc.email.Send(email)
+	status := 0
+	if response != nil {
+		status = response.StatusCode
+	}
+	sc.telemetry.observeEmail(status, err)
 	return err
 }
 
@@ -56,12 +113,29 @@ func (sc *ServerContext) ExecuteTemplate(name string, data any) (string, error)
 	return sc.templates.Execute(name, data)
 }
 
-func (sc *ServerContext) GetEnv(name string) string {
-	return os.Getenv(name)
+// RequestID returns the ID of the request, also sent in the X-Request-Id
+// response header.
+func (sc *ServerContext) RequestID() string {
+	id, _ := sc.ec.Get(requestIDKey).(string)
+	return id
 }
 
-func (sc *ServerContext) errorResponse(status int, errMessage string) error {
-	return sc.ec.JSON(status, map[string]string{"error": errMessage})
+// Logger returns the logger of the request, which tags the messages with the
+// request ID.
+func (sc *ServerContext) Logger() *slog.Logger {
+	return sc.logger
+}
+
+// Principal returns the ID of the authenticated principal of the request, or
+// an empty string for the anonymous requests.
+func (sc *ServerContext) Principal() string {
+	principal, _ := sc.ec.Get(principalKey).(string)
+	return principal
+}
+
+// Options returns the options of the server.
+func (sc *ServerContext) Options() opts.ServerOptions {
+	return sc.options
 }
 
 func (sc *ServerContext) DataListByOwner(tableName string, ownerID string) ([]data.Object, error) {
@@ -84,18 +158,45 @@ func (sc *ServerContext) DataUpdateByID(tableName string, id string, obj data.Ob
 	return sc.tables.UpdateByID(tableName, id, obj)
 }
 
-func (sc *ServerContext) BindModel(model any) error {
-	if err := sc.ec.Bind(model); err != nil {
-		return sc.BadRequest("Invalid request payload")
+// DataAuthorize checks that the principal of the request holds the permission
+// on an object. It returns sql.ErrNoRows when the object does not exist or
+// when the principal cannot read it, so that the objects of other
+// organizations are not disclosed, and data.ErrForbidden when the principal
+// can read the object but lacks the permission.
+func (sc *ServerContext) DataAuthorize(tableName string, id string, permission data.Permission) error {
+	principal := sc.Principal()
+	if principal == "" {
+		return sql.ErrNoRows
 	}
+	err := sc.tables.Authorize(tableName, id, principal, data.PermissionRead)
+	if errors.Is(err, data.ErrForbidden) {
+		return sql.ErrNoRows
+	} else if err != nil {
+		return err
+	}
+	return sc.tables.Authorize(tableName, id, principal, permission)
+}
+
+func (sc *ServerContext) DataPatch(tableName string, id string, patchType data.PatchType, patch []byte) (data.Object, error) {
+	return sc.tables.Patch(tableName, id, patchType, patch)
+}
 
-	if err := sc.validator.Struct(model); err != nil {
-		return sc.BadRequest(err.Error())
+func (sc *ServerContext) DataSearch(query string, options data.SearchOptions) ([]data.SearchResult, error) {
+	return sc.tables.Search(query, options)
+}
+
+// BindModel binds the parameters and the body of the request to the model and
+// validates it. The error is written to the client with InvalidRequest.
+func (sc *ServerContext) BindModel(model any) error {
+	if err := sc.ec.Bind(model); err != nil {
+		return err
 	}
-	return nil
+	return sc.validator.Struct(model)
 }
 
+// FormatURL returns the external URL of the formatted path, such as a link
+// sent by email, by appending it to the base URL of the server.
 func (sc *ServerContext) FormatURL(pathFormat string, args ...any) string {
-	fullURL := filepath.Join(sc.GetEnv("BASE_URL"), fmt.Sprintf(pathFormat, args...))
-	return fullURL
+	path := strings.TrimPrefix(fmt.Sprintf(pathFormat, args...), "/")
+	return strings.TrimSuffix(sc.options.BaseURL, "/") + "/" + path
 }
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/jrpalma/linuxfleet/data"
+)
+
+type deviceMetricsRequest struct {
+	DeviceID    string   `param:"id" validate:"required"`
+	Metrics     []string `query:"metric" validate:"dive,required,max=128"`
+	Start       string   `query:"start"`
+	End         string   `query:"end"`
+	Step        string   `query:"step"`
+	Aggregation string   `query:"agg" validate:"omitempty,oneof=avg min max sum count"`
+}
+
+type deviceMetricsResponse struct {
+	DeviceID    string              `json:"device_id"`
+	Start       time.Time           `json:"start"`
+	End         time.Time           `json:"end"`
+	Step        string              `json:"step"`
+	Aggregation string              `json:"agg"`
+	Series      []data.MetricSeries `json:"series"`
+}
+
+// deviceMetricsHandler returns the metrics of a device between start and end,
+// one point per step. Times are RFC 3339 or Unix seconds and the step is a
+// duration such as 5m. By default the last hour is returned at one minute steps.
+// The device is not found unless the principal of the request can read it.
+func (h *Server) deviceMetricsHandler(c echo.Context) error {
+	sc := h.ServerContext(c)
+
+	var request deviceMetricsRequest
+	if err := sc.BindModel(&request); err != nil {
+		return sc.InvalidRequest(err)
+	}
+
+	query := data.MetricQuery{
+		DeviceID:    request.DeviceID,
+		Metrics:     request.Metrics,
+		End:         time.Now(),
+		Step:        time.Minute,
+		Aggregation: data.MetricAvg,
+	}
+	var err error
+	if request.End != "" {
+		query.End, err = parseMetricTime(request.End)
+		if err != nil {
+			return sc.BadRequest("Invalid end time")
+		}
+	}
+	query.Start = query.End.Add(-time.Hour)
+	if request.Start != "" {
+		query.Start, err = parseMetricTime(request.Start)
+		if err != nil {
+			return sc.BadRequest("Invalid start time")
+		}
+	}
+	if request.Step != "" {
+		query.Step, err = time.ParseDuration(request.Step)
+		if err != nil {
+			return sc.BadRequest("Invalid step")
+		}
+	}
+	if request.Aggregation != "" {
+		query.Aggregation = data.MetricAggregation(request.Aggregation)
+	}
+
+	err = sc.DataAuthorize(data.DeviceTable.Name, request.DeviceID, data.PermissionRead)
+	if errors.Is(err, sql.ErrNoRows) {
+		return sc.NotFound("Device not found")
+	} else if err != nil {
+		return sc.InternalError("Failed to authorize the metrics query", err)
+	}
+
+	series, err := h.metrics.Query(query)
+	if errors.Is(err, data.ErrInvalidMetricQuery) {
+		return sc.Error(http.StatusBadRequest, CodeInvalidMetricQuery, err.Error())
+	} else if err != nil {
+		return sc.InternalError("Failed to query metrics", err)
+	}
+
+	response := deviceMetricsResponse{
+		DeviceID:    request.DeviceID,
+		Start:       query.Start.UTC(),
+		End:         query.End.UTC(),
+		Step:        query.Step.String(),
+		Aggregation: string(query.Aggregation),
+		Series:      series,
+	}
+	if response.Series == nil {
+		response.Series = []data.MetricSeries{}
+	}
+	return sc.OKJSON(response)
+}
+
+// parseMetricTime parses an RFC 3339 time or a number of Unix seconds.
+func parseMetricTime(value string) (time.Time, error) {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
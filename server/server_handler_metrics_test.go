@@ -0,0 +1,82 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/jrpalma/linuxfleet/data"
+)
+
+func TestDeviceMetrics(t *testing.T) {
+	Convey("Scenario: The admin charts the metrics of a device", t, func() {
+		server := testServer()
+		device := data.Object{ID: "web-1", OwnerID: "owner1", Version: 1, Attributes: map[string]any{"hostname": "web-1"}}
+		So(server.tables.Insert("device", device), ShouldBeNil)
+
+		start := time.Now().Add(-time.Hour).Truncate(time.Hour)
+		var samples []data.Sample
+		for i := range 10 {
+			at := start.Add(time.Duration(i) * time.Minute)
+			samples = append(samples, data.Sample{Metric: "cpu", Time: at, Value: float64(i)}, data.Sample{Metric: "memory", Time: at, Value: 50})
+		}
+		So(server.metrics.Write("web-1", samples), ShouldBeNil)
+
+		_, token := testLogin(server, "admin@owner1.example.com", "owner1")
+		_, otherToken := testLogin(server, "admin@owner2.example.com", "owner2")
+		metricsRequestAs := func(token string, id string, query string) *TestContext {
+			request := httptest.NewRequest(http.MethodGet, "/api/v1/devices/"+id+"/metrics?"+query, nil)
+			if token != "" {
+				request.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+			}
+			recorder := httptest.NewRecorder()
+			server.echo.ServeHTTP(recorder, request)
+			return &TestContext{HttpResponse: recorder}
+		}
+		metricsRequest := func(id string, query string) *TestContext {
+			return metricsRequestAs(token, id, query)
+		}
+
+		Convey("When GET /api/devices/web-1/metrics at five minute steps", func() {
+			tc := metricsRequest("web-1", "metric=cpu&agg=max&step=5m&start="+start.Format(time.RFC3339))
+			So(tc.HttpResponse.Code, ShouldEqual, http.StatusOK)
+
+			response := &deviceMetricsResponse{}
+			So(tc.UnmarshalResponse(response), ShouldBeNil)
+			So(response.Series, ShouldHaveLength, 1)
+			So(response.Series[0].Metric, ShouldEqual, "cpu")
+			So(response.Series[0].Points, ShouldHaveLength, 2)
+			So(response.Series[0].Points[1].Value, ShouldEqual, 9)
+		})
+		Convey("When GET /api/devices/web-1/metrics for every metric", func() {
+			tc := metricsRequest("web-1", "step=1h&start="+start.Format(time.RFC3339))
+			So(tc.HttpResponse.Code, ShouldEqual, http.StatusOK)
+
+			response := &deviceMetricsResponse{}
+			So(tc.UnmarshalResponse(response), ShouldBeNil)
+			So(response.Series, ShouldHaveLength, 2)
+			So(response.Aggregation, ShouldEqual, "avg")
+		})
+		Convey("When GET /api/devices/web-1/metrics with an invalid step", func() {
+			tc := metricsRequest("web-1", "step=1s")
+			So(tc.HttpResponse.Code, ShouldEqual, http.StatusBadRequest)
+		})
+		Convey("When GET /api/devices/web-2/metrics for an unknown device", func() {
+			tc := metricsRequest("web-2", "")
+			So(tc.HttpResponse.Code, ShouldEqual, http.StatusNotFound)
+		})
+		Convey("When GET /api/devices/web-1/metrics without a session", func() {
+			tc := metricsRequestAs("", "web-1", "")
+			So(tc.HttpResponse.Code, ShouldEqual, http.StatusUnauthorized)
+		})
+		Convey("When GET /api/devices/web-1/metrics by the administrator of another organization", func() {
+			tc := metricsRequestAs(otherToken, "web-1", "")
+			So(tc.HttpResponse.Code, ShouldEqual, http.StatusNotFound)
+		})
+	})
+}
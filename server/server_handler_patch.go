@@ -0,0 +1,63 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/jrpalma/linuxfleet/data"
+)
+
+// maxPatchSize is the largest patch accepted by patchObjectHandler.
+const maxPatchSize = 1 << 20
+
+// patchObjectHandler returns the handler that patches the attributes of an
+// object of the table. The body is a JSON Merge Patch or a JSON Patch, chosen
+// by its content type, and the response is the patched object. The principal
+// of the request must hold the write permission on the object.
+func (h *Server) patchObjectHandler(table data.TableDefinition) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		sc := h.ServerContext(c)
+
+		mediaType, _, _ := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+		patchType := data.PatchType(mediaType)
+		if patchType != data.MergePatch && patchType != data.JSONPatch {
+			c.Response().Header().Set("Accept-Patch", string(data.MergePatch)+", "+string(data.JSONPatch))
+			return sc.UnsupportedMediaType("Patches must be application/merge-patch+json or application/json-patch+json")
+		}
+
+		patch, err := io.ReadAll(io.LimitReader(c.Request().Body, maxPatchSize+1))
+		if err != nil {
+			return sc.BadRequest("Invalid request payload")
+		} else if len(patch) > maxPatchSize {
+			return sc.Error(http.StatusRequestEntityTooLarge, CodePayloadTooLarge, "Patch is too large")
+		}
+
+		err = sc.DataAuthorize(table.Name, c.Param("id"), data.PermissionWrite)
+		if errors.Is(err, sql.ErrNoRows) {
+			return sc.NotFound("Object not found")
+		} else if errors.Is(err, data.ErrForbidden) {
+			return sc.Forbidden("The object cannot be modified by this administrator")
+		} else if err != nil {
+			return sc.InternalError("Failed to authorize the patch", err)
+		}
+
+		obj, err := sc.DataPatch(table.Name, c.Param("id"), patchType, patch)
+		if errors.Is(err, sql.ErrNoRows) {
+			return sc.NotFound("Object not found")
+		} else if errors.Is(err, data.ErrPatchTestFailed) {
+			return sc.Error(http.StatusConflict, CodePatchTestFailed, err.Error())
+		} else if errors.Is(err, data.ErrConflict) {
+			return sc.Error(http.StatusConflict, CodeVersionConflict, err.Error())
+		} else if errors.Is(err, data.ErrInvalidPatch) {
+			return sc.Error(http.StatusBadRequest, CodeInvalidPatch, err.Error())
+		} else if err != nil {
+			return sc.InternalError("Failed to patch object", err)
+		}
+		return sc.OKJSON(obj)
+	}
+}
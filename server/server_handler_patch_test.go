@@ -0,0 +1,107 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/jrpalma/linuxfleet/data"
+)
+
+func TestPatchObject(t *testing.T) {
+	Convey("Scenario: The admin patches a device", t, func() {
+		server := testServer()
+		device := data.Object{ID: "web-1", OwnerID: "owner1", Version: 1, Attributes: map[string]any{"hostname": "web-1", "os": map[string]any{"name": "debian"}}}
+		So(server.tables.Insert("device", device), ShouldBeNil)
+		_, token := testLogin(server, "admin@owner1.example.com", "owner1")
+		auditor, auditorToken := testLogin(server, "auditor@owner2.example.com", "owner2")
+		_, otherToken := testLogin(server, "admin@owner3.example.com", "owner3")
+		So(server.tables.Grant(data.Grant{Table: "device", ObjectID: "web-1", PrincipalID: auditor.ID, Permissions: data.PermissionRead}), ShouldBeNil)
+		editor, editorToken := testLogin(server, "editor@owner4.example.com", "owner4")
+		So(server.tables.AddGroupMember("readers", data.Member{Kind: data.MemberPrincipal, ID: editor.ID}), ShouldBeNil)
+		So(server.tables.AddGroupMember("writers", data.Member{Kind: data.MemberPrincipal, ID: editor.ID}), ShouldBeNil)
+		So(server.tables.Grant(data.Grant{Table: "device", ObjectID: "web-1", PrincipalID: "readers", Permissions: data.PermissionRead}), ShouldBeNil)
+		So(server.tables.Grant(data.Grant{Table: "device", ObjectID: "web-1", PrincipalID: "writers", Permissions: data.PermissionWrite}), ShouldBeNil)
+
+		patchAs := func(token string, id string, contentType string, body string) *TestContext {
+			request := httptest.NewRequest(http.MethodPatch, "/api/v1/devices/"+id, strings.NewReader(body))
+			request.Header.Set(echo.HeaderContentType, contentType)
+			if token != "" {
+				request.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+			}
+			recorder := httptest.NewRecorder()
+			server.echo.ServeHTTP(recorder, request)
+			return &TestContext{HttpResponse: recorder}
+		}
+		patchRequest := func(id string, contentType string, body string) *TestContext {
+			return patchAs(token, id, contentType, body)
+		}
+
+		Convey("When PATCH /api/devices/web-1 with a merge patch", func() {
+			tc := patchRequest("web-1", "application/merge-patch+json; charset=utf-8", `{"os": {"version": "12"}}`)
+			So(tc.HttpResponse.Code, ShouldEqual, http.StatusOK)
+
+			response := &data.Object{}
+			So(tc.UnmarshalResponse(response), ShouldBeNil)
+			So(response.Attributes["os"], ShouldResemble, map[string]any{"name": "debian", "version": "12"})
+			So(response.Version, ShouldEqual, 2)
+		})
+		Convey("When PATCH /api/devices/web-1 with a JSON patch", func() {
+			tc := patchRequest("web-1", "application/json-patch+json", `[{"op": "test", "path": "/hostname", "value": "web-1"}, {"op": "replace", "path": "/hostname", "value": "web-2"}]`)
+			So(tc.HttpResponse.Code, ShouldEqual, http.StatusOK)
+
+			stored, err := server.tables.GetByID("device", "web-1")
+			So(err, ShouldBeNil)
+			So(stored.Attributes["hostname"], ShouldEqual, "web-2")
+		})
+		Convey("When PATCH /api/devices/web-1 with a failing test", func() {
+			tc := patchRequest("web-1", "application/json-patch+json", `[{"op": "test", "path": "/hostname", "value": "web-9"}]`)
+			So(tc.HttpResponse.Code, ShouldEqual, http.StatusConflict)
+		})
+		Convey("When PATCH /api/devices/web-1 with an invalid patch", func() {
+			tc := patchRequest("web-1", "application/json-patch+json", `{"op": "remove"}`)
+			So(tc.HttpResponse.Code, ShouldEqual, http.StatusBadRequest)
+		})
+		Convey("When PATCH /api/devices/web-1 with plain JSON", func() {
+			tc := patchRequest("web-1", "application/json", `{}`)
+			So(tc.HttpResponse.Code, ShouldEqual, http.StatusUnsupportedMediaType)
+			So(tc.HttpResponse.Header().Get("Accept-Patch"), ShouldContainSubstring, "application/merge-patch+json")
+		})
+		Convey("When PATCH /api/devices/web-2 for an unknown device", func() {
+			tc := patchRequest("web-2", "application/merge-patch+json", `{}`)
+			So(tc.HttpResponse.Code, ShouldEqual, http.StatusNotFound)
+		})
+		Convey("When PATCH /api/devices/web-1 without a session", func() {
+			tc := patchAs("", "web-1", "application/merge-patch+json", `{"hostname": "evil"}`)
+			So(tc.HttpResponse.Code, ShouldEqual, http.StatusUnauthorized)
+			So(tc.HttpResponse.Header().Get(echo.HeaderWWWAuthenticate), ShouldStartWith, "Bearer")
+			tc = patchAs("not-a-session", "web-1", "application/merge-patch+json", `{"hostname": "evil"}`)
+			So(tc.HttpResponse.Code, ShouldEqual, http.StatusUnauthorized)
+		})
+		Convey("When PATCH /api/devices/web-1 by an administrator of another organization", func() {
+			tc := patchAs(otherToken, "web-1", "application/merge-patch+json", `{"hostname": "evil"}`)
+			So(tc.HttpResponse.Code, ShouldEqual, http.StatusNotFound)
+		})
+		Convey("When PATCH /api/devices/web-1 by an administrator who can only read it", func() {
+			tc := patchAs(auditorToken, "web-1", "application/merge-patch+json", `{"hostname": "evil"}`)
+			So(tc.HttpResponse.Code, ShouldEqual, http.StatusForbidden)
+
+			stored, err := server.tables.GetByID("device", "web-1")
+			So(err, ShouldBeNil)
+			So(stored.Attributes["hostname"], ShouldEqual, "web-1")
+		})
+		Convey("When PATCH /api/devices/web-1 by an administrator who reads and writes it through different groups", func() {
+			tc := patchAs(editorToken, "web-1", "application/merge-patch+json", `{"hostname": "web-3"}`)
+			So(tc.HttpResponse.Code, ShouldEqual, http.StatusOK)
+
+			stored, err := server.tables.GetByID("device", "web-1")
+			So(err, ShouldBeNil)
+			So(stored.Attributes["hostname"], ShouldEqual, "web-3")
+		})
+	})
+}
@@ -5,33 +5,35 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"errors"
+	"net/http"
 
 	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 	"github.com/sendgrid/sendgrid-go/helpers/mail"
 
 	"github.com/jrpalma/linuxfleet/data"
+	"github.com/jrpalma/linuxfleet/secret"
 )
 
 type initiateRegistrationRequest struct {
 	Email    string `validate:"required,email"`
 	Password string `validate:"required,min=8"`
 }
-type initiateRegistrationResponse struct {
-	Token string
-}
 
+// initiateRegistrationHandler stores a registration and emails its link. The
+// token of the registration is only sent by email, so that the registration
+// proves that the administrator receives the emails of the address.
 func (h *Server) initiateRegistrationHandler(c echo.Context) error {
 	sc := h.ServerContext(c)
 
 	var request initiateRegistrationRequest
 	if err := sc.BindModel(&request); err != nil {
-		return sc.BadRequest(err.Error())
+		return sc.InvalidRequest(err)
 	}
 
 	token, err := uuid.NewRandom()
 	if err != nil {
-		return sc.InternalError("Failed to generate signup link")
+		return sc.InternalError("Failed to generate signup link", err)
 	}
 
 	registrationURL := sc.FormatURL("/registration/complete?token=%v", token)
@@ -39,12 +41,12 @@ func (h *Server) initiateRegistrationHandler(c echo.Context) error {
 
 	salt, err := uuid.NewRandom()
 	if err != nil {
-		return sc.InternalError("Failed to generate signup salt")
+		return sc.InternalError("Failed to generate signup salt", err)
 	}
 
 	htmlEmailContent, err := sc.ExecuteTemplate("registration-email.tmpl", templateValues)
 	if err != nil {
-		return sc.InternalError("Failed to execute email template")
+		return sc.InternalError("Failed to execute email template", err)
 	}
 
 	hash := sha256.New()
@@ -52,63 +54,96 @@ func (h *Server) initiateRegistrationHandler(c echo.Context) error {
 	hash.Write([]byte(request.Password))
 	passwordHash := hex.EncodeToString(hash.Sum(nil))
 
-	registrationObject := data.Object{
-		ID:      token.String(),
-		Version: 1,
-		Attributes: map[string]any{
-			"email":    request.Email,
-			"password": passwordHash,
-			"salt":     salt.String(),
-		},
+	registration := data.Registration{
+		ID:        token.String(),
+		Email:     request.Email,
+		Password:  passwordHash,
+		Salt:      salt.String(),
+		ExpiresAt: data.TimestampAfter(sc.Options().TokenLifetime),
 	}
 
-	err = sc.DataInsert("registration", registrationObject)
+	err = h.registrations.Insert(registration)
 	if err != nil {
-		return sc.InternalError("Failed to store user data")
+		return sc.InternalError("Failed to store user data", err)
 	}
 
 	to := mail.NewEmail(request.Email, request.Email)
-	from := mail.NewEmail("LinuxFleet Support", "support@linuxfleet.com")
+	from := mail.NewEmail(sc.Options().MailFromName, sc.Options().MailFromAddress)
 	message := mail.NewSingleEmail(from, "LinuxFleet Registration", to, "", htmlEmailContent)
 
 	err = sc.SendEmail(message)
 	if err != nil {
-		return sc.InternalError("Failed to send registration email")
+		return sc.InternalError("Failed to send registration email", err)
 	}
 
-	return sc.OKJSON(map[string]any{"token": token.String()})
+	return sc.OK("The registration link was sent by email")
 }
 
+// completeRegistrationRequest completes a registration with the base32 TOTP
+// seed of the authenticator app of the administrator.
 type completeRegistrationRequest struct {
 	Token string `validate:"required,uuid"`
-	Seed  string `validate:"required,min=8"`
+	Seed  string `validate:"required,min=16"`
 }
 
+// completeRegistrationHandler creates the administrator of a registration in
+// a new organization, of which it is a member. The registration is deleted,
+// so that its token cannot be used again.
 func (h *Server) completeRegistrationHandler(c echo.Context) error {
 	sc := h.ServerContext(c)
 
 	var request completeRegistrationRequest
 	if err := sc.BindModel(&request); err != nil {
-		return sc.BadRequest(err.Error())
+		return sc.InvalidRequest(err)
+	}
+	if !secret.ValidateSeedForTOTP(request.Seed) {
+		return sc.BadRequest("The seed is not a base32 TOTP seed")
 	}
 
-	registrationObject, err := sc.DataGetByID("registration", request.Token)
+	registration, err := h.registrations.Get(request.Token)
 	if errors.Is(err, sql.ErrNoRows) {
 		return sc.NotFound("The registration does not exists")
 	} else if err != nil {
-		return sc.InternalError(err.Error())
+		return sc.InternalError("Failed to get registration", err)
 	}
 
 	adminID, err := uuid.NewRandom()
 	if err != nil {
-		return sc.InternalError("Failed not generate admin ID")
+		return sc.InternalError("Failed to generate admin ID", err)
 	}
 
-	adminObject := data.Object{Attributes: registrationObject.Attributes, ID: adminID.String(), Version: 1}
-	adminObject.Attributes["seed"] = request.Seed
+	organizationID, err := uuid.NewRandom()
+	if err != nil {
+		return sc.InternalError("Failed to generate organization ID", err)
+	}
 
-	if err := sc.DataInsert("admin", adminObject); err != nil {
-		return sc.InternalError("Failed to save administrator")
+	admin := data.Admin{
+		ID:       adminID.String(),
+		OwnerID:  organizationID.String(),
+		Email:    registration.Email,
+		Password: registration.Password,
+		Salt:     registration.Salt,
+		Seed:     request.Seed,
+	}
+
+	err = h.admins.Insert(admin)
+	if errors.Is(err, data.ErrConflict) {
+		return sc.Error(http.StatusConflict, CodeAdminExists, "An administrator with this email already exists")
+	} else if err != nil {
+		return sc.InternalError("Failed to save administrator", err)
+	}
+
+	err = h.tables.AddGroupMember(admin.OwnerID, data.Member{Kind: data.MemberPrincipal, ID: admin.ID})
+	if err != nil {
+		if deleteErr := h.admins.Delete(admin.ID); deleteErr != nil {
+			h.requestLogger(c).Error("failed to delete the administrator", "error", deleteErr)
+		}
+		return sc.InternalError("Failed to add the administrator to its organization", err)
+	}
+
+	err = h.registrations.Delete(registration.ID)
+	if err != nil {
+		h.requestLogger(c).Error("failed to delete the completed registration", "error", err)
 	}
 
 	return sc.OK("User registration was completed successfully")
@@ -1,12 +1,16 @@
 package server
 
 import (
+	"database/sql"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	_ "github.com/mattn/go-sqlite3"
 	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/jrpalma/linuxfleet/data"
 )
 
 func TestRegistration(t *testing.T) {
@@ -35,10 +39,31 @@ func TestRegistration(t *testing.T) {
 			server.initiateRegistrationHandler(tc.EchoContext)
 
 			So(tc.HttpResponse.Code, ShouldEqual, http.StatusOK)
-			response := &initiateRegistrationResponse{}
-			err := tc.UnmarshalResponse(response)
+			So(tc.HttpResponse.Body.String(), ShouldNotContainSubstring, "token")
+			So(server.email.(*EmailSenderMock).emailedToken(), ShouldNotEqual, "")
+		})
+		Convey("When the registration email is sent", func() {
+			options := server.Options()
+			options.BaseURL = "https://fleet.example.com/"
+			options.MailFromName = "Fleet Admin"
+			options.MailFromAddress = "admin@fleet.example.com"
+			So(server.ReloadOptions(options), ShouldBeNil)
+
+			initiateRequest := &initiateRegistrationRequest{Email: "user@example.com", Password: "abc123#8"}
+			tc := server.EchoTestContext(http.MethodPost, "/api/registration/initiate", initiateRequest)
+			server.initiateRegistrationHandler(tc.EchoContext)
+			So(tc.HttpResponse.Code, ShouldEqual, http.StatusOK)
+			token := server.email.(*EmailSenderMock).emailedToken()
+
+			sent := server.email.(*EmailSenderMock).sent
+			So(sent, ShouldHaveLength, 1)
+			So(sent[0].From.Name, ShouldEqual, "Fleet Admin")
+			So(sent[0].From.Address, ShouldEqual, "admin@fleet.example.com")
+			So(sent[0].Content[0].Value, ShouldContainSubstring, "https://fleet.example.com/registration/complete?token="+token)
+
+			registration, err := server.tables.GetByID("registration", token)
 			So(err, ShouldBeNil)
-			So(response.Token, ShouldNotEqual, "")
+			So(registration.ExpiresAt.Time, ShouldHappenWithin, time.Minute, time.Now().Add(options.TokenLifetime))
 		})
 	})
 
@@ -55,8 +80,24 @@ func TestRegistration(t *testing.T) {
 			server.completeRegistrationHandler(tc.EchoContext)
 			So(tc.HttpResponse.Code, ShouldEqual, http.StatusBadRequest)
 		})
+		Convey("When POST /api/registration/complete with a seed that is not base32", func() {
+			completeRequest := &completeRegistrationRequest{Token: uuid.NewString(), Seed: "1234567812345678"}
+			tc := server.EchoTestContext(http.MethodPost, "/api/registration/complete", completeRequest)
+			server.completeRegistrationHandler(tc.EchoContext)
+			So(tc.HttpResponse.Code, ShouldEqual, http.StatusBadRequest)
+		})
 		Convey("When POST /api/registration/complete without existing registration", func() {
-			completeRequest := &completeRegistrationRequest{Token: uuid.NewString(), Seed: "12345678"}
+			completeRequest := &completeRegistrationRequest{Token: uuid.NewString(), Seed: testSeed}
+			tc := server.EchoTestContext(http.MethodPost, "/api/registration/complete", completeRequest)
+			server.completeRegistrationHandler(tc.EchoContext)
+			So(tc.HttpResponse.Code, ShouldEqual, http.StatusNotFound)
+		})
+		Convey("When POST /api/registration/complete with an expired registration", func() {
+			token := uuid.NewString()
+			registration := data.Object{ID: token, Version: 1, ExpiresAt: data.TimestampAfter(-time.Minute)}
+			So(server.tables.Insert("registration", registration), ShouldBeNil)
+
+			completeRequest := &completeRegistrationRequest{Token: token, Seed: testSeed}
 			tc := server.EchoTestContext(http.MethodPost, "/api/registration/complete", completeRequest)
 			server.completeRegistrationHandler(tc.EchoContext)
 			So(tc.HttpResponse.Code, ShouldEqual, http.StatusNotFound)
@@ -67,16 +108,42 @@ func TestRegistration(t *testing.T) {
 			server.initiateRegistrationHandler(tc.EchoContext)
 
 			So(tc.HttpResponse.Code, ShouldEqual, http.StatusOK)
-			response := &initiateRegistrationResponse{}
-			err := tc.UnmarshalResponse(response)
-			So(err, ShouldBeNil)
-			So(response.Token, ShouldNotEqual, "")
+			token := server.email.(*EmailSenderMock).emailedToken()
+			So(token, ShouldNotEqual, "")
 
 			Convey("Given POST /api/registration/complete with valid request", func() {
-				completeRequest := &completeRegistrationRequest{Token: response.Token, Seed: "12345678"}
-				tc := server.EchoTestContext(http.MethodPost, "/api/registration/complete?token="+response.Token, completeRequest)
+				completeRequest := &completeRegistrationRequest{Token: token, Seed: testSeed}
+				tc := server.EchoTestContext(http.MethodPost, "/api/registration/complete?token="+token, completeRequest)
 				server.completeRegistrationHandler(tc.EchoContext)
 				So(tc.HttpResponse.Code, ShouldEqual, http.StatusOK)
+
+				admins, err := server.admins.ListByAttribute("email", "user@example.com")
+				So(err, ShouldBeNil)
+				So(admins, ShouldHaveLength, 1)
+				So(admins[0].OwnerID, ShouldNotBeEmpty)
+				So(admins[0].Seed, ShouldEqual, testSeed)
+				principals, err := server.tables.Principals(admins[0].ID)
+				So(err, ShouldBeNil)
+				So(principals, ShouldContain, admins[0].OwnerID)
+
+				Convey("When the registration is completed again", func() {
+					tc := server.EchoTestContext(http.MethodPost, "/api/registration/complete", completeRequest)
+					server.completeRegistrationHandler(tc.EchoContext)
+					So(tc.HttpResponse.Code, ShouldEqual, http.StatusNotFound)
+					_, err := server.registrations.Get(token)
+					So(err, ShouldEqual, sql.ErrNoRows)
+				})
+				Convey("When the same email completes a second registration", func() {
+					tc := server.EchoTestContext(http.MethodPost, "/api/registration/initiate", initiateRequest)
+					server.initiateRegistrationHandler(tc.EchoContext)
+					second := server.email.(*EmailSenderMock).emailedToken()
+					So(second, ShouldNotEqual, token)
+
+					completeRequest := &completeRegistrationRequest{Token: second, Seed: testSeed}
+					tc = server.EchoTestContext(http.MethodPost, "/api/registration/complete", completeRequest)
+					server.completeRegistrationHandler(tc.EchoContext)
+					So(tc.HttpResponse.Code, ShouldEqual, http.StatusConflict)
+				})
 			})
 		})
 	})
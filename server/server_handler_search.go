@@ -0,0 +1,54 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/jrpalma/linuxfleet/data"
+)
+
+type searchRequest struct {
+	Query  string `query:"q" validate:"required,max=256"`
+	Tables string `query:"tables"`
+	Limit  int    `query:"limit" validate:"omitempty,min=1,max=100"`
+}
+
+type searchResponse struct {
+	Query   string                         `json:"query"`
+	Results map[string][]data.SearchResult `json:"results"`
+}
+
+// searchHandler searches the objects that the principal of the request can read.
+func (h *Server) searchHandler(c echo.Context) error {
+	sc := h.ServerContext(c)
+
+	var request searchRequest
+	if err := sc.BindModel(&request); err != nil {
+		return sc.InvalidRequest(err)
+	}
+
+	options := data.SearchOptions{PrincipalID: sc.Principal(), Limit: request.Limit}
+	if request.Tables != "" {
+		options.Tables = strings.Split(request.Tables, ",")
+	}
+
+	results, err := sc.DataSearch(request.Query, options)
+	if errors.Is(err, data.ErrSearchUnavailable) {
+		return sc.Error(http.StatusServiceUnavailable, CodeSearchUnavailable, "Search is not available on this server")
+	} else if errors.Is(err, data.ErrUnknownTable) {
+		return sc.Error(http.StatusBadRequest, CodeUnknownTable, err.Error())
+	} else if errors.Is(err, data.ErrEmptySearch) {
+		return sc.BadRequest(err.Error())
+	} else if err != nil {
+		return sc.InternalError("Failed to search", err)
+	}
+
+	response := searchResponse{Query: request.Query, Results: map[string][]data.SearchResult{}}
+	for _, result := range results {
+		response.Results[result.Table] = append(response.Results[result.Table], result)
+	}
+	return sc.OKJSON(response)
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/jrpalma/linuxfleet/data"
+)
+
+func TestSearch(t *testing.T) {
+	Convey("Scenario: The admin searches the fleet", t, func() {
+		server := testServer()
+		_, token := testLogin(server, "admin@owner1.example.com", "owner1")
+		_, otherToken := testLogin(server, "admin@owner2.example.com", "owner2")
+
+		searchAs := func(token string, query string) *TestContext {
+			request := httptest.NewRequest(http.MethodGet, "/api/v1/search"+query, nil)
+			if token != "" {
+				request.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+			}
+			recorder := httptest.NewRecorder()
+			server.echo.ServeHTTP(recorder, request)
+			return &TestContext{HttpResponse: recorder}
+		}
+
+		Convey("When GET /api/search without a session", func() {
+			tc := searchAs("", "?q=nginx")
+			So(tc.HttpResponse.Code, ShouldEqual, http.StatusUnauthorized)
+		})
+		Convey("When GET /api/search without a query", func() {
+			tc := searchAs(token, "")
+			So(tc.HttpResponse.Code, ShouldEqual, http.StatusBadRequest)
+		})
+
+		if !server.tables.SearchEnabled() {
+			Convey("When GET /api/search on a server without full-text search", func() {
+				tc := searchAs(token, "?q=nginx")
+				So(tc.HttpResponse.Code, ShouldEqual, http.StatusServiceUnavailable)
+			})
+			return
+		}
+
+		device := data.Object{ID: "web-1", OwnerID: "owner1", Version: 1, Attributes: map[string]any{"hostname": "web-1", "packages": []any{"nginx 1.18"}}}
+		user := data.Object{ID: "u1", OwnerID: "owner1", Version: 1, Attributes: map[string]any{"name": "nginx operator"}}
+		So(server.tables.Insert("device", device), ShouldBeNil)
+		So(server.tables.Insert("user", user), ShouldBeNil)
+
+		Convey("When GET /api/search?q=nginx", func() {
+			tc := searchAs(token, "?q=nginx")
+			So(tc.HttpResponse.Code, ShouldEqual, http.StatusOK)
+
+			response := &searchResponse{}
+			So(tc.UnmarshalResponse(response), ShouldBeNil)
+			So(response.Results["device"], ShouldHaveLength, 1)
+			So(response.Results["user"], ShouldHaveLength, 1)
+			So(response.Results["device"][0].Object.ID, ShouldEqual, "web-1")
+		})
+		Convey("When GET /api/search?q=nginx by the administrator of another organization", func() {
+			tc := searchAs(otherToken, "?q=nginx")
+			So(tc.HttpResponse.Code, ShouldEqual, http.StatusOK)
+
+			response := &searchResponse{}
+			So(tc.UnmarshalResponse(response), ShouldBeNil)
+			So(response.Results, ShouldBeEmpty)
+		})
+		Convey("When GET /api/search restricted to devices", func() {
+			tc := searchAs(token, "?q=nginx&tables=device")
+			So(tc.HttpResponse.Code, ShouldEqual, http.StatusOK)
+
+			response := &searchResponse{}
+			So(tc.UnmarshalResponse(response), ShouldBeNil)
+			So(response.Results, ShouldContainKey, "device")
+			So(response.Results, ShouldNotContainKey, "user")
+		})
+		Convey("When GET /api/search on a table that is not searchable", func() {
+			tc := searchAs(token, "?q=nginx&tables=admin")
+			So(tc.HttpResponse.Code, ShouldEqual, http.StatusBadRequest)
+		})
+	})
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/jrpalma/linuxfleet/opts"
+)
+
+// readinessTimeout bounds the time taken by all the readiness checks.
+const readinessTimeout = 2 * time.Second
+
+// Statuses of the server and of its components in the health responses.
+const (
+	healthOK           = "ok"
+	healthUnavailable  = "unavailable"
+	healthShuttingDown = "shutting_down"
+)
+
+// ReadinessCheck reports an error when a dependency of the server cannot be
+// used. It must return when ctx is done.
+type ReadinessCheck func(ctx context.Context) error
+
+type readinessCheck struct {
+	name  string
+	check ReadinessCheck
+}
+
+type healthResponse struct {
+	Status string                     `json:"status"`
+	Checks map[string]componentHealth `json:"checks,omitempty"`
+}
+
+// componentHealth is the result of a readiness check. The error of a failed
+// check is logged but not returned, since /readyz is not authenticated.
+type componentHealth struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+}
+
+// AddReadinessCheck registers a check that must pass for the server to be
+// ready. Its result is reported under name by /readyz.
+func (s *Server) AddReadinessCheck(name string, check ReadinessCheck) {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	s.readinessChecks = append(s.readinessChecks, readinessCheck{name: name, check: check})
+}
+
+// registerHealth registers the checks of the database, the mail sender and
+// the background workers.
+func (s *Server) registerHealth() {
+	s.AddReadinessCheck("database", s.tables.Ping)
+	s.AddReadinessCheck("migrations", s.tables.CheckMigrations)
+	s.AddReadinessCheck("mail", s.checkMail)
+	s.AddReadinessCheck("workers", s.checkWorkers)
+}
+
+// healthzHandler reports that the process is alive and serving requests.
+func (s *Server) healthzHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, healthResponse{Status: healthOK})
+}
+
+// readyzHandler runs the readiness checks and reports the status and latency
+// of every component. The server is ready when all of them pass, and it is
+// not ready anymore once it starts shutting down so that the load balancer
+// stops sending it requests.
+func (s *Server) readyzHandler(c echo.Context) error {
+	if s.shuttingDown.Load() {
+		return c.JSON(http.StatusServiceUnavailable, healthResponse{Status: healthShuttingDown})
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), readinessTimeout)
+	defer cancel()
+	response, errs := s.checkReadiness(ctx)
+	if response.Status != healthOK {
+		s.requestLogger(c).Warn("the server is not ready", "errors", errs)
+		return c.JSON(http.StatusServiceUnavailable, response)
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// checkReadiness runs the readiness checks concurrently. It returns the
+// errors of the failed checks by name apart from the response.
+func (s *Server) checkReadiness(ctx context.Context) (healthResponse, map[string]string) {
+	s.healthMu.Lock()
+	checks := s.readinessChecks
+	s.healthMu.Unlock()
+
+	response := healthResponse{Status: healthOK, Checks: map[string]componentHealth{}}
+	errs := map[string]string{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			err := check.check(ctx)
+			health := componentHealth{Status: healthOK, LatencyMS: float64(time.Since(start).Microseconds()) / 1000}
+			if err != nil {
+				health.Status = healthUnavailable
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			response.Checks[check.name] = health
+			if err != nil {
+				response.Status = healthUnavailable
+				errs[check.name] = err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+	return response, errs
+}
+
+// checkMail verifies that the mail provider of the current options can send
+// emails.
+func (s *Server) checkMail(context.Context) error {
+	if s.email == nil {
+		return errors.New("no email sender")
+	}
+	options := s.Options()
+	switch options.MailProvider {
+	case opts.MailProviderSendGrid:
+		if options.SendGridAPIKey == "" {
+			return errors.New("sendgrid_api_key is not set")
+		}
+	case opts.MailProviderLog:
+	default:
+		return fmt.Errorf("unknown mail provider %q", options.MailProvider)
+	}
+	return nil
+}
+
+// checkWorkers verifies that the background workers were started and have
+// not been stopped.
+func (s *Server) checkWorkers(context.Context) error {
+	if !s.workersRunning.Load() {
+		return errors.New("the background workers are not running")
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/jrpalma/linuxfleet/opts"
+)
+
+func TestHealthEndpoints(t *testing.T) {
+	Convey("Scenario: The load balancer checks the health of the server", t, func() {
+		server := testServer()
+		serve := func(target string) (*httptest.ResponseRecorder, healthResponse) {
+			recorder := httptest.NewRecorder()
+			server.echo.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+			var response healthResponse
+			So(json.Unmarshal(recorder.Body.Bytes(), &response), ShouldBeNil)
+			return recorder, response
+		}
+
+		Convey("When the process is alive", func() {
+			recorder, response := serve("/healthz")
+
+			Convey("Then it is healthy", func() {
+				So(recorder.Code, ShouldEqual, http.StatusOK)
+				So(response.Status, ShouldEqual, healthOK)
+			})
+		})
+		Convey("When the workers are running and every dependency is available", func() {
+			server.startWorkers()
+			defer server.Shutdown(context.Background())
+			recorder, response := serve("/readyz")
+
+			Convey("Then it is ready and every component is reported", func() {
+				So(recorder.Code, ShouldEqual, http.StatusOK)
+				So(response.Status, ShouldEqual, healthOK)
+				So(response.Checks, ShouldHaveLength, 4)
+				for _, name := range []string{"database", "migrations", "mail", "workers"} {
+					So(response.Checks[name].Status, ShouldEqual, healthOK)
+				}
+			})
+		})
+		Convey("When the workers are not running and the mail provider is not configured", func() {
+			options := server.Options()
+			options.MailProvider = opts.MailProviderSendGrid
+			options.SendGridAPIKey = ""
+			server.options.Store(&options)
+			recorder, response := serve("/readyz")
+
+			Convey("Then it is not ready and the failed components are reported", func() {
+				So(recorder.Code, ShouldEqual, http.StatusServiceUnavailable)
+				So(response.Status, ShouldEqual, healthUnavailable)
+				So(response.Checks["database"].Status, ShouldEqual, healthOK)
+				So(response.Checks["mail"].Status, ShouldEqual, healthUnavailable)
+				So(response.Checks["workers"].Status, ShouldEqual, healthUnavailable)
+			})
+		})
+		Convey("When a subsystem registers a failing check", func() {
+			var buffer bytes.Buffer
+			server.logger = slog.New(slog.NewJSONHandler(&buffer, nil))
+			server.startWorkers()
+			defer server.Shutdown(context.Background())
+			server.AddReadinessCheck("cluster", func(context.Context) error {
+				return errors.New("no leader at 10.0.0.2:7946")
+			})
+			recorder, response := serve("/readyz")
+
+			Convey("Then it is not ready and the error is logged but not returned", func() {
+				So(recorder.Code, ShouldEqual, http.StatusServiceUnavailable)
+				So(response.Checks["cluster"].Status, ShouldEqual, healthUnavailable)
+				So(recorder.Body.String(), ShouldNotContainSubstring, "10.0.0.2")
+				So(buffer.String(), ShouldContainSubstring, "no leader at 10.0.0.2:7946")
+			})
+		})
+		Convey("When the server starts shutting down with a drain delay", func() {
+			options := server.Options()
+			options.ShutdownDrainDelay = 200 * time.Millisecond
+			server.options.Store(&options)
+			server.startWorkers()
+			start := time.Now()
+			done := make(chan error)
+			go func() { done <- server.Shutdown(context.Background()) }()
+			for !server.shuttingDown.Load() {
+				time.Sleep(time.Millisecond)
+			}
+			recorder, response := serve("/readyz")
+
+			Convey("Then it reports not ready before it stops accepting requests", func() {
+				So(recorder.Code, ShouldEqual, http.StatusServiceUnavailable)
+				So(response.Status, ShouldEqual, healthShuttingDown)
+				So(server.workersRunning.Load(), ShouldBeTrue)
+				So(<-done, ShouldBeNil)
+				So(time.Since(start), ShouldBeGreaterThanOrEqualTo, options.ShutdownDrainDelay)
+				So(server.workersRunning.Load(), ShouldBeFalse)
+			})
+		})
+		Convey("When the server is shutting down", func() {
+			server.startWorkers()
+			So(server.Shutdown(context.Background()), ShouldBeNil)
+			recorder, response := serve("/readyz")
+
+			Convey("Then it is not ready anymore but still alive", func() {
+				So(recorder.Code, ShouldEqual, http.StatusServiceUnavailable)
+				So(response.Status, ShouldEqual, healthShuttingDown)
+				recorder, _ := serve("/healthz")
+				So(recorder.Code, ShouldEqual, http.StatusOK)
+			})
+		})
+	})
+}
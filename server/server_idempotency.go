@@ -0,0 +1,204 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/jrpalma/linuxfleet/data"
+	"github.com/jrpalma/linuxfleet/openapi"
+)
+
+// Headers of the idempotent requests.
+const (
+	headerIdempotencyKey     = "Idempotency-Key"
+	headerIdempotentReplayed = "Idempotent-Replayed"
+)
+
+const (
+	// maxIdempotencyKeyLength bounds the idempotency keys accepted from
+	// clients.
+	maxIdempotencyKeyLength = 255
+	// maxIdempotentRequestSize bounds the bodies of the requests read to
+	// tell a retry from another request with the same key.
+	maxIdempotentRequestSize = 1 << 20
+	// idempotencyLockTimeout is how long a key is held by its request being
+	// handled, after which a retry handles the request again.
+	idempotencyLockTimeout = time.Minute
+)
+
+// replayedHeaders are the headers of a response replayed with its body.
+var replayedHeaders = []string{echo.HeaderContentType, echo.HeaderLocation}
+
+// idempotencyKeyHeader documents the Idempotency-Key header.
+var idempotencyKeyHeader = openapi.Parameter{
+	Name:   headerIdempotencyKey,
+	In:     "header",
+	Schema: &openapi.Schema{Type: "string"},
+}
+
+// idempotencyRecorder copies the body of a response as it is written.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *idempotencyRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// idempotent makes the requests sent with an Idempotency-Key header safe to
+// retry. The response to the first request with a key is stored and replayed
+// to the requests sent again with the key by the same principal, with the
+// Idempotent-Replayed header, without handling them. A key sent with another
+// request is rejected with 422, and a key whose request is still being handled
+// with 409. The keys expire after IdempotencyKeyLifetime. The server errors
+// are not stored, so that the request can be retried. The secrets are the
+// JSON fields of the response that are left out of the stored response, such
+// as a session token, so a retry learns that the request succeeded but not
+// the secret.
+func (s *Server) idempotent(next echo.HandlerFunc, secrets []string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		key := c.Request().Header.Get(headerIdempotencyKey)
+		if key == "" {
+			return next(c)
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			return writeProblem(c, newProblem(http.StatusBadRequest, CodeInvalidRequest, "The Idempotency-Key header is too long"))
+		}
+
+		request := c.Request()
+		body, err := io.ReadAll(io.LimitReader(request.Body, maxIdempotentRequestSize+1))
+		if err != nil {
+			return writeProblem(c, newProblem(http.StatusBadRequest, CodeInvalidRequest, "Failed to read the request body"))
+		}
+		if len(body) > maxIdempotentRequestSize {
+			return writeProblem(c, newProblem(http.StatusRequestEntityTooLarge, CodePayloadTooLarge, "The request body is too large"))
+		}
+		request.Body = io.NopCloser(bytes.NewReader(body))
+
+		principal := idempotencyPrincipal(c)
+		now := time.Now()
+		stored, err := s.idempotencyKeys.Begin(principal, key, requestFingerprint(request, body), now, now.Add(idempotencyLockTimeout))
+		switch {
+		case errors.Is(err, data.ErrIdempotencyKeyReused):
+			return writeProblem(c, newProblem(http.StatusUnprocessableEntity, CodeIdempotencyKeyReused,
+				"The Idempotency-Key was already used for a different request"))
+		case errors.Is(err, data.ErrIdempotencyKeyInUse):
+			return writeProblem(c, newProblem(http.StatusConflict, CodeIdempotencyKeyInUse,
+				"The request of the Idempotency-Key is still in progress"))
+		case err != nil:
+			s.requestLogger(c).Error("failed to claim the idempotency key", "error", err)
+			return writeProblem(c, newProblem(http.StatusInternalServerError, CodeInternal, "Failed to claim the idempotency key"))
+		case stored != nil:
+			return replay(c, stored)
+		}
+
+		response := c.Response()
+		recorder := &idempotencyRecorder{ResponseWriter: response.Writer}
+		response.Writer = recorder
+		err = next(c)
+		response.Writer = recorder.ResponseWriter
+
+		if err != nil || !response.Committed || response.Status >= http.StatusInternalServerError {
+			if releaseErr := s.idempotencyKeys.Release(principal, key); releaseErr != nil {
+				s.requestLogger(c).Error("failed to release the idempotency key", "error", releaseErr)
+			}
+			return err
+		}
+		completed := data.IdempotentResponse{Status: response.Status, Header: map[string][]string{}, Body: redact(recorder.body.Bytes(), secrets)}
+		for _, name := range replayedHeaders {
+			if values := response.Header().Values(name); len(values) > 0 {
+				completed.Header[name] = values
+			}
+		}
+		expires := time.Now().Add(s.Options().IdempotencyKeyLifetime)
+		if err := s.idempotencyKeys.Complete(principal, key, completed, expires); err != nil {
+			s.requestLogger(c).Error("failed to store the idempotent response", "error", err)
+		}
+		return nil
+	}
+}
+
+// replay responds with a stored response.
+func replay(c echo.Context, stored *data.IdempotentResponse) error {
+	header := c.Response().Header()
+	for name, values := range stored.Header {
+		header[http.CanonicalHeaderKey(name)] = values
+	}
+	header.Set(headerIdempotentReplayed, "true")
+	c.Response().WriteHeader(stored.Status)
+	_, err := c.Response().Write(stored.Body)
+	return err
+}
+
+// idempotencyPrincipal returns the principal whose idempotency keys are
+// separate from the others: the administrator authenticated by
+// authenticateAPI, or the address of the anonymous requests read by the
+// IPExtractor of the server.
+func idempotencyPrincipal(c echo.Context) string {
+	if principal, ok := c.Get(principalKey).(string); ok && principal != "" {
+		return "admin:" + principal
+	}
+	return "ip:" + c.RealIP()
+}
+
+// secretFields returns the JSON names of the fields of a response body tagged
+// secret, such as a session token.
+func secretFields(response any) []string {
+	t := reflect.TypeOf(response)
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil
+	}
+	var secrets []string
+	for _, field := range reflect.VisibleFields(t) {
+		if field.Tag.Get("secret") != "true" {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" {
+			name = field.Name
+		}
+		secrets = append(secrets, name)
+	}
+	return secrets
+}
+
+// redact removes the secret fields from a JSON object body. The body is
+// dropped when it has secrets but is not a JSON object.
+func redact(body []byte, secrets []string) []byte {
+	if len(secrets) == 0 {
+		return body
+	}
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(body, &object); err != nil {
+		return nil
+	}
+	for _, name := range secrets {
+		delete(object, name)
+	}
+	redacted, err := json.Marshal(object)
+	if err != nil {
+		return nil
+	}
+	return redacted
+}
+
+// requestFingerprint identifies a request by its method, its path and its
+// body.
+func requestFingerprint(request *http.Request, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(request.Method + " " + request.URL.RequestURI() + "\n"))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
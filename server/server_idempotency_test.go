@@ -0,0 +1,166 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pquerna/otp/totp"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/jrpalma/linuxfleet/data"
+	"github.com/jrpalma/linuxfleet/openapi"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	Convey("Scenario: The automation retries the registration", t, func() {
+		server := testServer()
+		email := server.email.(*EmailSenderMock)
+		post := func(path string, key string, token string, body string) *httptest.ResponseRecorder {
+			request := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+			request.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			if key != "" {
+				request.Header.Set(headerIdempotencyKey, key)
+			}
+			if token != "" {
+				request.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+			}
+			recorder := httptest.NewRecorder()
+			server.echo.ServeHTTP(recorder, request)
+			return recorder
+		}
+		complete := func(key string, token string, body string) *httptest.ResponseRecorder {
+			return post("/api/v1/registration/complete", key, token, body)
+		}
+		register := func(emailAddress string) string {
+			registration := data.Registration{ID: uuid.NewString(), Email: emailAddress, Password: "hash", Salt: "salt"}
+			So(server.registrations.Insert(registration), ShouldBeNil)
+			return `{"Token":"` + registration.ID + `","Seed":"JBSWY3DPEHPK3PXP"}`
+		}
+		body := register("user@example.com")
+
+		Convey("When the request is retried with the same Idempotency-Key", func() {
+			first := complete("retry-1", "", body)
+			retry := complete("retry-1", "", body)
+
+			Convey("Then the first response is replayed without completing the registration twice", func() {
+				So(first.Code, ShouldEqual, http.StatusOK)
+				So(retry.Code, ShouldEqual, http.StatusOK)
+				So(retry.Body.String(), ShouldEqual, first.Body.String())
+				So(retry.Header().Get(echo.HeaderContentType), ShouldEqual, first.Header().Get(echo.HeaderContentType))
+				So(retry.Header().Get(headerIdempotentReplayed), ShouldEqual, "true")
+				So(first.Header().Get(headerIdempotentReplayed), ShouldBeEmpty)
+				So(complete("", "", body).Code, ShouldEqual, http.StatusNotFound)
+			})
+		})
+		Convey("When the Idempotency-Key is reused with a different body", func() {
+			complete("retry-1", "", body)
+			reused := complete("retry-1", "", register("other@example.com"))
+
+			Convey("Then the request is rejected", func() {
+				So(reused.Code, ShouldEqual, http.StatusUnprocessableEntity)
+				So(reused.Body.String(), ShouldContainSubstring, `"code":"idempotency_key_reused"`)
+			})
+		})
+		Convey("When other principals send the same Idempotency-Key", func() {
+			_, token1 := testLogin(server, "admin1@example.com", "owner1")
+			_, token2 := testLogin(server, "admin2@example.com", "owner1")
+			first := complete("retry-1", token1, body)
+			second := complete("retry-1", token2, body)
+			anonymous := complete("retry-1", "", body)
+			spoofed := complete("retry-1", "token-1", body)
+
+			Convey("Then their keys are separate, and invalid tokens are anonymous", func() {
+				So(first.Code, ShouldEqual, http.StatusOK)
+				So(second.Code, ShouldEqual, http.StatusNotFound)
+				So(anonymous.Code, ShouldEqual, http.StatusNotFound)
+				So(spoofed.Code, ShouldEqual, http.StatusNotFound)
+				So(spoofed.Header().Get(headerIdempotentReplayed), ShouldEqual, "true")
+			})
+		})
+		Convey("When the first request is invalid", func() {
+			invalid := complete("retry-2", "", `{"Token":"invalid"}`)
+			retry := complete("retry-2", "", `{"Token":"invalid"}`)
+
+			Convey("Then the client error is replayed", func() {
+				So(invalid.Code, ShouldEqual, http.StatusBadRequest)
+				So(retry.Code, ShouldEqual, http.StatusBadRequest)
+				So(retry.Header().Get(echo.HeaderContentType), ShouldEqual, ProblemContentType)
+				So(retry.Body.String(), ShouldEqual, invalid.Body.String())
+			})
+		})
+		Convey("When the first request fails on the server", func() {
+			failures := 1
+			server.apiVersion("v1", nil).handle(openapi.Route{Method: http.MethodPost, Path: "/flaky", Summary: "Fail once"}, func(c echo.Context) error {
+				if failures > 0 {
+					failures--
+					return server.ServerContext(c).InternalError("Failed", errors.New("unavailable"))
+				}
+				return server.ServerContext(c).OK("Done")
+			})
+			failed := post("/api/v1/flaky", "retry-3", "", "{}")
+			retry := post("/api/v1/flaky", "retry-3", "", "{}")
+
+			Convey("Then the retry is handled again", func() {
+				So(failed.Code, ShouldEqual, http.StatusInternalServerError)
+				So(retry.Code, ShouldEqual, http.StatusOK)
+				So(retry.Header().Get(headerIdempotentReplayed), ShouldBeEmpty)
+			})
+		})
+		Convey("When a registration is initiated again with the same Idempotency-Key", func() {
+			initiate := `{"Email":"new@example.com","Password":"abc123#8"}`
+			first := post("/api/v1/registration/initiate", "retry-4", "", initiate)
+			retry := post("/api/v1/registration/initiate", "retry-4", "", initiate)
+
+			Convey("Then the registration is stored and emailed once", func() {
+				So(first.Code, ShouldEqual, http.StatusOK)
+				So(retry.Code, ShouldEqual, http.StatusOK)
+				So(retry.Header().Get(headerIdempotentReplayed), ShouldEqual, "true")
+				So(email.sent, ShouldHaveLength, 1)
+				registrations, err := server.registrations.ListByAttribute("email", "new@example.com")
+				So(err, ShouldBeNil)
+				So(registrations, ShouldHaveLength, 1)
+			})
+		})
+		Convey("When a login is retried with the same Idempotency-Key", func() {
+			hash := sha256.Sum256([]byte("salt" + "password1"))
+			admin := data.Admin{ID: "admin1", OwnerID: "org1", Email: "admin@example.com", Password: hex.EncodeToString(hash[:]), Salt: "salt", Seed: testSeed}
+			So(server.admins.Insert(admin), ShouldBeNil)
+			code, err := totp.GenerateCode(testSeed, time.Now())
+			So(err, ShouldBeNil)
+			login := `{"email": "admin@example.com", "password": "password1", "totp": "` + code + `"}`
+			first := post("/api/v1/login", "retry-5", "", login)
+			retry := post("/api/v1/login", "retry-5", "", login)
+
+			Convey("Then the response is replayed without its session token", func() {
+				So(first.Code, ShouldEqual, http.StatusOK)
+				So(first.Body.String(), ShouldContainSubstring, `"token"`)
+				So(retry.Code, ShouldEqual, http.StatusOK)
+				So(retry.Header().Get(headerIdempotentReplayed), ShouldEqual, "true")
+				So(retry.Body.String(), ShouldContainSubstring, `"expires_at"`)
+				So(retry.Body.String(), ShouldNotContainSubstring, `"token"`)
+				sessions, err := server.sessions.ListByAttribute("admin_id", "admin1")
+				So(err, ShouldBeNil)
+				So(sessions, ShouldHaveLength, 1)
+			})
+		})
+		Convey("When the API is documented", func() {
+			paths := server.OpenAPI().Paths
+
+			Convey("Then the Idempotency-Key header is documented on every POST route", func() {
+				So(paths["/api/v1/registration/complete"]["post"].Parameters, ShouldContain, idempotencyKeyHeader)
+				So(paths["/api/v1/registration/complete"]["post"].Responses, ShouldContainKey, "422")
+				So(paths["/api/v1/registration/initiate"]["post"].Parameters, ShouldContain, idempotencyKeyHeader)
+				So(paths["/api/v1/login"]["post"].Parameters, ShouldContain, idempotencyKeyHeader)
+			})
+		})
+	})
+}
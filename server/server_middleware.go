@@ -0,0 +1,104 @@
+package server
+
+import (
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+// Keys of the values stored in the echo context of a request.
+const (
+	requestIDKey = "request_id"
+	loggerKey    = "logger"
+	// principalKey holds the ID of the authenticated principal of the
+	// request, the administrator of its session.
+	principalKey = "principal_id"
+	// organizationKey holds the ID of the organization of the authenticated
+	// principal of the request.
+	organizationKey = "organization_id"
+)
+
+// maxRequestIDLength bounds the request IDs accepted from clients.
+const maxRequestIDLength = 128
+
+// requestMiddleware assigns an ID to every request, echoes it in the
+// X-Request-Id response header, and logs and measures the request once it is
+// handled.
+func (s *Server) requestMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		logger := s.requestLogger(c)
+
+		err := next(c)
+		if err != nil {
+			c.Error(err)
+		}
+
+		s.telemetry.observeRequest(c, start, s.routes)
+		request := c.Request()
+		logger.Info("request",
+			"method", request.Method,
+			"path", request.URL.Path,
+			"status", c.Response().Status,
+			"duration", time.Since(start),
+			"remote_ip", c.RealIP(),
+		)
+		return nil
+	}
+}
+
+// ipExtractor returns how the address of a client is read from its requests:
+// the address of the connection, or the X-Forwarded-For header when the
+// connection comes from one of the trusted proxies. Without trusted proxies,
+// the headers sent by clients cannot spoof their address.
+func ipExtractor(trustedProxies []string) echo.IPExtractor {
+	if len(trustedProxies) == 0 {
+		return echo.ExtractIPDirect()
+	}
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, proxy := range trustedProxies {
+		if _, ipRange, err := net.ParseCIDR(proxy); err == nil {
+			options = append(options, echo.TrustIPRange(ipRange))
+		}
+	}
+	return echo.ExtractIPFromXFFHeader(options...)
+}
+
+// requestLogger returns the logger of the request, tagged with its ID. The ID
+// is taken from the X-Request-Id request header when it is valid, so that the
+// requests of a client or a proxy can be correlated, and generated otherwise.
+func (s *Server) requestLogger(c echo.Context) *slog.Logger {
+	if logger, ok := c.Get(loggerKey).(*slog.Logger); ok {
+		return logger
+	}
+	id := c.Request().Header.Get(echo.HeaderXRequestID)
+	if !validRequestID(id) {
+		id = uuid.NewString()
+	}
+	c.Response().Header().Set(echo.HeaderXRequestID, id)
+
+	logger := s.logger.With(requestIDKey, id)
+	c.Set(requestIDKey, id)
+	c.Set(loggerKey, logger)
+	return logger
+}
+
+// validRequestID reports whether a request ID sent by a client is short and
+// only made of letters, digits, dashes, dots and underscores.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-' || r == '.' || r == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
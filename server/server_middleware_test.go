@@ -0,0 +1,114 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// logEntries decodes the JSON log lines written to buffer.
+func logEntries(buffer *bytes.Buffer) []map[string]any {
+	var entries []map[string]any
+	for line := range strings.Lines(buffer.String()) {
+		entry := map[string]any{}
+		if json.Unmarshal([]byte(line), &entry) == nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func TestRequestMiddleware(t *testing.T) {
+	Convey("Scenario: Requests are logged with their ID", t, func() {
+		server := testServer()
+		var buffer bytes.Buffer
+		server.logger = slog.New(slog.NewJSONHandler(&buffer, nil))
+
+		Convey("When a request is sent without an ID", func() {
+			request := httptest.NewRequest(http.MethodPatch, "/api/devices/1", nil)
+			recorder := httptest.NewRecorder()
+			server.echo.ServeHTTP(recorder, request)
+
+			Convey("Then an ID is generated, echoed and logged with the request", func() {
+				id := recorder.Header().Get(echo.HeaderXRequestID)
+				So(id, ShouldHaveLength, 36)
+				entries := logEntries(&buffer)
+				So(entries, ShouldHaveLength, 1)
+				So(entries[0]["msg"], ShouldEqual, "request")
+				So(entries[0]["request_id"], ShouldEqual, id)
+				So(entries[0]["path"], ShouldEqual, "/api/devices/1")
+				So(entries[0]["status"], ShouldEqual, http.StatusUnauthorized)
+			})
+		})
+		Convey("When a request is sent with an ID", func() {
+			request := httptest.NewRequest(http.MethodPatch, "/api/devices/1", nil)
+			request.Header.Set(echo.HeaderXRequestID, "client-42.a_b")
+			recorder := httptest.NewRecorder()
+			server.echo.ServeHTTP(recorder, request)
+
+			Convey("Then the ID of the client is used", func() {
+				So(recorder.Header().Get(echo.HeaderXRequestID), ShouldEqual, "client-42.a_b")
+				So(logEntries(&buffer)[0]["request_id"], ShouldEqual, "client-42.a_b")
+			})
+		})
+		Convey("When a request is sent with an invalid ID", func() {
+			request := httptest.NewRequest(http.MethodPatch, "/api/devices/1", nil)
+			request.Header.Set(echo.HeaderXRequestID, "bad id\n")
+			recorder := httptest.NewRecorder()
+			server.echo.ServeHTTP(recorder, request)
+
+			Convey("Then another ID is generated", func() {
+				So(recorder.Header().Get(echo.HeaderXRequestID), ShouldHaveLength, 36)
+			})
+		})
+		Convey("When a request is sent to an unknown route", func() {
+			request := httptest.NewRequest(http.MethodGet, "/api/unknown", nil)
+			recorder := httptest.NewRecorder()
+			server.echo.ServeHTTP(recorder, request)
+
+			Convey("Then the error status is logged", func() {
+				So(recorder.Code, ShouldEqual, http.StatusNotFound)
+				So(logEntries(&buffer)[0]["status"], ShouldEqual, http.StatusNotFound)
+			})
+		})
+	})
+
+	Convey("Scenario: A handler fails with an internal error", t, func() {
+		server := testServer()
+		var buffer bytes.Buffer
+		server.logger = slog.New(slog.NewJSONHandler(&buffer, nil))
+
+		tc := server.EchoTestContext(http.MethodGet, "/api/search", nil)
+		sc := server.ServerContext(tc.EchoContext)
+		So(sc.InternalError("Failed to store user data", errors.New("database is locked")), ShouldBeNil)
+
+		Convey("Then the error is logged with the request ID", func() {
+			entries := logEntries(&buffer)
+			So(entries, ShouldHaveLength, 1)
+			So(entries[0]["level"], ShouldEqual, "ERROR")
+			So(entries[0]["msg"], ShouldEqual, "Failed to store user data")
+			So(entries[0]["error"], ShouldEqual, "database is locked")
+			So(entries[0]["request_id"], ShouldEqual, sc.RequestID())
+		})
+		Convey("Then the client only gets the message and the request ID", func() {
+			So(tc.HttpResponse.Code, ShouldEqual, http.StatusInternalServerError)
+			So(tc.HttpResponse.Header().Get(echo.HeaderXRequestID), ShouldEqual, sc.RequestID())
+			So(tc.HttpResponse.Header().Get(echo.HeaderContentType), ShouldEqual, ProblemContentType)
+			var response Problem
+			So(tc.UnmarshalResponse(&response), ShouldBeNil)
+			So(response.Code, ShouldEqual, CodeInternal)
+			So(response.Detail, ShouldEqual, "Failed to store user data")
+			So(response.RequestID, ShouldEqual, sc.RequestID())
+			So(tc.HttpResponse.Body.String(), ShouldNotContainSubstring, "database is locked")
+		})
+	})
+}
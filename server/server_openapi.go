@@ -0,0 +1,32 @@
+package server
+
+import (
+	"github.com/labstack/echo/v4"
+
+	"github.com/jrpalma/linuxfleet/openapi"
+)
+
+// Title and version of the OpenAPI document of the server.
+const (
+	apiTitle   = "LinuxFleet API"
+	apiVersion = "1.0.0"
+)
+
+// handle registers the handler of a route and documents the route in the
+// OpenAPI document. Every route of the server but the pages of the console
+// must be registered with handle while the server is created.
+func (s *Server) handle(route openapi.Route, handler echo.HandlerFunc) {
+	s.echo.Add(route.Method, route.Path, handler)
+	s.api.Add(route)
+	s.routes[route.Path] = true
+}
+
+// OpenAPI returns the OpenAPI document of the routes of the server.
+func (s *Server) OpenAPI() openapi.Document {
+	return s.api.Document()
+}
+
+// openAPIHandler serves the OpenAPI document of the server.
+func (s *Server) openAPIHandler(c echo.Context) error {
+	return s.ServerContext(c).OKJSON(s.OpenAPI())
+}
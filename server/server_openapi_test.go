@@ -0,0 +1,71 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/jrpalma/linuxfleet/openapi"
+)
+
+func TestOpenAPI(t *testing.T) {
+	Convey("Scenario: The API is documented with OpenAPI", t, func() {
+		server := testServer()
+		document := server.OpenAPI()
+
+		Convey("When the routes of the server are listed", func() {
+			Convey("Then every route but the console pages is documented", func() {
+				for _, route := range server.echo.Routes() {
+					if strings.HasPrefix(route.Path, consolePath) {
+						continue
+					}
+					So(document.Documented(route.Method, route.Path), ShouldBeTrue)
+				}
+			})
+		})
+		Convey("When the registration request is documented", func() {
+			operation := document.Paths["/api/registration/initiate"]["post"]
+			body := operation.RequestBody.Content["application/json"].Schema
+
+			Convey("Then its validate tags are schema constraints", func() {
+				So(body.Required, ShouldResemble, []string{"Email", "Password"})
+				So(body.Properties["Email"].Format, ShouldEqual, "email")
+				So(*body.Properties["Password"].MinLength, ShouldEqual, 8)
+				So(operation.Responses["200"].Content["application/json"].Schema.Ref, ShouldEqual, "#/components/schemas/messageBody")
+				So(operation.Responses["400"].Content[ProblemContentType].Schema.Ref, ShouldEqual, "#/components/schemas/Problem")
+			})
+		})
+		Convey("When the metrics query is documented", func() {
+			operation := document.Paths["/api/devices/{id}/metrics"]["get"]
+			parameters := map[string]openapi.Parameter{}
+			for _, parameter := range operation.Parameters {
+				parameters[parameter.Name] = parameter
+			}
+
+			Convey("Then its path and query parameters are listed", func() {
+				So(operation.RequestBody, ShouldBeNil)
+				So(parameters["id"].In, ShouldEqual, "path")
+				So(parameters["id"].Required, ShouldBeTrue)
+				So(parameters["agg"].Schema.Enum, ShouldResemble, []any{"avg", "min", "max", "sum", "count"})
+				So(*parameters["metric"].Schema.Items.MaxLength, ShouldEqual, 128)
+			})
+		})
+		Convey("When the document is requested", func() {
+			recorder := httptest.NewRecorder()
+			server.echo.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/openapi.json", nil))
+
+			Convey("Then it is served as JSON", func() {
+				So(recorder.Code, ShouldEqual, http.StatusOK)
+				var served map[string]any
+				So(json.Unmarshal(recorder.Body.Bytes(), &served), ShouldBeNil)
+				So(served["openapi"], ShouldEqual, openapi.Version)
+				So(served["paths"], ShouldContainKey, "/api/devices/{id}")
+			})
+		})
+	})
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v4"
+)
+
+// ProblemContentType is the media type of the error responses (RFC 7807).
+const ProblemContentType = "application/problem+json"
+
+// ErrorCode identifies the cause of an error response. Clients branch on the
+// code, which is stable, instead of the message.
+type ErrorCode string
+
+const (
+	CodeInvalidRequest       ErrorCode = "invalid_request"
+	CodeValidationFailed     ErrorCode = "validation_failed"
+	CodeUnauthorized         ErrorCode = "unauthorized"
+	CodeForbidden            ErrorCode = "forbidden"
+	CodeNotFound             ErrorCode = "not_found"
+	CodeMethodNotAllowed     ErrorCode = "method_not_allowed"
+	CodeConflict             ErrorCode = "conflict"
+	CodeUnsupportedMediaType ErrorCode = "unsupported_media_type"
+	CodePayloadTooLarge      ErrorCode = "payload_too_large"
+	CodeServiceUnavailable   ErrorCode = "service_unavailable"
+	CodeRateLimited          ErrorCode = "rate_limited"
+	CodeInternal             ErrorCode = "internal_error"
+
+	CodeInvalidPatch       ErrorCode = "invalid_patch"
+	CodePatchTestFailed    ErrorCode = "patch_test_failed"
+	CodeVersionConflict    ErrorCode = "version_conflict"
+	CodeUnknownTable       ErrorCode = "unknown_table"
+	CodeInvalidMetricQuery ErrorCode = "invalid_metric_query"
+	CodeSearchUnavailable  ErrorCode = "search_unavailable"
+	CodeAdminExists        ErrorCode = "admin_exists"
+
+	CodeIdempotencyKeyReused ErrorCode = "idempotency_key_reused"
+	CodeIdempotencyKeyInUse  ErrorCode = "idempotency_key_in_use"
+)
+
+// statusCodes are the codes of the errors that are only known by their status,
+// such as the errors of the router.
+var statusCodes = map[int]ErrorCode{
+	http.StatusBadRequest:            CodeInvalidRequest,
+	http.StatusUnauthorized:          CodeUnauthorized,
+	http.StatusForbidden:             CodeForbidden,
+	http.StatusNotFound:              CodeNotFound,
+	http.StatusMethodNotAllowed:      CodeMethodNotAllowed,
+	http.StatusConflict:              CodeConflict,
+	http.StatusRequestEntityTooLarge: CodePayloadTooLarge,
+	http.StatusUnsupportedMediaType:  CodeUnsupportedMediaType,
+	http.StatusTooManyRequests:       CodeRateLimited,
+	http.StatusServiceUnavailable:    CodeServiceUnavailable,
+}
+
+// Problem is the body of the error responses, a problem details object of
+// RFC 7807 extended with an error code, the request ID and the fields that
+// failed validation.
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      ErrorCode    `json:"code"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError is a field of the request that failed validation. Field is the
+// path of the field as the client sent it, such as metric[0], and Code is the
+// validation rule that failed, such as required or email.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Param   string `json:"param,omitempty"`
+	Message string `json:"message"`
+}
+
+// newProblem returns the problem of a status with the code and the detail.
+func newProblem(status int, code ErrorCode, detail string) Problem {
+	return Problem{Type: "about:blank", Title: http.StatusText(status), Status: status, Detail: detail, Code: code}
+}
+
+// writeProblem responds with the problem, tagged with the path and the ID of
+// the request.
+func writeProblem(c echo.Context, problem Problem) error {
+	problem.Instance = c.Request().URL.Path
+	problem.RequestID, _ = c.Get(requestIDKey).(string)
+	body, err := json.Marshal(problem)
+	if err != nil {
+		return err
+	}
+	return c.Blob(problem.Status, ProblemContentType, body)
+}
+
+// errorHandler responds to the errors returned by the handlers and the router
+// with a problem. The details of the errors that are not HTTP errors are only
+// logged.
+func (s *Server) errorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	status := http.StatusInternalServerError
+	problem := newProblem(status, CodeInternal, "")
+	var httpError *echo.HTTPError
+	if errors.As(err, &httpError) {
+		status = httpError.Code
+		code, ok := statusCodes[status]
+		if !ok {
+			code = CodeInternal
+		}
+		problem = newProblem(status, code, fmt.Sprint(httpError.Message))
+	}
+	if status >= http.StatusInternalServerError {
+		s.requestLogger(c).Error("request failed", "error", err)
+	}
+
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(status)
+	} else {
+		err = writeProblem(c, problem)
+	}
+	if err != nil {
+		s.requestLogger(c).Error("failed to write the error response", "error", err)
+	}
+}
+
+// fieldErrors converts the errors of the validator into field errors.
+func fieldErrors(validationErrors validator.ValidationErrors) []FieldError {
+	fields := make([]FieldError, 0, len(validationErrors))
+	for _, fieldError := range validationErrors {
+		field := fieldError.Namespace()
+		if _, path, ok := strings.Cut(field, "."); ok {
+			field = path
+		}
+		fields = append(fields, FieldError{
+			Field:   field,
+			Code:    fieldError.Tag(),
+			Param:   fieldError.Param(),
+			Message: fieldMessage(fieldError),
+		})
+	}
+	return fields
+}
+
+// fieldMessage describes a failed validation rule.
+func fieldMessage(fieldError validator.FieldError) string {
+	param := fieldError.Param()
+	sized := "characters"
+	switch fieldError.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		sized = "items"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		sized = ""
+	}
+
+	switch fieldError.Tag() {
+	case "required":
+		return "is required"
+	case "email":
+		return "must be an email address"
+	case "uuid", "uuid4":
+		return "must be a UUID"
+	case "url", "http_url", "uri":
+		return "must be a URL"
+	case "oneof":
+		return "must be one of " + strings.ReplaceAll(param, " ", ", ")
+	case "min", "gte":
+		if sized == "" {
+			return "must be at least " + param
+		}
+		return fmt.Sprintf("must have at least %s %s", param, sized)
+	case "max", "lte":
+		if sized == "" {
+			return "must be at most " + param
+		}
+		return fmt.Sprintf("must have at most %s %s", param, sized)
+	case "len":
+		if sized == "" {
+			return "must be " + param
+		}
+		return fmt.Sprintf("must have %s %s", param, sized)
+	default:
+		return "must satisfy " + fieldError.Tag()
+	}
+}
+
+// fieldName returns the name of a struct field as the client sends it: its
+// JSON, query or path parameter name, or its Go name.
+func fieldName(field reflect.StructField) string {
+	for _, key := range []string{"json", "query", "param"} {
+		name, _, _ := strings.Cut(field.Tag.Get(key), ",")
+		if name == "-" {
+			return ""
+		}
+		if name != "" {
+			return name
+		}
+	}
+	return field.Name
+}
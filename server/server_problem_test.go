@@ -0,0 +1,79 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestProblemResponses(t *testing.T) {
+	Convey("Scenario: Errors are problem details with a code", t, func() {
+		server := testServer()
+
+		Convey("When a request fails validation", func() {
+			initiateRequest := &initiateRegistrationRequest{Email: "invalid", Password: "abc"}
+			tc := server.EchoTestContext(http.MethodPost, "/api/registration/initiate", initiateRequest)
+			server.initiateRegistrationHandler(tc.EchoContext)
+
+			Convey("Then every invalid field is listed and nothing else is written", func() {
+				So(tc.HttpResponse.Code, ShouldEqual, http.StatusBadRequest)
+				So(tc.HttpResponse.Header().Get(echo.HeaderContentType), ShouldEqual, ProblemContentType)
+				var problem Problem
+				So(tc.UnmarshalResponse(&problem), ShouldBeNil)
+				So(problem.Type, ShouldEqual, "about:blank")
+				So(problem.Title, ShouldEqual, "Bad Request")
+				So(problem.Status, ShouldEqual, http.StatusBadRequest)
+				So(problem.Code, ShouldEqual, CodeValidationFailed)
+				So(problem.Instance, ShouldEqual, "/api/registration/initiate")
+				So(problem.RequestID, ShouldNotBeEmpty)
+				So(problem.Errors, ShouldResemble, []FieldError{
+					{Field: "Email", Code: "email", Message: "must be an email address"},
+					{Field: "Password", Code: "min", Param: "8", Message: "must have at least 8 characters"},
+				})
+				So(server.email.(*EmailSenderMock).sent, ShouldBeEmpty)
+			})
+		})
+		Convey("When a query parameter fails validation", func() {
+			tc := server.EchoTestContext(http.MethodGet, "/api/search?q=nginx&limit=500", nil)
+			server.searchHandler(tc.EchoContext)
+
+			Convey("Then the field is named as the client sent it", func() {
+				var problem Problem
+				So(tc.UnmarshalResponse(&problem), ShouldBeNil)
+				So(problem.Errors, ShouldResemble, []FieldError{
+					{Field: "limit", Code: "max", Param: "100", Message: "must be at most 100"},
+				})
+			})
+		})
+		Convey("When the body cannot be decoded", func() {
+			request := httptest.NewRequest(http.MethodPost, "/api/registration/initiate", strings.NewReader("{"))
+			request.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			recorder := httptest.NewRecorder()
+			server.initiateRegistrationHandler(server.echo.NewContext(request, recorder))
+
+			Convey("Then the request is invalid", func() {
+				So(recorder.Code, ShouldEqual, http.StatusBadRequest)
+				So(recorder.Body.String(), ShouldContainSubstring, `"code":"invalid_request"`)
+			})
+		})
+		Convey("When the router rejects a request", func() {
+			notFound := httptest.NewRecorder()
+			server.echo.ServeHTTP(notFound, httptest.NewRequest(http.MethodGet, "/api/unknown", nil))
+			notAllowed := httptest.NewRecorder()
+			server.echo.ServeHTTP(notAllowed, httptest.NewRequest(http.MethodDelete, "/api/search", nil))
+
+			Convey("Then its errors are problems too", func() {
+				So(notFound.Code, ShouldEqual, http.StatusNotFound)
+				So(notFound.Header().Get(echo.HeaderContentType), ShouldEqual, ProblemContentType)
+				So(notFound.Body.String(), ShouldContainSubstring, `"code":"not_found"`)
+				So(notAllowed.Code, ShouldEqual, http.StatusMethodNotAllowed)
+				So(notAllowed.Body.String(), ShouldContainSubstring, `"code":"method_not_allowed"`)
+			})
+		})
+	})
+}
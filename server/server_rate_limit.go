@@ -0,0 +1,152 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/jrpalma/linuxfleet/data"
+	"github.com/jrpalma/linuxfleet/openapi"
+	"github.com/jrpalma/linuxfleet/opts"
+	"github.com/jrpalma/linuxfleet/ratelimit"
+)
+
+// sessionCookie is the cookie of the login sessions.
+const sessionCookie = "linuxfleet_session"
+
+// Headers of the rate limits, see the RateLimit header fields draft of the
+// IETF HTTPAPI working group.
+const (
+	headerRateLimitLimit     = "RateLimit-Limit"
+	headerRateLimitRemaining = "RateLimit-Remaining"
+	headerRateLimitReset     = "RateLimit-Reset"
+	headerRateLimitPolicy    = "RateLimit-Policy"
+)
+
+// rateLimitBucket is a bucket taken from by a request, with its limit.
+type rateLimitBucket struct {
+	principal string
+	key       string
+	limit     opts.RateLimit
+}
+
+// newRateLimitStore returns the store of the rate limits chosen by the
+// options. The database store is a file next to the database, named after it
+// with a -ratelimit suffix, so that the limiter does not wait for the writer
+// of the data tables. The memory store is used when it cannot be opened.
+func newRateLimitStore(options opts.ServerOptions, logger *slog.Logger) ratelimit.Store {
+	if options.RateLimitStore == opts.RateLimitStoreDatabase {
+		filename := options.DatabasePath + "-ratelimit"
+		if options.DatabasePath == ":memory:" {
+			filename = options.DatabasePath
+		}
+		store, err := data.OpenRateLimitStore(filename)
+		if err == nil {
+			return store
+		}
+		logger.Error("failed to open the rate limit database, the limits are kept in memory", "error", err)
+	}
+	return ratelimit.NewMemoryStore()
+}
+
+// rateLimitGroup returns the group of the rate limits of a route, its first
+// tag.
+func rateLimitGroup(route openapi.Route) string {
+	if len(route.Tags) == 0 {
+		return opts.DefaultRateLimitGroup
+	}
+	return route.Tags[0]
+}
+
+// rateLimit limits the rate of the requests to the routes of a group. A
+// request takes a token from the bucket of its address and of its
+// authenticated administrator in the group, and from the bucket of its
+// organization, and is rejected with 429 when one of them is empty, in which
+// case it takes no token from the others. The headers describe the bucket
+// with the fewest tokens left. The limits are read on every request, so that
+// they change when the options are reloaded. The requests are allowed when
+// the store fails, so that the API stays available.
+func (s *Server) rateLimit(group string, next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		buckets := s.rateLimitBuckets(c, group, s.Options())
+		if len(buckets) == 0 {
+			return next(c)
+		}
+		requests := make([]ratelimit.Request, len(buckets))
+		for i, bucket := range buckets {
+			requests[i] = ratelimit.Request{Key: bucket.key, Limit: bucket.limit.Limit()}
+		}
+		results, err := s.rateLimits.Take(requests, time.Now())
+		if err != nil {
+			s.requestLogger(c).Error("failed to take a rate limit token", "group", group, "error", err)
+			return next(c)
+		}
+
+		tightest := 0
+		for i, result := range results {
+			if !result.Allowed {
+				s.telemetry.rateLimited.Inc(group, buckets[i].principal)
+			}
+			if tighter(result, results[tightest]) {
+				tightest = i
+			}
+		}
+		result, limit := results[tightest], buckets[tightest].limit
+
+		header := c.Response().Header()
+		header.Set(headerRateLimitLimit, strconv.Itoa(result.Limit))
+		header.Set(headerRateLimitRemaining, strconv.Itoa(result.Remaining))
+		header.Set(headerRateLimitReset, ceilSeconds(result.Reset))
+		header.Set(headerRateLimitPolicy, fmt.Sprintf("%d;w=%s", limit.Requests, ceilSeconds(limit.Period)))
+		if !result.Allowed {
+			header.Set(echo.HeaderRetryAfter, ceilSeconds(result.RetryAfter))
+			return writeProblem(c, newProblem(http.StatusTooManyRequests, CodeRateLimited, "Too many requests, retry later"))
+		}
+		return next(c)
+	}
+}
+
+// rateLimitBuckets returns the buckets of the principals of a request in the
+// group. Only the principals verified by authenticateAPI have buckets, so that
+// a client cannot spread its requests over made up tokens. The address is
+// read by the IPExtractor of the server, see ipExtractor.
+func (s *Server) rateLimitBuckets(c echo.Context, group string, options opts.ServerOptions) []rateLimitBucket {
+	var buckets []rateLimitBucket
+	if limit := options.RateLimit(group); !limit.Unlimited() {
+		buckets = append(buckets, rateLimitBucket{"ip", group + ":ip:" + c.RealIP(), limit})
+		if principal, ok := c.Get(principalKey).(string); ok && principal != "" {
+			buckets = append(buckets, rateLimitBucket{"admin", group + ":admin:" + principal, limit})
+		}
+	}
+	if organization, ok := c.Get(organizationKey).(string); ok && organization != "" && !options.RateLimitOrganization.Unlimited() {
+		buckets = append(buckets, rateLimitBucket{"organization", "organization:" + organization, options.RateLimitOrganization})
+	}
+	return buckets
+}
+
+// tighter reports whether a result is closer to its limit than another: it is
+// rejected while the other is allowed, or it has fewer tokens left.
+func tighter(a ratelimit.Result, b ratelimit.Result) bool {
+	if a.Allowed != b.Allowed {
+		return !a.Allowed
+	}
+	return a.Remaining < b.Remaining
+}
+
+// hashKey returns the hex SHA-256 of a secret used in a key.
+func hashKey(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// ceilSeconds returns a duration in whole seconds, rounded up.
+func ceilSeconds(duration time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(duration.Seconds())), 10)
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/jrpalma/linuxfleet/opts"
+)
+
+func TestRateLimit(t *testing.T) {
+	Convey("Scenario: The API limits the rate of the requests", t, func() {
+		server := testServer()
+		options := server.Options()
+		options.RateLimits = map[string]opts.RateLimit{
+			opts.DefaultRateLimitGroup: {Requests: 2, Period: time.Minute},
+			"search":                   {Requests: 1, Period: time.Hour},
+		}
+		options.RateLimitOrganization = opts.RateLimit{}
+		So(server.ReloadOptions(options), ShouldBeNil)
+
+		_, token := testLogin(server, "admin@owner1.example.com", "owner1")
+		serve := func(target string, prepare func(*http.Request)) *httptest.ResponseRecorder {
+			request := httptest.NewRequest(http.MethodGet, target, nil)
+			request.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+			if prepare != nil {
+				prepare(request)
+			}
+			recorder := httptest.NewRecorder()
+			server.echo.ServeHTTP(recorder, request)
+			return recorder
+		}
+		fromAddress := func(address string) func(*http.Request) {
+			return func(request *http.Request) { request.RemoteAddr = address + ":4000" }
+		}
+
+		Convey("When a client sends more requests than its limit", func() {
+			first := serve("/api/v1/devices/web-1/metrics", nil)
+			second := serve("/api/devices/web-1/metrics", nil)
+			third := serve("/api/v1/devices/web-1/metrics", nil)
+
+			Convey("Then the requests over the limit are rejected with 429 and the headers", func() {
+				So(first.Code, ShouldEqual, http.StatusNotFound)
+				So(first.Header().Get(headerRateLimitLimit), ShouldEqual, "2")
+				So(first.Header().Get(headerRateLimitRemaining), ShouldEqual, "1")
+				So(first.Header().Get(headerRateLimitReset), ShouldEqual, "30")
+				So(first.Header().Get(headerRateLimitPolicy), ShouldEqual, "2;w=60")
+				So(second.Code, ShouldEqual, http.StatusNotFound)
+				So(second.Header().Get(headerRateLimitRemaining), ShouldEqual, "0")
+				So(third.Code, ShouldEqual, http.StatusTooManyRequests)
+				So(third.Header().Get("Content-Type"), ShouldEqual, ProblemContentType)
+				So(third.Body.String(), ShouldContainSubstring, `"code":"rate_limited"`)
+				So(third.Header().Get(echo.HeaderRetryAfter), ShouldEqual, "30")
+				So(server.telemetry.rateLimited.Value("devices", "ip"), ShouldEqual, 1)
+			})
+			Convey("Then the other clients and the other groups have their own limits", func() {
+				_, otherToken := testLogin(server, "admin@owner2.example.com", "owner2")
+				otherClient := func(request *http.Request) {
+					fromAddress("198.51.100.7")(request)
+					request.Header.Set(echo.HeaderAuthorization, "Bearer "+otherToken)
+				}
+				So(serve("/api/v1/devices/web-1/metrics", otherClient).Code, ShouldEqual, http.StatusNotFound)
+				So(serve("/api/v1/search?q=web", nil).Code, ShouldNotEqual, http.StatusTooManyRequests)
+				So(serve("/api/v1/search?q=web", nil).Code, ShouldEqual, http.StatusTooManyRequests)
+			})
+			Convey("Then the routes of the server are not limited", func() {
+				So(serve("/healthz", nil).Code, ShouldEqual, http.StatusOK)
+			})
+		})
+		Convey("When a client sends invalid tokens", func() {
+			bearer := func(token string) func(*http.Request) {
+				return func(request *http.Request) { request.Header.Set(echo.HeaderAuthorization, "Bearer "+token) }
+			}
+			first := serve("/api/v1/devices/web-1/metrics", bearer("token-1"))
+			serve("/api/v1/devices/web-1/metrics", bearer("token-2"))
+
+			Convey("Then they are rejected and limited by address", func() {
+				So(first.Code, ShouldEqual, http.StatusUnauthorized)
+				So(serve("/api/v1/devices/web-1/metrics", bearer("token-3")).Code, ShouldEqual, http.StatusTooManyRequests)
+				So(server.telemetry.rateLimited.Value("devices", "ip"), ShouldEqual, 1)
+			})
+		})
+		Convey("When a client sends an X-Forwarded-For header", func() {
+			forwarded := func(address string, client string) func(*http.Request) {
+				return func(request *http.Request) {
+					fromAddress(address)(request)
+					request.Header.Set(echo.HeaderXForwardedFor, client)
+				}
+			}
+			_, otherToken := testLogin(server, "operator@owner1.example.com", "owner1")
+			other := func(prepare func(*http.Request)) func(*http.Request) {
+				return func(request *http.Request) {
+					prepare(request)
+					request.Header.Set(echo.HeaderAuthorization, "Bearer "+otherToken)
+				}
+			}
+
+			Convey("Then it is ignored unless the request comes from a trusted proxy", func() {
+				serve("/api/v1/devices/web-1/metrics", forwarded("10.0.0.1", "192.0.2.1"))
+				serve("/api/v1/devices/web-1/metrics", forwarded("10.0.0.1", "192.0.2.2"))
+				So(serve("/api/v1/devices/web-1/metrics", other(forwarded("10.0.0.1", "192.0.2.3"))).Code, ShouldEqual, http.StatusTooManyRequests)
+			})
+			Convey("Then the address forwarded by a trusted proxy is limited", func() {
+				server.echo.IPExtractor = ipExtractor([]string{"10.0.0.0/8"})
+				serve("/api/v1/devices/web-1/metrics", forwarded("10.0.0.1", "192.0.2.1"))
+				serve("/api/v1/devices/web-1/metrics", forwarded("10.0.0.2", "192.0.2.1"))
+				So(serve("/api/v1/devices/web-1/metrics", other(forwarded("10.0.0.1", "192.0.2.2"))).Code, ShouldEqual, http.StatusNotFound)
+				So(serve("/api/v1/devices/web-1/metrics", other(forwarded("10.0.0.1", "192.0.2.1"))).Code, ShouldEqual, http.StatusTooManyRequests)
+				_, thirdToken := testLogin(server, "auditor@owner1.example.com", "owner1")
+				untrusted := func(request *http.Request) {
+					forwarded("198.51.100.7", "192.0.2.1")(request)
+					request.Header.Set(echo.HeaderAuthorization, "Bearer "+thirdToken)
+				}
+				So(serve("/api/v1/devices/web-1/metrics", untrusted).Code, ShouldEqual, http.StatusNotFound)
+			})
+		})
+		Convey("When a client sends an API token", func() {
+			_, otherToken := testLogin(server, "operator@owner1.example.com", "owner1")
+			bearer := func(token string, address string) func(*http.Request) {
+				return func(request *http.Request) {
+					request.RemoteAddr = address + ":4000"
+					request.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+				}
+			}
+			serve("/api/v1/devices/web-1/metrics", bearer(token, "203.0.113.9"))
+			serve("/api/v1/devices/web-1/metrics", bearer(token, "203.0.113.9"))
+
+			Convey("Then the token is limited from every address", func() {
+				So(serve("/api/v1/devices/web-1/metrics", bearer(token, "203.0.113.10")).Code, ShouldEqual, http.StatusTooManyRequests)
+				So(server.telemetry.rateLimited.Value("devices", "admin"), ShouldEqual, 1)
+				So(server.telemetry.rateLimited.Value("devices", "ip"), ShouldEqual, 0)
+			})
+			Convey("Then the address is limited with every token", func() {
+				So(serve("/api/v1/devices/web-1/metrics", bearer(otherToken, "203.0.113.9")).Code, ShouldEqual, http.StatusTooManyRequests)
+				So(server.telemetry.rateLimited.Value("devices", "ip"), ShouldEqual, 1)
+				So(server.telemetry.rateLimited.Value("devices", "admin"), ShouldEqual, 0)
+			})
+		})
+		Convey("When the clients of an organization send requests", func() {
+			options.RateLimits = map[string]opts.RateLimit{}
+			options.RateLimitOrganization = opts.RateLimit{Requests: 1, Period: time.Minute}
+			So(server.ReloadOptions(options), ShouldBeNil)
+			_, operatorToken := testLogin(server, "operator@owner1.example.com", "owner1")
+			_, otherToken := testLogin(server, "admin@owner2.example.com", "owner2")
+			organization := func(token string, address string) func(*http.Request) {
+				return func(request *http.Request) {
+					request.RemoteAddr = address + ":4000"
+					request.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+				}
+			}
+
+			Convey("Then they share the limit of the organization", func() {
+				So(serve("/api/v1/devices/web-1/metrics", organization(token, "192.0.2.10")).Code, ShouldEqual, http.StatusNotFound)
+				So(serve("/api/v1/devices/web-1/metrics", organization(operatorToken, "192.0.2.11")).Code, ShouldEqual, http.StatusTooManyRequests)
+				So(serve("/api/v1/devices/web-1/metrics", organization(otherToken, "192.0.2.11")).Code, ShouldEqual, http.StatusNotFound)
+			})
+		})
+		Convey("When the API is documented", func() {
+			operation := server.OpenAPI().Paths["/api/v1/search"]["get"]
+
+			Convey("Then the rate limited responses are documented", func() {
+				So(operation.Responses, ShouldContainKey, "429")
+			})
+		})
+	})
+}
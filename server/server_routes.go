@@ -0,0 +1,138 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/jrpalma/linuxfleet/data"
+	"github.com/jrpalma/linuxfleet/openapi"
+	"github.com/jrpalma/linuxfleet/telemetry"
+)
+
+// registerRoutes registers and documents the routes of the server. The routes
+// of the API are served by each of its versions.
+func (s *Server) registerRoutes() {
+	s.api.SetError(Problem{}, ProblemContentType)
+	s.api.AddSecurityScheme(bearerAuth, bearerAuthScheme)
+	s.api.AddSecurityScheme(metricsAuth, metricsAuthScheme)
+	for _, api := range []*apiGroup{s.apiVersion("v1", nil), s.unversionedAPI()} {
+		s.registerV1(api)
+	}
+
+	s.handle(openapi.Route{
+		Method:   http.MethodGet,
+		Path:     "/api/openapi.json",
+		Summary:  "Get the OpenAPI document of the API",
+		Tags:     []string{"server"},
+		Response: map[string]any{},
+	}, s.openAPIHandler)
+	s.handle(openapi.Route{
+		Method:       http.MethodGet,
+		Path:         "/metrics",
+		Summary:      "Get the metrics of the server and the fleet",
+		Tags:         []string{"server"},
+		Response:     "",
+		ResponseType: telemetry.ContentType,
+		Errors:       []int{http.StatusUnauthorized, http.StatusNotFound},
+		Security:     metricsAuth,
+	}, s.metricsHandler)
+	s.handle(openapi.Route{
+		Method:   http.MethodGet,
+		Path:     "/healthz",
+		Summary:  "Check that the server is alive",
+		Tags:     []string{"server"},
+		Response: healthResponse{},
+	}, s.healthzHandler)
+	s.handle(openapi.Route{
+		Method:    http.MethodGet,
+		Path:      "/readyz",
+		Summary:   "Check that the server and its dependencies are ready",
+		Tags:      []string{"server"},
+		Response:  healthResponse{},
+		Responses: map[int]any{http.StatusServiceUnavailable: healthResponse{}},
+	}, s.readyzHandler)
+	s.registerConsole()
+}
+
+// registerV1 registers the routes of version 1 of the API in the group.
+func (s *Server) registerV1(api *apiGroup) {
+	api.handle(openapi.Route{
+		Method:   http.MethodPost,
+		Path:     "/registration/initiate",
+		Summary:  "Start the registration of an administrator and email the registration link",
+		Tags:     []string{"registration"},
+		Request:  initiateRegistrationRequest{},
+		Response: messageBody{},
+		Errors:   []int{http.StatusBadRequest, http.StatusInternalServerError},
+	}, s.initiateRegistrationHandler)
+	api.handle(openapi.Route{
+		Method:   http.MethodPost,
+		Path:     "/registration/complete",
+		Summary:  "Complete a registration and create the administrator",
+		Tags:     []string{"registration"},
+		Request:  completeRegistrationRequest{},
+		Response: messageBody{},
+		Errors:   []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusInternalServerError},
+	}, s.completeRegistrationHandler)
+	api.handle(openapi.Route{
+		Method:   http.MethodPost,
+		Path:     "/login",
+		Summary:  "Log an administrator in and create a session",
+		Tags:     []string{"login"},
+		Request:  loginRequest{},
+		Response: loginResponse{},
+		Errors:   []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusInternalServerError},
+	}, s.loginHandler)
+	api.handle(openapi.Route{
+		Method:   http.MethodPost,
+		Path:     "/logout",
+		Summary:  "End the session of the request",
+		Tags:     []string{"login"},
+		Response: messageBody{},
+		Errors:   []int{http.StatusInternalServerError},
+		Security: bearerAuth,
+	}, s.logoutHandler)
+	api.handle(openapi.Route{
+		Method:   http.MethodGet,
+		Path:     "/search",
+		Summary:  "Search the objects readable by the administrator",
+		Tags:     []string{"search"},
+		Request:  searchRequest{},
+		Response: searchResponse{},
+		Errors:   []int{http.StatusBadRequest, http.StatusInternalServerError, http.StatusServiceUnavailable},
+		Security: bearerAuth,
+	}, s.searchHandler)
+	api.handle(openapi.Route{
+		Method:   http.MethodGet,
+		Path:     "/devices/:id/metrics",
+		Summary:  "Query the metrics of a device",
+		Tags:     []string{"devices"},
+		Request:  deviceMetricsRequest{},
+		Response: deviceMetricsResponse{},
+		Errors:   []int{http.StatusBadRequest, http.StatusNotFound, http.StatusInternalServerError},
+		Security: bearerAuth,
+	}, s.deviceMetricsHandler)
+	for _, patch := range []struct {
+		path  string
+		table data.TableDefinition
+		tag   string
+	}{
+		{"/devices/:id", data.DeviceTable, "devices"},
+		{"/users/:id", data.UserTable, "users"},
+		{"/jobs/:id", data.JobTable, "jobs"},
+	} {
+		api.handle(openapi.Route{
+			Method:  http.MethodPatch,
+			Path:    patch.path,
+			Summary: "Patch the attributes of a " + patch.table.Name,
+			Tags:    []string{patch.tag},
+			Body: map[string]any{
+				string(data.MergePatch): map[string]any{},
+				string(data.JSONPatch):  []data.PatchOperation{},
+			},
+			Response: data.Object{},
+			Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict,
+				http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType, http.StatusInternalServerError},
+			Security: bearerAuth,
+		}, s.patchObjectHandler(patch.table))
+	}
+}
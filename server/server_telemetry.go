@@ -0,0 +1,154 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/jrpalma/linuxfleet/openapi"
+	"github.com/jrpalma/linuxfleet/telemetry"
+)
+
+// deviceOnlineWindow is how recently a device must have reported a metric
+// sample to be counted as online.
+const deviceOnlineWindow = 5 * time.Minute
+
+// metricsAuth is the security scheme of /metrics. The scrapers send the
+// metrics token of the options in the Authorization header.
+const metricsAuth = "metricsAuth"
+
+var metricsAuthScheme = openapi.SecurityScheme{
+	Type:        "http",
+	Scheme:      "bearer",
+	Description: "The metrics_token of the server options.",
+}
+
+// unmatchedRoute labels the requests that did not match a route, so that
+// unknown paths do not create a series each.
+const unmatchedRoute = "/*"
+
+// serverMetrics measures the requests and the emails of the server.
+type serverMetrics struct {
+	requests  *telemetry.Counter
+	durations *telemetry.Histogram
+	emails    *telemetry.Counter
+
+	rateLimited *telemetry.Counter
+
+	versionRequests    *telemetry.Counter
+	versionLastRequest *telemetry.Gauge
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		requests: telemetry.NewCounter("linuxfleet_http_requests_total",
+			"HTTP requests by route, method and status.", "route", "method", "status"),
+		durations: telemetry.NewHistogram("linuxfleet_http_request_duration_seconds",
+			"Duration of the HTTP requests by route and method.", nil, "route", "method"),
+		emails: telemetry.NewCounter("linuxfleet_emails_total",
+			"Emails sent by result.", "result"),
+		rateLimited: telemetry.NewCounter("linuxfleet_http_rate_limited_total",
+			"Requests rejected by the rate limits by route group and principal.", "group", "principal"),
+		versionRequests: telemetry.NewCounter("linuxfleet_api_version_requests_total",
+			"API requests by version.", "version"),
+		versionLastRequest: telemetry.NewGauge("linuxfleet_api_version_last_request_timestamp_seconds",
+			"Unix time of the last API request by version.", "version"),
+	}
+}
+
+// observeRequest records a handled request that started at start. The
+// requests are labeled with their route, or unmatchedRoute for the paths that
+// are not routes of the server.
+func (m *serverMetrics) observeRequest(c echo.Context, start time.Time, routes map[string]bool) {
+	route := c.Path()
+	if !routes[route] {
+		route = unmatchedRoute
+	}
+	method := c.Request().Method
+	m.requests.Inc(route, method, strconv.Itoa(c.Response().Status))
+	m.durations.Observe(time.Since(start).Seconds(), route, method)
+}
+
+// observeEmail records the result of sending an email. An email is sent when
+// the provider accepted it without an error status.
+func (m *serverMetrics) observeEmail(status int, err error) {
+	if err != nil || status >= http.StatusBadRequest {
+		m.emails.Inc("failure")
+		return
+	}
+	m.emails.Inc("success")
+}
+
+// Telemetry returns the registry of the metrics served at /metrics, to which
+// other subsystems can add their own collectors.
+func (s *Server) Telemetry() *telemetry.Registry {
+	return s.registry
+}
+
+// registerTelemetry registers the metrics of the server, the data tables and
+// the fleet.
+func (s *Server) registerTelemetry() {
+	s.registry.Register(s.telemetry.requests, s.telemetry.durations, s.telemetry.emails, s.telemetry.rateLimited,
+		s.telemetry.versionRequests, s.telemetry.versionLastRequest)
+	s.registry.Register(s.tables.Collectors()...)
+	s.registry.Register(telemetry.CollectorFunc(s.collectFleet))
+}
+
+// metricsHandler serves the metrics in the Prometheus text format to the
+// requests with the metrics token. The metrics are not served when the
+// options have no token, since the fleet gauges span every organization.
+func (s *Server) metricsHandler(c echo.Context) error {
+	sc := s.ServerContext(c)
+	expected := sc.Options().MetricsToken
+	if expected == "" {
+		return sc.NotFound("The metrics are disabled")
+	}
+	token, _ := bearerToken(c.Request())
+	if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer realm="linuxfleet-metrics"`)
+		return sc.Unauthorized("A valid metrics token is required")
+	}
+	s.registry.ServeHTTP(c.Response(), c.Request())
+	return nil
+}
+
+// collectFleet returns the gauges of the devices and the jobs, counted when the
+// metrics are scraped. Nothing is returned when the tables cannot be read.
+func (s *Server) collectFleet() []telemetry.Family {
+	stats, err := s.tables.FleetStats(time.Now().Add(-deviceOnlineWindow))
+	if err != nil {
+		s.logger.Error("failed to collect the fleet metrics", "error", err)
+		return nil
+	}
+
+	devices := telemetry.Family{Name: "linuxfleet_devices", Help: "Devices by connection state.", Type: telemetry.GaugeType}
+	devices.Samples = []telemetry.Sample{
+		{Labels: []telemetry.Label{{Name: "state", Value: "online"}}, Value: float64(stats.DevicesOnline)},
+		{Labels: []telemetry.Label{{Name: "state", Value: "offline"}}, Value: float64(stats.DevicesOffline)},
+	}
+	return []telemetry.Family{
+		devices,
+		countFamily("linuxfleet_devices_by_os", "Devices by operating system.", "os", stats.DevicesByOS),
+		countFamily("linuxfleet_jobs", "Jobs by status, such as the jobs queued to run.", "status", stats.JobsByStatus),
+	}
+}
+
+// countFamily returns a gauge family with one sample per counted value.
+func countFamily(name string, help string, label string, counts map[string]int) telemetry.Family {
+	family := telemetry.Family{Name: name, Help: help, Type: telemetry.GaugeType}
+	for value, count := range counts {
+		family.Samples = append(family.Samples, telemetry.Sample{
+			Labels: []telemetry.Label{{Name: label, Value: value}},
+			Value:  float64(count),
+		})
+	}
+	slices.SortFunc(family.Samples, func(a, b telemetry.Sample) int {
+		return strings.Compare(a.Labels[0].Value, b.Labels[0].Value)
+	})
+	return family
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/sendgrid/sendgrid-go/helpers/mail"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/jrpalma/linuxfleet/data"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	Convey("Scenario: The server exposes its metrics", t, func() {
+		server := testServer()
+		serve := func(method string, target string) *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			server.echo.ServeHTTP(recorder, httptest.NewRequest(method, target, nil))
+			return recorder
+		}
+
+		Convey("When requests are sent to a route and to unknown paths", func() {
+			serve(http.MethodGet, "/api/devices/1/metrics")
+			serve(http.MethodGet, "/api/devices/2/metrics")
+			serve(http.MethodGet, "/unknown/1")
+			serve(http.MethodGet, "/api/unknown/2")
+
+			Convey("Then they are counted by route template", func() {
+				So(server.telemetry.requests.Value("/api/devices/:id/metrics", http.MethodGet, "401"), ShouldEqual, 2)
+				So(server.telemetry.requests.Value(unmatchedRoute, http.MethodGet, "404"), ShouldEqual, 2)
+				So(server.telemetry.durations.Count("/api/devices/:id/metrics", http.MethodGet), ShouldEqual, 2)
+			})
+		})
+		Convey("When emails are sent", func() {
+			email := server.email.(*EmailSenderMock)
+			tc := server.EchoTestContext(http.MethodPost, "/", nil)
+			sc := server.ServerContext(tc.EchoContext)
+			So(sc.SendEmail(mail.NewV3Mail()), ShouldBeNil)
+			email.err = errors.New("unavailable")
+			So(sc.SendEmail(mail.NewV3Mail()), ShouldNotBeNil)
+
+			Convey("Then the successes and the failures are counted", func() {
+				So(server.telemetry.emails.Value("success"), ShouldEqual, 1)
+				So(server.telemetry.emails.Value("failure"), ShouldEqual, 1)
+			})
+		})
+		Convey("When the metrics are scraped", func() {
+			device := data.Object{ID: "d1", OwnerID: "owner1", Version: 1, Attributes: map[string]any{"os": map[string]any{"name": "debian"}}}
+			So(server.tables.Insert(data.DeviceTable.Name, device), ShouldBeNil)
+			job := data.Object{ID: "j1", OwnerID: "owner1", Version: 1, Attributes: map[string]any{"status": "queued"}}
+			So(server.tables.Insert(data.JobTable.Name, job), ShouldBeNil)
+			options := server.Options()
+			options.MetricsToken = strings.Repeat("m", 32)
+			So(server.ReloadOptions(options), ShouldBeNil)
+			scrape := func(token string) *httptest.ResponseRecorder {
+				request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+				if token != "" {
+					request.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+				}
+				recorder := httptest.NewRecorder()
+				server.echo.ServeHTTP(recorder, request)
+				return recorder
+			}
+			recorder := scrape(options.MetricsToken)
+
+			Convey("Then the request, database and fleet metrics are served", func() {
+				So(recorder.Code, ShouldEqual, http.StatusOK)
+				body := recorder.Body.String()
+				So(body, ShouldContainSubstring, `linuxfleet_db_operation_duration_seconds_count{operation="insert",table="device"} 1`)
+				So(body, ShouldContainSubstring, `linuxfleet_devices{state="offline"} 1`)
+				So(body, ShouldContainSubstring, `linuxfleet_devices_by_os{os="debian"} 1`)
+				So(body, ShouldContainSubstring, `linuxfleet_jobs{status="queued"} 1`)
+			})
+			Convey("Then the requests without the metrics token are rejected", func() {
+				So(scrape("").Code, ShouldEqual, http.StatusUnauthorized)
+				So(scrape("wrong").Code, ShouldEqual, http.StatusUnauthorized)
+			})
+		})
+		Convey("When the metrics are scraped without a metrics token in the options", func() {
+			recorder := serve(http.MethodGet, "/metrics")
+
+			Convey("Then they are not served", func() {
+				So(recorder.Code, ShouldEqual, http.StatusNotFound)
+			})
+		})
+	})
+}
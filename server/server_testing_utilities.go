@@ -5,13 +5,17 @@ import (
 	"encoding/json"
 	"log"
 	"net/http/httptest"
+	"regexp"
 
+	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 	"github.com/sendgrid/rest"
 	"github.com/sendgrid/sendgrid-go/helpers/mail"
 
 	"github.com/jrpalma/linuxfleet/data"
 	"github.com/jrpalma/linuxfleet/html"
+	"github.com/jrpalma/linuxfleet/opts"
+	"github.com/jrpalma/linuxfleet/secret"
 )
 
 type TestContext struct {
@@ -25,31 +29,86 @@ func (tc *TestContext) UnmarshalResponse(model any) error {
 }
 
 type EmailSenderMock struct {
-	res *rest.Response
-	err error
+	res  *rest.Response
+	err  error
+	sent []*mail.SGMailV3
 }
 
 func (esm *EmailSenderMock) Send(email *mail.SGMailV3) (*rest.Response, error) {
+	esm.sent = append(esm.sent, email)
 	return esm.res, esm.err
 }
 
+// emailedTokenPattern matches the token of the links sent by email.
+var emailedTokenPattern = regexp.MustCompile(`token=([0-9a-f-]{36})`)
+
+// emailedToken returns the token of the link in the last email sent, or an
+// empty string when there is none.
+func (esm *EmailSenderMock) emailedToken() string {
+	if len(esm.sent) == 0 {
+		return ""
+	}
+	match := emailedTokenPattern.FindStringSubmatch(esm.sent[len(esm.sent)-1].Content[0].Value)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
 func testServer() *Server {
 	db, err := sql.Open("sqlite3", ":memory:")
 	if err != nil {
 		log.Fatal(err.Error())
 	}
+	// Every connection to :memory: opens a new empty database.
+	db.SetMaxOpenConns(1)
 
 	tables, err := data.NewTables(db)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
+	masterKey, err := secret.NewKey()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	err = tables.EnableEncryption(masterKey)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
 	templates := html.NewTemplates()
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
 	emailSernder := &EmailSenderMock{}
-	server := NewServer(tables, templates, emailSernder)
+	options := opts.DefaultServerOptions()
+	options.ShutdownDrainDelay = 0
+	server := NewServer(options, tables, templates, emailSernder)
 	return server
 }
+
+// testSeed is the TOTP seed of the administrators of the tests.
+const testSeed = "JBSWY3DPEHPK3PXP"
+
+// testLogin stores an administrator of the organization and starts a session
+// for it. The administrator is a member of the group of the organization, so
+// it owns the objects of the organization. It returns the administrator and
+// the token of the session.
+func testLogin(server *Server, email string, ownerID string) (data.Admin, string) {
+	admin := data.Admin{ID: uuid.NewString(), OwnerID: ownerID, Email: email}
+	err := server.admins.Insert(admin)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	err = server.tables.AddGroupMember(ownerID, data.Member{Kind: data.MemberPrincipal, ID: admin.ID})
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	token, _, err := server.startSession(admin, "")
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	return admin, token
+}
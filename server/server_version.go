@@ -0,0 +1,114 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/jrpalma/linuxfleet/openapi"
+)
+
+// unversionedDeprecation deprecates the routes of the API from before it was
+// versioned. They are served under /api as aliases of v1, so that the deployed
+// agents and scripts keep working until they are updated.
+var unversionedDeprecation = deprecation{
+	Since:     time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC),
+	Sunset:    time.Date(2027, time.April, 19, 0, 0, 0, 0, time.UTC),
+	Successor: "v1",
+}
+
+// deprecation announces that a version of the API will be removed.
+type deprecation struct {
+	// Since is when the version was deprecated, sent in the Deprecation
+	// header (RFC 9745).
+	Since time.Time
+	// Sunset is when the version will be removed, sent in the Sunset header
+	// (RFC 8594).
+	Sunset time.Time
+	// Successor is the version that replaces it, linked with the
+	// successor-version relation.
+	Successor string
+}
+
+// apiGroup is a version of the API whose routes share a path prefix, such as
+// /api/v1. The versions are served side by side: a new version registers its
+// own handlers, which may reuse those of the previous version, and the
+// previous version is deprecated once its clients can move to the new one.
+type apiGroup struct {
+	server      *Server
+	version     string
+	prefix      string
+	deprecation *deprecation
+}
+
+// apiVersion returns the group of the routes of a version of the API, served
+// under /api/<version>. The routes of a deprecated version are documented as
+// such and their responses carry the Deprecation, Sunset and Link headers.
+func (s *Server) apiVersion(version string, deprecation *deprecation) *apiGroup {
+	return &apiGroup{server: s, version: version, prefix: "/api/" + version, deprecation: deprecation}
+}
+
+// unversionedAPI returns the group of the routes from before the API was
+// versioned, served under /api.
+func (s *Server) unversionedAPI() *apiGroup {
+	return &apiGroup{server: s, version: "unversioned", prefix: "/api", deprecation: &unversionedDeprecation}
+}
+
+// handle registers and documents a route of the version. The path of the
+// route is relative to the prefix of the version. The rate limits of the route
+// are those of its first tag, shared by the versions, and the POST routes
+// accept an Idempotency-Key header, see idempotent. The routes with a
+// security scheme require a session, see requireSession.
+func (g *apiGroup) handle(route openapi.Route, handler echo.HandlerFunc) {
+	route.Path = g.prefix + route.Path
+	route.Errors = append(slices.Clone(route.Errors), http.StatusTooManyRequests)
+	if route.Security != "" {
+		route.Errors = append(route.Errors, http.StatusUnauthorized, http.StatusForbidden)
+	}
+	if route.Method == http.MethodPost {
+		route.Headers = append(slices.Clone(route.Headers), idempotencyKeyHeader)
+		route.Errors = append(route.Errors, http.StatusConflict, http.StatusUnprocessableEntity)
+		handler = g.server.idempotent(handler, secretFields(route.Response))
+	}
+	route.Deprecated = g.deprecation != nil
+	if route.Deprecated && route.Summary != "" {
+		route.Summary = fmt.Sprintf("%s (deprecated, removed on %s)", route.Summary, g.deprecation.Sunset.Format(time.DateOnly))
+	}
+	if route.Security != "" {
+		handler = g.server.requireSession(handler)
+	}
+	handler = g.server.rateLimit(rateLimitGroup(route), handler)
+	handler = g.server.authenticateAPI(handler)
+	g.server.handle(route, g.middleware(handler))
+}
+
+// middleware counts the requests of the version and sets the deprecation
+// headers. The successor of a request is the same path in the successor
+// version.
+func (g *apiGroup) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		g.server.telemetry.observeVersion(g.version, time.Now())
+		if g.deprecation != nil {
+			header := c.Response().Header()
+			header.Set("Deprecation", "@"+strconv.FormatInt(g.deprecation.Since.Unix(), 10))
+			header.Set("Sunset", g.deprecation.Sunset.UTC().Format(http.TimeFormat))
+			if g.deprecation.Successor != "" {
+				path := strings.TrimPrefix(c.Request().URL.Path, g.prefix)
+				header.Add("Link", fmt.Sprintf(`</api/%s%s>; rel="successor-version"`, g.deprecation.Successor, path))
+			}
+		}
+		return next(c)
+	}
+}
+
+// observeVersion records a request to a version of the API, so that the
+// metrics tell when a version is not used anymore and can be removed.
+func (m *serverMetrics) observeVersion(version string, now time.Time) {
+	m.versionRequests.Inc(version)
+	m.versionLastRequest.Set(float64(now.Unix()), version)
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/jrpalma/linuxfleet/openapi"
+)
+
+func TestAPIVersions(t *testing.T) {
+	Convey("Scenario: The API is served by version", t, func() {
+		server := testServer()
+		_, token := testLogin(server, "admin@owner1.example.com", "owner1")
+		serve := func(method string, target string) *httptest.ResponseRecorder {
+			request := httptest.NewRequest(method, target, nil)
+			request.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+			recorder := httptest.NewRecorder()
+			server.echo.ServeHTTP(recorder, request)
+			return recorder
+		}
+
+		Convey("When a route of v1 is requested", func() {
+			recorder := serve(http.MethodGet, "/api/v1/devices/web-1/metrics")
+
+			Convey("Then it is served without deprecation headers and its version is counted", func() {
+				So(recorder.Code, ShouldEqual, http.StatusNotFound)
+				So(recorder.Body.String(), ShouldContainSubstring, `"detail":"Device not found"`)
+				So(recorder.Header().Get("Deprecation"), ShouldBeEmpty)
+				So(server.telemetry.versionRequests.Value("v1"), ShouldEqual, 1)
+				So(server.telemetry.versionLastRequest.Value("v1"), ShouldBeGreaterThan, 0)
+			})
+		})
+		Convey("When an unversioned route is requested", func() {
+			recorder := serve(http.MethodGet, "/api/devices/web-1/metrics")
+
+			Convey("Then it is served as v1 with the deprecation headers", func() {
+				So(recorder.Body.String(), ShouldContainSubstring, `"detail":"Device not found"`)
+				So(recorder.Header().Get("Deprecation"), ShouldEqual, "@1792368000")
+				So(recorder.Header().Get("Sunset"), ShouldEqual, "Mon, 19 Apr 2027 00:00:00 GMT")
+				So(recorder.Header().Get("Link"), ShouldEqual, `</api/v1/devices/web-1/metrics>; rel="successor-version"`)
+				So(server.telemetry.versionRequests.Value("unversioned"), ShouldEqual, 1)
+				So(server.telemetry.versionRequests.Value("v1"), ShouldEqual, 0)
+			})
+		})
+		Convey("When a v2 route is registered beside v1", func() {
+			v1 := server.apiVersion("v1", &deprecation{
+				Since:     time.Date(2027, time.January, 1, 0, 0, 0, 0, time.UTC),
+				Sunset:    time.Date(2027, time.July, 1, 0, 0, 0, 0, time.UTC),
+				Successor: "v2",
+			})
+			v2 := server.apiVersion("v2", nil)
+			hello := func(version string) echo.HandlerFunc {
+				return func(c echo.Context) error { return c.String(http.StatusOK, version) }
+			}
+			v1.handle(openapi.Route{Method: http.MethodGet, Path: "/hello", Summary: "Say hello"}, hello("v1"))
+			v2.handle(openapi.Route{Method: http.MethodGet, Path: "/hello", Summary: "Say hello"}, hello("v2"))
+			old := serve(http.MethodGet, "/api/v1/hello")
+			current := serve(http.MethodGet, "/api/v2/hello")
+
+			Convey("Then both are served and documented, and the old one is deprecated", func() {
+				So(old.Body.String(), ShouldEqual, "v1")
+				So(old.Header().Get("Link"), ShouldEqual, `</api/v2/hello>; rel="successor-version"`)
+				So(current.Body.String(), ShouldEqual, "v2")
+				So(current.Header().Get("Deprecation"), ShouldBeEmpty)
+				document := server.OpenAPI()
+				So(document.Paths["/api/v1/hello"]["get"].Deprecated, ShouldBeTrue)
+				So(document.Paths["/api/v1/hello"]["get"].Summary, ShouldEqual, "Say hello (deprecated, removed on 2027-07-01)")
+				So(document.Paths["/api/v2/hello"]["get"].Deprecated, ShouldBeFalse)
+			})
+		})
+	})
+}
@@ -0,0 +1,164 @@
+// Package telemetry exposes the metrics of the server in the Prometheus text
+// format.
+//
+// A Registry holds collectors and serves what they collect over HTTP. Counter,
+// Gauge and Histogram are collectors updated by the code they measure, with
+// one series per combination of label values. Values that are computed when
+// the metrics are scraped, such as the number of devices, are collected by a
+// CollectorFunc. Any subsystem can register its own collectors:
+//
+//	sent := telemetry.NewCounter("linuxfleet_emails_total", "Emails sent by result.", "result")
+//	registry.Register(sent)
+//	sent.Inc("success")
+package telemetry
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the media type of the Prometheus text format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Type is the type of a metric family.
+type Type string
+
+const (
+	CounterType   Type = "counter"
+	GaugeType     Type = "gauge"
+	HistogramType Type = "histogram"
+)
+
+// Label is a label of a sample.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is one value of a metric family. Suffix is appended to the name of
+// the family, such as _bucket for the buckets of a histogram.
+type Sample struct {
+	Suffix string
+	Labels []Label
+	Value  float64
+}
+
+// Family is a metric with its samples.
+type Family struct {
+	Name    string
+	Help    string
+	Type    Type
+	Samples []Sample
+}
+
+// Collector returns the current metric families of a subsystem.
+type Collector interface {
+	Collect() []Family
+}
+
+// CollectorFunc is a Collector computing its families when it is called.
+type CollectorFunc func() []Family
+
+// Collect calls f.
+func (f CollectorFunc) Collect() []Family {
+	return f()
+}
+
+// Registry holds the collectors exposed by the server. It is an http.Handler
+// serving their metrics in the Prometheus text format.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []Collector
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register adds collectors to the registry. The families of different
+// collectors must have different names.
+func (r *Registry) Register(collectors ...Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, collectors...)
+}
+
+// Gather collects the families of every collector, sorted by name.
+func (r *Registry) Gather() []Family {
+	r.mu.Lock()
+	collectors := slices.Clone(r.collectors)
+	r.mu.Unlock()
+
+	var families []Family
+	for _, collector := range collectors {
+		families = append(families, collector.Collect()...)
+	}
+	slices.SortStableFunc(families, func(a, b Family) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return families
+}
+
+// WriteText writes the families of every collector in the Prometheus text format.
+func (r *Registry) WriteText(w io.Writer) error {
+	buffered := bufio.NewWriter(w)
+	for _, family := range r.Gather() {
+		writeFamily(buffered, family)
+	}
+	return buffered.Flush()
+}
+
+// ServeHTTP responds with the metrics in the Prometheus text format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	r.WriteText(w)
+}
+
+func writeFamily(w *bufio.Writer, family Family) {
+	if family.Help != "" {
+		fmt.Fprintf(w, "# HELP %s %s\n", family.Name, helpEscaper.Replace(family.Help))
+	}
+	fmt.Fprintf(w, "# TYPE %s %s\n", family.Name, family.Type)
+	for _, sample := range family.Samples {
+		w.WriteString(family.Name)
+		w.WriteString(sample.Suffix)
+		if len(sample.Labels) > 0 {
+			w.WriteByte('{')
+			for i, label := range sample.Labels {
+				if i > 0 {
+					w.WriteByte(',')
+				}
+				fmt.Fprintf(w, `%s="%s"`, label.Name, labelEscaper.Replace(label.Value))
+			}
+			w.WriteByte('}')
+		}
+		w.WriteByte(' ')
+		w.WriteString(formatValue(sample.Value))
+		w.WriteByte('\n')
+	}
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+// formatValue formats a sample value, with +Inf and -Inf for the infinities.
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
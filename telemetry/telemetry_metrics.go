@@ -0,0 +1,226 @@
+package telemetry
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds of the histogram buckets used for
+// latencies in seconds, from 5ms to 10s.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// vector holds one value of type T per combination of label values.
+type vector[T any] struct {
+	name       string
+	help       string
+	labelNames []string
+	newValue   func() *T
+
+	mu     sync.Mutex
+	values map[string]*T
+	labels map[string][]Label
+}
+
+func newVector[T any](name string, help string, labelNames []string, newValue func() *T) vector[T] {
+	return vector[T]{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		newValue:   newValue,
+		values:     map[string]*T{},
+		labels:     map[string][]Label{},
+	}
+}
+
+// with calls update with the value of the label values while holding the lock.
+// It panics when the number of label values does not match the label names.
+func (v *vector[T]) with(labelValues []string, update func(*T)) {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("telemetry: %s has %d labels, got %d values", v.name, len(v.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	value, ok := v.values[key]
+	if !ok {
+		value = v.newValue()
+		labels := make([]Label, len(labelValues))
+		for i, labelValue := range labelValues {
+			labels[i] = Label{Name: v.labelNames[i], Value: labelValue}
+		}
+		v.values[key] = value
+		v.labels[key] = labels
+	}
+	update(value)
+}
+
+// read calls read with the value of the label values while holding the lock,
+// unless no value was recorded for them.
+func (v *vector[T]) read(labelValues []string, read func(*T)) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if value, ok := v.values[strings.Join(labelValues, "\xff")]; ok {
+		read(value)
+	}
+}
+
+// each calls collect with the labels and value of every series, sorted by
+// label values, while holding the lock.
+func (v *vector[T]) each(collect func(labels []Label, value *T)) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		collect(v.labels[key], v.values[key])
+	}
+}
+
+// Counter is a value that only goes up, such as a number of requests.
+type Counter struct {
+	vector[float64]
+}
+
+// NewCounter creates a counter with the label names.
+func NewCounter(name string, help string, labelNames ...string) *Counter {
+	return &Counter{newVector(name, help, labelNames, func() *float64 { return new(float64) })}
+}
+
+// Inc adds one to the counter of the label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds a value to the counter of the label values. It panics when the
+// value is negative.
+func (c *Counter) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		panic(fmt.Sprintf("telemetry: counter %s cannot decrease", c.name))
+	}
+	c.with(labelValues, func(counter *float64) { *counter += value })
+}
+
+// Value returns the counter of the label values.
+func (c *Counter) Value(labelValues ...string) float64 {
+	var value float64
+	c.read(labelValues, func(counter *float64) { value = *counter })
+	return value
+}
+
+// Collect returns the counter family.
+func (c *Counter) Collect() []Family {
+	family := Family{Name: c.name, Help: c.help, Type: CounterType}
+	c.each(func(labels []Label, value *float64) {
+		family.Samples = append(family.Samples, Sample{Labels: labels, Value: *value})
+	})
+	return []Family{family}
+}
+
+// Gauge is a value that goes up and down, such as a number of connections.
+type Gauge struct {
+	vector[float64]
+}
+
+// NewGauge creates a gauge with the label names.
+func NewGauge(name string, help string, labelNames ...string) *Gauge {
+	return &Gauge{newVector(name, help, labelNames, func() *float64 { return new(float64) })}
+}
+
+// Set sets the gauge of the label values.
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.with(labelValues, func(gauge *float64) { *gauge = value })
+}
+
+// Add adds a value, which may be negative, to the gauge of the label values.
+func (g *Gauge) Add(value float64, labelValues ...string) {
+	g.with(labelValues, func(gauge *float64) { *gauge += value })
+}
+
+// Value returns the gauge of the label values.
+func (g *Gauge) Value(labelValues ...string) float64 {
+	var value float64
+	g.read(labelValues, func(gauge *float64) { value = *gauge })
+	return value
+}
+
+// Collect returns the gauge family.
+func (g *Gauge) Collect() []Family {
+	family := Family{Name: g.name, Help: g.help, Type: GaugeType}
+	g.each(func(labels []Label, value *float64) {
+		family.Samples = append(family.Samples, Sample{Labels: labels, Value: *value})
+	})
+	return []Family{family}
+}
+
+// Histogram counts observations, such as latencies, in buckets.
+type Histogram struct {
+	vector[histogramValue]
+	buckets []float64
+}
+
+type histogramValue struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram creates a histogram with the upper bounds of its buckets, in
+// increasing order, and the label names. DefaultBuckets is used when buckets
+// is empty.
+func NewHistogram(name string, help string, buckets []float64, labelNames ...string) *Histogram {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	if !slices.IsSorted(buckets) {
+		panic(fmt.Sprintf("telemetry: buckets of %s are not sorted", name))
+	}
+	newValue := func() *histogramValue {
+		return &histogramValue{counts: make([]uint64, len(buckets))}
+	}
+	return &Histogram{vector: newVector(name, help, labelNames, newValue), buckets: buckets}
+}
+
+// Observe adds an observation to the histogram of the label values.
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.with(labelValues, func(histogram *histogramValue) {
+		for i, bound := range h.buckets {
+			if value <= bound {
+				histogram.counts[i]++
+			}
+		}
+		histogram.count++
+		histogram.sum += value
+	})
+}
+
+// Count returns the number of observations of the label values.
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	var count uint64
+	h.read(labelValues, func(histogram *histogramValue) { count = histogram.count })
+	return count
+}
+
+// Collect returns the histogram family with its cumulative buckets.
+func (h *Histogram) Collect() []Family {
+	family := Family{Name: h.name, Help: h.help, Type: HistogramType}
+	h.each(func(labels []Label, value *histogramValue) {
+		for i, bound := range h.buckets {
+			bucketLabels := append(slices.Clip(labels), Label{Name: "le", Value: formatValue(bound)})
+			family.Samples = append(family.Samples, Sample{Suffix: "_bucket", Labels: bucketLabels, Value: float64(value.counts[i])})
+		}
+		infLabels := append(slices.Clip(labels), Label{Name: "le", Value: formatValue(math.Inf(1))})
+		family.Samples = append(family.Samples,
+			Sample{Suffix: "_bucket", Labels: infLabels, Value: float64(value.count)},
+			Sample{Suffix: "_sum", Labels: labels, Value: value.sum},
+			Sample{Suffix: "_count", Labels: labels, Value: float64(value.count)},
+		)
+	})
+	return []Family{family}
+}
@@ -0,0 +1,73 @@
+package telemetry
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRegistry(t *testing.T) {
+	Convey("Scenario: The metrics of a registry are scraped", t, func() {
+		registry := NewRegistry()
+		requests := NewCounter("app_requests_total", "Requests by route.", "route")
+		connections := NewGauge("app_connections", "Open connections.")
+		durations := NewHistogram("app_duration_seconds", "Durations.", []float64{0.1, 1}, "route")
+		registry.Register(requests, connections, durations)
+
+		requests.Inc("/b")
+		requests.Add(2, `/a"\`)
+		connections.Set(3)
+		connections.Add(-1)
+		durations.Observe(0.05, "/a")
+		durations.Observe(0.5, "/a")
+		durations.Observe(5, "/a")
+
+		Convey("When the values are read", func() {
+			So(requests.Value(`/a"\`), ShouldEqual, 2)
+			So(requests.Value("/c"), ShouldEqual, 0)
+			So(connections.Value(), ShouldEqual, 2)
+			So(durations.Count("/a"), ShouldEqual, 3)
+		})
+		Convey("When they are written in the text format", func() {
+			var text strings.Builder
+			So(registry.WriteText(&text), ShouldBeNil)
+
+			Convey("Then the families are sorted by name with escaped labels and cumulative buckets", func() {
+				So(text.String(), ShouldEqual, `# HELP app_connections Open connections.
+# TYPE app_connections gauge
+app_connections 2
+# HELP app_duration_seconds Durations.
+# TYPE app_duration_seconds histogram
+app_duration_seconds_bucket{route="/a",le="0.1"} 1
+app_duration_seconds_bucket{route="/a",le="1"} 2
+app_duration_seconds_bucket{route="/a",le="+Inf"} 3
+app_duration_seconds_sum{route="/a"} 5.55
+app_duration_seconds_count{route="/a"} 3
+# HELP app_requests_total Requests by route.
+# TYPE app_requests_total counter
+app_requests_total{route="/a\"\\"} 2
+app_requests_total{route="/b"} 1
+`)
+			})
+		})
+		Convey("When a collector function is registered", func() {
+			registry.Register(CollectorFunc(func() []Family {
+				return []Family{{Name: "app_devices", Type: GaugeType, Samples: []Sample{{Value: 7}}}}
+			}))
+			recorder := httptest.NewRecorder()
+			registry.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+			Convey("Then its families are computed when the metrics are served", func() {
+				So(recorder.Header().Get("Content-Type"), ShouldEqual, ContentType)
+				So(recorder.Body.String(), ShouldContainSubstring, "# TYPE app_devices gauge\napp_devices 7\n")
+			})
+		})
+		Convey("When a counter is decreased or given the wrong labels", func() {
+			So(func() { requests.Add(-1, "/a") }, ShouldPanic)
+			So(func() { requests.Inc() }, ShouldPanic)
+		})
+	})
+}